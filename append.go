@@ -0,0 +1,95 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// AppendForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) AppendForEnvironment(envUUID, path string, r io.Reader, length int64) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return err
+	}
+	doc, err := ms.managedResourceForPath(managedPath)
+	if errors.IsNotFound(err) {
+		_, err := ms.put(context.Background(), envUUID, "", path, r, length, putOptions{
+			condition: ifUnchanged(managedPath, ""),
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+	existing, existingLength, err := ms.getResource(context.Background(), doc.ResourceId, managedPath)
+	if err != nil {
+		return err
+	}
+	// The existing data is closed as soon as it has all been read, so
+	// that it does not hold on to resources while the data is stored.
+	existing = &closeAtEOFReader{ReadCloser: existing}
+	defer existing.Close()
+	if length >= 0 {
+		length += existingLength
+	}
+	// Stored data is immutable, since it may be shared with other
+	// paths, so the combined data is stored as new data. The metadata
+	// of the path is kept, but the data has a different hash.
+	_, err = ms.put(context.Background(), envUUID, "", path, io.MultiReader(existing, r), length, putOptions{
+		contentType: doc.ContentType,
+		filename:    doc.Filename,
+		expiryTime:  doc.ExpiryTime,
+		labels:      doc.Labels,
+		condition:   ifUnchanged(managedPath, doc.ResourceId),
+	})
+	return err
+}
+
+// closeAtEOFReader is a ReadCloser which closes the
+// ReadCloser it wraps once it has been read to the end.
+type closeAtEOFReader struct {
+	io.ReadCloser
+	closed bool
+}
+
+// Read is defined on io.Reader.
+func (r *closeAtEOFReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if closeErr := r.Close(); closeErr != nil {
+			return n, closeErr
+		}
+	}
+	return n, err
+}
+
+// Close is defined on io.Closer.
+func (r *closeAtEOFReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.ReadCloser.Close()
+}
+
+// ifUnchanged is a putCondition which only allows data to be stored at
+// path if the data already there has the given resource catalog id, or
+// if resourceId is empty, if there is nothing there.
+func ifUnchanged(path, resourceId string) putCondition {
+	return func(current *managedResourceDoc) error {
+		if current == nil && resourceId == "" || current != nil && current.ResourceId == resourceId {
+			return nil
+		}
+		return errors.Annotatef(ErrPreconditionFailed, "resource at path %q has changed", path)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	txntesting "github.com/juju/txn/testing"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) appendData(c *gc.C, path, data string, length int64) {
+	err := s.managedStorage.AppendForEnvironment("env", path, strings.NewReader(data), length)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironment(c *gc.C) {
+	s.assertPut(c, "/path/to/log", []byte("line 1\n"))
+	s.appendData(c, "/path/to/log", "line 2\n", 7)
+	s.appendData(c, "/path/to/log", "line 3\n", -1)
+	s.assertGet(c, "/path/to/log", []byte("line 1\nline 2\nline 3\n"))
+
+	// The data is rehashed, and the old data released.
+	md, err := s.managedStorage.StatForEnvironment("env", "/path/to/log")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(md.Length, gc.Equals, int64(21))
+	c.Assert(md.SHA384Hash, gc.Equals, calculateCheckSum(c, 0, 21, []byte("line 1\nline 2\nline 3\n")))
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentVisible(c *gc.C) {
+	data := "line 1\n"
+	s.assertPut(c, "/path/to/log", []byte(data))
+	for _, line := range []string{"line 2\n", "line 3\n", "line 4\n"} {
+		s.appendData(c, "/path/to/log", line, -1)
+		data += line
+		// Each append can be read as soon as it is made.
+		s.assertGet(c, "/path/to/log", []byte(data))
+		s.assertResourceCatalogCount(c, 1)
+	}
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentRemoved(c *gc.C) {
+	s.appendData(c, "/path/to/log", "line 1\n", -1)
+	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/log")
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/log")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+
+	// Appending again starts afresh.
+	s.appendData(c, "/path/to/log", "line 2\n", -1)
+	s.assertGet(c, "/path/to/log", []byte("line 2\n"))
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentChanged(c *gc.C) {
+	s.assertPut(c, "/path/to/log", []byte("line 1\n"))
+	beforeFunc := func() {
+		err := s.managedStorage.PutForEnvironment("env", "/path/to/log", strings.NewReader("replaced\n"), 9)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	hooks := txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc)
+	err := s.managedStorage.AppendForEnvironment("env", "/path/to/log", strings.NewReader("line 2\n"), -1)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrPreconditionFailed)
+	hooks.Check()
+	s.assertGet(c, "/path/to/log", []byte("replaced\n"))
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentNotFound(c *gc.C) {
+	s.appendData(c, "/path/to/log", "line 1\n", 7)
+	s.assertGet(c, "/path/to/log", []byte("line 1\n"))
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentSharedData(c *gc.C) {
+	s.assertPut(c, "/path/to/log", []byte("line 1\n"))
+	s.assertPut(c, "/path/to/copy", []byte("line 1\n"))
+	s.appendData(c, "/path/to/log", "line 2\n", 7)
+	s.assertGet(c, "/path/to/log", []byte("line 1\nline 2\n"))
+	// Other paths sharing the old data are unaffected.
+	s.assertGet(c, "/path/to/copy", []byte("line 1\n"))
+	s.assertResourceCatalogCount(c, 2)
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentKeepsMetadata(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("line 1\n")
+	err := s.managedStorage.PutForEnvironmentWithMeta("env", "/path/to/log", bytes.NewReader(blob), int64(len(blob)), blobstore.PutMeta{ContentType: "text/x-log"})
+	c.Assert(err, jc.ErrorIsNil)
+	s.appendData(c, "/path/to/log", "line 2\n", 7)
+	md, err := s.managedStorage.StatForEnvironment("env", "/path/to/log")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(md.ContentType, gc.Equals, "text/x-log")
+
+	err = s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/expiring", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	s.appendData(c, "/path/to/expiring", "line 2\n", 7)
+	now = now.Add(time.Hour)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/expiring")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentKeepsLabels(c *gc.C) {
+	labels := map[string]string{"build": "42"}
+	blob := []byte("line 1\n")
+	err := s.managedStorage.PutForEnvironmentWithLabels("env", "/path/to/log", bytes.NewReader(blob), int64(len(blob)), labels)
+	c.Assert(err, jc.ErrorIsNil)
+	s.appendData(c, "/path/to/log", "line 2\n", 7)
+	s.assertLabels(c, "/path/to/log", labels)
+}
+
+func (s *managedStorageSuite) TestAppendForEnvironmentLengthMismatch(c *gc.C) {
+	s.assertPut(c, "/path/to/log", []byte("line 1\n"))
+	err := s.managedStorage.AppendForEnvironment("env", "/path/to/log", strings.NewReader("line 2\n"), 100)
+	c.Assert(err, gc.NotNil)
+	s.assertGet(c, "/path/to/log", []byte("line 1\n"))
+}
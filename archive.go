@@ -0,0 +1,91 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ImportArchiveForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ImportArchiveForEnvironment(envUUID string, r io.Reader) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	if envUUID == "" {
+		return errors.NotValidf("empty environment UUID")
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Annotate(err, "cannot read archive")
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// Directories are implied by the paths of the data within them.
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return errors.NotValidf("archive entry %q of type %q", hdr.Name, hdr.Typeflag)
+		}
+		// Each entry is read directly from the archive as it is stored,
+		// so the archive as a whole is never held.
+		if _, err := ms.put(context.Background(), envUUID, "", hdr.Name, tr, hdr.Size, putOptions{}); err != nil {
+			return errors.Annotatef(err, "cannot import %q", hdr.Name)
+		}
+	}
+}
+
+// ExportArchiveForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ExportArchiveForEnvironment(envUUID string, w io.Writer) (err error) {
+	iter, err := ms.listForEnvironment(envUUID, "")
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	tw := tar.NewWriter(w)
+	var info ResourceInfo
+	for iter.Next(&info) {
+		if info.Pending {
+			continue
+		}
+		if err := ms.exportResource(tw, envUUID, info); errors.IsNotFound(err) {
+			// The data was removed while we were iterating.
+			continue
+		} else if err != nil {
+			return errors.Annotatef(err, "cannot export %q", info.Path)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return errors.Annotate(tw.Close(), "cannot write archive")
+}
+
+// exportResource writes the data described by info to tw.
+func (ms *managedStorage) exportResource(tw *tar.Writer, envUUID string, info ResourceInfo) error {
+	rdr, length, err := ms.get(context.Background(), envUUID, "", info.Path)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	hdr := &tar.Header{
+		Name:     strings.TrimPrefix(info.Path, "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     length,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, rdr, length)
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+// readArchive returns the contents of the regular files in the
+// tar archive held in buf, keyed on name.
+func readArchive(c *gc.C, buf []byte) map[string]string {
+	tr := tar.NewReader(bytes.NewReader(buf))
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			c.Assert(err, gc.Equals, io.EOF)
+			return files
+		}
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, jc.ErrorIsNil)
+		files[hdr.Name] = string(data)
+	}
+}
+
+func (s *managedStorageSuite) TestExportImportArchive(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/copy", blob)
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/empty", bytes.NewReader(nil), 0)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForEnvironment("another-env", "/path/to/other", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var buf bytes.Buffer
+	err = s.managedStorage.ExportArchiveForEnvironment("env", &buf)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(readArchive(c, buf.Bytes()), jc.DeepEquals, map[string]string{
+		"path/to/blob":  "some resource",
+		"path/to/copy":  "some resource",
+		"path/to/empty": "",
+	})
+
+	err = s.managedStorage.ImportArchiveForEnvironment("restored-env", bytes.NewReader(buf.Bytes()))
+	c.Assert(err, jc.ErrorIsNil)
+	infos, err := s.managedStorage.ListForEnvironment("restored-env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 3)
+	r, _, err := s.managedStorage.GetForEnvironment("restored-env", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+	// The imported data shares that already stored.
+	s.assertResourceCatalogCount(c, 2)
+}
+
+func (s *managedStorageSuite) TestImportArchiveSkipsDirectories(c *gc.C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Name: "path/", Typeflag: tar.TypeDir, Mode: 0755})
+	c.Assert(err, jc.ErrorIsNil)
+	err = tw.WriteHeader(&tar.Header{Name: "path/to/blob", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = tw.Write([]byte("blob"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(tw.Close(), jc.ErrorIsNil)
+
+	err = s.managedStorage.ImportArchiveForEnvironment("env", &buf)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", []byte("blob"))
+}
+
+func (s *managedStorageSuite) TestImportArchiveInvalidEntry(c *gc.C) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Name: "path/to/link", Typeflag: tar.TypeSymlink, Linkname: "blob"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(tw.Close(), jc.ErrorIsNil)
+
+	err = s.managedStorage.ImportArchiveForEnvironment("env", &buf)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestImportArchiveInvalidEnvironment(c *gc.C) {
+	err := s.managedStorage.ImportArchiveForEnvironment("", bytes.NewReader(nil))
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// AuditOperation identifies the kind of operation described by an AuditEvent.
+type AuditOperation string
+
+const (
+	// AuditPut is the operation of storing data at a path.
+	AuditPut AuditOperation = "put"
+
+	// AuditRemove is the operation of removing the data at a path.
+	AuditRemove AuditOperation = "remove"
+
+	// AuditProofOfAccess is the operation of recording a reference to
+	// existing data at a path, after a successful proof of access response.
+	AuditProofOfAccess AuditOperation = "proof-of-access"
+
+	// AuditPurge is the operation of permanently removing the data at
+	// a path which has expired or whose soft-delete window has passed.
+	AuditPurge AuditOperation = "purge"
+
+	// AuditCopy is the operation of referencing the data at one path
+	// from another, and AuditMove that of moving data to another path.
+	AuditCopy AuditOperation = "copy"
+	AuditMove AuditOperation = "move"
+)
+
+// AuditEvent describes a mutating operation performed by a ManagedStorage.
+type AuditEvent struct {
+	// Operation is the kind of operation performed.
+	Operation AuditOperation
+
+	// EnvUUID and User identify the namespace of Path, as for Reference.
+	EnvUUID string
+	User    string
+
+	// Path is the path at which the operation was performed,
+	// relative to its namespace.
+	Path string
+
+	// SourcePath is the path, in the same namespace, from which
+	// the data was copied or moved. It is empty for other operations.
+	SourcePath string
+
+	// Hash is the hex-encoded hash of the data stored, referenced
+	// or removed, calculated using HashAlgorithm.
+	Hash          string
+	HashAlgorithm HashAlgorithm
+
+	// Length is the length of the data in bytes. It is zero for
+	// removals of data whose upload was not complete.
+	Length int64
+
+	// Time is the time at which the operation completed.
+	Time time.Time
+}
+
+// AuditSink records the mutating operations performed by a ManagedStorage,
+// for security auditing. Events are recorded once the operation has been
+// committed, so the record reflects the state of the storage. Implementations
+// must be safe for concurrent use.
+type AuditSink interface {
+	// Record records the given event.
+	Record(event AuditEvent) error
+}
+
+// AuditFailurePolicy determines what happens when an AuditSink
+// fails to record an event.
+type AuditFailurePolicy string
+
+const (
+	// AuditFailOpen causes failures to record events to be logged,
+	// without affecting the result of the operation.
+	AuditFailOpen AuditFailurePolicy = "fail-open"
+
+	// AuditFailClosed causes failures to record events to be returned
+	// as the operation's error. The operation has nonetheless been
+	// committed; the error has a cause of ErrAuditFailed.
+	AuditFailClosed AuditFailurePolicy = "fail-closed"
+)
+
+// Validate returns an error if the policy is not known.
+func (p AuditFailurePolicy) Validate() error {
+	switch p {
+	case AuditFailOpen, AuditFailClosed:
+		return nil
+	}
+	return errors.NotValidf("audit failure policy %q", string(p))
+}
+
+// ErrAuditFailed is used to indicate that an operation was committed,
+// but could not be recorded by the storage's AuditSink.
+var ErrAuditFailed = fmt.Errorf("audit event not recorded")
+
+// nopAuditSink is an AuditSink which does nothing.
+type nopAuditSink struct{}
+
+// Record is defined on the AuditSink interface.
+func (nopAuditSink) Record(AuditEvent) error {
+	return nil
+}
+
+// auditing reports whether the storage records audit events.
+func (ms *managedStorage) auditing() bool {
+	_, nop := ms.auditSink.(nopAuditSink)
+	return !nop
+}
+
+// audit records event with the storage's AuditSink, applying the
+// storage's failure policy to any error.
+func (ms *managedStorage) audit(event AuditEvent) error {
+	if !ms.auditing() {
+		return nil
+	}
+	event.Time = ms.clock.Now()
+	err := ms.auditSink.Record(event)
+	if err == nil {
+		return nil
+	}
+	if ms.auditFailurePolicy == AuditFailClosed {
+		return errors.Annotatef(ErrAuditFailed, "cannot record %s of %q: %v", event.Operation, event.Path, err)
+	}
+	logger.Errorf("cannot record audit event for %s of %q: %v", event.Operation, event.Path, err)
+	return nil
+}
+
+// removalEvents returns the events describing the removal of the data
+// at the paths of docs with the given operation, or nil if the storage
+// does not record audit events. The lengths of the data are read before
+// the references to it are released, since the catalog entries may then
+// be deleted.
+func (ms *managedStorage) removalEvents(docs []managedResourceDoc, operation AuditOperation) []AuditEvent {
+	if !ms.auditing() {
+		return nil
+	}
+	refs := make(map[string]int)
+	for _, doc := range docs {
+		refs[doc.ResourceId]++
+	}
+	lengths := make(map[string]int64)
+	if catalogDocs, err := ms.catalogDocs(refs); err == nil {
+		for _, doc := range catalogDocs {
+			if doc.Path != "" {
+				lengths[doc.Id] = doc.Length
+			}
+		}
+	}
+	events := make([]AuditEvent, len(docs))
+	for i, doc := range docs {
+		events[i] = AuditEvent{
+			Operation: operation,
+			EnvUUID:   doc.EnvUUID,
+			User:      doc.User,
+			Path:      doc.Path,
+			Length:    lengths[doc.ResourceId],
+		}
+		// Paths are relative to the namespace, keeping the leading
+		// "/", as they are in ResourceInfo.
+		if prefix, err := ms.resourceStoragePath(doc.EnvUUID, doc.User, ""); err == nil {
+			events[i].Path = strings.TrimPrefix(doc.Path, prefix)
+		}
+		events[i].Hash, events[i].HashAlgorithm = resourceIdHash(doc.ResourceId)
+	}
+	return events
+}
+
+// resourceIdHash returns the hash and algorithm
+// identified by a resource catalog entry id.
+func resourceIdHash(id string) (string, HashAlgorithm) {
+	if i := strings.Index(id, ":"); i >= 0 {
+		return id[i+1:], HashAlgorithm(id[:i])
+	}
+	return id, SHA384
+}
@@ -0,0 +1,232 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// recordingAuditSink is an AuditSink which records the events it is given,
+// failing with err if it is set.
+type recordingAuditSink struct {
+	mu     sync.Mutex
+	events []blobstore.AuditEvent
+	err    error
+}
+
+func (s *recordingAuditSink) Record(event blobstore.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *managedStorageSuite) newAuditedManagedStorage(c *gc.C, policy blobstore.AuditFailurePolicy) (blobstore.ManagedStorage, *recordingAuditSink) {
+	sink := &recordingAuditSink{}
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:           s.db,
+		ResourceStorage:    s.resourceStorage,
+		AuditSink:          sink,
+		AuditFailurePolicy: policy,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms, sink
+}
+
+func (s *managedStorageSuite) TestAuditSink(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	ms, sink := s.newAuditedManagedStorage(c, "")
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "/path/to/another", calculateCheckSum(c, 0, int64(len(blob)), blob))
+	c.Assert(err, jc.ErrorIsNil)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	err = ms.ProofOfAccessResponse(blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	// Reads and failed operations are not audited.
+	_, _, err = ms.GetForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	event := blobstore.AuditEvent{
+		EnvUUID:       "env",
+		Path:          "/path/to/blob",
+		Hash:          hash,
+		HashAlgorithm: blobstore.SHA384,
+		Length:        int64(len(blob)),
+		Time:          now,
+	}
+	putEvent, removeEvent := event, event
+	putEvent.Operation = blobstore.AuditPut
+	removeEvent.Operation = blobstore.AuditRemove
+	proofEvent := blobstore.AuditEvent{
+		Operation:     blobstore.AuditProofOfAccess,
+		EnvUUID:       "env",
+		Path:          "/path/to/another",
+		Hash:          hash,
+		HashAlgorithm: blobstore.SHA384,
+		Length:        int64(len(blob)),
+		Time:          now,
+	}
+	c.Assert(sink.events, jc.DeepEquals, []blobstore.AuditEvent{putEvent, proofEvent, removeEvent})
+}
+
+func (s *managedStorageSuite) TestAuditSinkRemoveLastReference(c *gc.C) {
+	ms, sink := s.newAuditedManagedStorage(c, "")
+	blob := []byte("some resource")
+	err := ms.PutGlobal("/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveGlobal("/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+	c.Assert(sink.events, gc.HasLen, 2)
+	c.Assert(sink.events[1].Operation, gc.Equals, blobstore.AuditRemove)
+	c.Assert(sink.events[1].Length, gc.Equals, int64(len(blob)))
+	c.Assert(sink.events[1].Hash, gc.Equals, sink.events[0].Hash)
+}
+
+func (s *managedStorageSuite) TestAuditSinkFailOpen(c *gc.C) {
+	ms, sink := s.newAuditedManagedStorage(c, blobstore.AuditFailOpen)
+	sink.err = fmt.Errorf("sink unavailable")
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestAuditSinkFailClosed(c *gc.C) {
+	ms, sink := s.newAuditedManagedStorage(c, blobstore.AuditFailClosed)
+	sink.err = fmt.Errorf("sink unavailable")
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `cannot record put of "/path/to/blob": sink unavailable: audit event not recorded`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrAuditFailed)
+
+	// The put was nonetheless committed.
+	s.assertGet(c, "/path/to/blob", blob)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrAuditFailed)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestNewManagedStorageWithParamsInvalidAuditFailurePolicy(c *gc.C) {
+	_, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:           s.db,
+		ResourceStorage:    s.resourceStorage,
+		AuditFailurePolicy: "ignore",
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid managed storage params: audit failure policy "ignore" not valid`)
+}
+
+func (s *managedStorageSuite) TestAuditSinkCopyAndMove(c *gc.C) {
+	ms, sink := s.newAuditedManagedStorage(c, "")
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.MoveForEnvironment("env", "/path/to/copy", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(sink.events, gc.HasLen, 3)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	for i, expect := range []struct {
+		operation        blobstore.AuditOperation
+		path, sourcePath string
+	}{
+		{blobstore.AuditCopy, "/path/to/copy", "/path/to/blob"},
+		{blobstore.AuditMove, "/path/to/moved", "/path/to/copy"},
+	} {
+		event := sink.events[i+1]
+		c.Check(event.Operation, gc.Equals, expect.operation)
+		c.Check(event.EnvUUID, gc.Equals, "env")
+		c.Check(event.Path, gc.Equals, expect.path)
+		c.Check(event.SourcePath, gc.Equals, expect.sourcePath)
+		c.Check(event.Hash, gc.Equals, hash)
+		c.Check(event.Length, gc.Equals, int64(len(blob)))
+	}
+}
+
+func (s *managedStorageSuite) TestAuditSinkRemoveAllForEnvironment(c *gc.C) {
+	ms, sink := s.newAuditedManagedStorage(c, "")
+	blob := []byte("some resource")
+	for _, path := range []string{"/path/to/blob", "/path/to/another"} {
+		err := ms.PutForEnvironment("env", path, bytes.NewReader(blob), int64(len(blob)))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	sink.events = nil
+	removed, err := ms.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 2)
+
+	// Each path removed is audited, even once the data is deleted.
+	c.Assert(sink.events, gc.HasLen, 2)
+	var paths []string
+	for _, event := range sink.events {
+		c.Check(event.Operation, gc.Equals, blobstore.AuditRemove)
+		c.Check(event.EnvUUID, gc.Equals, "env")
+		c.Check(event.Length, gc.Equals, int64(len(blob)))
+		paths = append(paths, event.Path)
+	}
+	c.Assert(paths, jc.SameContents, []string{"/path/to/blob", "/path/to/another"})
+}
+
+func (s *managedStorageSuite) TestAuditSinkPurgeExpired(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	ms, sink := s.newAuditedManagedStorage(c, "")
+	blob := []byte("some resource")
+	err := ms.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	now = now.Add(time.Hour)
+	removed, err := ms.PurgeExpired()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+
+	c.Assert(sink.events, gc.HasLen, 2)
+	c.Assert(sink.events[1], jc.DeepEquals, blobstore.AuditEvent{
+		Operation:     blobstore.AuditPurge,
+		EnvUUID:       "env",
+		Path:          "/path/to/blob",
+		Hash:          calculateCheckSum(c, 0, int64(len(blob)), blob),
+		HashAlgorithm: blobstore.SHA384,
+		Length:        int64(len(blob)),
+		Time:          now,
+	})
+}
+
+func (s *managedStorageSuite) TestAuditSinkPurgeFailClosed(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	ms, sink := s.newAuditedManagedStorage(c, blobstore.AuditFailClosed)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	now = now.Add(time.Hour)
+	sink.err = fmt.Errorf("sink unavailable")
+	removed, err := ms.PurgeExpired()
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrAuditFailed)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 0)
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"io"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// BlobItem describes data to be stored by BatchPutForEnvironment.
+type BlobItem struct {
+	// Path is the path at which the data is stored.
+	Path string
+
+	// Reader supplies the data to be stored.
+	Reader io.Reader
+
+	// Length is the length of the data, or -1 if
+	// the reader is to be consumed until EOF.
+	Length int64
+
+	// CheckHash, if non-empty, is the hex-encoded hash the data must
+	// match, calculated using the storage's hash algorithm.
+	CheckHash string
+}
+
+// batchPutConcurrency is the maximum number of items
+// stored concurrently by BatchPutForEnvironment.
+var batchPutConcurrency = 8
+
+// BatchPutForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) BatchPutForEnvironment(envUUID string, items []BlobItem) (_ []error, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	if envUUID == "" {
+		return nil, errors.NotValidf("empty environment UUID")
+	}
+	if _, err := ms.resourceStoragePath(envUUID, "", ""); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(items))
+	seen := make(map[string]bool)
+	limit := make(chan struct{}, batchPutConcurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		managedPath, err := ms.resourceStoragePath(envUUID, "", item.Path)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if seen[managedPath] {
+			// Which of the items would be stored last is undefined.
+			errs[i] = errors.NotValidf("path %q repeated in batch", item.Path)
+			continue
+		}
+		seen[managedPath] = true
+		if item.Reader == nil {
+			errs[i] = errors.NotValidf("nil reader for path %q", item.Path)
+			continue
+		}
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(i int, item BlobItem) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			// Identical data in several items is de-duped by the
+			// resource catalog, just as for concurrent puts.
+			errs[i] = ms.PutForEnvironmentAndCheckHash(envUUID, item.Path, item.Reader, item.Length, item.CheckHash)
+		}(i, item)
+	}
+	wg.Wait()
+	return errs, nil
+}
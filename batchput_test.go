@@ -0,0 +1,144 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestBatchPutForEnvironment(c *gc.C) {
+	items := []blobstore.BlobItem{{
+		Path:   "/path/to/blob",
+		Reader: strings.NewReader("some resource"),
+		Length: 13,
+	}, {
+		Path:   "/path/to/same",
+		Reader: strings.NewReader("some resource"),
+		Length: -1,
+	}, {
+		Path:      "/path/to/another",
+		Reader:    strings.NewReader("another resource"),
+		Length:    16,
+		CheckHash: calculateCheckSum(c, 0, 16, []byte("another resource")),
+	}}
+	errs, err := s.managedStorage.BatchPutForEnvironment("env", items)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.DeepEquals, []error{nil, nil, nil})
+	s.assertGet(c, "/path/to/blob", []byte("some resource"))
+	s.assertGet(c, "/path/to/same", []byte("some resource"))
+	s.assertGet(c, "/path/to/another", []byte("another resource"))
+	// Identical data is only stored once.
+	s.assertResourceCatalogCount(c, 2)
+}
+
+func (s *managedStorageSuite) TestBatchPutForEnvironmentPartialFailure(c *gc.C) {
+	items := []blobstore.BlobItem{{
+		Path:   "/path/to/blob",
+		Reader: strings.NewReader("some resource"),
+		Length: 13,
+	}, {
+		Path:      "/path/to/mismatch",
+		Reader:    strings.NewReader("some resource"),
+		Length:    13,
+		CheckHash: "wrong",
+	}, {
+		Path:   "path/to/blob",
+		Reader: strings.NewReader("repeated"),
+		Length: 8,
+	}, {
+		Path:   "/path/to/short",
+		Reader: strings.NewReader("short"),
+		Length: 100,
+	}, {
+		Path: "/path/to/nil",
+	}}
+	errs, err := s.managedStorage.BatchPutForEnvironment("env", items)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(errs, gc.HasLen, 5)
+	c.Assert(errs[0], jc.ErrorIsNil)
+	c.Assert(errs[1], gc.ErrorMatches, "hash mismatch")
+	c.Assert(errs[2], jc.Satisfies, errors.IsNotValid)
+	c.Assert(errs[3], gc.ErrorMatches, "cannot calculate data checksums: expected 100 bytes, got 5")
+	c.Assert(errs[4], jc.Satisfies, errors.IsNotValid)
+	s.assertGet(c, "/path/to/blob", []byte("some resource"))
+	for _, path := range []string{"/path/to/mismatch", "/path/to/short", "/path/to/nil"} {
+		_, _, err = s.managedStorage.GetForEnvironment("env", path)
+		c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	}
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestBatchPutForEnvironmentInvalid(c *gc.C) {
+	items := []blobstore.BlobItem{{
+		Path:   "/path/to/blob",
+		Reader: strings.NewReader("some resource"),
+		Length: 13,
+	}}
+	_, err := s.managedStorage.BatchPutForEnvironment("", items)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = s.managedStorage.BatchPutForEnvironment("bad/env", items)
+	c.Assert(err, gc.ErrorMatches, `environment UUID "bad/env" cannot contain "/"`)
+}
+
+// concurrencyReader records the number of readers
+// being read concurrently.
+type concurrencyReader struct {
+	io.Reader
+	counter *concurrencyCounter
+	started bool
+}
+
+type concurrencyCounter struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (r *concurrencyReader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		r.counter.mu.Lock()
+		r.counter.active++
+		if r.counter.active > r.counter.max {
+			r.counter.max = r.counter.active
+		}
+		r.counter.mu.Unlock()
+	}
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.counter.mu.Lock()
+		r.counter.active--
+		r.counter.mu.Unlock()
+	}
+	return n, err
+}
+
+func (s *managedStorageSuite) TestBatchPutForEnvironmentConcurrency(c *gc.C) {
+	s.PatchValue(blobstore.BatchPutConcurrency, 2)
+	var counter concurrencyCounter
+	var items []blobstore.BlobItem
+	for i := 0; i < 10; i++ {
+		items = append(items, blobstore.BlobItem{
+			Path:   fmt.Sprintf("/path/to/blob%d", i),
+			Reader: &concurrencyReader{Reader: strings.NewReader(fmt.Sprintf("resource %d", i)), counter: &counter},
+			Length: -1,
+		})
+	}
+	errs, err := s.managedStorage.BatchPutForEnvironment("env", items)
+	c.Assert(err, jc.ErrorIsNil)
+	for _, err := range errs {
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	c.Assert(counter.max <= 2, jc.IsTrue)
+	s.assertResourceCatalogCount(c, 10)
+}
@@ -0,0 +1,56 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GetByHash is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetByHash(hash string) (rc io.ReadCloser, length int64, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	defer func() {
+		rc = ms.observeGet(start, rc, length, err)
+	}()
+	if err := ms.hashAlgorithm.checkHashFormat(hash); err != nil {
+		return nil, 0, err
+	}
+	resourceId, err := ms.resourceCatalog.Find(hash)
+	if IsUploadPending(err) {
+		// Data still being uploaded is not yet available.
+		return nil, 0, errors.NotFoundf("resource with %s=%q", ms.hashAlgorithm, hash)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	// Data which is only referenced at paths no longer visible, or by
+	// versions of data at them, is not served, as it may not be read
+	// through any path.
+	query := append(bson.D{{"resourceid", resourceId}}, liveRecordQuery(ms.clock.Now())...)
+	if n, err := ms.managedResourceCollection.Find(query).Count(); err != nil {
+		return nil, 0, errors.Annotate(err, "cannot read managed resource records")
+	} else if n == 0 {
+		return nil, 0, errors.NotFoundf("resource with %s=%q", ms.hashAlgorithm, hash)
+	}
+	r, err := ms.resourceCatalog.Get(resourceId)
+	if errors.IsNotFound(err) || IsUploadPending(err) {
+		// Removed, and possibly stored again, since it was found.
+		return nil, 0, errors.NotFoundf("resource with %s=%q", ms.hashAlgorithm, hash)
+	} else if err != nil {
+		return nil, 0, errors.Annotatef(err, "cannot load catalog entry for resource with %s=%q", ms.hashAlgorithm, hash)
+	}
+	ctx := context.Background()
+	rdr, err := ms.openStoredWithContext(ctx, r.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ms.throttleReadCloser(ctx, rdr), r.Length, nil
+}
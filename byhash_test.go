@@ -0,0 +1,68 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) assertGetByHash(c *gc.C, blob []byte) {
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	r, length, err := s.managedStorage.GetByHash(hash)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+}
+
+func (s *managedStorageSuite) TestGetByHash(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForUser("user", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGetByHash(c, blob)
+
+	// The data is found whichever namespace still refers to it.
+	s.assertPut(c, "/path/to/other", blob)
+	err = s.managedStorage.RemoveForUser("user", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGetByHash(c, blob)
+}
+
+func (s *managedStorageSuite) TestGetByHashEmpty(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte{})
+	s.assertGetByHash(c, []byte{})
+}
+
+func (s *managedStorageSuite) TestGetByHashNotFound(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	_, _, err := s.managedStorage.GetByHash(hash)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	s.assertPut(c, "/path/to/blob", blob)
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = s.managedStorage.GetByHash(hash)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGetByHashPending(c *gc.C) {
+	blob := []byte("some resource")
+	s.putInterrupted(c, "/path/to/blob", "resource-path", blob, blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	_, _, err := s.managedStorage.GetByHash(hash)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGetByHashMalformed(c *gc.C) {
+	_, _, err := s.managedStorage.GetByHash("wrong")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,195 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// cacheEntryFraction is the reciprocal of the fraction of a caching
+// storage's capacity which may be used by a single item of data. Larger
+// data is not cached, so that it does not evict everything else.
+const cacheEntryFraction = 4
+
+type cachingStorage struct {
+	inner    ResourceStorage
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	hits    int64
+	misses  int64
+
+	// generation is incremented whenever data is invalidated, so that data
+	// read from inner concurrently with a change is not cached.
+	generation int64
+}
+
+// cacheEntry holds the data at a path in a cachingStorage.
+type cacheEntry struct {
+	path string
+	data []byte
+}
+
+var (
+	_ ResourceStorage       = (*cachingStorage)(nil)
+	_ ResourceStorageLister = (*cachingStorage)(nil)
+	_ ResourceStorageCache  = (*cachingStorage)(nil)
+)
+
+// NewCachingStorage returns a ResourceStorage instance which caches data
+// read from inner in memory, so that data which is read repeatedly is only
+// fetched from inner once. At most maxBytes of data is cached, discarding
+// the least recently read data first; data larger than a quarter of maxBytes
+// is never cached. Cached data at a path is discarded when the path is
+// written or removed through the returned storage, so inner must not be
+// changed by other means. The returned storage implements
+// ResourceStorageCache.
+func NewCachingStorage(inner ResourceStorage, maxBytes int64) ResourceStorage {
+	return &cachingStorage{
+		inner:    inner,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get is defined on ResourceStorage.
+func (s *cachingStorage) Get(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	if elem, ok := s.entries[path]; ok {
+		s.lru.MoveToFront(elem)
+		s.hits++
+		data := elem.Value.(*cacheEntry).data
+		s.mu.Unlock()
+		return memReader{bytes.NewReader(data)}, nil
+	}
+	s.misses++
+	generation := s.generation
+	s.mu.Unlock()
+
+	rc, err := s.inner.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	maxEntryBytes := s.maxBytes / cacheEntryFraction
+	if seeker, ok := rc.(io.Seeker); ok {
+		// Avoid reading data which is too large to cache.
+		size, err := seeker.Seek(0, 2)
+		if err == nil {
+			_, err = seeker.Seek(0, 0)
+		}
+		if err != nil {
+			rc.Close()
+			return nil, errors.Annotatef(err, "cannot determine size of data at path %q", path)
+		}
+		if size > maxEntryBytes {
+			return rc, nil
+		}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rc, maxEntryBytes+1))
+	if err != nil {
+		rc.Close()
+		return nil, errors.Annotatef(err, "cannot read data at path %q", path)
+	}
+	if int64(len(data)) > maxEntryBytes {
+		// The data is too large to cache, so return what has been read
+		// followed by the remainder.
+		return &prefixedReadCloser{io.MultiReader(bytes.NewReader(data), rc), rc}, nil
+	}
+	if err := rc.Close(); err != nil {
+		return nil, errors.Annotatef(err, "cannot read data at path %q", path)
+	}
+	s.add(path, data, generation)
+	return memReader{bytes.NewReader(data)}, nil
+}
+
+// prefixedReadCloser reads data already read from
+// a reader, followed by the rest of that reader.
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// add caches data read from path, provided no data
+// has been invalidated since generation.
+func (s *cachingStorage) add(path string, data []byte, generation int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.generation != generation {
+		return
+	}
+	if _, ok := s.entries[path]; ok {
+		// Another Get has cached the data meanwhile.
+		return
+	}
+	s.entries[path] = s.lru.PushFront(&cacheEntry{path: path, data: data})
+	s.bytes += int64(len(data))
+	for s.bytes > s.maxBytes {
+		s.removeEntry(s.lru.Back())
+	}
+}
+
+// invalidate discards any cached data at path.
+func (s *cachingStorage) invalidate(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	if elem, ok := s.entries[path]; ok {
+		s.removeEntry(elem)
+	}
+}
+
+// removeEntry removes elem from the cache. It must
+// be called with s.mu held.
+func (s *cachingStorage) removeEntry(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.entries, entry.path)
+	s.bytes -= int64(len(entry.data))
+}
+
+// Put is defined on ResourceStorage.
+func (s *cachingStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	// The data is invalidated both before and after writing it, so that
+	// neither the old data nor any read while writing remains cached.
+	s.invalidate(path)
+	defer s.invalidate(path)
+	return s.inner.Put(path, r, length)
+}
+
+// Remove is defined on ResourceStorage.
+func (s *cachingStorage) Remove(path string) error {
+	s.invalidate(path)
+	defer s.invalidate(path)
+	return s.inner.Remove(path)
+}
+
+// List is defined on ResourceStorageLister.
+func (s *cachingStorage) List() ([]StoredResource, error) {
+	lister, ok := s.inner.(ResourceStorageLister)
+	if !ok {
+		return nil, errors.NotSupportedf("listing unlistable resource storage")
+	}
+	return lister.List()
+}
+
+// CacheStats is defined on ResourceStorageCache.
+func (s *cachingStorage) CacheStats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return CacheStats{
+		Hits:    s.hits,
+		Misses:  s.misses,
+		Entries: len(s.entries),
+		Bytes:   s.bytes,
+	}
+}
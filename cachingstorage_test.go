@@ -0,0 +1,137 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&cachingStorageSuite{})
+
+type cachingStorageSuite struct {
+	testing.IsolationSuite
+	inner *countingStorage
+}
+
+// countingStorage counts the calls to Get
+// on the ResourceStorage it wraps.
+type countingStorage struct {
+	blobstore.ResourceStorage
+	gets int
+}
+
+func (s *countingStorage) Get(path string) (io.ReadCloser, error) {
+	s.gets++
+	return s.ResourceStorage.Get(path)
+}
+
+func (s *cachingStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.inner = &countingStorage{ResourceStorage: blobstore.NewMemResourceStorage()}
+}
+
+func (s *cachingStorageSuite) newCache(c *gc.C, maxBytes int64) blobstore.ResourceStorageCache {
+	stor := blobstore.NewCachingStorage(s.inner, maxBytes)
+	cache, ok := stor.(blobstore.ResourceStorageCache)
+	c.Assert(ok, jc.IsTrue)
+	return cache
+}
+
+func (s *cachingStorageSuite) put(c *gc.C, stor blobstore.ResourceStorage, path, data string) {
+	_, err := stor.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *cachingStorageSuite) TestGetCaches(c *gc.C) {
+	stor := s.newCache(c, 100)
+	s.put(c, stor, "/path/to/file", "hello world")
+	assertGet(c, stor, "/path/to/file", "hello world")
+	assertGet(c, stor, "/path/to/file", "hello world")
+	c.Assert(s.inner.gets, gc.Equals, 1)
+	c.Assert(stor.CacheStats(), jc.DeepEquals, blobstore.CacheStats{
+		Hits:    1,
+		Misses:  1,
+		Entries: 1,
+		Bytes:   11,
+	})
+}
+
+func (s *cachingStorageSuite) TestGetNotFound(c *gc.C) {
+	stor := s.newCache(c, 100)
+	_, err := stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(stor.CacheStats().Misses, gc.Equals, int64(1))
+}
+
+func (s *cachingStorageSuite) TestPutInvalidates(c *gc.C) {
+	stor := s.newCache(c, 100)
+	s.put(c, stor, "/path/to/file", "hello world")
+	assertGet(c, stor, "/path/to/file", "hello world")
+	s.put(c, stor, "/path/to/file", "hello again")
+	c.Assert(stor.CacheStats().Entries, gc.Equals, 0)
+	assertGet(c, stor, "/path/to/file", "hello again")
+	c.Assert(s.inner.gets, gc.Equals, 2)
+}
+
+func (s *cachingStorageSuite) TestRemoveInvalidates(c *gc.C) {
+	stor := s.newCache(c, 100)
+	s.put(c, stor, "/path/to/file", "hello world")
+	assertGet(c, stor, "/path/to/file", "hello world")
+	err := stor.Remove("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stor.CacheStats().Entries, gc.Equals, 0)
+	_, err = stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *cachingStorageSuite) TestEvictsLeastRecentlyUsed(c *gc.C) {
+	stor := s.newCache(c, 40)
+	for _, path := range []string{"a", "b", "c", "d"} {
+		s.put(c, stor, path, strings.Repeat(path, 10))
+		assertGet(c, stor, path, strings.Repeat(path, 10))
+	}
+	c.Assert(stor.CacheStats().Bytes, gc.Equals, int64(40))
+	// Reading a makes b the least recently used.
+	assertGet(c, stor, "a", strings.Repeat("a", 10))
+	s.put(c, stor, "e", strings.Repeat("e", 10))
+	assertGet(c, stor, "e", strings.Repeat("e", 10))
+	c.Assert(stor.CacheStats().Bytes, gc.Equals, int64(40))
+	c.Assert(stor.CacheStats().Entries, gc.Equals, 4)
+
+	gets := s.inner.gets
+	assertGet(c, stor, "a", strings.Repeat("a", 10))
+	c.Assert(s.inner.gets, gc.Equals, gets)
+	assertGet(c, stor, "b", strings.Repeat("b", 10))
+	c.Assert(s.inner.gets, gc.Equals, gets+1)
+}
+
+func (s *cachingStorageSuite) TestLargeDataNotCached(c *gc.C) {
+	for i, inner := range []blobstore.ResourceStorage{
+		s.inner,
+		unseekableStorage{s.inner},
+	} {
+		c.Logf("test %d", i)
+		stor := blobstore.NewCachingStorage(inner, 40).(blobstore.ResourceStorageCache)
+		data := strings.Repeat("x", 11)
+		s.put(c, stor, "/path/to/file", data)
+		assertGet(c, stor, "/path/to/file", data)
+		assertGet(c, stor, "/path/to/file", data)
+		c.Assert(stor.CacheStats(), jc.DeepEquals, blobstore.CacheStats{Misses: 2})
+	}
+}
+
+func (s *cachingStorageSuite) TestList(c *gc.C) {
+	stor := blobstore.NewCachingStorage(blobstore.NewMemResourceStorage(), 100)
+	assertList(c, stor)
+	s.put(c, stor, "/path/to/file", "hello world")
+	assertList(c, stor, "/path/to/file")
+}
@@ -0,0 +1,27 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"time"
+)
+
+// Clock supplies the current time to the time-dependent logic of a
+// ManagedStorage, such as the expiry of data, soft deletion, version
+// retention and the grace periods allowed before clean up. Tests may
+// supply a Clock whose time they control, rather than sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// WallClock is a Clock which returns the system time.
+var WallClock Clock = wallClock{}
+
+type wallClock struct{}
+
+// Now is defined on the Clock interface.
+func (wallClock) Now() time.Time {
+	return timeNow()
+}
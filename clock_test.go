@@ -0,0 +1,259 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// fakeClock is a blobstore.Clock whose time is set by the test.
+type fakeClock struct {
+	now time.Time
+}
+
+// Now is defined on the blobstore.Clock interface.
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (s *managedStorageSuite) newClockManagedStorage(c *gc.C, clock blobstore.Clock, window time.Duration) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  s.resourceStorage,
+		SoftDeleteWindow: window,
+		Clock:            clock,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func (s *managedStorageSuite) TestClockExpiry(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, 0)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+
+	clock.now = clock.now.Add(59 * time.Minute)
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+	removed, err := ms.PurgeExpired()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+
+	clock.now = clock.now.Add(time.Minute)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	removed, err = ms.PurgeExpired()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestClockSoftDeletePurge(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, time.Hour)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	clock.now = clock.now.Add(30 * time.Minute)
+	purged, err := ms.PurgeDeleted()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(purged, gc.Equals, 0)
+
+	clock.now = clock.now.Add(31 * time.Minute)
+	purged, err = ms.PurgeDeleted()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(purged, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestClockPendingUploadElapsed(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, 0)
+	rc := blobstore.GetResourceCatalog(ms)
+	id, _, err := rc.Put("hash", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(ms, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+	clock.now = clock.now.Add(time.Minute)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, blobstore.IsUploadPending)
+	c.Assert(err.(*blobstore.UploadPendingError).Elapsed, gc.Equals, time.Minute)
+}
+
+func (s *managedStorageSuite) TestClockRemoveForEnvironmentIfSoleExpired(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, 0)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+
+	clock.now = clock.now.Add(time.Hour)
+	removed, err := ms.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(removed, jc.IsFalse)
+}
+
+func (s *managedStorageSuite) TestClockRemoveForEnvironmentIfSoleSoftDelete(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, time.Hour)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	removed, err := ms.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, jc.IsTrue)
+
+	// The record is soft-deleted, so it may be restored.
+	_, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	removed, err = ms.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(removed, jc.IsFalse)
+	s.assertResourceCatalogCount(c, 1)
+	err = ms.UndeleteForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestClockEnvironmentsWithDataSkipsRemoved(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, time.Hour)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironmentWithTTL("expiring-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironment("deleted-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("deleted-env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	envUUIDs, err := ms.EnvironmentsWithData()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(envUUIDs, jc.DeepEquals, []string{"env", "expiring-env"})
+
+	clock.now = clock.now.Add(time.Hour)
+	envUUIDs, err = ms.EnvironmentsWithData()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(envUUIDs, jc.DeepEquals, []string{"env"})
+}
+
+func (s *managedStorageSuite) TestClockPutRequestExpired(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, 0)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "/path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The request expires by the storage's clock,
+	// whether or not its timer has fired.
+	clock.now = clock.now.Add(*blobstore.RequestExpiry)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	err = ms.ProofOfAccessResponse(response)
+	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestClockGetByHashOnlyLiveRecords(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms := s.newClockManagedStorage(c, clock, time.Hour)
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := ms.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironment("env", "/path/to/other", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.ErrorIsNil)
+
+	r, _, err := ms.GetByHash(hash)
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+
+	// The data is still stored, but only at paths
+	// which have expired or been soft-deleted.
+	clock.now = clock.now.Add(time.Hour)
+	s.assertResourceCatalogCount(c, 1)
+	_, _, err = ms.GetByHash(hash)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestClockResumableUploadExpiry(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  s.resourceStorage,
+		Clock:            clock,
+		UploadSessionTTL: time.Hour,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	handle, err := ms.BeginUploadForEnvironment("env", "/path/to/blob", 10)
+	c.Assert(err, jc.ErrorIsNil)
+	clock.now = clock.now.Add(59 * time.Minute)
+	err = ms.AppendUpload(handle, 0, strings.NewReader("data"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Appending keeps the upload alive.
+	clock.now = clock.now.Add(59 * time.Minute)
+	removed, err := ms.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+	offset, err := ms.UploadOffset(handle)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(offset, gc.Equals, int64(4))
+
+	clock.now = clock.now.Add(time.Minute)
+	_, err = ms.UploadOffset(handle)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	removed, err = ms.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	count, err := s.db.C("uploadSessions").Count()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestClockGarbageCollect(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	stor := blobstore.NewMemResourceStorageWithClock(clock)
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: stor,
+		Clock:           clock,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = stor.Put("unreferenced", strings.NewReader("data"), 4)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The age of the data is measured by the same clock.
+	clock.now = clock.now.Add(59 * time.Minute)
+	removed, err := ms.GarbageCollect(time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+	clock.now = clock.now.Add(2 * time.Minute)
+	removed, err = ms.GarbageCollect(time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+}
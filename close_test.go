@@ -0,0 +1,91 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// closingStorage records calls to Close.
+type closingStorage struct {
+	blobstore.ResourceStorage
+	closed int
+	err    error
+}
+
+func (s *closingStorage) Close() error {
+	s.closed++
+	return s.err
+}
+
+func (s *managedStorageSuite) TestClose(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.Close()
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+	_, err = s.managedStorage.ListForEnvironment("env")
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+	_, err = s.managedStorage.UploadOffset("handle")
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+
+	// Closing again has no effect.
+	err = s.managedStorage.Close()
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The stored data is unaffected.
+	ms := blobstore.NewManagedStorage(s.db, s.resourceStorage)
+	r, _, err := ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+}
+
+func (s *managedStorageSuite) TestCloseDiscardsRequests(c *gc.C) {
+	blob, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 1)
+
+	err = s.managedStorage.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+	_, err = s.managedStorage.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+}
+
+func (s *managedStorageSuite) TestCloseClosesResourceStorage(c *gc.C) {
+	stor := &closingStorage{ResourceStorage: s.resourceStorage}
+	ms := blobstore.NewManagedStorage(s.db, stor)
+	err := ms.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stor.closed, gc.Equals, 1)
+	err = ms.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stor.closed, gc.Equals, 1)
+}
+
+func (s *managedStorageSuite) TestCloseResourceStorageError(c *gc.C) {
+	stor := &closingStorage{ResourceStorage: s.resourceStorage, err: errors.New("boom")}
+	ms := blobstore.NewManagedStorage(s.db, stor)
+	err := ms.Close()
+	c.Assert(err, gc.ErrorMatches, "cannot close resource storage: boom")
+	_, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+}
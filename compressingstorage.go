@@ -0,0 +1,293 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// compressedHeader prefixes data written by a compressingStorage, so that
+// it can be distinguished from uncompressed data written before compression
+// was enabled. It is followed by the length of the uncompressed data, as a
+// big-endian 64-bit integer, and then the compressed data.
+const compressedHeader = "\x00juju-blobstore-gzip\x00"
+
+// compressedPrefixLength is the length of the header
+// and uncompressed length preceding compressed data.
+const compressedPrefixLength = len(compressedHeader) + 8
+
+type compressingStorage struct {
+	inner   ResourceStorage
+	tempDir string
+}
+
+var (
+	_ ResourceStorage          = (*compressingStorage)(nil)
+	_ ResourceStorageLister    = (*compressingStorage)(nil)
+	_ ResourceStorageRawGetter = (*compressingStorage)(nil)
+)
+
+// NewCompressingStorage returns a ResourceStorage instance which gzips data
+// before writing it to inner, and decompresses it again when it is read.
+// The checksum returned by Put is the SHA-384 hash of the uncompressed data,
+// so de-duping is unaffected. Data in inner which was not written by a
+// compressing storage is returned as is, so existing data remains readable.
+func NewCompressingStorage(inner ResourceStorage) ResourceStorage {
+	return &compressingStorage{inner: inner}
+}
+
+// NewCompressingStorageWithTempDir is the same as NewCompressingStorage
+// except that the temporary files holding compressed data while it is
+// stored are created in tempDir, which should usually be the TempDir
+// given in the ManagedStorageParams. If tempDir is empty, os.TempDir
+// is used.
+func NewCompressingStorageWithTempDir(inner ResourceStorage, tempDir string) ResourceStorage {
+	return &compressingStorage{inner: inner, tempDir: tempDir}
+}
+
+// Get is defined on ResourceStorage.
+// The returned reader also implements io.Seeker, although seeking
+// backwards requires the data to be decompressed again from the start.
+func (s *compressingStorage) Get(path string) (io.ReadCloser, error) {
+	r := &decompressingReader{storage: s.inner, path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRaw is defined on ResourceStorageRawGetter. Compressed data is
+// returned as a gzip stream, with the "gzip" encoding. Its length is
+// known if the reader returned by the inner storage has a Size method,
+// as GridFS files do.
+func (s *compressingStorage) GetRaw(path string) (io.ReadCloser, int64, string, error) {
+	rc, err := s.inner.Get(path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	br := bufio.NewReader(rc)
+	header, err := br.Peek(compressedPrefixLength)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, 0, "", errors.Annotatef(err, "failed to read data at path %q", path)
+	}
+	length := int64(-1)
+	if sizer, ok := rc.(interface {
+		Size() int64
+	}); ok {
+		length = sizer.Size()
+	}
+	if !isCompressed(header) {
+		return &rawReadCloser{br, rc}, length, "", nil
+	}
+	br.Discard(compressedPrefixLength)
+	if length >= 0 {
+		length -= int64(compressedPrefixLength)
+	}
+	return &rawReadCloser{br, rc}, length, "gzip", nil
+}
+
+// isCompressed reports whether the data starting
+// with prefix was written by a compressingStorage.
+func isCompressed(prefix []byte) bool {
+	return len(prefix) == compressedPrefixLength && string(prefix[:len(compressedHeader)]) == compressedHeader
+}
+
+// rawReadCloser is a reader over buffered stored
+// data, which closes the reader for the data.
+type rawReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Put is defined on ResourceStorage.
+//
+// The compressed data is written to a temporary file before being
+// passed on, since its length must be known in advance.
+func (s *compressingStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	f, err := ioutil.TempFile(s.tempDir, "juju-resource-gzip")
+	if err != nil {
+		return "", errors.Annotate(err, "failed to create temporary file")
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	var prefix [compressedPrefixLength]byte
+	copy(prefix[:], compressedHeader)
+	binary.BigEndian.PutUint64(prefix[len(compressedHeader):], uint64(length))
+	if _, err := f.Write(prefix[:]); err != nil {
+		return "", errors.Annotate(err, "failed to write data")
+	}
+	sha384hash := sha512.New384()
+	zw := gzip.NewWriter(f)
+	if _, err := io.CopyN(zw, io.TeeReader(r, sha384hash), length); err != nil {
+		return "", errors.Annotatef(err, "failed to write data")
+	}
+	if err := zw.Close(); err != nil {
+		return "", errors.Annotatef(err, "failed to flush data")
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Trace(err)
+	}
+	if _, err := s.inner.Put(path, f, size); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+}
+
+// Remove is defined on ResourceStorage.
+func (s *compressingStorage) Remove(path string) error {
+	return s.inner.Remove(path)
+}
+
+// List is defined on ResourceStorageLister.
+func (s *compressingStorage) List() ([]StoredResource, error) {
+	lister, ok := s.inner.(ResourceStorageLister)
+	if !ok {
+		return nil, errors.NotSupportedf("listing unlistable resource storage")
+	}
+	return lister.List()
+}
+
+// decompressingReader is an io.ReadSeeker over data
+// which may have been written by a compressingStorage.
+type decompressingReader struct {
+	storage ResourceStorage
+	path    string
+	rdr     io.Reader
+	closer  io.Closer
+
+	// offset is the position in the uncompressed data of rdr.
+	offset int64
+
+	// pos is the position in the uncompressed data set by Seek,
+	// to which rdr is moved when next read. Moving only when
+	// reading means that finding the size of the data by seeking
+	// to the end and back does not decompress the data.
+	pos int64
+
+	// size is the length of the uncompressed data,
+	// or -1 if it is not yet known.
+	size int64
+}
+
+// open opens the stored data, positioned at the start
+// of its uncompressed content.
+func (r *decompressingReader) open() error {
+	rc, err := r.storage.Get(r.path)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(rc)
+	prefix, err := br.Peek(compressedPrefixLength)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return errors.Annotatef(err, "failed to read data at path %q", r.path)
+	}
+	if isCompressed(prefix) {
+		r.size = int64(binary.BigEndian.Uint64(prefix[len(compressedHeader):]))
+		br.Discard(compressedPrefixLength)
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return errors.Annotatef(err, "cannot decompress data at path %q", r.path)
+		}
+		r.rdr = zr
+	} else {
+		r.size = -1
+		if sizer, ok := rc.(interface {
+			Size() int64
+		}); ok {
+			r.size = sizer.Size()
+		}
+		r.rdr = br
+	}
+	r.closer = rc
+	r.offset, r.pos = 0, 0
+	return nil
+}
+
+// Read is defined on io.Reader.
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.pos != r.offset {
+		if err := r.move(); err != nil {
+			return 0, err
+		}
+		if r.offset < r.pos {
+			// The position is beyond the end of the data.
+			return 0, io.EOF
+		}
+	}
+	n, err := r.rdr.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	return n, err
+}
+
+// move moves rdr to the position set by Seek, or to the end of
+// the data if that comes first. Moving backwards requires the
+// data to be decompressed again from the start.
+func (r *decompressingReader) move() error {
+	if r.pos < r.offset {
+		pos := r.pos
+		r.closer.Close()
+		if err := r.open(); err != nil {
+			return err
+		}
+		r.pos = pos
+	}
+	n, err := io.CopyN(ioutil.Discard, r.rdr, r.pos-r.offset)
+	r.offset += n
+	if err != nil && err != io.EOF {
+		return errors.Annotatef(err, "failed to seek in data at path %q", r.path)
+	}
+	return nil
+}
+
+// Seek is defined on io.Seeker.
+func (r *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		if r.size < 0 {
+			// The length of data not written by a compressingStorage
+			// may not be known, so read to the end to find it.
+			r.pos = math.MaxInt64
+			if err := r.move(); err != nil {
+				return 0, err
+			}
+			r.size, r.pos = r.offset, r.offset
+		}
+		offset += r.size
+	default:
+		return r.pos, errors.NotValidf("whence %d", whence)
+	}
+	if offset < 0 {
+		return r.pos, errors.NotValidf("negative offset %d", offset)
+	}
+	r.pos = offset
+	return r.pos, nil
+}
+
+// Close is defined on io.Closer.
+func (r *decompressingReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,210 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"compress/gzip"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&compressingStorageSuite{})
+
+type compressingStorageSuite struct {
+	testing.IsolationSuite
+	inner blobstore.ResourceStorage
+	stor  blobstore.ResourceStorage
+}
+
+func (s *compressingStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.inner = blobstore.NewMemResourceStorage()
+	s.stor = blobstore.NewCompressingStorage(s.inner)
+}
+
+func (s *compressingStorageSuite) assertPut(c *gc.C, path, data string) {
+	checksum, err := s.stor.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(checksum, gc.Equals, fmt.Sprintf("%x", sha512.Sum384([]byte(data))))
+	assertGet(c, s.stor, path, data)
+}
+
+func (s *compressingStorageSuite) storedSize(c *gc.C, path string) int {
+	r, err := s.inner.Get(path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	return len(data)
+}
+
+func (s *compressingStorageSuite) TestPut(c *gc.C) {
+	data := strings.Repeat("key: value\n", 1000)
+	s.assertPut(c, "/path/to/file", data)
+	c.Assert(s.storedSize(c, "/path/to/file") < len(data)/5, jc.IsTrue)
+}
+
+func (s *compressingStorageSuite) TestPutEmpty(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "")
+}
+
+func (s *compressingStorageSuite) TestPutShortRead(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("short"), 100)
+	c.Assert(err, gc.ErrorMatches, "failed to write data: EOF")
+	_, err = s.inner.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *compressingStorageSuite) TestPutTempDir(c *gc.C) {
+	tempDir := c.MkDir()
+	stor := blobstore.NewCompressingStorageWithTempDir(s.inner, tempDir)
+
+	// The compressed data is written to the temporary directory
+	// as it is read, and the file is removed once it is stored.
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+		pw.Write([]byte("some data"))
+		infos, err := ioutil.ReadDir(tempDir)
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(infos, gc.HasLen, 1)
+		pw.Write([]byte("more data"))
+	}()
+	_, err := stor.Put("/path/to/file", pr, 18)
+	c.Assert(err, jc.ErrorIsNil)
+	infos, err := ioutil.ReadDir(tempDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+	assertGet(c, stor, "/path/to/file", "some datamore data")
+}
+
+func (s *compressingStorageSuite) TestPutTempDirMissing(c *gc.C) {
+	stor := blobstore.NewCompressingStorageWithTempDir(s.inner, filepath.Join(c.MkDir(), "missing"))
+	_, err := stor.Put("/path/to/file", strings.NewReader("hello"), 5)
+	c.Assert(err, gc.ErrorMatches, "failed to create temporary file: .*")
+}
+
+func (s *compressingStorageSuite) TestGetUncompressed(c *gc.C) {
+	// Data written before compression was enabled is read as is.
+	for _, data := range []string{"hello world", "", "\x00juju"} {
+		_, err := s.inner.Put("/path/to/file", strings.NewReader(data), int64(len(data)))
+		c.Assert(err, jc.ErrorIsNil)
+		assertGet(c, s.stor, "/path/to/file", data)
+	}
+}
+
+func (s *compressingStorageSuite) TestGetNonExistent(c *gc.C) {
+	_, err := s.stor.Get("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *compressingStorageSuite) TestGetSeek(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	r, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	seeker := r.(io.Seeker)
+	_, err = seeker.Seek(6, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "world")
+
+	// Seeking backwards starts again from the beginning.
+	offset, err := seeker.Seek(-5, io.SeekCurrent)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(offset, gc.Equals, int64(6))
+	data, err = ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "world")
+
+	// The length of the data is recorded, so seeking
+	// to the end does not read the data.
+	offset, err = seeker.Seek(-5, io.SeekEnd)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(offset, gc.Equals, int64(6))
+	data, err = ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "world")
+}
+
+func (s *compressingStorageSuite) TestGetSeekEndUncompressed(c *gc.C) {
+	data := "hello world"
+	_, err := s.inner.Put("/path/to/file", strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	seeker := r.(io.Seeker)
+	size, err := seeker.Seek(0, io.SeekEnd)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(size, gc.Equals, int64(len(data)))
+	_, err = seeker.Seek(0, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	read, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(read), gc.Equals, data)
+}
+
+func (s *compressingStorageSuite) TestCachingStorageGet(c *gc.C) {
+	// The caching storage finds the size of the data by seeking.
+	stor := blobstore.NewCachingStorage(s.stor, 1024)
+	data := "hello world"
+	_, err := stor.Put("/path/to/file", strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	assertGet(c, stor, "/path/to/file", data)
+}
+
+func (s *compressingStorageSuite) TestRemove(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	err := s.stor.Remove("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *compressingStorageSuite) TestList(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	assertList(c, s.stor, "/path/to/file")
+}
+
+func (s *compressingStorageSuite) TestGetRaw(c *gc.C) {
+	data := strings.Repeat("key: value\n", 1000)
+	s.assertPut(c, "/path/to/file", data)
+	r, length, encoding, err := s.stor.(blobstore.ResourceStorageRawGetter).GetRaw("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(encoding, gc.Equals, "gzip")
+	zr, err := gzip.NewReader(r)
+	c.Assert(err, jc.ErrorIsNil)
+	decompressed, err := ioutil.ReadAll(zr)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(decompressed), gc.Equals, data)
+	c.Assert(length, gc.Equals, int64(s.storedSize(c, "/path/to/file")-len("\x00juju-blobstore-gzip\x00")-8))
+}
+
+func (s *compressingStorageSuite) TestGetRawUncompressed(c *gc.C) {
+	data := "hello world"
+	_, err := s.inner.Put("/path/to/file", strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, length, encoding, err := s.stor.(blobstore.ResourceStorageRawGetter).GetRaw("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(encoding, gc.Equals, "")
+	c.Assert(length, gc.Equals, int64(len(data)))
+	stored, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(stored), gc.Equals, data)
+}
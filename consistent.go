@@ -0,0 +1,75 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+)
+
+// GetForEnvironmentConsistent is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentConsistent(envUUID, path string) (rc io.ReadCloser, length int64, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	defer func() {
+		rc = ms.observeGet(start, rc, length, err)
+	}()
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, 0, err
+	}
+	session := ms.db.Session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+	db := ms.db.With(session)
+	resource, err := ms.primaryCatalogEntry(db, managedPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	rdr, err := ms.openStoredConsistent(db, resource.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ms.throttleReadCloser(context.Background(), rdr), resource.Length, nil
+}
+
+// primaryCatalogEntry returns the resource catalog entry for the data at
+// managedPath, reading both the managed resource record and the entry from
+// db, whose session must read from the primary, so that the result reflects
+// all writes acknowledged so far.
+func (ms *managedStorage) primaryCatalogEntry(db *mgo.Database, managedPath string) (*Resource, error) {
+	var doc managedResourceDoc
+	if err := db.C(managedResourceCollection).FindId(managedPath).One(&doc); err == mgo.ErrNotFound || err == nil && doc.expired(ms.clock.Now()) {
+		return nil, errors.NotFoundf("resource at path %q", managedPath)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot load record for resource with path %q", managedPath)
+	}
+	r, err := newResourceCatalogWithClock(db, ms.hashAlgorithm, ms.clock).Get(doc.ResourceId)
+	if IsUploadPending(err) {
+		return nil, uploadPendingError(db, doc.ResourceId, managedPath, ms.clock.Now())
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", managedPath)
+	}
+	return r, nil
+}
+
+// openStoredConsistent is the same as openStored except that the data read
+// reflects all writes acknowledged so far, if the resource storage
+// implements ResourceStorageConsistentGetter. Data held inline is read
+// from db, whose session must read from the primary.
+func (ms *managedStorage) openStoredConsistent(db *mgo.Database, resourcePath string) (io.ReadCloser, error) {
+	if isInlinePath(resourcePath) {
+		return ms.openInline(db, resourcePath)
+	}
+	if stor, ok := ms.resourceStore.(ResourceStorageConsistentGetter); ok && resourcePath != emptyResourcePath {
+		return stor.GetConsistent(resourcePath)
+	}
+	return ms.openStored(resourcePath)
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestGetForEnvironmentConsistent(c *gc.C) {
+	// Reads from the session may be served by a secondary,
+	// but consistent reads are not.
+	session := s.Session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Eventual, true)
+	ms := blobstore.NewManagedStorage(s.db.With(session), s.resourceStorage)
+
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, length, err := ms.GetForEnvironmentConsistent("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+}
+
+// consistentStorage records the paths read from it with GetConsistent.
+type consistentStorage struct {
+	blobstore.ResourceStorage
+	paths []string
+}
+
+func (s *consistentStorage) GetConsistent(path string) (io.ReadCloser, error) {
+	s.paths = append(s.paths, path)
+	return s.Get(path)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentConsistentStorage(c *gc.C) {
+	stor := &consistentStorage{ResourceStorage: s.resourceStorage}
+	ms := blobstore.NewManagedStorage(s.db, stor)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, _, err := ms.GetForEnvironmentConsistent("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+	c.Assert(stor.paths, gc.HasLen, 1)
+
+	// Ordinary reads do not read consistently.
+	r, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+	c.Assert(stor.paths, gc.HasLen, 1)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentConsistentNotFound(c *gc.C) {
+	_, _, err := s.managedStorage.GetForEnvironmentConsistent("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentConsistentPending(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = blobstore.PutManagedResource(s.managedStorage, blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/pending",
+	}, id)
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = s.managedStorage.GetForEnvironmentConsistent("env", "/path/to/pending")
+	c.Assert(blobstore.IsUploadPending(err), jc.IsTrue)
+}
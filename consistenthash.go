@@ -0,0 +1,90 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// ConsistentHashRing places paths across shards so that adding or removing
+// a shard moves only the paths placed in that shard, roughly 1/N of them
+// for N shards, rather than most of them as ShardForPath does.
+//
+// Each shard is identified on the ring by its index, so shards should be
+// added to the end of the list. To remove a shard, replace it with nil,
+// leaving the indices of the others unchanged.
+type ConsistentHashRing struct {
+	points []ringPoint
+}
+
+// ringPoint is one of the points on a ConsistentHashRing, from which
+// the paths hashing after the previous point are placed in shard.
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// NewConsistentHashRing returns a ConsistentHashRing placing paths across
+// the non-nil shards, each of which is placed on the ring virtualNodes times
+// so that paths are spread evenly. Its Shard method may be passed as the
+// hashToShard argument of NewShardedStorage, with the same shards.
+func NewConsistentHashRing(shards []ResourceStorage, virtualNodes int) (*ConsistentHashRing, error) {
+	if virtualNodes < 1 {
+		return nil, errors.NotValidf("%d virtual nodes", virtualNodes)
+	}
+	ring := &ConsistentHashRing{}
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		for v := 0; v < virtualNodes; v++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:  ringHash(fmt.Sprintf("shard-%d-%d", i, v)),
+				shard: i,
+			})
+		}
+	}
+	if len(ring.points) == 0 {
+		return nil, errors.NotValidf("ring without shards")
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring, nil
+}
+
+// Shard returns the index of the shard which holds the data at path.
+func (ring *ConsistentHashRing) Shard(path string) int {
+	h := ringHash(path)
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= h
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].shard
+}
+
+// ringHash returns the position of key on a ConsistentHashRing.
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ShardRebalanceRing returns the moves needed for the data held by stor,
+// which must have been returned by NewShardedStorage, to be placed by ring,
+// in the same way as ShardRebalance. When a shard is added or removed, only
+// the data placed in that shard is moved.
+func ShardRebalanceRing(stor ResourceStorage, ring *ConsistentHashRing) ([]ShardMove, error) {
+	s, ok := stor.(*shardedStorage)
+	if !ok {
+		return nil, errors.NotValidf("rebalancing unsharded resource storage")
+	}
+	return s.rebalance(ring.Shard)
+}
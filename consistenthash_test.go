@@ -0,0 +1,120 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *shardedStorageSuite) newRing(c *gc.C, shards []blobstore.ResourceStorage) *blobstore.ConsistentHashRing {
+	ring, err := blobstore.NewConsistentHashRing(shards, 100)
+	c.Assert(err, jc.ErrorIsNil)
+	return ring
+}
+
+func (s *shardedStorageSuite) TestConsistentHashRingPlacement(c *gc.C) {
+	ring := s.newRing(c, s.shards)
+	s.stor = blobstore.NewShardedStorage(s.shards, ring.Shard)
+	counts := make([]int, len(s.shards))
+	for i := 0; i < 300; i++ {
+		path := fmt.Sprintf("path-%d", i)
+		s.put(c, path, "data")
+		shard := ring.Shard(path)
+		c.Assert(shard, gc.Equals, ring.Shard(path))
+		counts[shard]++
+		_, err := s.shards[shard].Get(path)
+		c.Check(err, jc.ErrorIsNil)
+	}
+	// The paths are spread roughly evenly.
+	for _, count := range counts {
+		c.Check(count > 50, jc.IsTrue, gc.Commentf("counts %v", counts))
+	}
+}
+
+func (s *shardedStorageSuite) TestConsistentHashRingAddShard(c *gc.C) {
+	ring := s.newRing(c, s.shards)
+	grown := s.newRing(c, append(s.shards, blobstore.NewMemResourceStorage()))
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("path-%d", i)
+		from, to := ring.Shard(path), grown.Shard(path)
+		if from != to {
+			// Only paths placed in the new shard move.
+			c.Check(to, gc.Equals, 3)
+			moved++
+		}
+	}
+	c.Check(moved > 150 && moved < 350, jc.IsTrue, gc.Commentf("%d paths moved", moved))
+}
+
+func (s *shardedStorageSuite) TestConsistentHashRingRemoveShard(c *gc.C) {
+	ring := s.newRing(c, s.shards)
+	shrunk := s.newRing(c, []blobstore.ResourceStorage{s.shards[0], nil, s.shards[2]})
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("path-%d", i)
+		from, to := ring.Shard(path), shrunk.Shard(path)
+		c.Check(to, gc.Not(gc.Equals), 1)
+		if from != 1 {
+			// Only paths placed in the removed shard move.
+			c.Check(to, gc.Equals, from)
+		}
+	}
+}
+
+func (s *shardedStorageSuite) TestShardRebalanceRing(c *gc.C) {
+	ring := s.newRing(c, s.shards)
+	s.stor = blobstore.NewShardedStorage(s.shards, ring.Shard)
+	var paths []string
+	for i := 0; i < 30; i++ {
+		path := fmt.Sprintf("path-%d", i)
+		paths = append(paths, path)
+		s.put(c, path, "data")
+	}
+	shards := []blobstore.ResourceStorage{s.shards[0], nil, s.shards[2]}
+	shrunk := s.newRing(c, shards)
+	moves, err := blobstore.ShardRebalanceRing(s.stor, shrunk)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(moves, gc.Not(gc.HasLen), 0)
+	moved := make(map[string]blobstore.ShardMove)
+	for _, move := range moves {
+		moved[move.Path] = move
+	}
+	for _, path := range paths {
+		move, ok := moved[path]
+		if ring.Shard(path) == 1 {
+			c.Check(move, jc.DeepEquals, blobstore.ShardMove{Path: path, From: 1, To: shrunk.Shard(path)})
+		} else {
+			c.Check(ok, jc.IsFalse)
+		}
+	}
+
+	// Once the data is moved, the storage without the removed shard holds it all.
+	for _, move := range moves {
+		r, err := s.shards[move.From].Get(move.Path)
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = s.shards[move.To].Put(move.Path, r, 4)
+		r.Close()
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	stor := blobstore.NewShardedStorage(shards, shrunk.Shard)
+	for _, path := range paths {
+		assertGet(c, stor, path, "data")
+	}
+	moves, err = blobstore.ShardRebalanceRing(stor, shrunk)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(moves, gc.HasLen, 0)
+}
+
+func (s *shardedStorageSuite) TestNewConsistentHashRingInvalid(c *gc.C) {
+	_, err := blobstore.NewConsistentHashRing(s.shards, 0)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = blobstore.NewConsistentHashRing([]blobstore.ResourceStorage{nil}, 100)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+)
+
+// ErrDedupMismatch is used to indicate that data was not de-duped
+// against stored data with the same hash, because the stored data
+// is not the length expected.
+var ErrDedupMismatch = fmt.Errorf("stored data does not match")
+
+// verifyDedup returns an error whose cause is ErrDedupMismatch if the
+// storage verifies de-duping, and the data already stored with the given
+// hash is not length bytes long. If length is negative, the length recorded
+// in the resource catalog is expected. Data which is not yet stored, or is
+// still being uploaded, is not checked.
+func (ms *managedStorage) verifyDedup(hash string, length int64) error {
+	if !ms.verifyDedupEnabled {
+		return nil
+	}
+	id, err := ms.resourceCatalog.Find(hash)
+	if errors.IsNotFound(err) || IsUploadPending(err) {
+		return nil
+	} else if err != nil {
+		return errors.Annotate(err, "cannot query resource catalog")
+	}
+	r, err := ms.resourceCatalog.Get(id)
+	if errors.IsNotFound(err) || IsUploadPending(err) {
+		return nil
+	} else if err != nil {
+		return errors.Annotate(err, "cannot query resource catalog")
+	}
+	if length < 0 {
+		length = r.Length
+	}
+	if r.Length != length {
+		return errors.Annotatef(ErrDedupMismatch,
+			"de-duping %d bytes with hash %q against %d bytes catalogued",
+			length, hash, r.Length,
+		)
+	}
+	stored, err := ms.storedLength(r.Path)
+	if err != nil {
+		return err
+	}
+	if stored != length {
+		return errors.Annotatef(ErrDedupMismatch,
+			"de-duping %d bytes with hash %q against %d bytes at storage path %q",
+			length, hash, stored, r.Path,
+		)
+	}
+	return nil
+}
+
+// storedLength returns the length of the data at
+// resourcePath in the resource storage.
+func (ms *managedStorage) storedLength(resourcePath string) (int64, error) {
+	rdr, err := ms.openStored(resourcePath)
+	if err != nil {
+		return 0, errors.Annotatef(err, "cannot read data at storage path %q", resourcePath)
+	}
+	defer rdr.Close()
+	// Seek to the end if we can, rather than reading all of the data.
+	var n int64
+	if seeker, ok := rdr.(io.Seeker); ok {
+		n, err = seeker.Seek(0, io.SeekEnd)
+	} else {
+		n, err = io.Copy(ioutil.Discard, rdr)
+	}
+	if err != nil {
+		return 0, errors.Annotatef(err, "cannot determine length of data at storage path %q", resourcePath)
+	}
+	return n, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) newVerifyingManagedStorage(c *gc.C) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		VerifyDedup:     true,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+// truncateStored replaces the data at resPath with its first n bytes.
+func (s *managedStorageSuite) truncateStored(c *gc.C, resPath string, blob []byte, n int) {
+	err := s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.resourceStorage.Put(resPath, bytes.NewReader(blob[:n]), int64(n))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutVerifyDedup(c *gc.C) {
+	ms := s.newVerifyingManagedStorage(c)
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/another", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutVerifyDedupStoredLengthMismatch(c *gc.C) {
+	ms := s.newVerifyingManagedStorage(c)
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	s.truncateStored(c, resPath, blob, 4)
+
+	err := ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `de-duping 13 bytes with hash ".*" against 4 bytes at storage path ".*": stored data does not match`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDedupMismatch)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	id, err := blobstore.GetResourceCatalog(ms).Find(calculateCheckSum(c, 0, int64(len(blob)), blob))
+	c.Assert(err, jc.ErrorIsNil)
+	refCount, err := blobstore.GetResourceCatalog(ms).RefCount(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(refCount, gc.Equals, 1)
+}
+
+func (s *managedStorageSuite) TestPutVerifyDedupCatalogLengthMismatch(c *gc.C) {
+	ms := s.newVerifyingManagedStorage(c)
+	blob := []byte("some resource")
+	rc := blobstore.GetResourceCatalog(ms)
+	id, _, err := rc.Put(calculateCheckSum(c, 0, int64(len(blob)), blob), 4)
+	c.Assert(err, jc.ErrorIsNil)
+	err = rc.UploadComplete(id, "wherever")
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `de-duping 13 bytes with hash ".*" against 4 bytes catalogued: stored data does not match`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDedupMismatch)
+}
+
+func (s *managedStorageSuite) TestPutWithoutVerifyDedup(c *gc.C) {
+	// By default, the stored data is not checked.
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	s.truncateStored(c, resPath, blob, 4)
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutRequestVerifyDedup(c *gc.C) {
+	ms := s.newVerifyingManagedStorage(c)
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	_, err := ms.PutForEnvironmentRequest("env", "/path/to/another", hash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.truncateStored(c, resPath, blob, 4)
+	_, err = ms.PutForEnvironmentRequest("env", "/path/to/another", hash)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDedupMismatch)
+}
@@ -0,0 +1,397 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrDecryptionFailed is used to indicate that stored data could not be
+// authenticated when decrypted, because it has been tampered with or was
+// encrypted using a different key.
+var ErrDecryptionFailed = fmt.Errorf("decryption failed")
+
+type encryptingStorage struct {
+	inner ResourceStorage
+	key   [32]byte
+}
+
+var (
+	_ ResourceStorage       = (*encryptingStorage)(nil)
+	_ ResourceStorageLister = (*encryptingStorage)(nil)
+)
+
+const (
+	// encryptionChunkSize is the size of the chunks of plaintext
+	// which are sealed separately, so that data may be encrypted
+	// and decrypted as it is streamed.
+	encryptionChunkSize = 64 * 1024
+
+	// encryptionSaltSize is the size of the random salt from
+	// which the key used to seal each blob's chunks is derived.
+	encryptionSaltSize = 32
+
+	// encryptionPrefixSize is the size of the random nonce prefix
+	// stored after the salt. The rest of each chunk's nonce is
+	// its index, and a byte marking the final chunk.
+	encryptionPrefixSize = 7
+
+	// encryptionHeaderSize is the size of the salt and
+	// nonce prefix stored ahead of the sealed chunks.
+	encryptionHeaderSize = encryptionSaltSize + encryptionPrefixSize
+
+	// encryptionOverhead is the size of the
+	// authentication tag sealed with each chunk.
+	encryptionOverhead = 16
+)
+
+// encryptionKeyInfo binds the keys derived for
+// each blob to their use by an encryptingStorage.
+const encryptionKeyInfo = "juju-blobstore AES-256-GCM chunk key"
+
+// NewEncryptingStorage returns a ResourceStorage instance which encrypts data
+// using AES-256-GCM before writing it to inner, and decrypts it again when it
+// is read.
+//
+// Each blob is sealed with its own key, derived from key with HKDF-SHA256 and
+// a random 32 byte salt stored ahead of the data, so that the number of blobs
+// sealed does not bring nonces near reuse. Data is sealed in chunks of 64KiB,
+// so that it is streamed rather than held in memory. Each chunk's nonce is
+// made from a random prefix, which is stored after the salt, the chunk's
+// index, and whether it is the last chunk.
+// The path is authenticated with each chunk, so chunks cannot be reordered,
+// truncated or moved to another path without their decryption failing.
+//
+// The checksum returned by Put is the SHA-384 hash of the plaintext, so data
+// is de-duped on its logical content rather than on its ciphertext.
+func NewEncryptingStorage(inner ResourceStorage, key [32]byte) ResourceStorage {
+	return &encryptingStorage{inner: inner, key: key}
+}
+
+// blobAEAD returns the AEAD with which the chunks
+// of the blob stored with the given salt are sealed.
+func (s *encryptingStorage) blobAEAD(salt []byte) (cipher.AEAD, error) {
+	var blobKey [32]byte
+	kdf := hkdf.New(sha256.New, s.key[:], salt, []byte(encryptionKeyInfo))
+	if _, err := io.ReadFull(kdf, blobKey[:]); err != nil {
+		return nil, errors.Annotate(err, "cannot derive key")
+	}
+	block, err := aes.NewCipher(blobKey[:])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Get is defined on ResourceStorage. The first chunk is decrypted before
+// Get returns; should a later chunk fail to decrypt, the error is returned
+// when it is read. If the inner storage's reader implements io.Seeker, so
+// does the returned reader.
+func (s *encryptingStorage) Get(path string) (io.ReadCloser, error) {
+	rc, err := s.inner.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &decryptingReader{
+		path: path,
+		rc:   rc,
+		br:   bufio.NewReaderSize(rc, encryptionChunkSize+encryptionOverhead+1),
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(r.br, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		rc.Close()
+		return nil, errors.Annotatef(ErrDecryptionFailed, "data at path %q", path)
+	} else if err != nil {
+		rc.Close()
+		return nil, errors.Annotatef(err, "failed to read data at path %q", path)
+	}
+	r.prefix = header[encryptionSaltSize:]
+	if r.aead, err = s.blobAEAD(header[:encryptionSaltSize]); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if err := r.nextChunk(); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if seeker, ok := rc.(io.Seeker); ok {
+		return &decryptingReadSeeker{decryptingReader: r, seeker: seeker, size: -1}, nil
+	}
+	return r, nil
+}
+
+// Put is defined on ResourceStorage.
+//
+// The length of the data must be known, since
+// the final chunk is sealed differently.
+func (s *encryptingStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	if length < 0 {
+		return "", errors.NotValidf("unknown length")
+	}
+	chunks := (length + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		// Even empty data is sealed, so that it is authenticated.
+		chunks = 1
+	}
+	if chunks > math.MaxUint32 {
+		return "", errors.NotValidf("length %d", length)
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(rand.Reader, header); err != nil {
+		return "", errors.Annotate(err, "cannot generate salt and nonce")
+	}
+	aead, err := s.blobAEAD(header[:encryptionSaltSize])
+	if err != nil {
+		return "", err
+	}
+	sha384hash := sha512.New384()
+	er := &encryptingReader{
+		aead:      aead,
+		path:      path,
+		r:         io.TeeReader(r, sha384hash),
+		remaining: length,
+		prefix:    header[encryptionSaltSize:],
+		buf:       header,
+	}
+	sealedLength := encryptionHeaderSize + length + chunks*int64(aead.Overhead())
+	_, err = s.inner.Put(path, er, sealedLength)
+	if er.err != nil {
+		return "", errors.Annotatef(er.err, "failed to write data")
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+}
+
+// chunkNonce returns the nonce with which the chunk with
+// the given index is sealed, following the nonce prefix.
+func chunkNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, encryptionPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingReader reads the salt and nonce prefix followed
+// by the sealed chunks of the data read from r.
+type encryptingReader struct {
+	aead      cipher.AEAD
+	path      string
+	r         io.Reader
+	remaining int64
+	prefix    []byte
+	index     uint32
+	plain     []byte
+	buf       []byte
+	done      bool
+
+	// err holds the error with which reading from r failed.
+	err error
+}
+
+// Read is defined on io.Reader.
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		} else if r.done {
+			return 0, io.EOF
+		}
+		r.sealChunk()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// sealChunk reads and seals the next chunk of data.
+func (r *encryptingReader) sealChunk() {
+	n := r.remaining
+	if n > encryptionChunkSize {
+		n = encryptionChunkSize
+	}
+	if r.plain == nil {
+		r.plain = make([]byte, encryptionChunkSize, encryptionChunkSize+r.aead.Overhead())
+	}
+	plain := r.plain[:n]
+	if _, err := io.ReadFull(r.r, plain); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		r.err = err
+		return
+	}
+	r.remaining -= n
+	r.done = r.remaining == 0
+	// The chunk is sealed in place, since the plaintext is not needed again.
+	r.buf = r.aead.Seal(plain[:0], chunkNonce(r.prefix, r.index, r.done), plain, []byte(r.path))
+	r.index++
+}
+
+// decryptingReader reads the data decrypted from the
+// sealed chunks read from rc, following the header.
+type decryptingReader struct {
+	aead   cipher.AEAD
+	path   string
+	rc     io.ReadCloser
+	br     *bufio.Reader
+	prefix []byte
+	index  uint32
+	sealed []byte
+	buf    []byte
+	final  bool
+	err    error
+
+	// offset is the offset in the data of the next byte read.
+	offset int64
+}
+
+// Read is defined on io.Reader.
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		} else if r.final {
+			return 0, io.EOF
+		}
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+// nextChunk reads and decrypts the next chunk. The last chunk is the one
+// with no data after it, which must have been sealed as the final chunk,
+// so that data truncated at a chunk boundary is detected.
+func (r *decryptingReader) nextChunk() error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, encryptionChunkSize+r.aead.Overhead())
+	}
+	n, err := io.ReadFull(r.br, r.sealed)
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		r.err = errors.Annotatef(err, "failed to read data at path %q", r.path)
+		return r.err
+	} else if _, err := r.br.Peek(1); err == io.EOF {
+		final = true
+	} else if err != nil {
+		r.err = errors.Annotatef(err, "failed to read data at path %q", r.path)
+		return r.err
+	}
+	plain, err := r.aead.Open(r.sealed[:0], chunkNonce(r.prefix, r.index, final), r.sealed[:n], []byte(r.path))
+	if err != nil {
+		r.err = errors.Annotatef(ErrDecryptionFailed, "data at path %q", r.path)
+		return r.err
+	}
+	r.buf = plain
+	r.final = final
+	r.index++
+	return nil
+}
+
+// Close is defined on io.Closer.
+func (r *decryptingReader) Close() error {
+	return r.rc.Close()
+}
+
+// decryptingReadSeeker is a decryptingReader whose
+// sealed chunks are read from an io.Seeker.
+type decryptingReadSeeker struct {
+	*decryptingReader
+	seeker io.Seeker
+
+	// size is the length of the data, or -1 if it is not yet known.
+	size int64
+}
+
+// Seek is defined on io.Seeker. The chunk holding the new
+// offset is read and decrypted before Seek returns.
+func (r *decryptingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if r.size < 0 {
+		sealedSize, err := r.seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return r.offset, errors.Annotatef(err, "cannot seek data at path %q", r.path)
+		}
+		r.size = unsealedSize(sealedSize, r.aead.Overhead())
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, errors.NotValidf("seeking to negative offset %d", offset)
+	}
+	r.err = nil
+	r.offset = offset
+	if offset >= r.size {
+		r.buf, r.final = nil, true
+		return offset, nil
+	}
+	chunk := offset / encryptionChunkSize
+	sealedOffset := encryptionHeaderSize + chunk*int64(encryptionChunkSize+r.aead.Overhead())
+	if _, err := r.seeker.Seek(sealedOffset, io.SeekStart); err != nil {
+		r.err = errors.Annotatef(err, "cannot seek data at path %q", r.path)
+		return offset, r.err
+	}
+	r.br.Reset(r.rc)
+	r.index = uint32(chunk)
+	if err := r.nextChunk(); err != nil {
+		return offset, err
+	}
+	r.buf = r.buf[offset%encryptionChunkSize:]
+	return offset, nil
+}
+
+// unsealedSize returns the length of the data sealed
+// in chunks whose total length, with the header,
+// is sealedSize.
+func unsealedSize(sealedSize int64, overhead int) int64 {
+	sealedChunkSize := int64(encryptionChunkSize + overhead)
+	body := sealedSize - encryptionHeaderSize
+	size := body / sealedChunkSize * encryptionChunkSize
+	if rem := body % sealedChunkSize; rem > int64(overhead) {
+		size += rem - int64(overhead)
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// Remove is defined on ResourceStorage.
+func (s *encryptingStorage) Remove(path string) error {
+	return s.inner.Remove(path)
+}
+
+// List is defined on ResourceStorageLister.
+func (s *encryptingStorage) List() ([]StoredResource, error) {
+	lister, ok := s.inner.(ResourceStorageLister)
+	if !ok {
+		return nil, errors.NotSupportedf("listing unlistable resource storage")
+	}
+	return lister.List()
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&encryptingStorageSuite{})
+
+type encryptingStorageSuite struct {
+	testing.IsolationSuite
+	key   [32]byte
+	inner blobstore.ResourceStorage
+	stor  blobstore.ResourceStorage
+}
+
+func (s *encryptingStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	copy(s.key[:], "0123456789abcdef0123456789abcdef")
+	s.inner = blobstore.NewMemResourceStorage()
+	s.stor = blobstore.NewEncryptingStorage(s.inner, s.key)
+}
+
+func (s *encryptingStorageSuite) assertPut(c *gc.C, path, data string) {
+	checksum, err := s.stor.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(checksum, gc.Equals, fmt.Sprintf("%x", sha512.Sum384([]byte(data))))
+	assertGet(c, s.stor, path, data)
+}
+
+func (s *encryptingStorageSuite) stored(c *gc.C, path string) []byte {
+	r, err := s.inner.Get(path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	return data
+}
+
+func (s *encryptingStorageSuite) TestPut(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	c.Assert(bytes.Contains(s.stored(c, "/path/to/file"), []byte("hello world")), jc.IsFalse)
+}
+
+func (s *encryptingStorageSuite) TestPutUsesFreshNonce(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	s.assertPut(c, "/path/to/another", "hello world")
+	c.Assert(s.stored(c, "/path/to/file"), gc.Not(gc.DeepEquals), s.stored(c, "/path/to/another"))
+}
+
+func (s *encryptingStorageSuite) TestPutUsesFreshSalt(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	s.assertPut(c, "/path/to/another", "hello world")
+	c.Assert(s.stored(c, "/path/to/file")[:32], gc.Not(gc.DeepEquals), s.stored(c, "/path/to/another")[:32])
+}
+
+func (s *encryptingStorageSuite) TestPutUnknownLength(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), -1)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = s.inner.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *encryptingStorageSuite) TestPutShortRead(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("short"), 100)
+	c.Assert(err, gc.ErrorMatches, "failed to write data: EOF")
+	_, err = s.inner.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *encryptingStorageSuite) TestGetNonExistent(c *gc.C) {
+	_, err := s.stor.Get("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *encryptingStorageSuite) TestGetTampered(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	data := s.stored(c, "/path/to/file")
+	data[len(data)-1] ^= 1
+	_, err := s.inner.Put("/path/to/file", bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(err, gc.ErrorMatches, `data at path "/path/to/file": decryption failed`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDecryptionFailed)
+}
+
+func (s *encryptingStorageSuite) TestGetTruncated(c *gc.C) {
+	_, err := s.inner.Put("/path/to/file", strings.NewReader("short"), 5)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDecryptionFailed)
+}
+
+func (s *encryptingStorageSuite) TestGetWrongKey(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	var otherKey [32]byte
+	stor := blobstore.NewEncryptingStorage(s.inner, otherKey)
+	_, err := stor.Get("/path/to/file")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDecryptionFailed)
+}
+
+func (s *encryptingStorageSuite) TestRemove(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	err := s.stor.Remove("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *encryptingStorageSuite) TestPutEmpty(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "")
+}
+
+func (s *encryptingStorageSuite) TestPutManyChunks(c *gc.C) {
+	data := strings.Repeat("0123456789abcdef", 10000)
+	s.assertPut(c, "/path/to/file", data)
+	// Each chunk of 64KiB is sealed separately.
+	c.Assert(s.stored(c, "/path/to/file"), gc.HasLen, 39+len(data)+3*16)
+}
+
+func (s *encryptingStorageSuite) TestGetTruncatedAtChunk(c *gc.C) {
+	data := strings.Repeat("0123456789abcdef", 10000)
+	s.assertPut(c, "/path/to/file", data)
+	stored := s.stored(c, "/path/to/file")[:39+2*(64*1024+16)]
+	_, err := s.inner.Put("/path/to/file", bytes.NewReader(stored), int64(len(stored)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, `data at path "/path/to/file": decryption failed`)
+}
+
+func (s *encryptingStorageSuite) TestGetReorderedChunks(c *gc.C) {
+	data := strings.Repeat("0123456789abcdef", 10000)
+	s.assertPut(c, "/path/to/file", data)
+	stored := s.stored(c, "/path/to/file")
+	first := append([]byte(nil), stored[39:39+64*1024+16]...)
+	copy(stored[39:], stored[39+64*1024+16:39+2*(64*1024+16)])
+	copy(stored[39+64*1024+16:], first)
+	_, err := s.inner.Put("/path/to/file", bytes.NewReader(stored), int64(len(stored)))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrDecryptionFailed)
+}
+
+func (s *encryptingStorageSuite) TestGetMovedPath(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	stored := s.stored(c, "/path/to/file")
+	_, err := s.inner.Put("/path/to/another", bytes.NewReader(stored), int64(len(stored)))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("/path/to/another")
+	c.Assert(err, gc.ErrorMatches, `data at path "/path/to/another": decryption failed`)
+}
+
+func (s *encryptingStorageSuite) TestGetSeek(c *gc.C) {
+	data := strings.Repeat("0123456789abcdef", 10000)
+	s.assertPut(c, "/path/to/file", data)
+	r, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	seeker := r.(io.Seeker)
+	for _, offset := range []int64{100000, 5, 64 * 1024, int64(len(data)) - 3} {
+		pos, err := seeker.Seek(offset, io.SeekStart)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(pos, gc.Equals, offset)
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(r, buf)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(string(buf), gc.Equals, data[offset:offset+3])
+	}
+	pos, err := seeker.Seek(-10, io.SeekEnd)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(pos, gc.Equals, int64(len(data)-10))
+	rest, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(rest), gc.Equals, data[len(data)-10:])
+}
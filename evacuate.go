@@ -0,0 +1,134 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils"
+)
+
+// EvacuationProgress describes the progress of an EvacuateShard call.
+type EvacuationProgress struct {
+	// Path is the storage path of the data just processed,
+	// and NewPath the path it was moved to, if it was moved.
+	Path    string
+	NewPath string
+
+	// Skipped is true if the data was not held by the
+	// source, so there was nothing to move.
+	Skipped bool
+
+	// Err is the reason the data could not be moved, if any.
+	// The data remains in the source.
+	Err error
+
+	// Done is the number of resources processed so far,
+	// out of Total.
+	Done, Total int
+
+	// BytesCopied is the number of bytes moved so far.
+	BytesCopied int64
+}
+
+// EvacuateShard moves the data of every completed resource in catalog which
+// is held by one ResourceStorage to another, so that the source may be
+// decommissioned. Each item of data is copied to a new storage path in the
+// destination and verified by reading it back and checking it against the
+// hash recorded in the catalog. Only then is the catalog entry updated to
+// refer to the new path, and the data removed from the source. Data which
+// cannot be moved is left in the source, and the error is passed to
+// progress; if any data could not be moved, an error is returned once all
+// resources have been processed.
+//
+// Data already moved is no longer referenced at the source, so an interrupted
+// evacuation may be resumed by calling EvacuateShard again. Copies left
+// behind by an interruption are not referenced by the catalog, and may be
+// removed using ManagedStorage.GarbageCollect. The ResourceStorage used by
+// ManagedStorage must find data at its new path in the destination; for
+// example, by sharding across the remaining shards by path.
+//
+// If progress is non-nil, it is called after each resource is processed.
+func EvacuateShard(
+	ctx context.Context, from, to ResourceStorage, catalog ResourceCatalog, progress func(EvacuationProgress),
+) error {
+	resources, err := catalog.List()
+	if err != nil {
+		return errors.Annotate(err, "cannot list resources to evacuate")
+	}
+	var status EvacuationProgress
+	for _, r := range resources {
+		if r.Path != "" && r.Path != emptyResourcePath && !isInlinePath(r.Path) {
+			status.Total++
+		}
+	}
+	failed := 0
+	for _, r := range resources {
+		if r.Path == "" || r.Path == emptyResourcePath || isInlinePath(r.Path) {
+			// There is no data held in the resource storage.
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		status.Path = r.Path
+		status.NewPath, status.Skipped, status.Err = evacuateResource(ctx, from, to, catalog, r)
+		if status.Err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			status.Err = errors.Annotatef(status.Err, "cannot evacuate resource at storage path %q", r.Path)
+			failed++
+		} else if !status.Skipped {
+			status.BytesCopied += r.Length
+		}
+		status.Done++
+		if progress != nil {
+			progress(status)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("cannot evacuate %d of %d resources", failed, status.Total)
+	}
+	return nil
+}
+
+// evacuateResource moves the data of r from one storage to another,
+// returning the path it was moved to, or skipped=true if the data
+// is not held by the source.
+func evacuateResource(
+	ctx context.Context, from, to ResourceStorage, catalog ResourceCatalog, r *Resource,
+) (newPath string, skipped bool, err error) {
+	oldPath := r.Path
+	rdr, err := from.Get(oldPath)
+	if errors.IsNotFound(err) {
+		return "", true, nil
+	} else if err != nil {
+		return "", false, errors.Annotate(err, "cannot read data")
+	}
+	defer rdr.Close()
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		return "", false, errors.Annotate(err, "cannot generate UUID to store resource")
+	}
+	moved := *r
+	moved.Path = uuid.String()
+	if _, err := to.Put(moved.Path, &contextReader{ctx, rdr}, r.Length); err != nil {
+		return "", false, errors.Annotate(err, "cannot write data")
+	}
+	defer cleanupResource(to, moved.Path, &err)
+	if err := verifyStoredResource(ctx, to, &moved); err != nil {
+		return "", false, err
+	}
+	if err := catalog.MovePath(resourceDocId(r.HashAlgorithm, r.Hash), oldPath, moved.Path); err != nil {
+		return "", false, errors.Annotate(err, "cannot update resource catalog")
+	}
+	// The source data is no longer referenced, so failing to
+	// remove it is not fatal; it may be garbage collected later.
+	if err := from.Remove(oldPath); err != nil {
+		logger.Errorf("cannot remove evacuated data at storage path %q: %v", oldPath, err)
+	}
+	return moved.Path, false, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&evacuateSuite{})
+
+type evacuateSuite struct {
+	testing.IsolationSuite
+	from    blobstore.ResourceStorage
+	to      blobstore.ResourceStorage
+	catalog *movingCatalog
+}
+
+// movingCatalog is a ResourceCatalog which supports
+// listing and moving paths.
+type movingCatalog struct {
+	fakeCatalog
+	moveErr error
+}
+
+func (f *movingCatalog) MovePath(id, oldPath, newPath string) error {
+	if f.moveErr != nil {
+		return f.moveErr
+	}
+	for _, r := range f.resources {
+		if string(r.HashAlgorithm)+":"+r.Hash == id && r.Path == oldPath {
+			r.Path = newPath
+			return nil
+		}
+	}
+	return blobstore.ErrPreconditionFailed
+}
+
+func (s *evacuateSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.from = blobstore.NewMemResourceStorage()
+	s.to = blobstore.NewMemResourceStorage()
+	s.catalog = &movingCatalog{}
+}
+
+func (s *evacuateSuite) addResource(c *gc.C, stor blobstore.ResourceStorage, path, data string) {
+	_, err := stor.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	s.catalog.resources = append(s.catalog.resources,
+		blobstore.NewResource(path, blobstore.SHA256, hash, int64(len(data))))
+}
+
+func (s *evacuateSuite) evacuate(c *gc.C) ([]blobstore.EvacuationProgress, error) {
+	var progress []blobstore.EvacuationProgress
+	err := blobstore.EvacuateShard(context.Background(), s.from, s.to, s.catalog, func(p blobstore.EvacuationProgress) {
+		progress = append(progress, p)
+	})
+	return progress, err
+}
+
+func (s *evacuateSuite) TestEvacuateShard(c *gc.C) {
+	s.addResource(c, s.from, "abc", "hello")
+	s.addResource(c, s.to, "def", "world!")
+	s.catalog.resources = append(s.catalog.resources,
+		blobstore.NewResource("", blobstore.SHA256, "pending", 10))
+
+	progress, err := s.evacuate(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(progress, gc.HasLen, 2)
+	newPath := s.catalog.resources[0].Path
+	c.Assert(newPath, gc.Not(gc.Equals), "abc")
+	c.Assert(progress, jc.DeepEquals, []blobstore.EvacuationProgress{
+		{Path: "abc", NewPath: newPath, Done: 1, Total: 2, BytesCopied: 5},
+		{Path: "def", Skipped: true, Done: 2, Total: 2, BytesCopied: 5},
+	})
+	assertGet(c, s.to, newPath, "hello")
+	assertList(c, s.from)
+
+	// Evacuating again does nothing.
+	progress, err = s.evacuate(c)
+	c.Assert(err, jc.ErrorIsNil)
+	for _, p := range progress {
+		c.Check(p.Skipped, jc.IsTrue)
+	}
+}
+
+func (s *evacuateSuite) TestEvacuateShardCorrupt(c *gc.C) {
+	s.addResource(c, s.from, "abc", "hello")
+	s.addResource(c, s.from, "def", "world!")
+	s.catalog.resources[0].Hash = "bad"
+
+	progress, err := s.evacuate(c)
+	c.Assert(err, gc.ErrorMatches, "cannot evacuate 1 of 2 resources")
+	c.Assert(progress, gc.HasLen, 2)
+	c.Assert(progress[0].Err, gc.ErrorMatches, `cannot evacuate resource at storage path "abc": copied data: checksum mismatch`)
+	c.Assert(errors.Cause(progress[0].Err), gc.Equals, blobstore.ErrChecksumMismatch)
+	c.Assert(progress[1].Err, jc.ErrorIsNil)
+
+	// The corrupt data is left in the source, and not copied.
+	assertGet(c, s.from, "abc", "hello")
+	assertList(c, s.from, "abc")
+	assertList(c, s.to, s.catalog.resources[1].Path)
+}
+
+func (s *evacuateSuite) TestEvacuateShardCatalogChanged(c *gc.C) {
+	s.addResource(c, s.from, "abc", "hello")
+	s.catalog.moveErr = blobstore.ErrPreconditionFailed
+
+	progress, err := s.evacuate(c)
+	c.Assert(err, gc.ErrorMatches, "cannot evacuate 1 of 1 resources")
+	c.Assert(errors.Cause(progress[0].Err), gc.Equals, blobstore.ErrPreconditionFailed)
+	// The copy is removed, and the source is untouched.
+	assertList(c, s.to)
+	assertGet(c, s.from, "abc", "hello")
+	c.Assert(s.catalog.resources[0].Path, gc.Equals, "abc")
+}
+
+func (s *evacuateSuite) TestEvacuateShardCancelled(c *gc.C) {
+	s.addResource(c, s.from, "abc", "hello")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := blobstore.EvacuateShard(ctx, s.from, s.to, s.catalog, nil)
+	c.Assert(err, gc.Equals, context.Canceled)
+	assertGet(c, s.from, "abc", "hello")
+}
@@ -3,6 +3,11 @@
 
 package blobstore
 
+import (
+	"context"
+	"io"
+)
+
 var (
 	NewResourceCatalog = newResourceCatalog
 	NewResource        = newResource
@@ -10,6 +15,19 @@ var (
 	PutResourceTxn     = &putResourceTxn
 	RequestExpiry      = &requestExpiry
 	AfterFunc          = &afterFunc
+	RemoveAllBatchSize = &removeAllBatchSize
+	RetrySleep         = &retrySleep
+	TimeNow            = &timeNow
+
+	PendingUploadGracePeriod = &pendingUploadGracePeriod
+	BatchPutConcurrency      = &batchPutConcurrency
+	ConcurrentUploadWait     = &concurrentUploadWait
+	UploadLeaseDuration      = &uploadLeaseDuration
+	UploadLeasePollInterval  = &uploadLeasePollInterval
+	ThrottleSleep            = &throttleSleep
+	ProgressUpdateInterval   = &progressUpdateInterval
+	ProgressCallbackInterval = &progressCallbackInterval
+	SyncFile                 = &syncFile
 )
 
 func GetResourceCatalog(ms ManagedStorage) ResourceCatalog {
@@ -17,7 +35,7 @@ func GetResourceCatalog(ms ManagedStorage) ResourceCatalog {
 }
 
 func PutManagedResource(ms ManagedStorage, managedResource ManagedResource, id string) (string, error) {
-	return ms.(*managedStorage).putManagedResource(managedResource, id)
+	return ms.(*managedStorage).putManagedResource(managedResource, id, nil)
 }
 
 func ResourceStoragePath(ms ManagedStorage, envUUID, user, resourcePath string) (string, error) {
@@ -27,3 +45,19 @@ func ResourceStoragePath(ms ManagedStorage, envUUID, user, resourcePath string)
 func RequestQueueLength(ms ManagedStorage) int {
 	return len(ms.(*managedStorage).queuedRequests)
 }
+
+func NewUploadBuffer(threshold int64, dir string) io.ReadWriteCloser {
+	return newUploadBuffer(threshold, dir)
+}
+
+func FinishUploadBuffer(b io.ReadWriteCloser) error {
+	return b.(*uploadBuffer).finishWrite()
+}
+
+func UploadBufferSpilled(b io.ReadWriteCloser) bool {
+	return b.(*uploadBuffer).spilled()
+}
+
+func NewThrottledReader(ctx context.Context, r io.Reader, rate, burst int64) io.Reader {
+	return &throttledReader{newTokenBucket(ctx, rate, burst), r}
+}
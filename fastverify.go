@@ -0,0 +1,76 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// crc32cTable is the table used to calculate CRC-32C checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newCRC32C returns a hash.Hash which calculates CRC-32C checksums.
+func newCRC32C() hash.Hash {
+	return crc32.New(crc32cTable)
+}
+
+// recordCRC32C records the hex-encoded CRC-32C checksum of the data
+// for the catalog entry with the given id, unless one is already
+// recorded. Entries catalogued before the checksum was calculated
+// acquire one when the same data is next stored.
+func (ms *managedStorage) recordCRC32C(resourceId, checksum string) error {
+	ops := []txn.Op{{
+		C:      resourceCatalogCollection,
+		Id:     resourceId,
+		Assert: bson.D{{"crc32c", bson.D{{"$exists", false}}}},
+		Update: bson.D{{"$set", bson.D{{"crc32c", checksum}}}},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil && err != txn.ErrAborted {
+		return err
+	}
+	return nil
+}
+
+// VerifyFastForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) VerifyFastForEnvironment(envUUID, path string) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return err
+	}
+	r, err := ms.catalogEntry(resourceId, managedPath)
+	if err != nil {
+		return err
+	}
+	rdr, err := ms.openStored(r.Path)
+	if err != nil {
+		return err
+	}
+	verifier := &verifyingReader{ReadCloser: rdr, path: managedPath}
+	if r.CRC32C != "" {
+		verifier.hash, verifier.expected = newCRC32C(), r.CRC32C
+	} else {
+		// There is no secondary checksum recorded for data
+		// stored before it was calculated, so fall back to
+		// the primary hash.
+		verifier.hash, verifier.expected = r.HashAlgorithm.New(), r.Hash
+	}
+	if _, err := io.Copy(ioutil.Discard, verifier); err != nil {
+		verifier.Close()
+		return err
+	}
+	return verifier.Close()
+}
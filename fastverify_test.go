@@ -0,0 +1,83 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/juju/blobstore"
+)
+
+func crc32c(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+func (s *managedStorageSuite) TestPutRecordsCRC32C(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	var doc struct {
+		CRC32C string `bson:"crc32c"`
+	}
+	err := s.db.C("storedResources").Find(nil).One(&doc)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(doc.CRC32C, gc.Equals, crc32c(blob))
+
+	// The primary hash is unchanged, and still used for de-duping.
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.SHA384Hash, gc.Equals, calculateCheckSum(c, 0, int64(len(blob)), blob))
+	s.assertPut(c, "/path/to/another", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestVerifyFastForEnvironment(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	err := s.managedStorage.VerifyFastForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/empty", bytes.NewReader(nil), 0)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.VerifyFastForEnvironment("env", "/path/to/empty")
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestVerifyFastForEnvironmentCorrupt(c *gc.C) {
+	resPath := s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	err := s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.resourceStorage.Put(resPath, bytes.NewReader([]byte("corrupt resource")), 16)
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.managedStorage.VerifyFastForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.ErrorMatches, `resource at path "environs/env/path/to/blob": checksum mismatch`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrChecksumMismatch)
+}
+
+func (s *managedStorageSuite) TestVerifyFastForEnvironmentNoCRC32C(c *gc.C) {
+	resPath := s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	// Entries stored before the checksum was recorded
+	// are verified using the primary hash.
+	err := s.db.C("storedResources").Update(nil, bson.D{{"$unset", bson.D{{"crc32c", 1}}}})
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.VerifyFastForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.resourceStorage.Put(resPath, bytes.NewReader([]byte("corrupt resource")), 16)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.VerifyFastForEnvironment("env", "/path/to/blob")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrChecksumMismatch)
+}
+
+func (s *managedStorageSuite) TestVerifyFastForEnvironmentNotFound(c *gc.C) {
+	err := s.managedStorage.VerifyFastForEnvironment("env", "/path/to/missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
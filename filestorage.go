@@ -0,0 +1,255 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// FileDurability determines how much effort a file-backed ResourceStorage
+// makes to ensure that data survives a crash once Put has returned.
+type FileDurability string
+
+const (
+	// DurabilityNone leaves the data to be written to disk whenever the
+	// operating system chooses. It is the fastest, but data written shortly
+	// before a crash may be lost or, on some filesystems, left empty.
+	DurabilityNone FileDurability = "none"
+
+	// DurabilityFsyncFile flushes the data to disk before renaming it
+	// into place, so that the file is never seen without its data. Each
+	// Put waits for the disk, which typically costs milliseconds on
+	// spinning disks, and much less on SSDs. A crash shortly after Put
+	// may still lose the rename, so that the path has its previous data.
+	DurabilityFsyncFile FileDurability = "fsync-file"
+
+	// DurabilityFsyncDir additionally flushes the directory containing the
+	// file after the rename, so that the data is at its path once Put has
+	// returned. This doubles the waits for the disk made by each Put.
+	DurabilityFsyncDir FileDurability = "fsync-dir"
+)
+
+// Validate returns an error if the durability level is not known.
+func (d FileDurability) Validate() error {
+	switch d {
+	case DurabilityNone, DurabilityFsyncFile, DurabilityFsyncDir:
+		return nil
+	}
+	return errors.NotValidf("durability %q", string(d))
+}
+
+// FileStorageConfig holds the parameters used to construct
+// a file-backed ResourceStorage.
+type FileStorageConfig struct {
+	// Root is the directory beneath which data is stored.
+	Root string
+
+	// Durability determines whether data is flushed to disk when it is
+	// written. If empty, DurabilityFsyncFile is used.
+	Durability FileDurability
+
+	// Clock, if non-nil, supplies the modification times recorded
+	// for the data written, which are otherwise those of the files.
+	// It should be the Clock given to the ManagedStorage using the
+	// storage, so that garbage collection measures the age of data
+	// against the same time.
+	Clock Clock
+}
+
+// Validate returns an error if the config is not valid.
+func (cfg FileStorageConfig) Validate() error {
+	if cfg.Root == "" {
+		return errors.NotValidf("empty root")
+	}
+	if cfg.Durability != "" {
+		if err := cfg.Durability.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile flushes the file's data to disk. It is
+// a variable so that it may be patched for testing.
+var syncFile = (*os.File).Sync
+
+type fileStorage struct {
+	root       string
+	durability FileDurability
+	clock      Clock
+}
+
+var (
+	_ ResourceStorage       = (*fileStorage)(nil)
+	_ ResourceStorageLister = (*fileStorage)(nil)
+)
+
+// NewFileResourceStorage returns a ResourceStorage instance which stores
+// data as files beneath the specified root directory. Paths are interpreted
+// relative to root, and may not refer outside of it. Data is flushed to
+// disk as for DurabilityFsyncFile.
+func NewFileResourceStorage(root string) ResourceStorage {
+	return &fileStorage{root: root, durability: DurabilityFsyncFile}
+}
+
+// NewFileResourceStorageWithConfig returns a ResourceStorage instance
+// which stores data as files, as described by cfg.
+func NewFileResourceStorageWithConfig(cfg FileStorageConfig) (ResourceStorage, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Annotate(err, "invalid file storage config")
+	}
+	durability := cfg.Durability
+	if durability == "" {
+		durability = DurabilityFsyncFile
+	}
+	return &fileStorage{root: cfg.Root, durability: durability, clock: cfg.Clock}, nil
+}
+
+// filePath returns the location on disk of the data stored at path.
+func (f *fileStorage) filePath(p string) (string, error) {
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return "", errors.NotValidf("path %q referring outside of storage root", p)
+		}
+	}
+	cleaned := path.Clean("/" + p)
+	if cleaned == "/" {
+		return "", errors.NotValidf("empty path %q", p)
+	}
+	return filepath.Join(f.root, filepath.FromSlash(cleaned)), nil
+}
+
+// Get is defined on ResourceStorage.
+func (f *fileStorage) Get(path string) (io.ReadCloser, error) {
+	filename, err := f.filePath(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("file %q", path)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "failed to open file %q", path)
+	}
+	return file, nil
+}
+
+// Put is defined on ResourceStorage.
+//
+// The data is first written to a temporary file alongside its final
+// location, which is then renamed into place, so that readers never
+// see partially written data. The data is flushed to disk as required
+// by the storage's durability level.
+func (f *fileStorage) Put(path string, r io.Reader, length int64) (checksum string, err error) {
+	filename, err := f.filePath(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Annotatef(err, "failed to create directory for file %q", path)
+	}
+	file, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to create file %q", path)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			// The temporary file no longer exists if it was renamed
+			// into place before the failure.
+			if removeErr := os.Remove(file.Name()); removeErr != nil && !os.IsNotExist(removeErr) {
+				logger.Warningf("error cleaning up after failed write: %v", removeErr)
+			}
+		}
+	}()
+	sha384hash := sha512.New384()
+	if _, err = io.CopyN(io.MultiWriter(file, sha384hash), r, length); err != nil {
+		return "", errors.Annotatef(err, "failed to write data")
+	}
+	if f.durability != DurabilityNone {
+		if err = syncFile(file); err != nil {
+			return "", errors.Annotatef(err, "failed to sync data")
+		}
+	}
+	if err = file.Close(); err != nil {
+		return "", errors.Annotatef(err, "failed to flush data")
+	}
+	if f.clock != nil {
+		now := f.clock.Now()
+		if err = os.Chtimes(file.Name(), now, now); err != nil {
+			return "", errors.Annotatef(err, "failed to set modification time")
+		}
+	}
+	if err = os.Rename(file.Name(), filename); err != nil {
+		return "", errors.Annotatef(err, "failed to rename data into place")
+	}
+	if f.durability == DurabilityFsyncDir {
+		if err := syncDir(dir); err != nil {
+			return "", errors.Annotatef(err, "failed to sync directory for file %q", path)
+		}
+	}
+	return fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+}
+
+// syncDir flushes the directory's entries to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
+
+// Remove is defined on ResourceStorage.
+func (f *fileStorage) Remove(path string) error {
+	filename, err := f.filePath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return errors.Annotatef(err, "failed to remove file %q", path)
+	}
+	return nil
+}
+
+// List is defined on ResourceStorageLister.
+// Temporary files left behind by interrupted writes are included.
+func (f *fileStorage) List() ([]StoredResource, error) {
+	var result []StoredResource
+	err := filepath.Walk(f.root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filename == f.root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, filename)
+		if err != nil {
+			return err
+		}
+		result = append(result, StoredResource{
+			Path:     filepath.ToSlash(rel),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "failed to list files")
+	}
+	return result, nil
+}
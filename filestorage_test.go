@@ -0,0 +1,206 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&fileStorageSuite{})
+
+type fileStorageSuite struct {
+	testing.IsolationSuite
+	root string
+	stor blobstore.ResourceStorage
+}
+
+func (s *fileStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.root = c.MkDir()
+	s.stor = blobstore.NewFileResourceStorage(s.root)
+}
+
+func (s *fileStorageSuite) assertPut(c *gc.C, path, data string) {
+	r := strings.NewReader(data)
+	checksum, err := s.stor.Put(path, r, int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(checksum, gc.Equals, fmt.Sprintf("%x", sha512.Sum384([]byte(data))))
+	assertGet(c, s.stor, path, data)
+}
+
+func (s *fileStorageSuite) TestPut(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "path", "to", "file"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "hello world")
+}
+
+func (s *fileStorageSuite) TestPutSameFileOverwrites(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	s.assertPut(c, "/path/to/file", "hello again")
+}
+
+func (s *fileStorageSuite) TestPutLeavesNoTemporaryFiles(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	infos, err := ioutil.ReadDir(filepath.Join(s.root, "path", "to"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Name(), gc.Equals, "file")
+}
+
+func (s *fileStorageSuite) TestPutShortReadCleansUp(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("short"), 100)
+	c.Assert(err, gc.ErrorMatches, "failed to write data: EOF")
+	infos, err := ioutil.ReadDir(filepath.Join(s.root, "path", "to"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+// patchSyncFile records the names of the files synced by the file storage.
+func (s *fileStorageSuite) patchSyncFile(c *gc.C, err error) *[]string {
+	var synced []string
+	s.PatchValue(blobstore.SyncFile, func(f *os.File) error {
+		rel, relErr := filepath.Rel(s.root, f.Name())
+		c.Assert(relErr, jc.ErrorIsNil)
+		synced = append(synced, filepath.ToSlash(rel))
+		return err
+	})
+	return &synced
+}
+
+func (s *fileStorageSuite) TestPutDurability(c *gc.C) {
+	for i, test := range []struct {
+		durability blobstore.FileDurability
+		expect     []string
+	}{{
+		durability: blobstore.DurabilityNone,
+	}, {
+		durability: "",
+		expect:     []string{"path/to/.tmp-"},
+	}, {
+		durability: blobstore.DurabilityFsyncFile,
+		expect:     []string{"path/to/.tmp-"},
+	}, {
+		durability: blobstore.DurabilityFsyncDir,
+		expect:     []string{"path/to/.tmp-", "path/to"},
+	}} {
+		c.Logf("test %d: %q", i, test.durability)
+		synced := s.patchSyncFile(c, nil)
+		stor, err := blobstore.NewFileResourceStorageWithConfig(blobstore.FileStorageConfig{
+			Root:       s.root,
+			Durability: test.durability,
+		})
+		c.Assert(err, jc.ErrorIsNil)
+		_, err = stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+		c.Assert(err, jc.ErrorIsNil)
+		assertGet(c, stor, "/path/to/file", "hello world")
+		c.Assert(*synced, gc.HasLen, len(test.expect))
+		for j, name := range test.expect {
+			c.Check(strings.HasPrefix((*synced)[j], name), jc.IsTrue, gc.Commentf("%q", (*synced)[j]))
+		}
+	}
+}
+
+func (s *fileStorageSuite) TestPutDurabilityDefault(c *gc.C) {
+	synced := s.patchSyncFile(c, nil)
+	s.assertPut(c, "/path/to/file", "hello world")
+	c.Assert(*synced, gc.HasLen, 1)
+}
+
+func (s *fileStorageSuite) TestPutSyncError(c *gc.C) {
+	s.patchSyncFile(c, fmt.Errorf("disk on fire"))
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, gc.ErrorMatches, "failed to sync data: disk on fire")
+	infos, err := ioutil.ReadDir(filepath.Join(s.root, "path", "to"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func (s *fileStorageSuite) TestInvalidConfig(c *gc.C) {
+	_, err := blobstore.NewFileResourceStorageWithConfig(blobstore.FileStorageConfig{})
+	c.Assert(err, gc.ErrorMatches, "invalid file storage config: empty root not valid")
+	_, err = blobstore.NewFileResourceStorageWithConfig(blobstore.FileStorageConfig{
+		Root:       s.root,
+		Durability: "eventually",
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid file storage config: durability "eventually" not valid`)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *fileStorageSuite) TestList(c *gc.C) {
+	assertList(c, s.stor)
+	s.assertPut(c, "/path/to/file", "hello world")
+	s.assertPut(c, "/path/to/another", "hello again")
+	assertList(c, s.stor, "path/to/file", "path/to/another")
+}
+
+func (s *fileStorageSuite) TestListClock(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	stor, err := blobstore.NewFileResourceStorageWithConfig(blobstore.FileStorageConfig{
+		Root:  s.root,
+		Clock: clock,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, jc.ErrorIsNil)
+	infos, err := stor.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Modified.Equal(clock.now), jc.IsTrue)
+}
+
+func (s *fileStorageSuite) TestListNonExistentRoot(c *gc.C) {
+	stor := blobstore.NewFileResourceStorage(filepath.Join(s.root, "missing"))
+	assertList(c, stor)
+}
+
+func (s *fileStorageSuite) TestGetNonExistent(c *gc.C) {
+	_, err := s.stor.Get("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *fileStorageSuite) TestRemove(c *gc.C) {
+	path := "/path/to/file"
+	s.assertPut(c, path, "hello world")
+	err := s.stor.Remove(path)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get(path)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *fileStorageSuite) TestRemoveNonExistent(c *gc.C) {
+	err := s.stor.Remove("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *fileStorageSuite) TestPathsEscapingRootRejected(c *gc.C) {
+	for _, path := range []string{"..", "../file", "/path/../../file", "path/to/.."} {
+		_, err := s.stor.Put(path, strings.NewReader("data"), 4)
+		c.Check(err, jc.Satisfies, errors.IsNotValid)
+		_, err = s.stor.Get(path)
+		c.Check(err, jc.Satisfies, errors.IsNotValid)
+		err = s.stor.Remove(path)
+		c.Check(err, jc.Satisfies, errors.IsNotValid)
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(s.root), "file"))
+	c.Assert(os.IsNotExist(err), jc.IsTrue)
+}
+
+func (s *fileStorageSuite) TestEmptyPathRejected(c *gc.C) {
+	_, err := s.stor.Put("/", strings.NewReader("data"), 4)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
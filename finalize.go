@@ -0,0 +1,265 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// uploadLeaseDuration is the time for which a put uploading the data
+// of a pending resource holds the lease on uploading it. A put which
+// takes longer loses the lease, after which the data may be uploaded
+// by other puts too, which is wasteful but harmless.
+var uploadLeaseDuration = 10 * time.Minute
+
+// uploadLeasePollInterval is the time between checks by a put waiting
+// for the data it is putting to be uploaded by another process.
+var uploadLeasePollInterval = time.Second
+
+// claimUploadLease records resourcePath as the storage path to which
+// the data of the pending resource with the given id is being uploaded,
+// and takes the lease on uploading it, provided that no other put holds
+// the lease. It returns whether the lease was taken.
+func (ms *managedStorage) claimUploadLease(resourceId, resourcePath string) (bool, error) {
+	now := ms.clock.Now()
+	ops := []txn.Op{{
+		C:  resourceCatalogCollection,
+		Id: resourceId,
+		Assert: bson.D{
+			{"path", ""},
+			{"$or", []bson.D{
+				{{"pendingsince", bson.D{{"$exists", false}}}},
+				{{"pendingsince", bson.D{{"$lt", now.Add(-uploadLeaseDuration)}}}},
+			}},
+		},
+		Update: bson.D{{"$set", bson.D{{"pendingpath", resourcePath}, {"pendingsince", now}}}},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err == txn.ErrAborted {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseUploadLease gives up the lease on uploading the data of the
+// pending resource with the given id, taken by the put uploading it to
+// resourcePath, so that other puts waiting for the data may upload it.
+func (ms *managedStorage) releaseUploadLease(resourceId, resourcePath string) {
+	ops := []txn.Op{{
+		C:      resourceCatalogCollection,
+		Id:     resourceId,
+		Assert: bson.D{{"path", ""}, {"pendingpath", resourcePath}},
+		Update: bson.D{{"$unset", bson.D{{"pendingsince", 1}}}},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil && err != txn.ErrAborted {
+		logger.Warningf("cannot release upload lease of resource %q: %v", resourceId, err)
+	}
+}
+
+// awaitUploadLease takes the lease on uploading the data of the pending
+// resource with the given id to resourcePath. If another put, perhaps in
+// another process, holds the lease, it waits for that put to finish or
+// for its lease to expire. If the data has then been stored, its storage
+// path is returned. Otherwise the caller should upload the data, and if
+// leased is true must release the lease should it fail to do so. Should
+// the wait take longer than concurrentUploadWait, the caller uploads the
+// data without the lease.
+func (ms *managedStorage) awaitUploadLease(ctx context.Context, resourceId, resourcePath string) (storedPath string, leased bool, err error) {
+	timeout := time.After(concurrentUploadWait)
+	for {
+		leased, err := ms.claimUploadLease(resourceId, resourcePath)
+		if err != nil || leased {
+			return "", leased, err
+		}
+		r, err := ms.resourceCatalog.Get(resourceId)
+		if err == nil {
+			return r.Path, false, nil
+		} else if !IsUploadPending(err) {
+			return "", false, err
+		}
+		select {
+		case <-time.After(uploadLeasePollInterval):
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-timeout:
+			logger.Warningf("timed out waiting for upload of resource %q by another process", resourceId)
+			return "", false, nil
+		}
+	}
+}
+
+// completedAt returns whether the resource with the given
+// id has been recorded as complete at resourcePath.
+func (ms *managedStorage) completedAt(resourceId, resourcePath string) bool {
+	r, err := ms.resourceCatalog.Get(resourceId)
+	return err == nil && r.Path == resourcePath
+}
+
+// FinalizePendingUploads is defined on the ManagedStorage interface.
+func (ms *managedStorage) FinalizePendingUploads() (finalized, removed int, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	var docs []resourceDoc
+	if err := ms.db.C(resourceCatalogCollection).Find(bson.D{{"path", ""}}).Select(bson.D{{"data", 0}}).All(&docs); err != nil {
+		return 0, 0, errors.Annotate(err, "cannot read resource catalog")
+	}
+	cutoff := ms.clock.Now().Add(-pendingUploadGracePeriod)
+	var failures []string
+	for _, doc := range docs {
+		ok, err := ms.finalizePendingUpload(doc)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		if ok {
+			finalized++
+			continue
+		}
+		// Entries catalogued before creation times were recorded
+		// are left alone, since there is no knowing how long they
+		// have been pending.
+		if doc.Created.IsZero() || !doc.Created.Before(cutoff) {
+			continue
+		}
+		ok, err = ms.removePendingUpload(doc)
+		if err != nil {
+			failures = append(failures, err.Error())
+		} else if ok {
+			removed++
+		}
+	}
+	if len(failures) > 0 {
+		return finalized, removed, errors.Errorf(
+			"cannot finalize %d pending uploads: %s",
+			len(failures), strings.Join(failures, "; "),
+		)
+	}
+	return finalized, removed, nil
+}
+
+// finalizePendingUpload records the pending resource described by doc as
+// complete if its data is fully stored at its pending path, returning
+// whether it did so.
+func (ms *managedStorage) finalizePendingUpload(doc resourceDoc) (bool, error) {
+	resourcePath := doc.PendingPath
+	if doc.Length == 0 {
+		// Empty data is not saved to the storage.
+		resourcePath = emptyResourcePath
+	} else if resourcePath == "" {
+		return false, nil
+	} else {
+		expected, alg := doc.hash()
+		hash, err := ms.storedHash(resourcePath, doc.Length, alg)
+		if isMissingData(err) {
+			// The upload did not finish.
+			return false, nil
+		} else if err != nil {
+			return false, errors.Annotatef(err, "cannot check pending resource %q", doc.Id)
+		}
+		if hash != expected {
+			return false, nil
+		}
+	}
+	err := ms.resourceCatalog.UploadComplete(doc.Id, resourcePath)
+	if errors.IsAlreadyExists(err) || errors.IsNotFound(err) {
+		// The upload was completed, or the entry removed,
+		// since the entry was read.
+		return false, nil
+	} else if err != nil {
+		return false, errors.Annotatef(err, "cannot mark resource %q as upload complete", doc.Id)
+	}
+	logger.Debugf("finalized interrupted upload of resource with id %q", doc.Id)
+	return true, nil
+}
+
+// isMissingData returns whether err, returned when reading stored
+// data, indicates that the data is absent or incomplete.
+func isMissingData(err error) bool {
+	cause := errors.Cause(err)
+	return errors.IsNotFound(err) || cause == mgo.ErrNotFound || cause == ErrChecksumMismatch
+}
+
+// removePendingUpload removes the abandoned pending resource described
+// by doc, along with any data partially uploaded for it, returning
+// whether it did so. Entries still referenced by a path are kept.
+func (ms *managedStorage) removePendingUpload(doc resourceDoc) (bool, error) {
+	if referenced, err := pendingReferenced(ms.db, doc.Id, ms.clock.Now()); err != nil {
+		return false, errors.Annotatef(err, "cannot check references to resource with id %q", doc.Id)
+	} else if referenced {
+		return false, nil
+	}
+	// The entry is only removed if it has not been referenced
+	// or completed since it was read.
+	ops := []txn.Op{{
+		C:      resourceCatalogCollection,
+		Id:     doc.Id,
+		Assert: bson.D{{"refcount", doc.RefCount}, {"path", ""}},
+		Remove: true,
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err == txn.ErrAborted {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Annotatef(err, "cannot remove resource with id %q", doc.Id)
+	}
+	if doc.PendingPath != "" {
+		if err := ms.removeStored(doc.PendingPath); err != nil && !isMissingData(err) {
+			return true, errors.Annotatef(err, "cannot remove data at storage path %q", doc.PendingPath)
+		}
+	}
+	return true, nil
+}
+
+// PendingUpload describes a resource catalog entry
+// whose data has not been recorded as fully uploaded.
+type PendingUpload struct {
+	// ResourceId is the id of the catalog entry.
+	ResourceId string
+
+	// References are the paths which refer to the data.
+	References []Reference
+
+	// Length is the expected length of the data.
+	Length int64
+
+	// Age is the time since the entry was catalogued.
+	Age time.Duration
+}
+
+// PendingUploads is defined on the ManagedStorage interface.
+func (ms *managedStorage) PendingUploads(olderThan time.Duration) ([]PendingUpload, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	now := ms.clock.Now()
+	// Entries catalogued before creation times were recorded are
+	// not matched, since there is no knowing how old they are.
+	query := bson.D{{"path", ""}, {"created", bson.D{{"$lte", now.Add(-olderThan)}}}}
+	var docs []resourceDoc
+	if err := ms.db.C(resourceCatalogCollection).Find(query).Select(bson.D{{"data", 0}}).Sort("created").All(&docs); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource catalog")
+	}
+	uploads := make([]PendingUpload, len(docs))
+	for i, doc := range docs {
+		refs, err := ms.referencesTo(doc.Id)
+		if err != nil {
+			return nil, err
+		}
+		uploads[i] = PendingUpload{
+			ResourceId: doc.Id,
+			References: refs,
+			Length:     doc.Length,
+			Age:        now.Sub(doc.Created),
+		}
+	}
+	return uploads, nil
+}
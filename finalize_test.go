@@ -0,0 +1,159 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/juju/blobstore"
+)
+
+// putPending catalogs data which was stored at resourcePath, but not
+// recorded as complete, returning the id of its pending catalog entry.
+func (s *managedStorageSuite) putPending(c *gc.C, resourcePath string, blob []byte, stored []byte) string {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	id, _, err := rc.Put(hash, int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.db.C("storedResources").UpdateId(id, bson.D{{"$set", bson.D{{"pendingpath", resourcePath}}}})
+	c.Assert(err, jc.ErrorIsNil)
+	if stored != nil {
+		_, err = s.resourceStorage.Put(resourcePath, bytes.NewReader(stored), int64(len(stored)))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	return id
+}
+
+// putInterrupted records a reference at path to data which was stored
+// at resourcePath, but not recorded as complete, returning the id of its
+// pending catalog entry.
+func (s *managedStorageSuite) putInterrupted(c *gc.C, path, resourcePath string, blob []byte, stored []byte) string {
+	id := s.putPending(c, resourcePath, blob, stored)
+	_, err := blobstore.PutManagedResource(s.managedStorage, blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env" + path,
+	}, id)
+	c.Assert(err, jc.ErrorIsNil)
+	return id
+}
+
+func (s *managedStorageSuite) TestFinalizePendingUploads(c *gc.C) {
+	blob := []byte("some resource")
+	s.putInterrupted(c, "/path/to/blob", "resource-path", blob, blob)
+	_, _, err := s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(blobstore.IsUploadPending(err), jc.IsTrue)
+
+	finalized, removed, err := s.managedStorage.FinalizePendingUploads()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(finalized, gc.Equals, 1)
+	c.Assert(removed, gc.Equals, 0)
+	s.assertGet(c, "/path/to/blob", blob)
+
+	finalized, removed, err = s.managedStorage.FinalizePendingUploads()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(finalized, gc.Equals, 0)
+	c.Assert(removed, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestFinalizePendingUploadsIncomplete(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	s.putPending(c, "resource-path", blob, blob[:4])
+	s.putPending(c, "missing-path", []byte("another resource"), nil)
+
+	// Within the grace period, the uploads may still be in progress.
+	finalized, removed, err := s.managedStorage.FinalizePendingUploads()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(finalized, gc.Equals, 0)
+	c.Assert(removed, gc.Equals, 0)
+	s.assertResourceCatalogCount(c, 2)
+
+	now = now.Add(*blobstore.PendingUploadGracePeriod + time.Second)
+	finalized, removed, err = s.managedStorage.FinalizePendingUploads()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(finalized, gc.Equals, 0)
+	c.Assert(removed, gc.Equals, 2)
+	s.assertResourceCatalogCount(c, 0)
+	_, err = s.resourceStorage.Get("resource-path")
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *managedStorageSuite) TestFinalizePendingUploadsKeepsReferenced(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	s.putInterrupted(c, "/path/to/blob", "resource-path", blob, blob[:4])
+
+	// The entry is referenced by a path, so is kept
+	// however long the upload has been pending.
+	now = now.Add(*blobstore.PendingUploadGracePeriod + time.Second)
+	finalized, removed, err := s.managedStorage.FinalizePendingUploads()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(finalized, gc.Equals, 0)
+	c.Assert(removed, gc.Equals, 0)
+	s.assertResourceCatalogCount(c, 1)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(blobstore.IsUploadPending(err), jc.IsTrue)
+}
+
+func (s *managedStorageSuite) TestGarbageCollectKeepsPendingPath(c *gc.C) {
+	blob := []byte("some resource")
+	s.putPending(c, "resource-path", blob, blob)
+
+	// The data may yet be recorded as complete, so is kept.
+	removed, err := s.managedStorage.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+	finalized, _, err := s.managedStorage.FinalizePendingUploads()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(finalized, gc.Equals, 1)
+}
+
+func (s *managedStorageSuite) TestPutRecordsPendingPath(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	// The pending path is cleared once the upload is complete.
+	count, err := s.db.C("storedResources").Find(bson.D{{"pendingpath", bson.D{{"$exists", true}}}}).Count()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestPendingUploads(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	id := s.putInterrupted(c, "/path/to/blob", "resource-path", blob, blob[:4])
+	now = now.Add(time.Hour)
+	s.putInterrupted(c, "/path/to/other", "other-path", []byte("another resource"), nil)
+	s.assertPut(c, "/path/to/complete", []byte("complete resource"))
+	now = now.Add(time.Minute)
+
+	uploads, err := s.managedStorage.PendingUploads(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(uploads, gc.HasLen, 2)
+	c.Assert(uploads[0], jc.DeepEquals, blobstore.PendingUpload{
+		ResourceId: id,
+		References: []blobstore.Reference{{EnvUUID: "env", Path: "/path/to/blob"}},
+		Length:     int64(len(blob)),
+		Age:        time.Hour + time.Minute,
+	})
+	c.Assert(uploads[1].References, jc.DeepEquals, []blobstore.Reference{{EnvUUID: "env", Path: "/path/to/other"}})
+	c.Assert(uploads[1].Age, gc.Equals, time.Minute)
+
+	uploads, err = s.managedStorage.PendingUploads(time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(uploads, gc.HasLen, 1)
+	c.Assert(uploads[0].ResourceId, gc.Equals, id)
+
+	// Nothing is changed.
+	s.assertResourceCatalogCount(c, 3)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(blobstore.IsUploadPending(err), jc.IsTrue)
+}
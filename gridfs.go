@@ -4,7 +4,10 @@
 package blobstore
 
 import (
+	"context"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
@@ -13,13 +16,80 @@ import (
 
 var logger = loggo.GetLogger("juju.storage")
 
+const (
+	// DefaultGridFSChunkSize is the size of the chunks in which
+	// GridFS stores data if no other size is configured.
+	DefaultGridFSChunkSize = 255 * 1024
+
+	// MaxGridFSChunkSize is the largest allowed GridFS chunk size.
+	// Each chunk is held in a single document, which must fit within
+	// mongo's 16MiB document size limit along with its metadata.
+	MaxGridFSChunkSize = 16*1024*1024 - 64*1024
+
+	// DefaultGridFSConcurrency is the maximum number of operations
+	// performed on a GridFS at once if no other limit is configured.
+	DefaultGridFSConcurrency = 16
+)
+
+// GridFSConfig holds the parameters used to construct
+// a GridFS-backed ResourceStorage.
+type GridFSConfig struct {
+	// DBName is the name of the database holding the GridFS.
+	DBName string
+
+	// Namespace is used to segregate different sets of data.
+	Namespace string
+
+	// Session is the mongo session used to access the GridFS.
+	Session *mgo.Session
+
+	// ChunkSize is the size in bytes of the chunks in which data is
+	// stored. Smaller chunks mean more chunk documents for each item
+	// of data, and so more round trips to write and read it; larger
+	// chunks mean more memory is used to buffer each chunk, and more
+	// is wasted reading a small range from within a chunk. If zero,
+	// DefaultGridFSChunkSize is used. Changing the chunk size does not
+	// affect data already stored.
+	ChunkSize int
+
+	// MaxConcurrency is the maximum number of Get, Put and Remove
+	// operations performed on the GridFS at once; further operations
+	// wait for one to finish, so that heavy load does not exhaust mongo's
+	// connections. A Get counts until the reader it returns is closed.
+	// If zero, DefaultGridFSConcurrency is used.
+	MaxConcurrency int
+}
+
+// Validate returns an error if the config is not valid.
+func (cfg GridFSConfig) Validate() error {
+	if cfg.Session == nil {
+		return errors.NotValidf("nil session")
+	}
+	if cfg.ChunkSize < 0 || cfg.ChunkSize > MaxGridFSChunkSize {
+		return errors.NotValidf("chunk size %d", cfg.ChunkSize)
+	}
+	if cfg.MaxConcurrency < 0 {
+		return errors.NotValidf("max concurrency %d", cfg.MaxConcurrency)
+	}
+	return nil
+}
+
 type gridFSStorage struct {
 	dbName    string
 	namespace string
 	session   *mgo.Session
+	chunkSize int
+	// slots holds a value for each operation in progress,
+	// limiting the number performed at once.
+	slots chan struct{}
 }
 
-var _ ResourceStorage = (*gridFSStorage)(nil)
+var (
+	_ ResourceStorage                 = (*gridFSStorage)(nil)
+	_ ResourceStorageLister           = (*gridFSStorage)(nil)
+	_ ResourceStorageWithContext      = (*gridFSStorage)(nil)
+	_ ResourceStorageConsistentGetter = (*gridFSStorage)(nil)
+)
 
 // NewGridFS returns a ResourceStorage instance backed by a mongo GridFS.
 // namespace is used to segregate different sets of data.
@@ -28,9 +98,34 @@ func NewGridFS(dbName, namespace string, session *mgo.Session) ResourceStorage {
 		dbName:    dbName,
 		namespace: namespace,
 		session:   session,
+		chunkSize: DefaultGridFSChunkSize,
+		slots:     make(chan struct{}, DefaultGridFSConcurrency),
 	}
 }
 
+// NewGridFSWithConfig returns a ResourceStorage instance
+// backed by a mongo GridFS, as described by cfg.
+func NewGridFSWithConfig(cfg GridFSConfig) (ResourceStorage, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Annotate(err, "invalid GridFS config")
+	}
+	chunkSize := cfg.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultGridFSChunkSize
+	}
+	maxConcurrency := cfg.MaxConcurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = DefaultGridFSConcurrency
+	}
+	return &gridFSStorage{
+		dbName:    cfg.DBName,
+		namespace: cfg.Namespace,
+		session:   cfg.Session,
+		chunkSize: chunkSize,
+		slots:     make(chan struct{}, maxConcurrency),
+	}, nil
+}
+
 func (g *gridFSStorage) db() *mgo.Database {
 	return g.session.DB(g.dbName)
 }
@@ -39,25 +134,103 @@ func (g *gridFSStorage) gridFS() *mgo.GridFS {
 	return g.db().GridFS(g.namespace)
 }
 
+// acquire waits until another operation may be performed on the
+// GridFS, or until ctx is done. If it returns nil, the caller must
+// call release once the operation is done.
+func (g *gridFSStorage) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release records that an operation has finished.
+func (g *gridFSStorage) release() {
+	<-g.slots
+}
+
 // Get is defined on ResourceStorage.
 func (g *gridFSStorage) Get(path string) (io.ReadCloser, error) {
+	return g.GetWithContext(context.Background(), path)
+}
+
+// GetWithContext is defined on ResourceStorageWithContext.
+func (g *gridFSStorage) GetWithContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := g.acquire(ctx); err != nil {
+		return nil, err
+	}
 	file, err := g.gridFS().Open(path)
 	if err != nil {
+		g.release()
 		return nil, errors.Annotatef(err, "failed to open GridFS file %q", path)
 	}
-	return file, nil
+	// The data is read from mongo as the file is read,
+	// so the slot is held until the file is closed.
+	return &gridFSFile{GridFile: file, release: g.release}, nil
+}
+
+// GetConsistent is defined on ResourceStorageConsistentGetter.
+// The data is read using a copy of the session in strong mode,
+// so that it is read from the primary.
+func (g *gridFSStorage) GetConsistent(path string) (io.ReadCloser, error) {
+	if err := g.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+	session := g.session.Copy()
+	session.SetMode(mgo.Strong, true)
+	file, err := session.DB(g.dbName).GridFS(g.namespace).Open(path)
+	if err != nil {
+		session.Close()
+		g.release()
+		return nil, errors.Annotatef(err, "failed to open GridFS file %q", path)
+	}
+	release := func() {
+		session.Close()
+		g.release()
+	}
+	return &gridFSFile{GridFile: file, release: release}, nil
+}
+
+// gridFSFile is a file opened for reading from a GridFS,
+// which releases its slot when it is closed.
+type gridFSFile struct {
+	*mgo.GridFile
+	release func()
+	once    sync.Once
+}
+
+// Close is defined on io.Closer.
+func (f *gridFSFile) Close() error {
+	err := f.GridFile.Close()
+	f.once.Do(f.release)
+	return err
 }
 
 // Put is defined on ResourceStorage.
 func (g *gridFSStorage) Put(path string, r io.Reader, length int64) (checksum string, err error) {
+	return g.PutWithContext(context.Background(), path, r, length)
+}
+
+// PutWithContext is defined on ResourceStorageWithContext.
+func (g *gridFSStorage) PutWithContext(ctx context.Context, path string, r io.Reader, length int64) (checksum string, err error) {
+	if err := g.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer g.release()
 	file, err := g.gridFS().Create(path)
 	if err != nil {
 		return "", errors.Annotatef(err, "failed to create GridFS file %q", path)
 	}
+	file.SetChunkSize(g.chunkSize)
 	defer func() {
 		if err != nil {
 			file.Close()
-			if removeErr := g.Remove(path); removeErr != nil {
+			if removeErr := g.gridFS().Remove(path); removeErr != nil {
 				logger.Warningf("error cleaning up after failed write: %v", removeErr)
 			}
 		}
@@ -73,5 +246,34 @@ func (g *gridFSStorage) Put(path string, r io.Reader, length int64) (checksum st
 
 // Remove is defined on ResourceStorage.
 func (g *gridFSStorage) Remove(path string) error {
+	return g.RemoveWithContext(context.Background(), path)
+}
+
+// RemoveWithContext is defined on ResourceStorageWithContext.
+func (g *gridFSStorage) RemoveWithContext(ctx context.Context, path string) error {
+	if err := g.acquire(ctx); err != nil {
+		return err
+	}
+	defer g.release()
 	return g.gridFS().Remove(path)
 }
+
+// List is defined on ResourceStorageLister.
+func (g *gridFSStorage) List() ([]StoredResource, error) {
+	var doc struct {
+		Filename   string    `bson:"filename"`
+		UploadDate time.Time `bson:"uploadDate"`
+	}
+	var result []StoredResource
+	iter := g.gridFS().Files.Find(nil).Iter()
+	for iter.Next(&doc) {
+		result = append(result, StoredResource{
+			Path:     doc.Filename,
+			Modified: doc.UploadDate,
+		})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Annotate(err, "failed to list GridFS files")
+	}
+	return result, nil
+}
@@ -4,13 +4,20 @@
 package blobstore_test
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"strings"
+	"time"
 
+	"github.com/juju/errors"
 	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2"
 
 	"github.com/juju/blobstore"
 )
@@ -73,6 +80,18 @@ func assertGet(c *gc.C, stor blobstore.ResourceStorage, path, expected string) {
 	c.Assert(data, gc.DeepEquals, []byte(expected))
 }
 
+// assertList asserts that stor holds data at exactly the expected paths.
+func assertList(c *gc.C, stor blobstore.ResourceStorage, expected ...string) {
+	infos, err := stor.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	var paths []string
+	for _, info := range infos {
+		c.Check(info.Modified.IsZero(), jc.IsFalse)
+		paths = append(paths, info.Path)
+	}
+	c.Assert(paths, jc.SameContents, expected)
+}
+
 func (s *gridfsSuite) TestGetNonExistent(c *gc.C) {
 	_, err := s.stor.Get("missing")
 	c.Assert(err, gc.ErrorMatches, `failed to open GridFS file "missing": not found`)
@@ -86,6 +105,27 @@ func (s *gridfsSuite) TestGet(c *gc.C) {
 	assertGet(c, s.stor, "/path/to/file", data)
 }
 
+func (s *gridfsSuite) TestGetConsistent(c *gc.C) {
+	session := s.Session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Eventual, true)
+	stor := blobstore.NewGridFS("juju", "test", session)
+	data := "hello world"
+	_, err := stor.Put("/path/to/file", strings.NewReader(data), int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	r, err := stor.(blobstore.ResourceStorageConsistentGetter).GetConsistent("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	read, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(read), gc.Equals, data)
+}
+
+func (s *gridfsSuite) TestGetConsistentNonExistent(c *gc.C) {
+	_, err := s.stor.(blobstore.ResourceStorageConsistentGetter).GetConsistent("missing")
+	c.Assert(err, gc.ErrorMatches, `failed to open GridFS file "missing": not found`)
+}
+
 func (s *gridfsSuite) TestRemove(c *gc.C) {
 	path := "/path/to/file"
 	assertPut(c, s.stor, path, "hello world")
@@ -117,3 +157,129 @@ func (s *gridfsSuite) TestNamespaceSeparationRemove(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	assertGet(c, anotherStor, "/path/to/file", "hello again")
 }
+
+func (s *gridfsSuite) TestList(c *gc.C) {
+	assertList(c, s.stor)
+	assertPut(c, s.stor, "/path/to/file", "hello world")
+	assertPut(c, s.stor, "/path/to/another", "hello again")
+	assertList(c, s.stor, "/path/to/file", "/path/to/another")
+}
+
+func (s *gridfsSuite) TestPutChunkSize(c *gc.C) {
+	stor, err := blobstore.NewGridFSWithConfig(blobstore.GridFSConfig{
+		DBName:    "juju",
+		Namespace: "test",
+		Session:   s.Session,
+		ChunkSize: 4,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	assertPut(c, stor, "/path/to/file", "hello world")
+	n, err := s.Session.DB("juju").C("test.chunks").Count()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(n, gc.Equals, 3)
+}
+
+func (s *gridfsSuite) TestDefaultChunkSize(c *gc.C) {
+	stor, err := blobstore.NewGridFSWithConfig(blobstore.GridFSConfig{
+		DBName:    "juju",
+		Namespace: "test",
+		Session:   s.Session,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	assertPut(c, stor, "/path/to/file", "hello world")
+	var doc struct {
+		ChunkSize int `bson:"chunkSize"`
+	}
+	err = s.Session.DB("juju").C("test.files").Find(nil).One(&doc)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(doc.ChunkSize, gc.Equals, blobstore.DefaultGridFSChunkSize)
+}
+
+func (s *gridfsSuite) TestMaxConcurrency(c *gc.C) {
+	stor, err := blobstore.NewGridFSWithConfig(blobstore.GridFSConfig{
+		DBName:         "juju",
+		Namespace:      "test",
+		Session:        s.Session,
+		MaxConcurrency: 1,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	assertPut(c, stor, "/path/to/file", "hello world")
+
+	// Start a put which holds the only slot until its data arrives.
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		_, err := stor.Put("/path/to/another", pr, 10)
+		done <- err
+	}()
+	_, err = pw.Write([]byte("hello"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Other operations wait, until their context is done.
+	withContext := stor.(blobstore.ResourceStorageWithContext)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = withContext.GetWithContext(ctx, "/path/to/file")
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	err = withContext.RemoveWithContext(ctx, "/path/to/file")
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+
+	// Once the put finishes, they proceed.
+	_, err = pw.Write([]byte("world"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(<-done, jc.ErrorIsNil)
+	assertGet(c, stor, "/path/to/file", "hello world")
+	assertGet(c, stor, "/path/to/another", "helloworld")
+}
+
+func (s *gridfsSuite) TestMaxConcurrencyHeldByReader(c *gc.C) {
+	stor, err := blobstore.NewGridFSWithConfig(blobstore.GridFSConfig{
+		DBName:         "juju",
+		Namespace:      "test",
+		Session:        s.Session,
+		MaxConcurrency: 1,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	assertPut(c, stor, "/path/to/file", "hello world")
+
+	// A reader which is still open holds the only slot.
+	r, err := stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	withContext := stor.(blobstore.ResourceStorageWithContext)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = withContext.GetWithContext(ctx, "/path/to/file")
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+
+	// Closing it, more than once, releases the slot just once.
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "hello world")
+	c.Assert(r.Close(), jc.ErrorIsNil)
+	r.Close()
+	assertGet(c, stor, "/path/to/file", "hello world")
+}
+
+func (s *gridfsSuite) TestInvalidConfig(c *gc.C) {
+	for i, test := range []struct {
+		cfg    blobstore.GridFSConfig
+		expect string
+	}{{
+		cfg:    blobstore.GridFSConfig{DBName: "juju", Namespace: "test"},
+		expect: "invalid GridFS config: nil session not valid",
+	}, {
+		cfg:    blobstore.GridFSConfig{DBName: "juju", Namespace: "test", Session: s.Session, ChunkSize: -1},
+		expect: "invalid GridFS config: chunk size -1 not valid",
+	}, {
+		cfg:    blobstore.GridFSConfig{DBName: "juju", Namespace: "test", Session: s.Session, ChunkSize: blobstore.MaxGridFSChunkSize + 1},
+		expect: fmt.Sprintf("invalid GridFS config: chunk size %d not valid", blobstore.MaxGridFSChunkSize+1),
+	}, {
+		cfg:    blobstore.GridFSConfig{DBName: "juju", Namespace: "test", Session: s.Session, MaxConcurrency: -1},
+		expect: "invalid GridFS config: max concurrency -1 not valid",
+	}} {
+		c.Logf("test %d", i)
+		_, err := blobstore.NewGridFSWithConfig(test.cfg)
+		c.Assert(err, gc.ErrorMatches, test.expect)
+		c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	}
+}
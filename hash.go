@@ -0,0 +1,82 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// HashAlgorithm identifies the algorithm used to calculate
+// the checksums used to de-dupe and verify stored data.
+type HashAlgorithm string
+
+const (
+	SHA256 HashAlgorithm = "sha256"
+	SHA384 HashAlgorithm = "sha384"
+	SHA512 HashAlgorithm = "sha512"
+
+	// DefaultHashAlgorithm is the algorithm used if none is specified.
+	DefaultHashAlgorithm = SHA384
+)
+
+// Validate returns an error if the algorithm is not supported.
+func (a HashAlgorithm) Validate() error {
+	switch a {
+	case SHA256, SHA384, SHA512:
+		return nil
+	}
+	return errors.NotValidf("hash algorithm %q", string(a))
+}
+
+// New returns a hash.Hash which calculates checksums using the algorithm.
+// It panics if the algorithm is not supported.
+func (a HashAlgorithm) New() hash.Hash {
+	switch a {
+	case SHA256:
+		return sha256.New()
+	case SHA384:
+		return sha512.New384()
+	case SHA512:
+		return sha512.New()
+	}
+	panic(errors.Errorf("unsupported hash algorithm %q", string(a)))
+}
+
+// checkHashFormat returns an error satisfying errors.IsNotValid if hash
+// is not a hex-encoded hash of the length calculated by the algorithm.
+// Hashes are catalogued in lower case, so upper case hex is rejected.
+func (a HashAlgorithm) checkHashFormat(hash string) error {
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != a.New().Size() || strings.ToLower(hash) != hash {
+		return errors.NotValidf("malformed %s hash %q", string(a), hash)
+	}
+	return nil
+}
+
+// NewHashingReader returns a reader which reads from r, and a function
+// returning the hex-encoded hash of the data read, calculated using
+// the algorithm. Once the reader has been read to the end, the hash is
+// in the form expected by ManagedStorage and ResourceCatalog.
+// It panics if the algorithm is not supported.
+func (a HashAlgorithm) NewHashingReader(r io.Reader) (io.Reader, func() string) {
+	h := a.New()
+	return io.TeeReader(r, h), func() string {
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
+}
+
+// NewHashingReader returns a reader which reads from r, and a function
+// returning the hex-encoded SHA-384 hash of the data read. This is the
+// hash used by ManagedStorage unless another algorithm is configured,
+// in which case the algorithm's NewHashingReader method should be used.
+func NewHashingReader(r io.Reader) (io.Reader, func() string) {
+	return SHA384.NewHashingReader(r)
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&hashSuite{})
+
+type hashSuite struct {
+	testing.IsolationSuite
+}
+
+func (s *hashSuite) TestValidate(c *gc.C) {
+	for _, algorithm := range []blobstore.HashAlgorithm{blobstore.SHA256, blobstore.SHA384, blobstore.SHA512} {
+		c.Check(algorithm.Validate(), jc.ErrorIsNil)
+	}
+	for _, algorithm := range []blobstore.HashAlgorithm{"", "md5"} {
+		c.Check(algorithm.Validate(), jc.Satisfies, errors.IsNotValid)
+	}
+}
+
+func (s *hashSuite) TestNew(c *gc.C) {
+	for _, test := range []struct {
+		algorithm blobstore.HashAlgorithm
+		expected  string
+	}{{
+		algorithm: blobstore.SHA256,
+		expected:  "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}, {
+		algorithm: blobstore.SHA384,
+		expected:  "59e1748777448c69de6b800d7a33bbfb9ff1b463e44354c3553bcdb9c666fa90125a3c79f90397bdf5f6a13de828684f",
+	}, {
+		algorithm: blobstore.SHA512,
+		expected:  "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+	}} {
+		h := test.algorithm.New()
+		h.Write([]byte("hello"))
+		c.Check(fmt.Sprintf("%x", h.Sum(nil)), gc.Equals, test.expected)
+	}
+}
+
+func (s *hashSuite) TestNewUnsupported(c *gc.C) {
+	c.Assert(func() { blobstore.HashAlgorithm("md5").New() }, gc.PanicMatches, `unsupported hash algorithm "md5"`)
+}
+
+func (s *hashSuite) TestNewHashingReader(c *gc.C) {
+	rdr, hash := blobstore.NewHashingReader(strings.NewReader("hello"))
+	data, err := ioutil.ReadAll(rdr)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "hello")
+	c.Assert(hash(), gc.Equals, "59e1748777448c69de6b800d7a33bbfb9ff1b463e44354c3553bcdb9c666fa90125a3c79f90397bdf5f6a13de828684f")
+}
+
+func (s *hashSuite) TestHashAlgorithmNewHashingReader(c *gc.C) {
+	rdr, hash := blobstore.SHA256.NewHashingReader(strings.NewReader("hello"))
+	_, err := io.Copy(ioutil.Discard, rdr)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(hash(), gc.Equals, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+}
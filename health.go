@@ -0,0 +1,80 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"os"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	// healthCheckHash is looked up in the resource catalog by HealthCheck.
+	// It is not a valid hash, so is never catalogued.
+	healthCheckHash = "health-check"
+
+	// healthCheckPath is read from the resource storage by HealthCheck.
+	// Stored data is always written at a UUID path, so nothing is held there.
+	healthCheckPath = "health-check"
+)
+
+// HealthCheck is defined on the ManagedStorage interface.
+func (ms *managedStorage) HealthCheck(ctx context.Context) (err error) {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	err = runWithContext(ctx, func() error {
+		_, err := ms.resourceCatalog.Find(healthCheckHash)
+		if errors.IsNotFound(err) || IsUploadPending(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Annotate(err, "resource catalog unavailable")
+	}
+	err = runWithContext(ctx, func() error {
+		rdr, err := ms.resourceStore.Get(healthCheckPath)
+		if err == nil {
+			return rdr.Close()
+		}
+		if isStorageNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Annotate(err, "resource storage unavailable")
+	}
+	return nil
+}
+
+// isStorageNotFound returns whether err, returned by a ResourceStorage,
+// indicates that there is no data at the requested path. Not all
+// implementations return errors satisfying juju/errors.IsNotFound.
+func isStorageNotFound(err error) bool {
+	cause := errors.Cause(err)
+	return errors.IsNotFound(err) || cause == mgo.ErrNotFound || os.IsNotExist(cause)
+}
+
+// runWithContext calls f, returning its result, or the
+// context's error if the context is done before f returns.
+// In the latter case f continues to run in the background.
+func runWithContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// unavailableStorage is a ResourceStorage whose Get
+// fails with err, or blocks until unblock is closed.
+type unavailableStorage struct {
+	blobstore.ResourceStorage
+	err     error
+	unblock chan struct{}
+}
+
+func (s unavailableStorage) Get(path string) (io.ReadCloser, error) {
+	if s.unblock != nil {
+		<-s.unblock
+	}
+	return nil, s.err
+}
+
+func (s *managedStorageSuite) TestHealthCheck(c *gc.C) {
+	for i, stor := range []blobstore.ResourceStorage{
+		s.resourceStorage,
+		blobstore.NewMemResourceStorage(),
+		blobstore.NewFileResourceStorage(c.MkDir()),
+	} {
+		c.Logf("test %d", i)
+		ms := blobstore.NewManagedStorage(s.db, stor)
+		err := ms.HealthCheck(context.Background())
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	// Nothing is left behind.
+	s.assertResourceCatalogCount(c, 0)
+	stored, err := s.resourceStorage.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stored, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestHealthCheckStorageUnavailable(c *gc.C) {
+	ms := blobstore.NewManagedStorage(s.db, unavailableStorage{
+		ResourceStorage: s.resourceStorage,
+		err:             errors.New("connection refused"),
+	})
+	err := ms.HealthCheck(context.Background())
+	c.Assert(err, gc.ErrorMatches, "resource storage unavailable: connection refused")
+}
+
+func (s *managedStorageSuite) TestHealthCheckStorageTimeout(c *gc.C) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	ms := blobstore.NewManagedStorage(s.db, unavailableStorage{
+		ResourceStorage: s.resourceStorage,
+		err:             errors.NotFoundf("data"),
+		unblock:         unblock,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := ms.HealthCheck(ctx)
+	c.Assert(err, gc.ErrorMatches, "resource storage unavailable: context deadline exceeded")
+	c.Assert(errors.Cause(err), gc.Equals, context.DeadlineExceeded)
+}
+
+func (s *managedStorageSuite) TestHealthCheckCancelled(c *gc.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.managedStorage.HealthCheck(ctx)
+	c.Assert(err, gc.ErrorMatches, "resource catalog unavailable: context canceled")
+}
+
+func (s *managedStorageSuite) TestHealthCheckClosed(c *gc.C) {
+	err := s.managedStorage.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.HealthCheck(context.Background())
+	c.Assert(err, gc.Equals, blobstore.ErrStoreClosed)
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// concurrentUploadWait is the longest time a put waits for a concurrent
+// upload of the same data to finish before uploading the data itself,
+// so that a put is not held up indefinitely by one which is stuck.
+var concurrentUploadWait = time.Minute
+
+// localUploads records the data being uploaded to the resource
+// storage by puts in this process, keyed by hash, so that they may
+// wait for each other without polling the database. Puts in other
+// processes using the same database are waited for by the lease
+// recorded in the resource catalog; see awaitUploadLease.
+type localUploads struct {
+	mu      sync.Mutex
+	uploads map[string]chan struct{}
+}
+
+// begin registers an upload of the data with the given hash. If no other
+// upload of it is in flight, it returns a function which must be called
+// when the upload has finished, whether or not it succeeded. Otherwise it
+// returns a channel which is closed when the other upload finishes.
+func (u *localUploads) begin(hash string) (finished func(), wait <-chan struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if done, ok := u.uploads[hash]; ok {
+		return nil, done
+	}
+	if u.uploads == nil {
+		u.uploads = make(map[string]chan struct{})
+	}
+	done := make(chan struct{})
+	u.uploads[hash] = done
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			delete(u.uploads, hash)
+			close(done)
+		})
+	}, nil
+}
+
+// awaitLocalUpload waits for any upload, by another put in this process, of
+// the data with the given hash and resource catalog id to finish. If the
+// data has then been stored, its storage path is returned. Otherwise the
+// caller is registered as uploading the data, and must call the returned
+// function once it has finished.
+func (ms *managedStorage) awaitLocalUpload(ctx context.Context, hash, resourceId string) (resourcePath string, finished func(), err error) {
+	timeout := time.After(concurrentUploadWait)
+	for {
+		finished, wait := ms.localUploads.begin(hash)
+		if wait == nil {
+			return "", finished, nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-timeout:
+			logger.Warningf("timed out waiting for concurrent upload of resource %q", resourceId)
+			return "", func() {}, nil
+		}
+		r, err := ms.resourceCatalog.Get(resourceId)
+		if err == nil {
+			return r.Path, nil, nil
+		} else if !IsUploadPending(err) {
+			return "", nil, err
+		}
+		// The other upload failed, so the data is
+		// still to be uploaded; try to do so.
+	}
+}
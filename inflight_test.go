@@ -0,0 +1,204 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// blockingStorage is a ResourceStorage whose first Put blocks until
+// unblock is closed, then fails with err if it is non-nil. It counts
+// the calls to Put.
+type blockingStorage struct {
+	blobstore.ResourceStorage
+	started chan struct{}
+	unblock chan struct{}
+	err     error
+
+	mu   sync.Mutex
+	puts int
+}
+
+func newBlockingStorage(inner blobstore.ResourceStorage, err error) *blockingStorage {
+	return &blockingStorage{
+		ResourceStorage: inner,
+		started:         make(chan struct{}),
+		unblock:         make(chan struct{}),
+		err:             err,
+	}
+}
+
+func (s *blockingStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	s.mu.Lock()
+	s.puts++
+	first := s.puts == 1
+	s.mu.Unlock()
+	if first {
+		close(s.started)
+		<-s.unblock
+		if s.err != nil {
+			return "", s.err
+		}
+	}
+	return s.ResourceStorage.Put(path, r, length)
+}
+
+func (s *blockingStorage) putCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts
+}
+
+// putConcurrently puts blob at path/to/first, and once it has started
+// writing to stor, at path/to/second, both using the same managed storage.
+// It returns the results of the puts.
+func (s *managedStorageSuite) putConcurrently(c *gc.C, stor *blockingStorage, blob []byte, beforeUnblock func()) (first, second error) {
+	ms := blobstore.NewManagedStorage(s.db, stor)
+	return s.putConcurrentlyWith(c, ms, ms, stor, blob, beforeUnblock)
+}
+
+// putConcurrentlyWith is like putConcurrently, but makes the first put
+// with ms1 and the second with ms2, which stand in for the managed
+// storage of separate processes when they are distinct.
+func (s *managedStorageSuite) putConcurrentlyWith(c *gc.C, ms1, ms2 blobstore.ManagedStorage, stor *blockingStorage, blob []byte, beforeUnblock func()) (first, second error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		first = ms1.PutForEnvironment("env", "path/to/first", bytes.NewReader(blob), int64(len(blob)))
+	}()
+	<-stor.started
+	go func() {
+		defer wg.Done()
+		second = ms2.PutForEnvironment("env", "path/to/second", bytes.NewReader(blob), int64(len(blob)))
+	}()
+	if beforeUnblock != nil {
+		beforeUnblock()
+	}
+	close(stor.unblock)
+	wg.Wait()
+	return first, second
+}
+
+func (s *managedStorageSuite) TestConcurrentPutsUploadOnce(c *gc.C) {
+	stor := newBlockingStorage(s.resourceStorage, nil)
+	blob := []byte("some resource")
+	first, second := s.putConcurrently(c, stor, blob, func() {
+		// Give the second put time to reach the upload.
+		time.Sleep(50 * time.Millisecond)
+	})
+	c.Assert(first, jc.ErrorIsNil)
+	c.Assert(second, jc.ErrorIsNil)
+	c.Assert(stor.putCount(), gc.Equals, 1)
+	s.assertGet(c, "path/to/first", blob)
+	s.assertGet(c, "path/to/second", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestConcurrentPutFirstFails(c *gc.C) {
+	stor := newBlockingStorage(s.resourceStorage, errors.New("boom"))
+	blob := []byte("some resource")
+	first, second := s.putConcurrently(c, stor, blob, func() {
+		time.Sleep(50 * time.Millisecond)
+	})
+	c.Assert(first, gc.ErrorMatches, ".*boom")
+	// The second put uploads the data itself.
+	c.Assert(second, jc.ErrorIsNil)
+	c.Assert(stor.putCount(), gc.Equals, 2)
+	s.assertGet(c, "path/to/second", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestConcurrentPutWaitTimesOut(c *gc.C) {
+	s.PatchValue(blobstore.ConcurrentUploadWait, time.Millisecond)
+	stor := newBlockingStorage(s.resourceStorage, nil)
+	blob := []byte("some resource")
+	first, second := s.putConcurrently(c, stor, blob, func() {
+		// The second put gives up waiting, and uploads the data itself.
+		for a := 0; a < 100 && stor.putCount() < 2; a++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Check(stor.putCount(), gc.Equals, 2)
+	})
+	c.Assert(first, jc.ErrorIsNil)
+	c.Assert(second, jc.ErrorIsNil)
+	s.assertGet(c, "path/to/first", blob)
+	s.assertGet(c, "path/to/second", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestConcurrentPutsInSeparateProcessesUploadOnce(c *gc.C) {
+	s.PatchValue(blobstore.UploadLeasePollInterval, 10*time.Millisecond)
+	stor := newBlockingStorage(s.resourceStorage, nil)
+	blob := []byte("some resource")
+	first, second := s.putConcurrentlyWith(c,
+		blobstore.NewManagedStorage(s.db, stor),
+		blobstore.NewManagedStorage(s.db, stor),
+		stor, blob, func() {
+			// Give the second put time to find the lease held.
+			time.Sleep(50 * time.Millisecond)
+		},
+	)
+	c.Assert(first, jc.ErrorIsNil)
+	c.Assert(second, jc.ErrorIsNil)
+	c.Assert(stor.putCount(), gc.Equals, 1)
+	s.assertGet(c, "path/to/first", blob)
+	s.assertGet(c, "path/to/second", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestConcurrentPutInSeparateProcessFirstFails(c *gc.C) {
+	s.PatchValue(blobstore.UploadLeasePollInterval, 10*time.Millisecond)
+	stor := newBlockingStorage(s.resourceStorage, errors.New("boom"))
+	blob := []byte("some resource")
+	first, second := s.putConcurrentlyWith(c,
+		blobstore.NewManagedStorage(s.db, stor),
+		blobstore.NewManagedStorage(s.db, stor),
+		stor, blob, func() {
+			time.Sleep(50 * time.Millisecond)
+		},
+	)
+	c.Assert(first, gc.ErrorMatches, ".*boom")
+	// The failed put releases the lease, and the second
+	// put uploads the data itself.
+	c.Assert(second, jc.ErrorIsNil)
+	c.Assert(stor.putCount(), gc.Equals, 2)
+	s.assertGet(c, "path/to/second", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestConcurrentPutInSeparateProcessLeaseExpired(c *gc.C) {
+	s.PatchValue(blobstore.UploadLeasePollInterval, 10*time.Millisecond)
+	stor := newBlockingStorage(s.resourceStorage, nil)
+	s.resourceStorage = stor
+	blob := []byte("some resource")
+	// The second process's clock is past the expiry of the first's
+	// lease, as if the first process had crashed long ago.
+	clock := &fakeClock{time.Now().Add(*blobstore.UploadLeaseDuration + time.Minute)}
+	first, second := s.putConcurrentlyWith(c,
+		blobstore.NewManagedStorage(s.db, stor),
+		s.newClockManagedStorage(c, clock, 0),
+		stor, blob, func() {
+			// The second put takes over the lease and uploads the data.
+			for a := 0; a < 100 && stor.putCount() < 2; a++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Check(stor.putCount(), gc.Equals, 2)
+		},
+	)
+	c.Assert(first, jc.ErrorIsNil)
+	c.Assert(second, jc.ErrorIsNil)
+	s.assertGet(c, "path/to/first", blob)
+	s.assertGet(c, "path/to/second", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
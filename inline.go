@@ -0,0 +1,83 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// MaxInlineThreshold is the largest permitted value of
+// ManagedStorageParams.InlineThreshold. Data held inline is written to
+// its catalog entry by a transaction, so it is held both in the entry and,
+// until the transaction is pruned, in the transaction's own document; each
+// is limited by MongoDB to 16MB. The threshold is kept well below that so
+// that catalog entries remain cheap to read.
+const MaxInlineThreshold = 1024 * 1024
+
+// inlineResourcePrefix prefixes the storage paths recorded in the
+// resource catalog for data held inline in the catalog entry itself.
+// The data is not held in the resource storage.
+const inlineResourcePrefix = "inline:"
+
+// isInlinePath returns whether resourcePath refers to data
+// held inline in a resource catalog entry.
+func isInlinePath(resourcePath string) bool {
+	return strings.HasPrefix(resourcePath, inlineResourcePrefix)
+}
+
+// storeInline reads length bytes of data from r and records them in the
+// pending resource catalog entry with the given id, completing its upload,
+// and returns the storage path recorded. If the upload has already been
+// completed, an error satisfying errors.IsAlreadyExists is returned.
+func (ms *managedStorage) storeInline(resourceId string, r io.Reader, length int64) (string, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", errors.Annotate(err, "cannot read data")
+	}
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		return "", errors.Annotate(err, "cannot generate UUID to store resource")
+	}
+	resourcePath := inlineResourcePrefix + uuid.String()
+	ops := []txn.Op{{
+		C:      resourceCatalogCollection,
+		Id:     resourceId,
+		Assert: bson.D{{"path", ""}},
+		Update: bson.D{
+			{"$set", bson.D{{"path", resourcePath}, {"data", data}}},
+			{"$unset", bson.D{{"pendingpath", 1}, {"pendingsince", 1}}},
+		},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err == txn.ErrAborted {
+		if n, err := ms.db.C(resourceCatalogCollection).FindId(resourceId).Count(); err == nil && n == 0 {
+			return "", errors.NotFoundf("resource with id %q", resourceId)
+		}
+		return "", errUploadedConcurrently
+	} else if err != nil {
+		return "", err
+	}
+	return resourcePath, nil
+}
+
+// openInline returns a reader for the data held inline
+// in the resource catalog entry at resourcePath.
+func (ms *managedStorage) openInline(db *mgo.Database, resourcePath string) (io.ReadCloser, error) {
+	var doc resourceDoc
+	query := bson.D{{"path", resourcePath}}
+	err := db.C(resourceCatalogCollection).Find(query).Select(bson.D{{"data", 1}}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, errors.NotFoundf("resource at storage path %q", resourcePath)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot read data at storage path %q", resourcePath)
+	}
+	return memReader{bytes.NewReader(doc.Data)}, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) newInlineManagedStorage(c *gc.C, threshold int64) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		InlineThreshold: threshold,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func (s *managedStorageSuite) assertStoredCount(c *gc.C, expected int) {
+	stored, err := s.resourceStorage.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stored, gc.HasLen, expected)
+}
+
+func (s *managedStorageSuite) TestPutInline(c *gc.C) {
+	ms := s.newInlineManagedStorage(c, 16)
+	blob := []byte("small resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+
+	// The data is held in the catalog entry, not the resource storage.
+	s.assertStoredCount(c, 0)
+	var doc struct {
+		Path string `bson:"path"`
+		Data []byte `bson:"data"`
+	}
+	err = s.db.C("storedResources").Find(nil).One(&doc)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(strings.HasPrefix(doc.Path, "inline:"), jc.IsTrue)
+	c.Assert(doc.Data, jc.DeepEquals, blob)
+}
+
+func (s *managedStorageSuite) TestPutAboveInlineThreshold(c *gc.C) {
+	ms := s.newInlineManagedStorage(c, 16)
+	blob := []byte("a resource too large to hold inline")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+	s.assertStoredCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutInlineDedup(c *gc.C) {
+	ms := s.newInlineManagedStorage(c, 16)
+	blob := []byte("small resource")
+	for _, path := range []string{"/path/to/blob", "/path/to/other"} {
+		err := ms.PutForEnvironment("env", path, bytes.NewReader(blob), int64(len(blob)))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	s.assertResourceCatalogCount(c, 1)
+
+	err := ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/other", blob)
+	err = ms.RemoveForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+	s.assertStoredCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestInlineDataReadableWithoutThreshold(c *gc.C) {
+	ms := s.newInlineManagedStorage(c, 16)
+	blob := []byte("small resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Data already held inline remains readable, and is
+	// de-duped, if the threshold is later lowered.
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/other", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, s.managedStorage, "/path/to/blob", blob)
+	assertManagedGet(c, s.managedStorage, "/path/to/other", blob)
+	s.assertResourceCatalogCount(c, 1)
+	s.assertStoredCount(c, 0)
+	n, err := s.db.C("storedResources").Find(bson.D{{"data", bson.D{{"$exists", true}}}}).Count()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *managedStorageSuite) TestInvalidInlineThreshold(c *gc.C) {
+	for _, threshold := range []int64{-1, blobstore.MaxInlineThreshold + 1} {
+		_, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+			Database:        s.db,
+			ResourceStorage: s.resourceStorage,
+			InlineThreshold: threshold,
+		})
+		c.Check(err, jc.Satisfies, errors.IsNotValid)
+	}
+}
@@ -4,9 +4,20 @@
 package blobstore
 
 import (
+	"context"
 	"io"
+	"time"
+
+	"gopkg.in/mgo.v2/txn"
 )
 
+// ReadSeekCloser is the interface that groups the basic Read, Seek and Close methods.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
 // ResourceStorage instances save and retrieve data from an underlying storage implementation.
 type ResourceStorage interface {
 	// Get returns a reader for the resource located at path.
@@ -19,6 +30,77 @@ type ResourceStorage interface {
 	Remove(path string) error
 }
 
+// ResourceStorageWithContext is implemented by ResourceStorage instances
+// whose operations may wait before starting, such as those returned by
+// NewGridFSWithConfig, which limit the number of operations performed at
+// once. The operations are the same as those of ResourceStorage, except
+// that waiting is abandoned, and the context's error returned, once ctx
+// is done.
+type ResourceStorageWithContext interface {
+	GetWithContext(ctx context.Context, path string) (io.ReadCloser, error)
+	PutWithContext(ctx context.Context, path string, r io.Reader, length int64) (checksum string, err error)
+	RemoveWithContext(ctx context.Context, path string) error
+}
+
+// StoredResource describes data held in a ResourceStorage.
+type StoredResource struct {
+	// Path is the storage path of the data.
+	Path string
+
+	// Modified is the time at which the data was last written.
+	Modified time.Time
+}
+
+// ResourceStorageLister is implemented by ResourceStorage instances
+// which are able to enumerate the data they hold.
+type ResourceStorageLister interface {
+	// List returns a description of all data held in the storage.
+	List() ([]StoredResource, error)
+}
+
+// ResourceStorageRawGetter is implemented by ResourceStorage instances
+// which encode data as they store it, such as those returned by
+// NewCompressingStorage.
+type ResourceStorageRawGetter interface {
+	// GetRaw returns a reader for the data at path as it is encoded,
+	// along with its encoded length, or -1 if that is not known, and
+	// the content encoding applied, such as "gzip". If the data is not
+	// encoded, the encoding is empty, and the data is returned as by Get.
+	GetRaw(path string) (r io.ReadCloser, length int64, encoding string, err error)
+}
+
+// ResourceStorageConsistentGetter is implemented by ResourceStorage
+// instances whose reads may not observe all the writes acknowledged so
+// far, such as those returned by NewGridFS with a session which reads
+// from secondaries.
+type ResourceStorageConsistentGetter interface {
+	// GetConsistent is the same as Get except that
+	// the data read reflects all acknowledged writes.
+	GetConsistent(path string) (io.ReadCloser, error)
+}
+
+// CacheStats describes the use of a ResourceStorageCache.
+type CacheStats struct {
+	// Hits and Misses are the number of Get calls
+	// answered from, and not from, the cache.
+	Hits, Misses int64
+
+	// Entries is the number of items of data held in
+	// the cache, and Bytes their total size.
+	Entries int
+	Bytes   int64
+}
+
+// ResourceStorageCache is implemented by ResourceStorage
+// instances which cache data, such as those returned by
+// NewCachingStorage.
+type ResourceStorageCache interface {
+	ResourceStorage
+
+	// CacheStats returns the current cache statistics.
+	CacheStats() CacheStats
+}
+
 // ResourceCatalog instances persist Resources.
 // Resources with the same hash values are not duplicated; instead a reference count is incremented.
 // Similarly, when a Resource is removed, the reference count is decremented. When the reference
@@ -30,6 +112,19 @@ type ResourceCatalog interface {
 	// Find returns the resource id for the Resource with the given hash.
 	Find(hash string) (id string, err error)
 
+	// FindMany returns the resource ids for the Resources with the given
+	// hashes, keyed on hash, using a single query. Hashes with no Resource,
+	// or whose Resource upload is not yet complete, are omitted.
+	FindMany(hashes []string) (map[string]string, error)
+
+	// List returns all Resources in the catalog. Resources whose
+	// upload is not yet complete are included, with an empty Path.
+	List() ([]*Resource, error)
+
+	// RefCount returns the number of references to the Resource with the given id.
+	// The count is returned even if the upload of the Resource is not yet complete.
+	RefCount(id string) (int, error)
+
 	// Put ensures a Resource entry exists for the given hash,
 	// returning the id and path recorded by UploadComplete.
 	// If UploadComplete has not been called, path will be empty.
@@ -38,6 +133,13 @@ type ResourceCatalog interface {
 	// otherwise a new entry is created with a reference count of 1.
 	Put(hash string, length int64) (id, path string, err error)
 
+	// AddRef increments the reference count of the Resource with the
+	// given id, returning the path recorded by UploadComplete. Unlike Put,
+	// the Resource is identified by id rather than hash, so it need not
+	// have been hashed with the catalog's hash algorithm. If there is no
+	// such Resource, an error satisfying juju/errors.IsNotFound is returned.
+	AddRef(id string) (path string, err error)
+
 	// UploadComplete records that the underlying resource described by
 	// the Resource entry with id is now fully uploaded to the specified
 	// storage path, and the resource is available for use. If another
@@ -45,49 +147,762 @@ type ResourceCatalog interface {
 	// an error satisfiying juju/errors.IsAlreadyExists.
 	UploadComplete(id, path string) error
 
+	// MovePath records that the data of the Resource with id has been moved
+	// from oldPath to newPath in the resource storage. If the Resource's
+	// path is no longer oldPath, an error whose cause is ErrPreconditionFailed
+	// is returned.
+	MovePath(id, oldPath, newPath string) error
+
 	// Remove decrements the reference count for a Resource with the given id, deleting it
 	// if the reference count reaches zero. The path of the Resource is returned.
 	// If the Resource is deleted, wasDeleted is returned as true.
 	Remove(id string) (wasDeleted bool, path string, err error)
+
+	// RemoveManyOps returns the transaction operations which decrement the
+	// reference counts for the Resources with the given ids, once for each time
+	// an id is specified, so that references may be released in the same
+	// transaction as whatever held them is removed. Resources whose reference
+	// count reaches zero are deleted by the operations, and their paths are
+	// returned keyed on id. Ids which do not exist are ignored. Should the
+	// operations be aborted, because the Resources have changed since they
+	// were read, they must be rebuilt.
+	RemoveManyOps(ids []string) (ops []txn.Op, deletedPaths map[string]string, err error)
+
+	// CompactReferences removes Resource entries which can no longer be used:
+	// those with no remaining references, and those whose upload has not
+	// completed within a grace period, as happens when an uploader crashes.
+	// The number of entries removed is returned. Entries which change while
+	// being compacted are left alone, so it is safe to call at any time.
+	CompactReferences() (cleaned int, err error)
 }
 
 // ManagedStorage instances persist data for an environment, for a user, or globally.
-// (Only environment storage is currently implemented).
+//
+// Errors returned by ManagedStorage and ResourceCatalog methods may be matched
+// using either juju/errors or the standard library's errors.Is. Errors which
+// satisfy juju/errors.IsNotFound or IsAlreadyExists match ErrNotFound or
+// ErrAlreadyExists respectively, and errors whose cause is one of the package's
+// sentinel errors, such as ErrUploadPending or ErrChecksumMismatch, match it.
 type ManagedStorage interface {
 	// GetForEnvironment returns a reader for data at path, namespaced to the environment.
 	// If the data is still being uploaded and is not fully written yet,
 	// an ErrUploadPending error is returned. This means the path is valid but the caller
-	// should try again to retrieve the data.
+	// should try again to retrieve the data. The error is an *UploadPendingError
+	// recording how long the upload has been in progress, so that callers may
+	// give up on uploads which appear to be stuck.
 	GetForEnvironment(envUUID, path string) (r io.ReadCloser, length int64, err error)
 
+	// GetForEnvironmentConsistent is the same as GetForEnvironment except that
+	// the records of the data are read from the primary, regardless of the
+	// database session's mode, so that data stored by a put which has returned
+	// is always found. It is more expensive, so should be used only where a
+	// read must observe a preceding write. If the resource storage implements
+	// ResourceStorageConsistentGetter, as GridFS does, the data itself is read
+	// with GetConsistent; otherwise the resource storage must read consistently
+	// for the guarantee to hold. Resource storage wrapping GridFS must itself
+	// implement ResourceStorageConsistentGetter for its data to be read so.
+	GetForEnvironmentConsistent(envUUID, path string) (r io.ReadCloser, length int64, err error)
+
+	// GetForEnvironmentRaw is the same as GetForEnvironment except that,
+	// if the resource storage implements ResourceStorageRawGetter, the data
+	// is returned as stored, without being decoded, along with the content
+	// encoding applied, such as "gzip", so that the caller may forward the
+	// encoded data rather than decode it. The length is that of the encoded
+	// data, or -1 if that is not known. If the data is not encoded, the
+	// encoding is empty, and the data and length are as GetForEnvironment
+	// returns them. Resource storage wrapping the storage which encodes the
+	// data must itself implement ResourceStorageRawGetter for the encoded
+	// data to be returned.
+	GetForEnvironmentRaw(envUUID, path string) (r io.ReadCloser, length int64, encoding string, err error)
+
+	// GetByHash returns a reader for the data with the given hash, calculated
+	// using the hash algorithm the ManagedStorage was created with, along with
+	// its length, whichever paths and namespaces it is stored at. An error
+	// satisfying errors.IsNotFound is returned if no such data is stored,
+	// including while it is still being uploaded, and if the data is only
+	// referenced at paths which have expired or been soft-deleted.
+	//
+	// No namespace is checked: knowing the hash of the data is taken as
+	// proof of being allowed to read it. GetByHash should therefore only be
+	// offered to callers who may read any data in the storage, or where the
+	// hashes of data are kept as secret as the data itself.
+	GetByHash(hash string) (r io.ReadCloser, length int64, err error)
+
+	// GetForEnvironmentToWriter is the same as GetForEnvironment except that
+	// the data is copied to w, rather than returned as a reader which must
+	// be closed. The number of bytes written is returned; if the data could
+	// not be copied in full, an error is returned along with the number of
+	// bytes which were written before the failure.
+	GetForEnvironmentToWriter(envUUID, path string, w io.Writer) (n int64, err error)
+
+	// GetForEnvironmentWithContext is the same as GetForEnvironment except that
+	// reads from the returned reader fail with the context's error once ctx
+	// is cancelled.
+	GetForEnvironmentWithContext(ctx context.Context, envUUID, path string) (r io.ReadCloser, length int64, err error)
+
+	// GetForEnvironmentVerified is the same as GetForEnvironment except that
+	// the returned reader checks the data read against the hash recorded
+	// when it was stored. If the data has been corrupted, reading
+	// to the end of it, or closing it after doing so, returns an error
+	// whose cause is ErrChecksumMismatch. Partially read data is not verified.
+	GetForEnvironmentVerified(envUUID, path string) (r io.ReadCloser, length int64, err error)
+
+	// VerifyFastForEnvironment reads the data at path, namespaced to the
+	// environment, and checks it against the CRC-32C checksum recorded
+	// when it was stored, which is cheaper to calculate than the hash used
+	// for de-duping. Data stored before the checksum was recorded is checked
+	// against that hash instead. If the data has been corrupted, an error
+	// whose cause is ErrChecksumMismatch is returned.
+	VerifyFastForEnvironment(envUUID, path string) error
+
+	// GetForEnvironmentIfChanged is the same as GetForEnvironment except
+	// that it also returns the hex-encoded hash of the data, calculated
+	// using the storage's hash algorithm. If the hash is knownHash, the
+	// data is not opened, and an error whose cause is ErrNotModified is
+	// returned along with the hash; this allows HTTP servers to respond
+	// to conditional requests. An empty knownHash matches no data.
+	GetForEnvironmentIfChanged(envUUID, path, knownHash string) (r io.ReadCloser, length int64, hash string, err error)
+
+	// ChecksumForEnvironment returns the hex-encoded hash of the data at
+	// path, namespaced to the environment, calculated using the storage's
+	// hash algorithm. The hash recorded when the data was stored is returned
+	// without reading the data, unless it was supplied by the client storing
+	// the data using PutForEnvironmentTrustingHash and has not yet been
+	// verified; then the storage reads the data to calculate it, without
+	// returning the data to the caller. As with GetForEnvironment, an
+	// ErrUploadPending error is returned if the data is not fully written yet.
+	ChecksumForEnvironment(envUUID, path string) (hash string, err error)
+
+	// GetRangeForEnvironment returns a reader for length bytes of the data
+	// at path, namespaced to the environment, starting at offset. If the
+	// range extends beyond the end of the data, an error whose cause is
+	// ErrOutOfRange is returned.
+	GetRangeForEnvironment(envUUID, path string, offset, length int64) (r io.ReadCloser, err error)
+
+	// GetRangesForEnvironment returns a reader for each of the given ranges
+	// of the data at path, namespaced to the environment, as is needed to
+	// serve multi-range HTTP requests. The data is opened once and shared
+	// by the readers. The ranges must be in ascending order and must not
+	// overlap; if any extends beyond the end of the data, an error whose
+	// cause is ErrOutOfRange is returned.
+	//
+	// The readers are intended to be read in order. If the data does not
+	// support seeking, reading a reader after any part of a later one has
+	// been read fails with an error whose cause is ErrRangeOrder. The data
+	// is closed once all the readers have been closed.
+	GetRangesForEnvironment(envUUID, path string, ranges []ByteRange) ([]io.ReadCloser, error)
+
+	// GetSeekerForEnvironment is the same as GetForEnvironment except that
+	// the returned reader is seekable, as is needed to serve ranges of the
+	// data over HTTP. If the resource storage cannot seek within the data,
+	// an error satisfying juju/errors.IsNotSupported is returned.
+	GetSeekerForEnvironment(envUUID, path string) (r ReadSeekCloser, length int64, err error)
+
+	// GetReaderAtForEnvironment returns an io.ReaderAt over the data at path,
+	// namespaced to the environment, along with its length and a function to
+	// be called to release the data once it is no longer needed. It allows
+	// the data to be read at random, as by archive/zip, and is safe for
+	// concurrent use. If the reader for the data returned by the resource
+	// storage supports random access, as GridFS does by seeking, each read
+	// is made from the storage as needed. Otherwise the data is first read
+	// in full into a buffer, which is spilled to a temporary file, as data
+	// being stored is (see ManagedStorageParams.UploadBufferSize), so that
+	// the buffering of large data is slow and takes up space; a warning is
+	// logged when that happens.
+	GetReaderAtForEnvironment(envUUID, path string) (r io.ReaderAt, length int64, closeFunc func() error, err error)
+
+	// StatForEnvironment returns metadata for the data at path, namespaced to the
+	// environment, without opening the data itself. As with GetForEnvironment,
+	// an ErrUploadPending error is returned if the data is not fully written yet.
+	StatForEnvironment(envUUID, path string) (Metadata, error)
+
+	// ExistsForEnvironment reports whether fully uploaded data exists at path,
+	// namespaced to the environment. Missing data is not an error. If the data
+	// is still being uploaded, false is returned with an ErrUploadPending error.
+	ExistsForEnvironment(envUUID, path string) (bool, error)
+
+	// ListForEnvironment returns information about all data stored for the
+	// environment. Data which is still being uploaded is included, but
+	// flagged as pending.
+	ListForEnvironment(envUUID string) ([]ResourceInfo, error)
+
+	// ListForEnvironmentPrefix is the same as ListForEnvironment except that
+	// only data at paths starting with prefix is included. Any leading "/"
+	// of the prefix is ignored, as it is for the paths themselves, so that
+	// both "agent-binaries/" and "/agent-binaries/" select the same data.
+	// An empty prefix selects all data stored for the environment.
+	ListForEnvironmentPrefix(envUUID, prefix string) ([]ResourceInfo, error)
+
+	// ListForEnvironmentIter is the same as ListForEnvironment except that
+	// entries are streamed via the returned iterator rather than being
+	// collected into a slice. The caller must close the iterator when done.
+	ListForEnvironmentIter(envUUID string) (ResourceInfoIterator, error)
+
+	// ListForEnvironmentPage is the same as ListForEnvironment except that at
+	// most limit entries are returned, ordered by path, starting after the
+	// position given by cursor. An empty cursor starts from the first path;
+	// otherwise it must be a cursor returned by a previous call for the same
+	// environment. The returned cursor gives the position of the next page,
+	// and is empty if there are no more entries. The position is that of a path
+	// rather than an offset, so data stored or removed between pages does not
+	// cause other entries to be skipped or repeated; data stored at a path
+	// before the cursor is not returned by later pages.
+	ListForEnvironmentPage(envUUID, cursor string, limit int) (entries []ResourceInfo, nextCursor string, err error)
+
+	// ScrubForEnvironment checks the integrity of all fully uploaded data
+	// stored for the environment, reading the data and comparing its hash
+	// with the hash recorded when it was stored. The result for each path is
+	// passed to report; if the data is corrupt, the error's cause is
+	// ErrChecksumMismatch. Reads are limited to the storage's ScrubRate so
+	// that other users of the resource storage are not starved. If ctx is
+	// cancelled, the scrub stops and the context's error is returned.
+	ScrubForEnvironment(ctx context.Context, envUUID string, report func(path string, ok bool, err error)) error
+
+	// RehashCatalog converts every catalog entry hashed using another
+	// algorithm to be keyed on the hash of its data calculated using target,
+	// preserving its reference count. If converted entries then share a
+	// hash, their references are merged into one entry and the duplicate
+	// data is removed. The result for each converted entry is passed to
+	// report, if non-nil, along with the entry's original id; entries whose
+	// upload is not complete cannot be converted, and are reported with an
+	// error satisfying IsUploadPending. An interrupted conversion may be
+	// resumed by calling RehashCatalog again.
+	//
+	// RehashCatalog should be called while the storage is not otherwise in
+	// use, and the storage should afterwards be constructed with target
+	// as its HashAlgorithm.
+	RehashCatalog(target HashAlgorithm, report func(id string, err error)) error
+
+	// MergeAcrossAlgorithms merges catalog entries hashed using another
+	// algorithm into the entries for the same data hashed using the
+	// storage's algorithm, as may both exist while the storage is being
+	// moved to a new algorithm. The data of each entry hashed using
+	// another algorithm is hashed again, and if the storage already holds
+	// data with that hash and length, the entry's references are moved to
+	// it, and the number of entries merged is returned.
+	//
+	// It is intended to be run after RehashCatalog, and may be run while
+	// the storage is in use: reads of merged data are redirected to the
+	// entry it was merged into. The duplicate data is left in the resource
+	// storage so that reads already under way are not disturbed, and is
+	// removed by GarbageCollect.
+	MergeAcrossAlgorithms() (merged int, err error)
+
 	// PutForEnvironment stores data from reader at path, namespaced to the environment.
 	//
 	// PutForEnvironment is equivalent to PutForEnvironmentAndCheckHash with an empty
 	// hash string.
+	//
+	// If storing the data would take the environment over the quota given by the
+	// storage's QuotaProvider, an error whose cause is ErrQuotaExceeded is returned.
+	// Data which is already stored does not count towards the quota.
+	//
+	// If the storage verifies de-duping (see ManagedStorageParams.VerifyDedup),
+	// and data with the same hash is already stored but is not the same
+	// length, an error whose cause is ErrDedupMismatch is returned.
+	//
+	// If the same data is being stored concurrently by another put using
+	// this storage, the data is not written to the resource storage again;
+	// instead the put waits for the other to finish, and refers to the data
+	// it wrote. Should the other put fail, or not finish within a minute,
+	// the data is written as usual. This only applies to puts made in the
+	// same process: puts of the same data from different processes, such
+	// as different controllers, may each write it, after which only one
+	// copy is kept.
 	PutForEnvironment(envUUID, path string, r io.Reader, length int64) error
 
+	// PutForEnvironmentWithContext is the same as PutForEnvironment except
+	// that the upload is abandoned, and the context's error returned, if ctx
+	// is cancelled before the data is stored.
+	PutForEnvironmentWithContext(ctx context.Context, envUUID, path string, r io.Reader, length int64) error
+
+	// PutForEnvironmentWithProgress is the same as PutForEnvironment except
+	// that progress is called with the number of bytes read from r so far,
+	// each time a further 4MiB have been read, and
+	// once more when all the data has been read. The total length is not
+	// passed, since it is the length given, if that is not -1. The callback
+	// is called from the goroutine reading the data, so reading stops until
+	// it returns; it should not block.
+	PutForEnvironmentWithProgress(envUUID, path string, r io.Reader, length int64, progress func(bytesWritten int64)) error
+
+	// SwapForEnvironment is the same as PutForEnvironment except that it
+	// is safe to replace data which is being read concurrently. The new data
+	// is fully stored before the path is pointed at it, which is done in the
+	// same transaction as the reference to the data it replaces is released,
+	// so readers of the path see either the old data or the new. The old data
+	// is not deleted from the underlying storage, even if nothing else refers
+	// to it, so that reads of it already under way complete; it is removed by
+	// GarbageCollect.
+	SwapForEnvironment(envUUID, path string, r io.Reader, length int64) error
+
 	// PutForEnvironmentAndCheckHash is the same as PutForEnvironment
 	// except that it also checks that the content matches the provided
-	// hash. The hash must be hex-encoded SHA-384.
+	// hash. The hash must be hex-encoded, and calculated using the storage's
+	// hash algorithm (SHA-384 by default). If it is not well formed, an
+	// error satisfying errors.IsNotValid is returned before any data is read.
 	//
 	// If checkHash is empty, then the hash check is elided.
 	//
 	// If length is < 0, then the reader will be consumed until EOF.
+	// Otherwise the reader must yield exactly length bytes; if it yields
+	// more or fewer, an error is returned and nothing is stored.
 	PutForEnvironmentAndCheckHash(envUUID, path string, r io.Reader, length int64, checkHash string) error
 
+	// PutForEnvironmentTrustingHash is the same as PutForEnvironment except
+	// that the data's hash is not calculated; the hex-encoded hash supplied
+	// by the caller, which must have been calculated using the storage's hash
+	// algorithm, is recorded instead. This saves the cost of hashing large
+	// data whose hash the caller already knows.
+	//
+	// The storage's integrity then depends on the caller: if the hash is
+	// wrong, the data is catalogued under the wrong hash, so that later puts
+	// of the data which does have that hash are de-duped to this data, and
+	// vice versa. Data stored this way is flagged as unverified until checked
+	// by VerifyTrustedHashes; GetForEnvironmentVerified also detects the
+	// mismatch when the data is read. The length, if not negative, is checked
+	// as usual.
+	PutForEnvironmentTrustingHash(envUUID, path string, r io.Reader, length int64, hash string) error
+
+	// PutOrReferenceForEnvironment stores at path, namespaced to the
+	// environment, the length bytes of data with the given hex-encoded
+	// hash, calculated using the storage's hash algorithm. If the data is
+	// already stored, a reference to it is recorded without reading any
+	// data; otherwise source is called to obtain a reader for the data,
+	// which is stored as by PutForEnvironmentAndCheckHash. This saves an
+	// upload when the data is likely to be stored already, without first
+	// asking whether it is.
+	//
+	// Unlike PutForEnvironmentRequest, the caller need not prove access to
+	// the data, so this should only be offered to callers trusted to
+	// read any data whose hash they may know.
+	PutOrReferenceForEnvironment(envUUID, path string, hash string, length int64, source func() (io.Reader, error)) error
+
+	// VerifyTrustedHashes checks data stored using PutForEnvironmentTrustingHash
+	// which has not yet been verified, reading it and comparing its hash with
+	// the hash supplied when it was stored. The result for each item of data
+	// is passed to report along with the trusted hash; if they do not match,
+	// the error's cause is ErrChecksumMismatch and the data remains flagged
+	// as unverified. Reads are limited to the storage's ScrubRate. If ctx is
+	// cancelled, verification stops and the context's error is returned.
+	VerifyTrustedHashes(ctx context.Context, report func(hash string, err error)) error
+
+	// BatchPutForEnvironment stores the data described by items, namespaced to
+	// the environment, as if by PutForEnvironmentAndCheckHash. Several items are
+	// stored concurrently, to amortise the cost of storing many small items.
+	// The error for each item, or nil if it was stored, is returned at the
+	// same index; an error is returned separately only if nothing could be
+	// attempted. Items with paths already seen in the batch are not stored.
+	BatchPutForEnvironment(envUUID string, items []BlobItem) ([]error, error)
+
+	// PutForEnvironmentReturningHash is the same as PutForEnvironment except
+	// that it also returns the hex-encoded hash of the stored data, calculated
+	// using the storage's hash algorithm (SHA-384 by default).
+	PutForEnvironmentReturningHash(envUUID, path string, r io.Reader, length int64) (hash string, err error)
+
+	// PutForEnvironmentWithMeta is the same as PutForEnvironment except
+	// that the data is recorded with the given metadata. The content type
+	// and filename are recorded against path, so the same data may be stored
+	// at different paths with different content types and filenames. Both are
+	// returned by StatForEnvironment.
+	PutForEnvironmentWithMeta(envUUID, path string, r io.Reader, length int64, meta PutMeta) error
+
+	// PutForEnvironmentTee is the same as PutForEnvironment except that the
+	// data is also written to tee as it is read, so it may be consumed by
+	// another sink without reading r twice. If writing to tee fails, no data
+	// is stored and the error is returned. Data already written to tee is not
+	// retracted if storing the data subsequently fails.
+	PutForEnvironmentTee(envUUID, path string, r io.Reader, length int64, tee io.Writer) error
+
+	// PutForEnvironmentFromFile is the same as PutForEnvironment except
+	// that the data is read from the named file, whose size is taken as
+	// the expected length. If the file changes size while it is being
+	// read, nothing is stored and an error is returned. If the file does
+	// not exist, an error satisfying juju/errors.IsNotFound is returned.
+	PutForEnvironmentFromFile(envUUID, path, filename string) error
+
+	// PutForEnvironmentWithLabels is the same as PutForEnvironment except
+	// that labels are recorded against path. Like the content type, labels
+	// belong to the path rather than the data, so the same data may be stored
+	// at different paths with different labels; copying or moving the data
+	// keeps its labels, and storing other data at the path replaces them. If
+	// a label key is empty, starts with "$" or contains ".", or the keys and
+	// values total more than MaxLabelBytes, an error satisfying
+	// juju/errors.IsNotValid is returned.
+	PutForEnvironmentWithLabels(envUUID, path string, r io.Reader, length int64, labels map[string]string) error
+
+	// LabelsForEnvironment returns the labels recorded against path,
+	// namespaced to the environment. If there are none, an empty map
+	// is returned.
+	LabelsForEnvironment(envUUID, path string) (map[string]string, error)
+
+	// AppendForEnvironment appends length bytes read from r to the data
+	// at path, namespaced to the environment, or stores them as
+	// PutForEnvironment does if there is no data at path. A length of -1
+	// means all the data up to EOF is appended. The appended data can be
+	// read as soon as AppendForEnvironment returns. Since data is de-duped
+	// by hash, it cannot be changed in place: the existing and appended
+	// data are read and stored together as new data with its own hash,
+	// which is not shared with other paths holding the old data, and the
+	// old data is released if nothing else refers to it. The cost of an
+	// append therefore grows with the size of the data. The content type,
+	// filename, labels and any expiry time of the path are kept. If the
+	// data at path is changed while appending, nothing is appended and an
+	// error whose cause is ErrPreconditionFailed is returned.
+	AppendForEnvironment(envUUID, path string, r io.Reader, length int64) error
+
+	// PutForEnvironmentWithTTL is the same as PutForEnvironment except that
+	// the data at path expires once ttl has elapsed. Expired data is not
+	// visible, and is removed by PurgeExpired. Moving the data keeps its
+	// expiry time; copies of it, or later puts to the same path, do not
+	// expire unless they also have a TTL.
+	PutForEnvironmentWithTTL(envUUID, path string, r io.Reader, length int64, ttl time.Duration) error
+
+	// PutForEnvironmentIfAbsent is the same as PutForEnvironment except that
+	// if data already exists at path, an AlreadyExists error is returned and
+	// the existing data is left unchanged.
+	PutForEnvironmentIfAbsent(envUUID, path string, r io.Reader, length int64) error
+
+	// PutForEnvironmentIfMatch is the same as PutForEnvironment except that
+	// the data is only stored if the data already at path has the hex-encoded
+	// hash expectedHash, calculated using the storage's hash algorithm.
+	// Otherwise, including when there is no data at path, an error whose
+	// cause is ErrPreconditionFailed is returned.
+	PutForEnvironmentIfMatch(envUUID, path, expectedHash string, r io.Reader, length int64) error
+
+	// BeginUploadForEnvironment starts a resumable upload of length bytes of data
+	// to path, namespaced to the environment, returning a handle identifying the
+	// upload. The data is supplied using AppendUpload, in one or more chunks, and
+	// is stored at path once CompleteUpload is called. The upload's progress is
+	// persisted, so it may be resumed by another client using the handle.
+	BeginUploadForEnvironment(envUUID, path string, length int64) (handle string, err error)
+
+	// UploadOffset returns the number of bytes received so far by the upload
+	// with the given handle, which is the offset at which to resume it.
+	UploadOffset(handle string) (int64, error)
+
+	// AppendUpload reads data from r until EOF, and appends it to the upload
+	// with the given handle. The offset must be the number of bytes received
+	// so far, otherwise an error satisfying juju/errors.IsNotValid is returned,
+	// as it is if the data would exceed the length of the upload.
+	AppendUpload(handle string, offset int64, r io.Reader) error
+
+	// CompleteUpload stores the data received by the upload with the given
+	// handle at the upload's path, after which the handle is no longer valid.
+	// An error is returned if not all of the data has been received.
+	CompleteUpload(handle string) error
+
+	// AbortUploadForEnvironment abandons the upload with the given handle,
+	// which must have been started for the environment, and removes the
+	// data received by it, after which the handle is no longer valid.
+	// Uploads which are neither completed nor aborted are abandoned once
+	// idle for longer than the storage's UploadSessionTTL (see
+	// ManagedStorageParams.UploadSessionTTL).
+	AbortUploadForEnvironment(envUUID, handle string) error
+
+	// ReserveForEnvironment reserves path, namespaced to the environment, for
+	// length bytes of data with the given hash, to be supplied later using
+	// CompleteForEnvironment with the returned token. Until then, getting the
+	// data at path returns an ErrUploadPending error. If path is already in
+	// use, an error satisfying juju/errors.IsAlreadyExists is returned.
+	// Reservations not completed within a day lapse: the path is then free,
+	// and CompleteForEnvironment returns an error satisfying
+	// juju/errors.IsNotFound.
+	ReserveForEnvironment(envUUID, path, hash string, length int64) (uploadToken string, err error)
+
+	// CompleteForEnvironment stores the data for the reservation with the
+	// given token, after which the token is no longer valid. If length is
+	// not negative, it must match the reserved length, and the data must have
+	// the reserved hash. If the reserved path has since been removed or
+	// replaced, an error whose cause is ErrPreconditionFailed is returned.
+	CompleteForEnvironment(uploadToken string, r io.Reader, length int64) error
+
+	// PendingProgressForEnvironment returns the number of bytes of data
+	// received so far by a put in progress to path, namespaced to the
+	// environment, and the length of the data being put, which is -1 if it
+	// is not known. The progress is recorded periodically, so it may lag
+	// the put slightly. If no put to path is in progress, an error
+	// satisfying juju/errors.IsNotFound is returned.
+	PendingProgressForEnvironment(envUUID, path string) (bytesWritten, totalExpected int64, err error)
+
+	// PutForEnvironmentVersioned is the same as PutForEnvironment except that
+	// a new version of the data at path is recorded, keeping the data of prior
+	// versions, and its number is returned. Versions other than the latest
+	// which are not kept by retention are then pruned. Unversioned puts change
+	// the data at path without recording a version. Removing the path removes
+	// its versions, once any soft-deleted record is purged, and moving the
+	// path moves them.
+	PutForEnvironmentVersioned(envUUID, path string, r io.Reader, length int64, retention VersionRetention) (version int, err error)
+
+	// GetForEnvironmentVersion returns a reader for the given version of the
+	// data at path, namespaced to the environment. If there is no such version,
+	// an error satisfying juju/errors.IsNotFound is returned.
+	GetForEnvironmentVersion(envUUID, path string, version int) (r io.ReadCloser, length int64, err error)
+
+	// ListVersionsForEnvironment returns the versions of the data at path,
+	// namespaced to the environment, which have not been pruned, oldest first.
+	ListVersionsForEnvironment(envUUID, path string) ([]VersionInfo, error)
+
 	// RemoveForEnvironment deletes data at path, namespaced to the environment.
+	// If the storage has a soft-delete window, the data is kept until it is
+	// purged, and may be restored with UndeleteForEnvironment until then.
 	RemoveForEnvironment(envUUID, path string) error
 
+	// RemoveForEnvironmentIfSole is the same as RemoveForEnvironment except
+	// that the data at path is only removed if no other path refers to it,
+	// so that removing it deletes the stored data. If other paths share the
+	// data, nothing is changed and removed is false. If soft deletion is
+	// enabled, the record is marked as deleted as by RemoveForEnvironment,
+	// and the data is deleted once it is purged.
+	RemoveForEnvironmentIfSole(envUUID, path string) (removed bool, err error)
+
+	// GetForUser returns a reader for data at path, namespaced to the user.
+	// If the data is still being uploaded and is not fully written yet,
+	// an ErrUploadPending error is returned.
+	GetForUser(user, path string) (r io.ReadCloser, length int64, err error)
+
+	// PutForUser stores data from reader at path, namespaced to the user.
+	// Data identical to that stored for an environment or another user
+	// shares the same underlying resource.
+	PutForUser(user, path string, r io.Reader, length int64) error
+
+	// PutForUserAndCheckHash is the same as PutForUser except that it also
+	// checks that the content matches the provided hex-encoded hash, calculated
+	// using the storage's hash algorithm.
+	// If checkHash is empty, then the hash check is elided.
+	PutForUserAndCheckHash(user, path string, r io.Reader, length int64, checkHash string) error
+
+	// RemoveForUser deletes data at path, namespaced to the user.
+	RemoveForUser(user, path string) error
+
+	// GetGlobal returns a reader for data stored globally at path.
+	// If the data is still being uploaded and is not fully written yet,
+	// an ErrUploadPending error is returned.
+	GetGlobal(path string) (r io.ReadCloser, length int64, err error)
+
+	// PutGlobal stores data from reader globally at path, visible regardless
+	// of environment or user. Data identical to that stored for an environment
+	// or user shares the same underlying resource.
+	PutGlobal(path string, r io.Reader, length int64) error
+
+	// PutGlobalAndCheckHash is the same as PutGlobal except that it also
+	// checks that the content matches the provided hex-encoded hash, calculated
+	// using the storage's hash algorithm.
+	// If checkHash is empty, then the hash check is elided.
+	PutGlobalAndCheckHash(path string, r io.Reader, length int64, checkHash string) error
+
+	// RemoveGlobal deletes data stored globally at path.
+	RemoveGlobal(path string) error
+
+	// CopyForEnvironment stores a reference at dstPath to the data at srcPath,
+	// both namespaced to the environment, without copying the data itself.
+	// If no data exists at srcPath, a NotFound error is returned; if the
+	// data is still being uploaded, an ErrUploadPending error is returned.
+	CopyForEnvironment(envUUID, srcPath, dstPath string) error
+
+	// MoveForEnvironment atomically moves the reference to the data at srcPath
+	// to dstPath, both namespaced to the environment, without copying the data
+	// itself. If data already exists at dstPath, an AlreadyExists error is returned.
+	// If srcPath and dstPath are the same, nothing is done.
+	MoveForEnvironment(envUUID, srcPath, dstPath string) error
+
+	// ImportArchiveForEnvironment stores the data in the tar archive read from r,
+	// namespaced to the environment, at the path given by each entry's name.
+	// The data is stored as it is by PutForEnvironment, so data already stored
+	// is shared rather than stored again. Directory entries are ignored, and
+	// entries of other types are not valid. Entries are read and stored one
+	// at a time; if one cannot be stored, those before it remain stored.
+	ImportArchiveForEnvironment(envUUID string, r io.Reader) error
+
+	// ExportArchiveForEnvironment writes all data namespaced to the environment
+	// to w as a tar archive, in the form read by ImportArchiveForEnvironment.
+	// Data still being uploaded is omitted. The archive is written as the data
+	// is read, rather than being held in memory.
+	ExportArchiveForEnvironment(envUUID string, w io.Writer) error
+
+	// ManifestForEnvironment returns a description of all data stored for
+	// the environment, giving the hash, length, content type, filename and
+	// labels of each path, ordered by path, without reading the data itself.
+	// Data which is still being uploaded is included, but flagged as pending.
+	ManifestForEnvironment(envUUID string) (Manifest, error)
+
+	// ReconcileFromManifest compares the data stored for the manifest's
+	// environment with that described by the manifest, reporting the paths
+	// missing from the storage, those stored which are not in the manifest,
+	// and those whose entries in the manifest differ from the data stored.
+	ReconcileFromManifest(manifest Manifest) (ManifestReconciliation, error)
+
+	// RemoveAllForEnvironment removes all data namespaced to the environment,
+	// including any versions recorded, returning the number of paths removed. Paths are
+	// removed in batches, each in a single transaction which also decrements the reference
+	// counts of the data they refer to, so an interrupted removal never leaves reference
+	// counts out of step with the paths remaining. Data no longer referenced is then deleted
+	// from the underlying storage; data left behind by an interruption at that point is
+	// removed by GarbageCollect. If a batch cannot be applied as one transaction, its paths
+	// are removed one at a time, each along with its reference. Either way the removal
+	// may safely be run again to complete it.
+	// Failures to remove individual paths do not stop the others from being removed;
+	// they are combined into the returned error.
+	RemoveAllForEnvironment(envUUID string) (removed int, err error)
+
+	// PurgeExpired removes all data whose expiry time has passed,
+	// returning the number of paths removed.
+	PurgeExpired() (removed int, err error)
+
+	// UndeleteForEnvironment restores the data at path, namespaced to the
+	// environment, which was removed within the storage's soft-delete window.
+	// If there is no such data, a NotFound error is returned.
+	UndeleteForEnvironment(envUUID, path string) error
+
+	// PurgeDeleted deletes all data which was removed before the start of
+	// the storage's soft-delete window, returning the number of paths
+	// purged. It should be called periodically when soft delete is enabled.
+	PurgeDeleted() (purged int, err error)
+
+	// UsageForEnvironment returns the storage used by the environment.
+	UsageForEnvironment(envUUID string) (Usage, error)
+
+	// EnvironmentsWithData returns the sorted UUIDs of all environments
+	// which have data stored at one or more paths. Data stored for users
+	// or globally is not attributed to any environment, and neither is
+	// data which has been soft-deleted or has expired.
+	EnvironmentsWithData() ([]string, error)
+
+	// RefCountForEnvironment returns the number of references to the data at path,
+	// namespaced to the environment, from all environments, users and global storage.
+	RefCountForEnvironment(envUUID, path string) (int, error)
+
+	// ReferrersForHash returns the paths, in all environments, users and
+	// global storage, which refer to the data with the given hash, calculated
+	// using the storage's hash algorithm. This is useful for finding out why
+	// removing data from one path does not free the space it uses. If the
+	// data is catalogued but no paths refer to it, an empty slice is returned;
+	// if it is not catalogued, an error satisfying juju/errors.IsNotFound
+	// is returned.
+	ReferrersForHash(hash string) ([]Reference, error)
+
+	// FinalizePendingUploads completes uploads which were interrupted after
+	// their data was stored, but before it was recorded as complete, as happens
+	// when a process dies part way through a put. Each such upload whose data
+	// is fully stored is recorded as complete, and the number finalized is
+	// returned. Uploads with no complete data which have been pending for
+	// longer than a grace period are assumed to have been abandoned, and are
+	// removed along with any partial data; the number removed is returned.
+	FinalizePendingUploads() (finalized, removed int, err error)
+
+	// PendingUploads returns the uploads which have been pending for at
+	// least olderThan, oldest first, so that stuck uploads can be found
+	// before they are cleaned up by FinalizePendingUploads. Uploads
+	// catalogued before creation times were recorded are not returned.
+	// Nothing is changed.
+	PendingUploads(olderThan time.Duration) ([]PendingUpload, error)
+
+	// GarbageCollect removes data from the underlying resource storage which
+	// is not referenced by any completed upload in the resource catalog,
+	// and which was written more than olderThan ago. Such data is left behind
+	// if a process dies part way through storing it. Younger data is skipped
+	// so that uploads in progress are not disturbed. The number of items of
+	// data removed is returned.
+	//
+	// Resumable uploads which have been idle for longer than the storage's
+	// UploadSessionTTL are abandoned, and their data is removed too.
+	//
+	// The resource storage must implement ResourceStorageLister, otherwise
+	// an error satisfying juju/errors.IsNotSupported is returned. The same
+	// error is returned for S3 storage configured without a key prefix,
+	// as the bucket may hold data which is not the storage's own.
+	GarbageCollect(olderThan time.Duration) (removed int, err error)
+
 	// PutForEnvironmentRequest requests that data, which may already exist in storage,
 	// be saved at path, namespaced to the environment. It allows callers who can
 	// demonstrate proof of ownership of the data to store a reference to it without
 	// having to upload it all. If no such data exists, a NotFound error is returned
 	// and a call to EnvironmentPut is required. If matching data is found, the caller
 	// is returned a response indicating the random byte range to for which they must
-	// provide a checksum to complete the process.
+	// provide a checksum to complete the process. If the storage is configured with
+	// more than one challenge range (see ManagedStorageParams.ChallengeRanges), a
+	// checksum must be provided for each of the response's disjoint Ranges. If the storage verifies
+	// de-duping and the stored data is not the length catalogued, an error
+	// whose cause is ErrDedupMismatch is returned. Data no longer than
+	// MinChallengeLength is challenged in full.
 	PutForEnvironmentRequest(envUUID, path string, hash string) (*RequestResponse, error)
 
+	// CanDedup returns whether data with the given hash, calculated using the
+	// storage's hash algorithm, is already stored such that a reference to it
+	// could be created using PutForEnvironmentRequest rather than uploading it.
+	// No request is made and no state is changed.
+	CanDedup(hash string) (bool, error)
+
+	// CanDedupMany is the same as CanDedup except that it checks
+	// many hashes at once, returning the result for each, keyed
+	// on hash. It is intended for planning batches of uploads.
+	CanDedupMany(hashes []string) (map[string]bool, error)
+
 	// ProofOfAccessResponse is called to respond to a Put..Request call in order to
 	// prove ownership of data for which a storage reference is created.
+	// Each request may be responded to only once, and only before it expires;
+	// the response must include the request's challenge token. Otherwise an
+	// error satisfying juju/errors.IsNotValid is returned.
+	// If the response does not include the expected checksum
+	// for every challenged range, ErrResponseMismatch is returned.
 	ProofOfAccessResponse(putResponse) error
+
+	// ProofOfAccessResponseReference is the same as ProofOfAccessResponse
+	// except that on success it returns the resource catalog id and storage
+	// path of the data now referenced.
+	ProofOfAccessResponseReference(putResponse) (StoredReference, error)
+
+	// Close releases the resources held by the storage. Outstanding put
+	// requests are discarded, and the resource storage is closed if it
+	// implements io.Closer; the database is not closed, since it is owned
+	// by the caller. Once closed, operations on the storage return
+	// ErrStoreClosed. Closing the storage again has no effect.
+	Close() error
+
+	// ScopedForEnvironment returns a view of the storage in which all
+	// operations are namespaced to the environment, so that the environment
+	// UUID need not be passed to each. The view holds no resources of its
+	// own. If envUUID is empty or contains "/", an error satisfying
+	// juju/errors.IsNotValid is returned.
+	ScopedForEnvironment(envUUID string) (EnvironmentStorage, error)
+
+	// HealthCheck returns nil if both the resource catalog and the
+	// resource storage can be reached before ctx is done. Each is checked
+	// by looking up something known to be absent, so nothing is written.
+	// An error identifies the subsystem which could not be reached.
+	HealthCheck(ctx context.Context) error
+}
+
+// EnvironmentStorage instances persist data for a single environment. Each
+// method is the same as the corresponding ManagedStorage method suffixed
+// with ForEnvironment, called with the environment's UUID.
+type EnvironmentStorage interface {
+	// EnvUUID returns the UUID of the environment to
+	// which the storage's data is namespaced.
+	EnvUUID() string
+
+	Get(path string) (r io.ReadCloser, length int64, err error)
+	GetWithContext(ctx context.Context, path string) (r io.ReadCloser, length int64, err error)
+	Stat(path string) (Metadata, error)
+	Exists(path string) (bool, error)
+	List() ([]ResourceInfo, error)
+	ListPrefix(prefix string) ([]ResourceInfo, error)
+	Put(path string, r io.Reader, length int64) error
+	PutAndCheckHash(path string, r io.Reader, length int64, checkHash string) error
+	PutWithContext(ctx context.Context, path string, r io.Reader, length int64) error
+	Remove(path string) error
+	Copy(srcPath, dstPath string) error
+	Move(srcPath, dstPath string) error
+	RemoveAll() (removed int, err error)
+	Usage() (Usage, error)
+}
+
+// ResourceInfoIterator instances iterate over entries in managed storage.
+type ResourceInfoIterator interface {
+	// Next populates info with the next entry, returning false if there are
+	// no more entries or an error occurred.
+	Next(info *ResourceInfo) bool
+
+	// Close releases the iterator's resources, returning any error
+	// encountered during iteration.
+	Close() error
 }
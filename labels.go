@@ -0,0 +1,66 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// MaxLabelBytes is the maximum total size of the
+// keys and values of the labels recorded against a path.
+const MaxLabelBytes = 4096
+
+// validateLabels returns an error if labels may not be recorded.
+func validateLabels(labels map[string]string) error {
+	size := 0
+	for key, value := range labels {
+		// Labels are stored as a mongo document, so
+		// keys are subject to mongo's restrictions.
+		if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			return errors.NotValidf("label key %q", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > MaxLabelBytes {
+		return errors.NewNotValid(nil, fmt.Sprintf("labels total %d bytes, more than the maximum of %d", size, MaxLabelBytes))
+	}
+	return nil
+}
+
+// PutForEnvironmentWithLabels is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentWithLabels(envUUID, path string, r io.Reader, length int64, labels map[string]string) (err error) {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{labels: labels})
+	return err
+}
+
+// LabelsForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) LabelsForEnvironment(envUUID, path string) (map[string]string, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := ms.managedResourceForPath(managedPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ms.catalogEntry(doc.ResourceId, managedPath); err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for key, value := range doc.Labels {
+		labels[key] = value
+	}
+	return labels, nil
+}
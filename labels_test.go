@@ -0,0 +1,94 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) putWithLabels(c *gc.C, path string, blob []byte, labels map[string]string) {
+	err := s.managedStorage.PutForEnvironmentWithLabels("env", path, bytes.NewReader(blob), int64(len(blob)), labels)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) assertLabels(c *gc.C, path string, expected map[string]string) {
+	labels, err := s.managedStorage.LabelsForEnvironment("env", path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(labels, jc.DeepEquals, expected)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithLabels(c *gc.C) {
+	blob := []byte("some resource")
+	s.putWithLabels(c, "/path/to/blob", blob, map[string]string{"build": "42", "commit": "abc123"})
+	s.putWithLabels(c, "/path/to/another", blob, map[string]string{"build": "43"})
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+
+	// The same data carries different labels at different paths.
+	s.assertLabels(c, "/path/to/blob", map[string]string{"build": "42", "commit": "abc123"})
+	s.assertLabels(c, "/path/to/another", map[string]string{"build": "43"})
+}
+
+func (s *managedStorageSuite) TestLabelsForEnvironmentNone(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	s.assertLabels(c, "/path/to/blob", map[string]string{})
+}
+
+func (s *managedStorageSuite) TestLabelsForEnvironmentNotFound(c *gc.C) {
+	_, err := s.managedStorage.LabelsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentReplacesLabels(c *gc.C) {
+	blob := []byte("some resource")
+	s.putWithLabels(c, "/path/to/blob", blob, map[string]string{"build": "42"})
+	s.putWithLabels(c, "/path/to/blob", blob, map[string]string{"commit": "abc123"})
+	s.assertLabels(c, "/path/to/blob", map[string]string{"commit": "abc123"})
+	s.assertPut(c, "/path/to/blob", []byte("other resource"))
+	s.assertLabels(c, "/path/to/blob", map[string]string{})
+}
+
+func (s *managedStorageSuite) TestCopyAndMoveKeepLabels(c *gc.C) {
+	labels := map[string]string{"build": "42"}
+	s.putWithLabels(c, "/path/to/blob", []byte("some resource"), labels)
+	err := s.managedStorage.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertLabels(c, "/path/to/copy", labels)
+	err = s.managedStorage.MoveForEnvironment("env", "/path/to/copy", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertLabels(c, "/path/to/moved", labels)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithLabelsInvalid(c *gc.C) {
+	for i, test := range []struct {
+		labels map[string]string
+		expect string
+	}{{
+		labels: map[string]string{"": "value"},
+		expect: `label key "" not valid`,
+	}, {
+		labels: map[string]string{"$set": "value"},
+		expect: `label key "\$set" not valid`,
+	}, {
+		labels: map[string]string{"a.b": "value"},
+		expect: `label key "a.b" not valid`,
+	}, {
+		labels: map[string]string{"key": strings.Repeat("x", blobstore.MaxLabelBytes)},
+		expect: `labels total 4099 bytes, more than the maximum of 4096`,
+	}} {
+		c.Logf("test %d", i)
+		blob := []byte("some resource")
+		err := s.managedStorage.PutForEnvironmentWithLabels("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), test.labels)
+		c.Assert(err, gc.ErrorMatches, test.expect)
+		c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	}
+	s.assertResourceCatalogCount(c, 0)
+}
@@ -4,15 +4,22 @@
 package blobstore
 
 import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
 	"crypto/sha512"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"math/rand"
-	"os"
+	"math/big"
+	"net/http"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -31,6 +38,82 @@ type ManagedResource struct {
 	EnvUUID string
 	User    string
 	Path    string
+
+	// ContentType is the MIME type of the data at the path.
+	ContentType string
+
+	// Filename, if non-empty, is the name of the
+	// file the data at the path was stored from.
+	Filename string
+
+	// ExpiryTime, if non-zero, is the time after which
+	// the data at the path is no longer visible.
+	ExpiryTime time.Time
+
+	// Labels holds arbitrary caller-supplied
+	// key/value pairs recorded against the path.
+	Labels map[string]string
+}
+
+// Metadata describes the data stored at a managed storage path.
+type Metadata struct {
+	// Length is the size of the data in bytes.
+	Length int64
+
+	// SHA384Hash is the hex-encoded SHA-384 hash of the data.
+	// It is only set if HashAlgorithm is SHA384.
+	SHA384Hash string
+
+	// Hash is the hex-encoded hash of the data, calculated
+	// using HashAlgorithm.
+	Hash          string
+	HashAlgorithm HashAlgorithm
+
+	// ContentType is the MIME type of the data at the path, as given
+	// when it was stored or else detected from its content.
+	ContentType string
+
+	// Filename is the name of the file the data at the path was
+	// stored from, as given when it was stored, or else empty.
+	Filename string
+}
+
+// PutMeta holds optional metadata to be recorded with stored data.
+type PutMeta struct {
+	// ContentType is the MIME type of the data. If empty,
+	// it is detected from the first 512 bytes of the data.
+	ContentType string
+
+	// Filename is the name of the file the data is stored from, such
+	// as the name it was uploaded as, for use in a Content-Disposition
+	// header when it is downloaded. It may be empty.
+	Filename string
+}
+
+// ResourceInfo describes an entry in managed storage.
+type ResourceInfo struct {
+	// Path is the path at which the data is stored,
+	// relative to its namespace.
+	Path string
+
+	// Length is the size of the data in bytes.
+	Length int64
+
+	// SHA384Hash is the hex-encoded SHA-384 hash of the data.
+	// It is only set if HashAlgorithm is SHA384.
+	SHA384Hash string
+
+	// Hash is the hex-encoded hash of the data, calculated
+	// using HashAlgorithm.
+	Hash          string
+	HashAlgorithm HashAlgorithm
+
+	// ContentType is the MIME type of the data at the path.
+	ContentType string
+
+	// Pending is true if the data is still being uploaded,
+	// in which case Length and the hashes are not known.
+	Pending bool
 }
 
 // managedResourceDoc is the persistent representation of a ManagedResource.
@@ -40,20 +123,69 @@ type managedResourceDoc struct {
 	User       string
 	Path       string
 	ResourceId string
+	// ContentType is recorded per path rather than in the resource
+	// catalog, since the same data may be stored under different types.
+	ContentType string
+	// Filename is also recorded per path, since
+	// the same data may be stored from different files.
+	Filename   string            `bson:",omitempty"`
+	ExpiryTime time.Time         `bson:",omitempty"`
+	Labels     map[string]string `bson:",omitempty"`
+	// DeletedTime is set when the record is soft-deleted, in which
+	// case it may be restored until the soft-delete window has passed.
+	DeletedTime time.Time `bson:",omitempty"`
 }
 
+// expired returns whether the record has an expiry time which has
+// passed, or has been soft-deleted; either way it is no longer visible.
+func (doc *managedResourceDoc) expired(now time.Time) bool {
+	if !doc.DeletedTime.IsZero() {
+		return true
+	}
+	return !doc.ExpiryTime.IsZero() && !now.Before(doc.ExpiryTime)
+}
+
+// Wrap time.Now so we can patch for testing.
+var timeNow = time.Now
+
 // managedStorage is a mongo backed ManagedResource instance.
 type managedStorage struct {
 	resourceStore             ResourceStorage
 	resourceCatalog           ResourceCatalog
 	managedResourceCollection *mgo.Collection
 	db                        *mgo.Database
+	hashAlgorithm             HashAlgorithm
+	randSource                io.Reader
+	observer                  Observer
+	quotaProvider             QuotaProvider
+	uploadBufferSize          int64
+	tempDir                   string
+	scrubRate                 int64
+	verifyDedupEnabled        bool
+	challengeRanges           int
+	throttleRate              int64
+	throttleBurst             int64
+	auditSink                 AuditSink
+	auditFailurePolicy        AuditFailurePolicy
+	softDeleteWindow          time.Duration
+	clock                     Clock
+	inlineThreshold           int64
+	uploadSessionTTL          time.Duration
 
 	// The following attributes are used to manage the processing
 	// of put requests based on proof of access.
 	requestMutex   sync.Mutex
 	nextRequestId  int64
 	queuedRequests map[int64]PutRequest
+	pollTimer      *time.Timer
+
+	// localUploads records the data being uploaded by puts
+	// in this process, so that concurrent puts of the same data
+	// in this process wait for each other without polling.
+	localUploads localUploads
+
+	// closed is set to 1, atomically, when the storage is closed.
+	closed int32
 }
 
 var _ ManagedStorage = (*managedStorage)(nil)
@@ -62,11 +194,15 @@ var _ ManagedStorage = (*managedStorage)(nil)
 // This is used when writing new data to the managed storage catalog.
 func newManagedResourceDoc(r ManagedResource, resourceId string) managedResourceDoc {
 	return managedResourceDoc{
-		Id:         r.Path,
-		ResourceId: resourceId,
-		Path:       r.Path,
-		EnvUUID:    r.EnvUUID,
-		User:       r.User,
+		Id:          r.Path,
+		ResourceId:  resourceId,
+		Path:        r.Path,
+		EnvUUID:     r.EnvUUID,
+		User:        r.User,
+		ContentType: r.ContentType,
+		Filename:    r.Filename,
+		ExpiryTime:  r.ExpiryTime,
+		Labels:      r.Labels,
 	}
 }
 
@@ -76,21 +212,301 @@ const (
 	managedResourceCollection = "managedStoredResources"
 )
 
+// ManagedStorageParams holds the parameters used to construct a ManagedStorage.
+type ManagedStorageParams struct {
+	// Database is the database in which resource entries are stored.
+	Database *mgo.Database
+
+	// ResourceStorage is the storage in which resource data is stored.
+	ResourceStorage ResourceStorage
+
+	// HashAlgorithm is the algorithm used to calculate the checksums
+	// used to de-dupe and verify data. If empty, DefaultHashAlgorithm
+	// is used.
+	HashAlgorithm HashAlgorithm
+
+	// RandSource is the source of randomness used to choose the byte ranges
+	// callers must checksum to prove access to data. The ranges must be
+	// unpredictable, so this should only be set for testing. If nil,
+	// crypto/rand.Reader is used.
+	RandSource io.Reader
+
+	// Observer, if non-nil, is notified of the operations
+	// performed by the ManagedStorage.
+	Observer Observer
+
+	// QuotaProvider, if non-nil, supplies the limits on the
+	// data which may be stored for each environment.
+	QuotaProvider QuotaProvider
+
+	// UploadBufferSize is the number of bytes of data being stored
+	// which are held in memory while its checksum is calculated; larger
+	// data is spilled to a temporary file. If zero, DefaultUploadBufferSize
+	// is used. If negative, data is always written to a temporary file.
+	UploadBufferSize int64
+
+	// TempDir is the directory in which the temporary files holding
+	// data spilled from memory while it is being stored are created.
+	// The files are readable only by their owner, and are removed once
+	// the data is stored, or the put fails or is cancelled. If empty,
+	// os.TempDir is used. A compressing ResourceStorage should be given
+	// the same directory, using NewCompressingStorageWithTempDir.
+	TempDir string
+
+	// ScrubRate is the maximum number of bytes per second read when
+	// checking the integrity of stored data with ScrubForEnvironment.
+	// If zero, DefaultScrubRate is used. If negative, reads are not limited.
+	ScrubRate int64
+
+	// VerifyDedup, if true, causes the length of stored data to be checked
+	// before another reference to it is recorded, so that different data
+	// which happens to have the same hash is not stored as an alias of it.
+	VerifyDedup bool
+
+	// ChallengeRanges is the number of disjoint byte ranges a caller
+	// must checksum to prove access to data when responding to a put
+	// request. More ranges give stronger proof, at the cost of reading
+	// more of the data. If zero, DefaultChallengeRanges is used.
+	ChallengeRanges int
+
+	// ThrottleRate, if positive, is the maximum number of bytes per second
+	// written to the resource storage by each put, and read from it by
+	// each get. If zero, throughput is not limited.
+	ThrottleRate int64
+
+	// ThrottleBurst is the number of bytes which may be transferred at
+	// once, faster than ThrottleRate, by an operation which has not used
+	// its full allowance. If zero, ThrottleRate bytes are allowed.
+	ThrottleBurst int64
+
+	// AuditSink, if non-nil, records the puts, removals, purges, copies,
+	// moves and proof of access responses performed by the ManagedStorage.
+	// Operations affecting many paths record an event for each path.
+	AuditSink AuditSink
+
+	// AuditFailurePolicy determines what happens when AuditSink fails
+	// to record an event. If empty, AuditFailOpen is used.
+	AuditFailurePolicy AuditFailurePolicy
+
+	// SoftDeleteWindow, if positive, causes removed data to be kept for
+	// that long, during which it may be restored with UndeleteForEnvironment.
+	// The data is deleted by PurgeDeleted once the window has passed.
+	// If zero, removed data is deleted immediately.
+	SoftDeleteWindow time.Duration
+
+	// Clock, if non-nil, supplies the time used to determine when data
+	// expires, soft-deleted data and old versions may be purged, and
+	// abandoned uploads and unreferenced data may be cleaned up. If nil,
+	// WallClock is used. GarbageCollect compares the time with the
+	// modification times listed by the resource storage, so storage which
+	// records its own times, such as that returned by NewMemResourceStorage
+	// or NewFileResourceStorageWithConfig, should be given the same Clock.
+	Clock Clock
+
+	// InlineThreshold, if positive, is the length at or below which data
+	// is held inline in its resource catalog entry, rather than written to
+	// the resource storage, saving the storage the cost of holding many
+	// tiny blobs. Data is de-duped by hash in the same way whichever way it
+	// is held. It may not exceed MaxInlineThreshold. If zero, all data is
+	// written to the resource storage.
+	InlineThreshold int64
+
+	// UploadSessionTTL is how long a resumable upload may go without data
+	// being appended to it before it is abandoned, after which it can no
+	// longer be resumed, and it and its data are removed by GarbageCollect.
+	// If zero, DefaultUploadSessionTTL is used.
+	UploadSessionTTL time.Duration
+}
+
+// DefaultUploadSessionTTL is how long a resumable upload may be idle
+// before it is abandoned if ManagedStorageParams.UploadSessionTTL is zero.
+const DefaultUploadSessionTTL = 24 * time.Hour
+
+// DefaultChallengeRanges is the number of byte ranges challenged
+// by a put request if ManagedStorageParams.ChallengeRanges is zero.
+const DefaultChallengeRanges = 1
+
+// MinChallengeLength is the length of data at or below which a put request
+// challenges the whole of the data, rather than a random range of it. If the
+// storage challenges multiple ranges, it applies to the segment of the data
+// from which each range is chosen. Proof of access to such data is as strong
+// as uploading it, but saves the caller nothing; it is only worthwhile for
+// data several times longer, where a single range of at most 2048 bytes is
+// read. Proof of access to empty data proves nothing.
+const MinChallengeLength = 512
+
+// Validate returns an error if the params are not valid.
+func (p ManagedStorageParams) Validate() error {
+	if p.Database == nil {
+		return errors.NotValidf("nil Database")
+	}
+	if p.ResourceStorage == nil {
+		return errors.NotValidf("nil ResourceStorage")
+	}
+	if p.HashAlgorithm != "" {
+		if err := p.HashAlgorithm.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.ChallengeRanges < 0 {
+		return errors.NotValidf("negative ChallengeRanges")
+	}
+	if p.ThrottleRate < 0 {
+		return errors.NotValidf("negative ThrottleRate")
+	}
+	if p.ThrottleBurst < 0 {
+		return errors.NotValidf("negative ThrottleBurst")
+	}
+	if p.AuditFailurePolicy != "" {
+		if err := p.AuditFailurePolicy.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.SoftDeleteWindow < 0 {
+		return errors.NotValidf("negative SoftDeleteWindow")
+	}
+	if p.InlineThreshold < 0 {
+		return errors.NotValidf("negative InlineThreshold")
+	}
+	if p.InlineThreshold > MaxInlineThreshold {
+		return errors.NotValidf("InlineThreshold %d exceeding %d", p.InlineThreshold, MaxInlineThreshold)
+	}
+	if p.UploadSessionTTL < 0 {
+		return errors.NotValidf("negative UploadSessionTTL")
+	}
+	return nil
+}
+
 // NewManagedStorage creates a new ManagedStorage using the transaction runner,
 // storing resource entries in the specified database, and resource data in the
 // specified resource storage.
 func NewManagedStorage(db *mgo.Database, rs ResourceStorage) ManagedStorage {
-	// Ensure random number generator used to calculate checksum byte range is seeded.
-	rand.Seed(int64(time.Now().Nanosecond()))
+	ms, err := NewManagedStorageWithParams(ManagedStorageParams{
+		Database:        db,
+		ResourceStorage: rs,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return ms
+}
+
+// NewManagedStorageWithParams creates a new ManagedStorage as described by params.
+func NewManagedStorageWithParams(params ManagedStorageParams) (ManagedStorage, error) {
+	if err := params.Validate(); err != nil {
+		return nil, errors.Annotate(err, "invalid managed storage params")
+	}
+	hashAlgorithm := params.HashAlgorithm
+	if hashAlgorithm == "" {
+		hashAlgorithm = DefaultHashAlgorithm
+	}
+	randSource := params.RandSource
+	if randSource == nil {
+		randSource = cryptorand.Reader
+	}
+	observer := params.Observer
+	if observer == nil {
+		observer = nopObserver{}
+	}
+	clock := params.Clock
+	if clock == nil {
+		clock = WallClock
+	}
+	uploadBufferSize := params.UploadBufferSize
+	if uploadBufferSize == 0 {
+		uploadBufferSize = DefaultUploadBufferSize
+	}
+	scrubRate := params.ScrubRate
+	if scrubRate == 0 {
+		scrubRate = DefaultScrubRate
+	}
+	challengeRanges := params.ChallengeRanges
+	if challengeRanges == 0 {
+		challengeRanges = DefaultChallengeRanges
+	}
+	auditSink := params.AuditSink
+	if auditSink == nil {
+		auditSink = nopAuditSink{}
+	}
+	auditFailurePolicy := params.AuditFailurePolicy
+	if auditFailurePolicy == "" {
+		auditFailurePolicy = AuditFailOpen
+	}
+	throttleBurst := params.ThrottleBurst
+	if throttleBurst == 0 {
+		throttleBurst = params.ThrottleRate
+	}
+	uploadSessionTTL := params.UploadSessionTTL
+	if uploadSessionTTL == 0 {
+		uploadSessionTTL = DefaultUploadSessionTTL
+	}
+	db := params.Database
 	ms := &managedStorage{
-		resourceStore:   rs,
-		resourceCatalog: newResourceCatalog(db),
-		db:              db,
-		queuedRequests:  make(map[int64]PutRequest),
+		resourceStore:      params.ResourceStorage,
+		resourceCatalog:    newResourceCatalogWithClock(db, hashAlgorithm, clock),
+		db:                 db,
+		hashAlgorithm:      hashAlgorithm,
+		randSource:         randSource,
+		observer:           observer,
+		quotaProvider:      params.QuotaProvider,
+		uploadBufferSize:   uploadBufferSize,
+		tempDir:            params.TempDir,
+		scrubRate:          scrubRate,
+		verifyDedupEnabled: params.VerifyDedup,
+		challengeRanges:    challengeRanges,
+		throttleRate:       params.ThrottleRate,
+		throttleBurst:      throttleBurst,
+		auditSink:          auditSink,
+		auditFailurePolicy: auditFailurePolicy,
+		softDeleteWindow:   params.SoftDeleteWindow,
+		clock:              clock,
+		inlineThreshold:    params.InlineThreshold,
+		uploadSessionTTL:   uploadSessionTTL,
+		queuedRequests:     make(map[int64]PutRequest),
 	}
 	ms.managedResourceCollection = db.C(managedResourceCollection)
 	ms.managedResourceCollection.EnsureIndex(mgo.Index{Key: []string{"path"}, Unique: true})
-	return ms
+	ms.managedResourceCollection.EnsureIndex(mgo.Index{Key: []string{"envuuid"}})
+	ms.managedResourceCollection.EnsureIndex(mgo.Index{Key: []string{"resourceid"}})
+	// Data held inline is read by its storage path.
+	db.C(resourceCatalogCollection).EnsureIndex(mgo.Index{Key: []string{"path"}})
+	db.C(resourceVersionCollection).EnsureIndex(mgo.Index{Key: []string{"path"}})
+	db.C(uploadProgressCollection).EnsureIndex(mgo.Index{Key: []string{"path"}})
+	return ms, nil
+}
+
+// ErrStoreClosed is used to indicate that an operation
+// was attempted on a ManagedStorage which has been closed.
+var ErrStoreClosed = fmt.Errorf("store closed")
+
+// checkOpen returns ErrStoreClosed if the storage has been closed.
+func (ms *managedStorage) checkOpen() error {
+	if atomic.LoadInt32(&ms.closed) != 0 {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// Close is defined on the ManagedStorage interface.
+func (ms *managedStorage) Close() error {
+	if !atomic.CompareAndSwapInt32(&ms.closed, 0, 1) {
+		return nil
+	}
+	// Outstanding put requests can no longer be responded to.
+	ms.requestMutex.Lock()
+	if ms.pollTimer != nil {
+		ms.pollTimer.Stop()
+		ms.pollTimer = nil
+	}
+	ms.queuedRequests = make(map[int64]PutRequest)
+	ms.requestMutex.Unlock()
+
+	if closer, ok := ms.resourceStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return errors.Annotate(err, "cannot close resource storage")
+		}
+	}
+	return nil
 }
 
 // resourceStoragePath returns the full path used to store a resource with resourcePath
@@ -116,74 +532,674 @@ func (ms *managedStorage) resourceStoragePath(envUUID, user, resourcePath string
 	return storagePath, nil
 }
 
-// preprocessUpload pulls in data from the reader, storing it in a temp file and
-// calculating the sha384 checksum.
-// The caller is expected to remove the temporary file if and only if we return a nil error.
-func (ms *managedStorage) preprocessUpload(r io.Reader, length int64) (
-	f *os.File, n int64, hash string, err error,
+// preprocessUpload pulls in data from the reader, storing it in an upload buffer and
+// calculating its checksum using the storage's hash algorithm. If length is
+// non-negative, the reader must yield exactly that many bytes.
+// The caller is expected to close the buffer if and only if we return a nil error.
+func (ms *managedStorage) preprocessUpload(r io.Reader, length int64, trustedHash string) (
+	b *uploadBuffer, n int64, hash string, err error,
 ) {
-	sha384hash := sha512.New384()
-	// Set up a chain of readers to pull in the data and calculate the checksum.
-	rdr := io.TeeReader(r, sha384hash)
-	f, err = ioutil.TempFile(os.TempDir(), "juju-resource")
-	if err != nil {
-		return nil, -1, "", err
+	// Set up a chain of readers to pull in the data and calculate the checksum,
+	// unless the caller vouches for it.
+	rdr, dataHash := ms.hashAlgorithm.NewHashingReader(r)
+	if trustedHash != "" {
+		rdr, dataHash = r, func() string { return trustedHash }
 	}
-	tempFilename := f.Name()
-	// Add a cleanup function to remove the data file if we exit with an error.
+	b = newUploadBuffer(ms.uploadBufferSize, ms.tempDir)
+	// Release the buffer if we exit with an error.
 	defer func() {
 		if err != nil {
-			f.Close()
-			os.Remove(tempFilename)
+			b.Close()
 		}
 	}()
 	if length >= 0 {
 		rdr = &io.LimitedReader{rdr, length}
 	}
-	// Write the data to a temp file.
-	length, err = io.Copy(f, rdr)
+	// Write the data to the buffer; io.Copy uses the buffer's ReadFrom
+	// method, so the data is read straight into memory or the spill file.
+	n, err = io.Copy(b, rdr)
 	if err != nil {
 		return nil, -1, "", err
 	}
-	// Reset the file so when we return it, it can be read from to get the data.
-	_, err = f.Seek(0, 0)
-	if err != nil {
+	if length >= 0 {
+		if n != length {
+			return nil, -1, "", errors.Errorf("expected %d bytes, got %d", length, n)
+		}
+		// Ensure the reader has nothing more to yield. Reading a single
+		// byte is enough to detect excess, without consuming the rest
+		// of what may be an arbitrarily long stream.
+		if extra, err := io.CopyN(ioutil.Discard, r, 1); err != nil && err != io.EOF {
+			return nil, -1, "", err
+		} else if extra > 0 {
+			return nil, -1, "", errors.Errorf("expected %d bytes, got more", length)
+		}
+	}
+	// Prepare the buffer so when we return it, it can be read from to get the data.
+	if err = b.finishWrite(); err != nil {
 		return nil, -1, "", err
 	}
-	return f, length, fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+	return b, n, dataHash(), nil
+}
+
+// contextReader wraps a reader so that reads fail
+// once the context is cancelled or its deadline passes.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read is defined on io.Reader.
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// teeReader is a reader which writes all the data it reads from r to w.
+// Unlike io.TeeReader, it records any error writing to w so that it can
+// be distinguished from an error reading from r.
+type teeReader struct {
+	r   io.Reader
+	w   io.Writer
+	err error
+}
+
+// Read is defined on io.Reader.
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.err = werr
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// contextReadCloser is a contextReader which also closes
+// the underlying reader.
+type contextReadCloser struct {
+	contextReader
+	io.Closer
 }
 
 // GetForEnvironment is defined on the ManagedStorage interface.
 func (ms *managedStorage) GetForEnvironment(envUUID, path string) (io.ReadCloser, int64, error) {
-	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	return ms.GetForEnvironmentWithContext(context.Background(), envUUID, path)
+}
+
+// GetForEnvironmentToWriter is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentToWriter(envUUID, path string, w io.Writer) (n int64, err error) {
+	r, length, err := ms.get(context.Background(), envUUID, "", path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := r.Close(); closeErr != nil && err == nil {
+			err = errors.Annotatef(closeErr, "cannot close resource at path %q", path)
+		}
+	}()
+	n, err = io.Copy(w, r)
+	if err != nil {
+		return n, errors.Annotatef(err, "cannot copy resource at path %q", path)
+	}
+	if n != length {
+		return n, errors.Errorf("expected %d bytes for resource at path %q, read %d", length, path, n)
+	}
+	return n, nil
+}
+
+// GetForEnvironmentWithContext is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentWithContext(ctx context.Context, envUUID, path string) (io.ReadCloser, int64, error) {
+	return ms.get(ctx, envUUID, "", path)
+}
+
+// GetForUser is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForUser(user, path string) (io.ReadCloser, int64, error) {
+	return ms.get(context.Background(), "", user, path)
+}
+
+// GetGlobal is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetGlobal(path string) (io.ReadCloser, int64, error) {
+	return ms.get(context.Background(), "", "", path)
+}
+
+// get is the internal implementation of the Get methods, returning
+// a reader for the data at path namespaced to envUUID and user.
+func (ms *managedStorage) get(ctx context.Context, envUUID, user, path string) (io.ReadCloser, int64, error) {
+	rdr, length, err := ms.getUnthrottled(ctx, envUUID, user, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ms.throttleReadCloser(ctx, rdr), length, nil
+}
+
+// getUnthrottled is the same as get except that
+// reads are not limited to the throttle rate.
+func (ms *managedStorage) getUnthrottled(ctx context.Context, envUUID, user, path string) (rc io.ReadCloser, length int64, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	defer func() {
+		rc = ms.observeGet(start, rc, length, err)
+	}()
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, user, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	rdr, length, err := ms.getResource(ctx, resourceId, managedPath)
+	if errors.IsNotFound(err) {
+		// The data may have been merged into another catalog
+		// entry since the record was read; if so, read it from there.
+		if newId, idErr := ms.resourceIdForPath(managedPath); idErr == nil && newId != resourceId {
+			rdr, length, err = ms.getResource(ctx, newId, managedPath)
+		}
+	}
 	if err != nil {
 		return nil, 0, err
 	}
+	if ctx.Done() != nil {
+		rdr = &contextReadCloser{contextReader{ctx, rdr}, rdr}
+	}
+	return rdr, length, nil
+}
+
+// StatForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) StatForEnvironment(envUUID, path string) (Metadata, error) {
+	if err := ms.checkOpen(); err != nil {
+		return Metadata{}, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	doc, err := ms.managedResourceForPath(managedPath)
+	if err != nil {
+		return Metadata{}, err
+	}
+	r, err := ms.catalogEntry(doc.ResourceId, managedPath)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{
+		Length:        r.Length,
+		SHA384Hash:    r.SHA384Hash,
+		Hash:          r.Hash,
+		HashAlgorithm: r.HashAlgorithm,
+		ContentType:   doc.ContentType,
+		Filename:      doc.Filename,
+	}, nil
+}
+
+// ExistsForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ExistsForEnvironment(envUUID, path string) (bool, error) {
+	if err := ms.checkOpen(); err != nil {
+		return false, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return false, err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err == nil {
+		_, err = ms.catalogEntry(resourceId, managedPath)
+	}
+	if errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RefCountForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) RefCountForEnvironment(envUUID, path string) (int, error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return 0, err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return 0, err
+	}
+	count, err := ms.resourceCatalog.RefCount(resourceId)
+	if err != nil {
+		return 0, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", managedPath)
+	}
+	return count, nil
+}
+
+// resourceIdForPath returns the id of the resource catalog entry
+// referenced by the managed resource record at managedPath.
+func (ms *managedStorage) resourceIdForPath(managedPath string) (string, error) {
+	doc, err := ms.managedResourceForPath(managedPath)
+	if err != nil {
+		return "", err
+	}
+	return doc.ResourceId, nil
+}
+
+// managedResourceForPath returns the managed resource record for managedPath.
+func (ms *managedStorage) managedResourceForPath(managedPath string) (*managedResourceDoc, error) {
 	var doc managedResourceDoc
 	if err := ms.managedResourceCollection.Find(bson.D{{"path", managedPath}}).One(&doc); err != nil {
 		if err == mgo.ErrNotFound {
-			return nil, 0, errors.NotFoundf("resource at path %q", managedPath)
+			return nil, errors.NotFoundf("resource at path %q", managedPath)
 		}
-		return nil, 0, errors.Annotatef(err, "cannot load record for resource with path %q", managedPath)
+		return nil, errors.Annotatef(err, "cannot load record for resource with path %q", managedPath)
+	}
+	if doc.expired(ms.clock.Now()) {
+		// The record is yet to be purged.
+		return nil, errors.NotFoundf("resource at path %q", managedPath)
+	}
+	return &doc, nil
+}
+
+// ListForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ListForEnvironment(envUUID string) ([]ResourceInfo, error) {
+	return ms.ListForEnvironmentPrefix(envUUID, "")
+}
+
+// ListForEnvironmentPrefix is defined on the ManagedStorage interface.
+func (ms *managedStorage) ListForEnvironmentPrefix(envUUID, prefix string) ([]ResourceInfo, error) {
+	iter, err := ms.listForEnvironment(envUUID, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []ResourceInfo
+	var info ResourceInfo
+	for iter.Next(&info) {
+		result = append(result, info)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListForEnvironmentIter is defined on the ManagedStorage interface.
+func (ms *managedStorage) ListForEnvironmentIter(envUUID string) (ResourceInfoIterator, error) {
+	return ms.listForEnvironment(envUUID, "")
+}
+
+// listForEnvironment returns an iterator over the data stored for the
+// environment at paths starting with prefix.
+func (ms *managedStorage) listForEnvironment(envUUID, prefix string) (*resourceInfoIter, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	envPrefix, query, err := ms.environmentPathQuery(envUUID, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &resourceInfoIter{
+		ms:     ms,
+		prefix: envPrefix,
+		iter:   ms.managedResourceCollection.Find(query).Iter(),
+	}, nil
+}
+
+// environmentPathQuery returns a query matching the managed resource records
+// for the environment with paths starting with prefix, along with the prefix
+// of the managed paths of all of the environment's data.
+func (ms *managedStorage) environmentPathQuery(envUUID, prefix string) (string, bson.D, error) {
+	if envUUID == "" {
+		return "", nil, errors.NotValidf("empty environment UUID")
+	}
+	envPrefix, err := ms.resourceStoragePath(envUUID, "", "")
+	if err != nil {
+		return "", nil, err
+	}
+	// Paths are stored relative to the environment's prefix regardless of
+	// any leading "/", so the same is done for the prefix. The prefix is not
+	// cleaned, since any trailing "/" is significant. As the regular
+	// expression is anchored to the start of the path and otherwise only
+	// matches literal text, the query is satisfied using the path index.
+	pathPrefix := envPrefix + "/" + strings.TrimLeft(prefix, "/")
+	return envPrefix, bson.D{{"path", bson.RegEx{Pattern: "^" + regexp.QuoteMeta(pathPrefix)}}}, nil
+}
+
+// resourceInfoIter is a ResourceInfoIterator over the
+// managed resource records matching a query.
+type resourceInfoIter struct {
+	ms     *managedStorage
+	prefix string
+	iter   *mgo.Iter
+	err    error
+}
+
+// Next is defined on the ResourceInfoIterator interface.
+func (it *resourceInfoIter) Next(info *ResourceInfo) bool {
+	if it.err != nil {
+		return false
+	}
+	var doc managedResourceDoc
+	for it.iter.Next(&doc) {
+		result, ok, err := it.ms.resourceInfo(doc, it.prefix)
+		if err != nil {
+			it.err = err
+			return false
+		} else if !ok {
+			continue
+		}
+		*info = result
+		return true
+	}
+	return false
+}
+
+// resourceInfo returns information about the data referenced by the
+// managed resource record doc, whose path is made relative to prefix.
+// If the data is no longer visible, false is returned.
+func (ms *managedStorage) resourceInfo(doc managedResourceDoc, prefix string) (ResourceInfo, bool, error) {
+	if doc.expired(ms.clock.Now()) {
+		return ResourceInfo{}, false, nil
+	}
+	result := ResourceInfo{
+		Path:        strings.TrimPrefix(doc.Path, prefix),
+		ContentType: doc.ContentType,
+	}
+	r, err := ms.resourceCatalog.Get(doc.ResourceId)
+	if errors.IsNotFound(err) {
+		// The resource was removed while we were iterating.
+		return ResourceInfo{}, false, nil
+	} else if IsUploadPending(err) {
+		result.Pending = true
+	} else if err != nil {
+		return ResourceInfo{}, false, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", doc.Path)
+	} else {
+		result.Length = r.Length
+		result.SHA384Hash = r.SHA384Hash
+		result.Hash = r.Hash
+		result.HashAlgorithm = r.HashAlgorithm
+	}
+	return result, true, nil
+}
+
+// Close is defined on the ResourceInfoIterator interface.
+func (it *resourceInfoIter) Close() error {
+	if err := it.iter.Close(); err != nil && it.err == nil {
+		it.err = errors.Annotate(err, "cannot read managed resource records")
+	}
+	return it.err
+}
+
+// emptyResourcePath is the storage path recorded in the resource catalog
+// for empty data. Empty data is not written to the resource storage, since
+// some storage rejects it, so all empty data shares this path.
+const emptyResourcePath = "empty"
+
+// openStored returns a reader for the data at resourcePath
+// in the resource storage.
+func (ms *managedStorage) openStored(resourcePath string) (io.ReadCloser, error) {
+	return ms.openStoredWithContext(context.Background(), resourcePath)
+}
+
+// openStoredWithContext is the same as openStored except that, if the
+// resource storage must wait before opening the data, it stops waiting
+// once ctx is done.
+func (ms *managedStorage) openStoredWithContext(ctx context.Context, resourcePath string) (io.ReadCloser, error) {
+	if resourcePath == emptyResourcePath {
+		return memReader{bytes.NewReader(nil)}, nil
+	}
+	if isInlinePath(resourcePath) {
+		return ms.openInline(ms.db, resourcePath)
+	}
+	if stor, ok := ms.resourceStore.(ResourceStorageWithContext); ok {
+		return stor.GetWithContext(ctx, resourcePath)
+	}
+	return ms.resourceStore.Get(resourcePath)
+}
+
+// putStored writes length bytes of data from r to resourcePath in the
+// resource storage. If the resource storage must wait before writing
+// the data, it stops waiting once ctx is done.
+func (ms *managedStorage) putStored(ctx context.Context, resourcePath string, r io.Reader, length int64) error {
+	if stor, ok := ms.resourceStore.(ResourceStorageWithContext); ok {
+		_, err := stor.PutWithContext(ctx, resourcePath, r, length)
+		return err
 	}
-	return ms.getResource(doc.ResourceId, managedPath)
+	_, err := ms.resourceStore.Put(resourcePath, r, length)
+	return err
+}
+
+// removeStored removes the data at resourcePath from the resource storage.
+func (ms *managedStorage) removeStored(resourcePath string) error {
+	if resourcePath == emptyResourcePath || isInlinePath(resourcePath) {
+		// There is no data held in the resource storage; data held
+		// inline is removed along with its catalog entry.
+		return nil
+	}
+	return ms.resourceStore.Remove(resourcePath)
 }
 
 // getResource returns a reader for the resource with the given resource id.
-func (ms *managedStorage) getResource(resourceId string, path string) (io.ReadCloser, int64, error) {
-	r, err := ms.resourceCatalog.Get(resourceId)
-	if err == ErrUploadPending {
+func (ms *managedStorage) getResource(ctx context.Context, resourceId string, path string) (io.ReadCloser, int64, error) {
+	r, err := ms.catalogEntry(resourceId, path)
+	if err != nil {
 		return nil, 0, err
-	} else if err != nil {
-		return nil, 0, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", path)
 	}
-	rdr, err := ms.resourceStore.Get(r.Path)
+	rdr, err := ms.openStoredWithContext(ctx, r.Path)
 	return rdr, r.Length, err
 }
 
+// catalogEntry returns the resource catalog entry with the given
+// resource id, which is referenced by the managed resource at path.
+func (ms *managedStorage) catalogEntry(resourceId string, path string) (*Resource, error) {
+	r, err := ms.resourceCatalog.Get(resourceId)
+	if IsUploadPending(err) {
+		return nil, uploadPendingError(ms.db, resourceId, path, ms.clock.Now())
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", path)
+	}
+	return r, nil
+}
+
+// uploadPendingError returns the error used to indicate that the upload of
+// the resource with the given id, referenced by the managed resource at path,
+// is not complete at the given time.
+func uploadPendingError(db *mgo.Database, resourceId, path string, now time.Time) error {
+	var doc resourceDoc
+	if err := db.C(resourceCatalogCollection).FindId(resourceId).Select(bson.D{{"created", 1}}).One(&doc); err != nil {
+		// The time the upload started is only informative.
+		logger.Debugf("cannot read start of upload for resource with path %q: %v", path, err)
+	}
+	pendingErr := doc.uploadPendingError(now)
+	pendingErr.Path = path
+	return pendingErr
+}
+
+// GetForEnvironmentVerified is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentVerified(envUUID, path string) (rc io.ReadCloser, length int64, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	defer func() {
+		rc = ms.observeGet(start, rc, length, err)
+	}()
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, 0, err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := ms.catalogEntry(resourceId, managedPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	rdr, err := ms.openStored(r.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &verifyingReader{
+		ReadCloser: ms.throttleReadCloser(context.Background(), rdr),
+		path:       managedPath,
+		hash:       r.HashAlgorithm.New(),
+		expected:   r.Hash,
+	}, r.Length, nil
+}
+
+// GetForEnvironmentIfChanged is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentIfChanged(
+	envUUID, path, knownHash string,
+) (rc io.ReadCloser, length int64, hash string, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, "", err
+	}
+	start := time.Now()
+	defer func() {
+		// Nothing is opened if the data is not modified.
+		if errors.Cause(err) != ErrNotModified {
+			rc = ms.observeGet(start, rc, length, err)
+		}
+	}()
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	r, err := ms.catalogEntry(resourceId, managedPath)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if knownHash != "" && knownHash == r.Hash {
+		return nil, 0, r.Hash, errors.Annotatef(ErrNotModified, "resource at path %q", managedPath)
+	}
+	rdr, err := ms.openStored(r.Path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return ms.throttleReadCloser(context.Background(), rdr), r.Length, r.Hash, nil
+}
+
+// storedContentType returns the MIME type of the
+// data at resourcePath in the resource storage.
+func (ms *managedStorage) storedContentType(resourcePath string) (string, error) {
+	rdr, err := ms.openStored(resourcePath)
+	if err != nil {
+		return "", errors.Annotatef(err, "cannot read resource at storage path %q", resourcePath)
+	}
+	defer rdr.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(rdr, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", errors.Annotatef(err, "cannot read resource at storage path %q", resourcePath)
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// ErrOutOfRange is used to indicate that a requested byte
+// range extends beyond the end of the stored data.
+var ErrOutOfRange = fmt.Errorf("range out of bounds")
+
+// GetRangeForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetRangeForEnvironment(envUUID, path string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, errors.NotValidf("range with offset %d and length %d", offset, length)
+	}
+	rdr, size, err := ms.get(context.Background(), envUUID, "", path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > size || length > size-offset {
+		rdr.Close()
+		return nil, errors.Annotatef(ErrOutOfRange, "range with offset %d and length %d of %d bytes at path %q", offset, length, size, path)
+	}
+	// Seek if we can, so that storage such as GridFS can go straight to
+	// the relevant chunk rather than reading from the start of the data.
+	if seeker, ok := rdr.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, rdr, offset)
+	}
+	if err != nil {
+		rdr.Close()
+		return nil, errors.Annotatef(err, "cannot seek to offset %d of data at path %q", offset, path)
+	}
+	return &rangeReadCloser{io.LimitReader(rdr, length), rdr}, nil
+}
+
+// GetSeekerForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetSeekerForEnvironment(envUUID, path string) (ReadSeekCloser, int64, error) {
+	rdr, length, err := ms.get(context.Background(), envUUID, "", path)
+	if err != nil {
+		return nil, 0, err
+	}
+	seeker, ok := rdr.(ReadSeekCloser)
+	if !ok {
+		rdr.Close()
+		return nil, 0, errors.NotSupportedf("seeking within data at path %q", path)
+	}
+	return seeker, length, nil
+}
+
+// rangeReadCloser is a reader over a range of data,
+// which closes the reader for all of the data.
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ErrChecksumMismatch is used to indicate that stored data does not
+// match the checksum recorded for it in the resource catalog.
+var ErrChecksumMismatch = fmt.Errorf("checksum mismatch")
+
+// verifyingReader calculates the hash of the data read through it,
+// and checks it against the expected hash once the end of the data is reached.
+type verifyingReader struct {
+	io.ReadCloser
+	path     string
+	hash     hash.Hash
+	expected string
+	err      error
+}
+
+// Read is defined on io.Reader.
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := fmt.Sprintf("%x", r.hash.Sum(nil)); actual != r.expected {
+			r.err = errors.Annotatef(ErrChecksumMismatch, "resource at path %q", r.path)
+			return n, r.err
+		}
+	}
+	return n, err
+}
+
+// Close is defined on io.Closer. If the data was read to the end and
+// did not match the expected hash, the mismatch error is returned.
+func (r *verifyingReader) Close() error {
+	if err := r.ReadCloser.Close(); err != nil {
+		return err
+	}
+	return r.err
+}
+
 // cleanupResourceCatalog is used to delete a resource catalog record if a put operation fails.
 func cleanupResourceCatalog(rc ResourceCatalog, id string, err *error) {
-	if *err == nil || errors.Cause(*err) == ErrUploadPending {
+	if *err == nil || IsUploadPending(*err) {
 		return
 	}
 	logger.Warningf("cleaning up resource catalog after failed put")
@@ -208,61 +1224,343 @@ func cleanupResource(rs ResourceStorage, resourcePath string, err *error) {
 }
 
 // PutForEnvironmentAndCheckHash is defined on the ManagedStorage interface.
-func (ms *managedStorage) PutForEnvironmentAndCheckHash(envUUID, path string, r io.Reader, length int64, checkHash string) error {
-	return ms.putForEnvironment(envUUID, path, r, length, checkHash)
+func (ms *managedStorage) PutForEnvironmentAndCheckHash(envUUID, path string, r io.Reader, length int64, checkHash string) (err error) {
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{checkHash: checkHash})
+	return err
 }
 
 // PutForEnvironment is defined on the ManagedStorage interface.
 func (ms *managedStorage) PutForEnvironment(envUUID, path string, r io.Reader, length int64) error {
-	return ms.putForEnvironment(envUUID, path, r, length, "")
+	return ms.PutForEnvironmentWithContext(context.Background(), envUUID, path, r, length)
+}
+
+// PutForEnvironmentWithContext is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentWithContext(ctx context.Context, envUUID, path string, r io.Reader, length int64) (err error) {
+	_, err = ms.put(ctx, envUUID, "", path, r, length, putOptions{})
+	return err
+}
+
+// PutForEnvironmentReturningHash is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentReturningHash(envUUID, path string, r io.Reader, length int64) (string, error) {
+	return ms.put(context.Background(), envUUID, "", path, r, length, putOptions{})
+}
+
+// PutForEnvironmentWithMeta is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentWithMeta(envUUID, path string, r io.Reader, length int64, meta PutMeta) (err error) {
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{
+		contentType: meta.ContentType,
+		filename:    meta.Filename,
+	})
+	return err
+}
+
+// PutForEnvironmentTee is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentTee(envUUID, path string, r io.Reader, length int64, tee io.Writer) (err error) {
+	if tee == nil {
+		return errors.NotValidf("nil tee writer")
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{tee: tee})
+	return err
+}
+
+// PutForEnvironmentWithTTL is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentWithTTL(envUUID, path string, r io.Reader, length int64, ttl time.Duration) (err error) {
+	if ttl <= 0 {
+		return errors.NotValidf("TTL %v", ttl)
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{
+		expiryTime: ms.clock.Now().Add(ttl),
+	})
+	return err
+}
+
+// PutForEnvironmentIfAbsent is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentIfAbsent(envUUID, path string, r io.Reader, length int64) (err error) {
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{
+		condition: ifAbsent(path),
+	})
+	return err
+}
+
+// PutForEnvironmentIfMatch is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentIfMatch(envUUID, path, expectedHash string, r io.Reader, length int64) (err error) {
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{
+		condition: ifMatch(path, resourceDocId(ms.hashAlgorithm, expectedHash)),
+	})
+	return err
+}
+
+// PutForUser is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForUser(user, path string, r io.Reader, length int64) (err error) {
+	_, err = ms.put(context.Background(), "", user, path, r, length, putOptions{})
+	return err
+}
+
+// PutForUserAndCheckHash is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForUserAndCheckHash(user, path string, r io.Reader, length int64, checkHash string) (err error) {
+	_, err = ms.put(context.Background(), "", user, path, r, length, putOptions{checkHash: checkHash})
+	return err
+}
+
+// PutGlobal is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutGlobal(path string, r io.Reader, length int64) (err error) {
+	_, err = ms.put(context.Background(), "", "", path, r, length, putOptions{})
+	return err
+}
+
+// PutGlobalAndCheckHash is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutGlobalAndCheckHash(path string, r io.Reader, length int64, checkHash string) (err error) {
+	_, err = ms.put(context.Background(), "", "", path, r, length, putOptions{checkHash: checkHash})
+	return err
+}
+
+// putOptions holds the optional parameters of a put.
+type putOptions struct {
+	// checkHash, if non-empty, is the expected hash of the data.
+	checkHash string
+
+	// trustedHash, if non-empty, is the hash of the data, which
+	// is recorded without being calculated.
+	trustedHash string
+
+	// contentType is the MIME type of the data.
+	// If empty, it is detected from the data.
+	contentType string
+
+	// filename, if non-empty, is the name of
+	// the file the data is stored from.
+	filename string
+
+	// expiryTime, if non-zero, is the time after
+	// which the data is no longer visible.
+	expiryTime time.Time
+
+	// condition, if non-nil, must allow any data
+	// already at the path to be replaced.
+	condition putCondition
+
+	// tee, if non-nil, is written a copy of the data as it is read.
+	tee io.Writer
+
+	// labels holds the labels to record against the path.
+	labels map[string]string
+
+	// progress, if non-nil, records the progress of the put.
+	progress *uploadProgress
+
+	// progressFunc, if non-nil, is called with the number of
+	// bytes read as the data is read.
+	progressFunc func(bytesWritten int64)
+
+	// swap, if true, causes the reference to any data replaced at the
+	// path to be released in the same transaction as the path is pointed
+	// at the new data, and the replaced data to be left for garbage
+	// collection; see SwapForEnvironment.
+	swap bool
+
+	// version, if non-nil, causes a version of the path to be
+	// recorded for the data, whose number is stored in it.
+	version *int
 }
 
-// putForEnvironment is the internal implementation for both the above
-// methods. It checks the hash if checkHash is non-nil.
-func (ms *managedStorage) putForEnvironment(envUUID, path string, r io.Reader, length int64, checkHash string) (putError error) {
-	dataFile, length, hash, err := ms.preprocessUpload(r, length)
+// put is the internal implementation for the above methods,
+// storing data at path namespaced to envUUID and user, and returning
+// the hash of the stored data.
+func (ms *managedStorage) put(ctx context.Context, envUUID, user, path string, r io.Reader, length int64, opts putOptions) (string, error) {
+	if err := ms.checkOpen(); err != nil {
+		return "", err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, user, path)
+	if err != nil {
+		return "", err
+	}
+	opts.progress = ms.startProgress(managedPath, length)
+	defer opts.progress.finish()
+	hash, length, err := ms.store(ctx, envUUID, user, path, r, length, opts)
 	if err != nil {
-		return errors.Annotate(err, "cannot calculate data checksums")
+		return "", err
+	}
+	// The put is audited once it is committed, and any failures to store
+	// the data have been cleaned up.
+	return hash, ms.audit(AuditEvent{
+		Operation:     AuditPut,
+		EnvUUID:       envUUID,
+		User:          user,
+		Path:          path,
+		Hash:          hash,
+		HashAlgorithm: ms.hashAlgorithm,
+		Length:        length,
+	})
+}
+
+// store stores the data for put, returning its hash and length.
+func (ms *managedStorage) store(
+	ctx context.Context, envUUID, user, path string, r io.Reader, length int64, opts putOptions,
+) (_ string, _ int64, putError error) {
+	if err := ms.checkOpen(); err != nil {
+		return "", 0, err
+	}
+	if opts.checkHash != "" {
+		// Check the hash is well formed before reading any data, so
+		// that the caller is not left with a confusing mismatch.
+		if err := ms.hashAlgorithm.checkHashFormat(opts.checkHash); err != nil {
+			return "", 0, err
+		}
 	}
-	// Remove the data file when we're done.
+	start := time.Now()
+	var received int64
+	var deduplicated bool
 	defer func() {
-		dataFile.Close()
-		os.Remove(dataFile.Name())
+		ms.observer.ObservePut(received, deduplicated, time.Since(start), putError)
 	}()
-	if checkHash != "" && checkHash != hash {
-		return errors.New("hash mismatch")
+	if opts.condition != nil {
+		// Check the condition up front to avoid storing data needlessly.
+		// It is checked again when the data is recorded at the path.
+		managedPath, err := ms.resourceStoragePath(envUUID, user, path)
+		if err != nil {
+			return "", 0, err
+		}
+		if _, err := ms.checkPutCondition(managedPath, opts.condition); err != nil {
+			return "", 0, err
+		}
+	}
+	if ctx.Done() != nil {
+		r = &contextReader{ctx, r}
+	}
+	if opts.progress != nil {
+		r = opts.progress.reader(r)
+	}
+	var progressFunc *progressFuncReader
+	if opts.progressFunc != nil {
+		progressFunc = &progressFuncReader{r: r, progress: opts.progressFunc}
+		r = progressFunc
+	}
+	var tee *teeReader
+	if opts.tee != nil {
+		tee = &teeReader{r: r, w: opts.tee}
+		r = tee
+	}
+	crc := newCRC32C()
+	dataFile, length, hash, err := ms.preprocessUpload(io.TeeReader(r, crc), length, opts.trustedHash)
+	if tee != nil && tee.err != nil {
+		// The data is written to the tee before anything is stored,
+		// so there is nothing to roll back.
+		return "", 0, errors.Annotate(tee.err, "cannot write data to tee")
+	}
+	if err != nil {
+		return "", 0, errors.Annotate(err, "cannot calculate data checksums")
+	}
+	received = length
+	if progressFunc != nil {
+		progressFunc.finish()
+	}
+	// Release the buffered data when we're done.
+	defer dataFile.Close()
+	if opts.checkHash != "" && opts.checkHash != hash {
+		return "", 0, errors.New("hash mismatch")
+	}
+	if err := ms.checkQuota(envUUID, hash, length); err != nil {
+		return "", 0, err
+	}
+	if err := ms.verifyDedup(hash, length); err != nil {
+		return "", 0, err
+	}
+	contentType := opts.contentType
+	if contentType == "" {
+		if contentType, err = detectContentType(dataFile); err != nil {
+			return "", 0, errors.Annotate(err, "cannot detect content type")
+		}
 	}
 	resourceId, resourcePath, err := ms.resourceCatalog.Put(hash, length)
 	if err != nil {
-		return errors.Annotate(err, "cannot update resource catalog")
+		return "", 0, errors.Annotate(err, "cannot update resource catalog")
 	}
 
 	logger.Debugf("resource catalog entry created with id %q", resourceId)
 	// If there's an error saving the resource data, ensure the resource catalog is cleaned up.
 	defer cleanupResourceCatalog(ms.resourceCatalog, resourceId, &putError)
 
-	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	managedPath, err := ms.resourceStoragePath(envUUID, user, path)
 	if err != nil {
-		return err
+		return "", 0, err
 	}
 
-	// Newly added resource data needs to be saved to the storage.
-	if resourcePath == "" {
+	if resourcePath == "" && length != 0 {
+		// Another put may be uploading the same data; if so,
+		// wait for it to finish rather than uploading it again.
+		var finished func()
+		resourcePath, finished, err = ms.awaitLocalUpload(ctx, hash, resourceId)
+		if err != nil {
+			return "", 0, errors.Annotatef(err, "cannot wait for concurrent upload of resource %q", managedPath)
+		}
+		if finished != nil {
+			defer finished()
+		}
+	}
+	// pendingPath is the storage path to which this put uploads
+	// the data, should it be held in the resource storage.
+	var pendingPath string
+	if resourcePath == "" && length > ms.inlineThreshold {
+		// A put in another process may be uploading the same data;
+		// if so, wait for it to finish rather than uploading it again.
 		uuid, err := utils.NewUUID()
 		if err != nil {
-			return errors.Annotate(err, "cannot generate UUID to store resource")
+			return "", 0, errors.Annotate(err, "cannot generate UUID to store resource")
 		}
-		resourcePath = uuid.String()
-
-		_, err = ms.resourceStore.Put(resourcePath, dataFile, length)
+		pendingPath = uuid.String()
+		var leased bool
+		resourcePath, leased, err = ms.awaitUploadLease(ctx, resourceId, pendingPath)
+		if err != nil {
+			return "", 0, errors.Annotatef(err, "cannot wait for concurrent upload of resource %q", managedPath)
+		}
+		if leased {
+			defer func() {
+				if putError != nil {
+					ms.releaseUploadLease(resourceId, pendingPath)
+				}
+			}()
+		}
+	}
+	// uploaded records whether the data stored is that read by this put.
+	uploaded := false
+	if resourcePath == "" && length == 0 {
+		// Empty data is not saved to the storage, so the upload is complete.
+		err = ms.resourceCatalog.UploadComplete(resourceId, emptyResourcePath)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return "", 0, errors.Annotatef(err, "cannot mark resource %q as upload complete", managedPath)
+		}
+		uploaded, resourcePath = err == nil, emptyResourcePath
+	} else if resourcePath == "" && length <= ms.inlineThreshold {
+		// Small data is held in the resource catalog entry itself.
+		resourcePath, err = ms.storeInline(resourceId, dataFile, length)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return "", 0, errors.Annotatef(err, "cannot store resource %q inline", managedPath)
+		}
+		uploaded = err == nil
+	} else if resourcePath == "" {
+		// Newly added resource data needs to be saved to the storage.
+		resourcePath = pendingPath
+		var dataRdr io.Reader = dataFile
+		if ctx.Done() != nil {
+			dataRdr = &contextReader{ctx, dataFile}
+		}
+		dataRdr = ms.throttle(ctx, dataRdr)
+		if opts.progress != nil {
+			dataRdr = opts.progress.keepAlive(dataRdr, length)
+		}
+		err = ms.putStored(ctx, resourcePath, dataRdr, length)
 		if err != nil {
-			return errors.Annotatef(err, "cannot add resource %q to store at storage path %q", managedPath, resourcePath)
+			return "", 0, errors.Annotatef(err, "cannot add resource %q to store at storage path %q", managedPath, resourcePath)
 		}
 
 		// If there's an error from here on, we need to ensure the saved resource data is cleaned up.
 		defer cleanupResource(ms.resourceStore, resourcePath, &putError)
 		err = ms.resourceCatalog.UploadComplete(resourceId, resourcePath)
-		if errors.IsAlreadyExists(err) {
+		if errors.IsAlreadyExists(err) && ms.completedAt(resourceId, resourcePath) {
+			// FinalizePendingUploads found the data we stored
+			// and recorded it as complete on our behalf.
+			uploaded = true
+		} else if errors.IsAlreadyExists(err) {
 			// Another client uploaded the resource and recorded it in the
 			// catalog before us, so remove the resource we just stored.
 			if err := ms.resourceStore.Remove(resourcePath); err != nil {
@@ -273,30 +1571,255 @@ func (ms *managedStorage) putForEnvironment(envUUID, path string, r io.Reader, l
 				)
 			}
 		} else if err != nil {
-			return errors.Annotatef(err, "cannot mark resource %q as upload complete", managedPath)
+			return "", 0, errors.Annotatef(err, "cannot mark resource %q as upload complete", managedPath)
+		} else {
+			uploaded = true
+		}
+	}
+	deduplicated = !uploaded
+	if uploaded && opts.trustedHash != "" {
+		if err := ms.markUnverified(resourceId, resourcePath); err != nil {
+			return "", 0, errors.Annotatef(err, "cannot record trusted hash of resource %q", managedPath)
+		}
+	}
+	if err := ms.recordCRC32C(resourceId, fmt.Sprintf("%x", crc.Sum(nil))); err != nil {
+		return "", 0, errors.Annotatef(err, "cannot record CRC-32C of resource %q", managedPath)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	if opts.version != nil {
+		// The version holds its own reference to the resource.
+		if _, _, err := ms.resourceCatalog.Put(hash, length); err != nil {
+			return "", 0, errors.Annotate(err, "cannot update resource catalog")
+		}
+		defer cleanupResourceCatalog(ms.resourceCatalog, resourceId, &putError)
+		version, err := ms.addVersion(managedPath, resourceId)
+		if err != nil {
+			return "", 0, errors.Annotatef(err, "cannot record version of resource %q", managedPath)
+		}
+		defer ms.cleanupVersion(managedPath, version, &putError)
+		*opts.version = version
+	}
+	// Resource data is saved, resource catalog entry is created/updated, now write the
+	// managed storage entry.
+	managedResource := ManagedResource{
+		EnvUUID:     envUUID,
+		User:        user,
+		Path:        managedPath,
+		ContentType: contentType,
+		Filename:    opts.filename,
+		ExpiryTime:  opts.expiryTime,
+		Labels:      opts.labels,
+	}
+	if opts.swap {
+		if err := ms.swapResourceReference(managedResource, resourceId); err != nil {
+			return "", 0, err
+		}
+	} else if err := ms.putResourceReference(managedResource, resourceId, opts.condition); err != nil {
+		return "", 0, err
+	}
+	return hash, length, nil
+}
+
+// detectContentType returns the MIME type of the data in f,
+// as determined by http.DetectContentType.
+func detectContentType(f io.ReaderAt) (string, error) {
+	buf := make([]byte, 512)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// CopyForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) CopyForEnvironment(envUUID, srcPath, dstPath string) (err error) {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	srcManagedPath, err := ms.resourceStoragePath(envUUID, "", srcPath)
+	if err != nil {
+		return err
+	}
+	dstManagedPath, err := ms.resourceStoragePath(envUUID, "", dstPath)
+	if err != nil {
+		return err
+	}
+	srcDoc, err := ms.managedResourceForPath(srcManagedPath)
+	if err != nil {
+		return err
+	}
+	resourceId := srcDoc.ResourceId
+	r, err := ms.catalogEntry(resourceId, srcManagedPath)
+	if err != nil {
+		return err
+	}
+
+	// Increment the resource catalog reference count. The entry is
+	// referenced by id, since it may have been hashed with a different
+	// algorithm from the one now configured.
+	resourcePath, err := ms.resourceCatalog.AddRef(resourceId)
+	if errors.IsNotFound(err) {
+		// The entry has been deleted from underneath us.
+		return ErrResourceDeleted
+	} else if err != nil {
+		return errors.Annotate(err, "cannot update resource catalog")
+	}
+	defer cleanupResourceCatalog(ms.resourceCatalog, resourceId, &err)
+	if resourcePath == "" {
+		return ErrResourceDeleted
+	}
+	// The copy does not inherit any expiry time of the source.
+	if err := ms.putResourceReference(ManagedResource{
+		EnvUUID:     envUUID,
+		Path:        dstManagedPath,
+		ContentType: srcDoc.ContentType,
+		Filename:    srcDoc.Filename,
+		Labels:      srcDoc.Labels,
+	}, resourceId, nil); err != nil {
+		return err
+	}
+	event := AuditEvent{
+		Operation:  AuditCopy,
+		EnvUUID:    envUUID,
+		Path:       dstPath,
+		SourcePath: srcPath,
+		Length:     r.Length,
+	}
+	event.Hash, event.HashAlgorithm = resourceIdHash(resourceId)
+	return ms.audit(event)
+}
+
+// MoveForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) MoveForEnvironment(envUUID, srcPath, dstPath string) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	srcManagedPath, err := ms.resourceStoragePath(envUUID, "", srcPath)
+	if err != nil {
+		return err
+	}
+	dstManagedPath, err := ms.resourceStoragePath(envUUID, "", dstPath)
+	if err != nil {
+		return err
+	}
+	if srcManagedPath == dstManagedPath {
+		return nil
+	}
+	var resourceId string
+	var deletedPaths []string
+	buildTxn := func(attempt int) (ops []txn.Op, err error) {
+		resourceId, ops, deletedPaths, err = ms.moveResourceTxn(srcManagedPath, dstManagedPath)
+		return ops, err
+	}
+	txnRunner := txnRunner(ms.db)
+	if err := txnRunner.Run(buildTxn); err != nil {
+		if errors.IsNotFound(err) || errors.IsAlreadyExists(err) {
+			return err
+		}
+		return errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	for _, resourcePath := range deletedPaths {
+		if err := ms.removeStored(resourcePath); err != nil && !errors.IsNotFound(err) {
+			return errors.Annotatef(err, "cannot delete old version of resource %q at storage path %q", dstManagedPath, resourcePath)
+		}
+	}
+	event := AuditEvent{
+		Operation:  AuditMove,
+		EnvUUID:    envUUID,
+		Path:       dstPath,
+		SourcePath: srcPath,
+	}
+	event.Hash, event.HashAlgorithm = resourceIdHash(resourceId)
+	if ms.auditing() {
+		if r, err := ms.resourceCatalog.Get(resourceId); err == nil {
+			event.Length = r.Length
+		}
+	}
+	return ms.audit(event)
+}
+
+// GarbageCollect is defined on the ManagedStorage interface.
+func (ms *managedStorage) GarbageCollect(olderThan time.Duration) (int, error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, err
+	}
+	lister, ok := ms.resourceStore.(ResourceStorageLister)
+	if !ok {
+		return 0, errors.NotSupportedf("garbage collection with unlistable resource storage")
+	}
+	cutoff := ms.clock.Now().Add(-olderThan)
+	// Stored data is listed before loading the catalog so that any data
+	// whose upload completes in between is seen to be referenced.
+	stored, err := lister.List()
+	if err != nil {
+		return 0, errors.Annotate(err, "cannot list resource storage")
+	}
+	referenced, err := ms.referencedStoragePaths()
+	if err != nil {
+		return 0, err
+	}
+	removed, err := ms.expireUploadSessions()
+	if err != nil {
+		return removed, err
+	}
+	uploading, err := ms.uploadStoragePaths()
+	if err != nil {
+		return removed, err
+	}
+	for _, r := range stored {
+		if referenced[r.Path] || uploading[r.Path] || !r.Modified.Before(cutoff) {
+			continue
+		}
+		logger.Debugf("removing unreferenced resource at storage path %q", r.Path)
+		if err := ms.resourceStore.Remove(r.Path); err != nil && !errors.IsNotFound(err) {
+			return removed, errors.Annotatef(err, "cannot remove unreferenced resource at storage path %q", r.Path)
 		}
+		removed++
 	}
-	// Resource data is saved, resource catalog entry is created/updated, now write the
-	// managed storage entry.
-	return ms.putResourceReference(envUUID, managedPath, resourceId)
+	return removed, nil
 }
 
-// putResourceReference saves a managed resource record for the given path and resource id.
-func (ms *managedStorage) putResourceReference(envUUID, managedPath, resourceId string) error {
-	managedResource := ManagedResource{
-		EnvUUID: envUUID,
-		Path:    managedPath,
+// referencedStoragePaths returns the set of storage paths recorded
+// in the resource catalog, by completed uploads and by those in progress,
+// whose data may yet be recorded as complete by FinalizePendingUploads.
+func (ms *managedStorage) referencedStoragePaths() (map[string]bool, error) {
+	query := bson.D{{"$or", []bson.D{
+		{{"path", bson.D{{"$ne", ""}}}},
+		{{"pendingpath", bson.D{{"$exists", true}}}},
+	}}}
+	iter := ms.db.C(resourceCatalogCollection).Find(query).Select(bson.D{{"path", 1}, {"pendingpath", 1}}).Iter()
+	paths := make(map[string]bool)
+	var doc resourceDoc
+	for iter.Next(&doc) {
+		if doc.Path != "" {
+			paths[doc.Path] = true
+		}
+		if doc.PendingPath != "" {
+			paths[doc.PendingPath] = true
+		}
+		doc = resourceDoc{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource catalog")
 	}
-	existingResourceId, err := ms.putManagedResource(managedResource, resourceId)
+	return paths, nil
+}
+
+// putResourceReference saves a managed resource record referencing the given
+// resource id, provided cond, if non-nil, allows any existing record to be replaced.
+func (ms *managedStorage) putResourceReference(managedResource ManagedResource, resourceId string, cond putCondition) error {
+	existingResourceId, err := ms.putManagedResource(managedResource, resourceId, cond)
 	if err != nil {
 		return err
 	}
-	logger.Debugf("managed resource entry created with path %q -> %q", managedPath, resourceId)
+	logger.Debugf("managed resource entry created with path %q -> %q", managedResource.Path, resourceId)
 	// If we are overwriting an existing resource with the same path, the managed resource
 	// entry will no longer reference the same resource catalog entry, so we need to remove
-	// the reference.
+	// the reference, and the data if it was the last one.
 	if existingResourceId != "" {
-		if _, _, err = ms.resourceCatalog.Remove(existingResourceId); err != nil {
+		if err = ms.releaseResource(managedResource.Path, existingResourceId); err != nil {
 			return errors.Annotatef(err, "cannot remove old resource catalog entry with id %q", existingResourceId)
 		}
 	}
@@ -315,13 +1838,29 @@ var txnRunner = func(db *mgo.Database) jujutxn.Runner {
 
 // putManagedResource saves the managed resource record and returns the resource id of any
 // existing record with the same path.
-func (ms *managedStorage) putManagedResource(managedResource ManagedResource, resourceId string) (
+// If cond is non-nil, the record is only saved if cond allows the existing record
+// to be replaced.
+func (ms *managedStorage) putManagedResource(managedResource ManagedResource, resourceId string, cond putCondition) (
 	existingResourceId string, err error,
 ) {
 	buildTxn := func(attempt int) ([]txn.Op, error) {
 		var addManagedResourceOps []txn.Op
 		existingResourceId, addManagedResourceOps, err = ms.putResourceTxn(managedResource, resourceId)
-		return addManagedResourceOps, err
+		if err != nil || cond == nil {
+			return addManagedResourceOps, err
+		}
+		existing, err := ms.checkPutCondition(managedResource.Path, cond)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil && addManagedResourceOps[0].Update != nil {
+			// Ensure the record the condition was checked against is
+			// the one replaced. If the record has changed since it
+			// was read, the transaction is retried.
+			existingResourceId = existing.ResourceId
+			addManagedResourceOps[0].Assert = managedResourceUnchanged(*existing)
+		}
+		return addManagedResourceOps, nil
 	}
 
 	txnRunner := txnRunner(ms.db)
@@ -331,21 +1870,241 @@ func (ms *managedStorage) putManagedResource(managedResource ManagedResource, re
 	return existingResourceId, nil
 }
 
+// putCondition returns an error if a put may not replace the managed
+// resource record current, which is nil if there is no visible record.
+type putCondition func(current *managedResourceDoc) error
+
+// ifAbsent is a putCondition which only allows data
+// to be stored at path if there is nothing there yet.
+func ifAbsent(path string) putCondition {
+	return func(current *managedResourceDoc) error {
+		if current != nil {
+			return errors.AlreadyExistsf("resource at path %q", path)
+		}
+		return nil
+	}
+}
+
+// ErrPreconditionFailed is used to indicate that a conditional
+// put was not made because its condition was not satisfied.
+var ErrPreconditionFailed = fmt.Errorf("precondition failed")
+
+// ErrNotModified is used to indicate that data was not returned
+// because it has the hash the caller already knows.
+var ErrNotModified = fmt.Errorf("not modified")
+
+// ifMatch is a putCondition which only allows data to be stored at path
+// if the data already there has the given resource catalog id.
+func ifMatch(path, resourceId string) putCondition {
+	return func(current *managedResourceDoc) error {
+		if current == nil {
+			return errors.Annotatef(ErrPreconditionFailed, "resource at path %q does not exist", path)
+		}
+		if current.ResourceId != resourceId {
+			return errors.Annotatef(ErrPreconditionFailed, "resource at path %q has changed", path)
+		}
+		return nil
+	}
+}
+
+// checkPutCondition checks cond against the managed resource record at
+// managedPath, returning the record, including any which has expired,
+// or nil if there is none.
+func (ms *managedStorage) checkPutCondition(managedPath string, cond putCondition) (*managedResourceDoc, error) {
+	var doc managedResourceDoc
+	err := ms.managedResourceCollection.FindId(managedPath).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, cond(nil)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot load record for resource with path %q", managedPath)
+	}
+	current := &doc
+	if doc.expired(ms.clock.Now()) {
+		current = nil
+	}
+	if err := cond(current); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
 // RemoveForEnvironment is defined on the ManagedStorage interface.
-func (ms *managedStorage) RemoveForEnvironment(envUUID, path string) (err error) {
-	// This operation may leave the db in an inconsistent state if any of the
-	// latter steps fail, but not in a way that will impact external users.
-	// eg if the managed resource record is removed, but the subsequent call to
-	// remove the resource catalog entry fails, the resource at the path will
-	// not be visible anymore, but the data will still be stored.
+func (ms *managedStorage) RemoveForEnvironment(envUUID, path string) error {
+	return ms.remove(envUUID, "", path)
+}
 
+// RemoveForEnvironmentIfSole is defined on the ManagedStorage interface.
+func (ms *managedStorage) RemoveForEnvironmentIfSole(envUUID, path string) (removed bool, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return false, err
+	}
+	start := time.Now()
+	defer func() {
+		ms.observer.ObserveRemove(time.Since(start), err)
+	}()
 	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
 	if err != nil {
+		return false, err
+	}
+	var catalogDoc resourceDoc
+	var deletedPaths []string
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var managedDoc managedResourceDoc
+		if err := ms.managedResourceCollection.FindId(managedPath).One(&managedDoc); err == mgo.ErrNotFound || managedDoc.expired(ms.clock.Now()) {
+			return nil, errors.NotFoundf("resource at path %q", managedPath)
+		} else if err != nil {
+			return nil, err
+		}
+		if err := ms.db.C(resourceCatalogCollection).FindId(managedDoc.ResourceId).Select(bson.D{{"data", 0}}).One(&catalogDoc); err != nil {
+			return nil, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", managedPath)
+		}
+		versionOps, versionIds, err := ms.versionRemoveOps(managedPath)
+		if err != nil {
+			return nil, err
+		}
+		// The versions of the data at the path do not share it
+		// with other paths, but hold references of their own.
+		own := int64(1)
+		var otherIds []string
+		for _, id := range versionIds {
+			if id == managedDoc.ResourceId {
+				own++
+			} else {
+				otherIds = append(otherIds, id)
+			}
+		}
+		// The reference count is asserted in the same transaction
+		// as the managed record is changed, so that no other
+		// reference can be added in between.
+		ownIds := make([]string, own)
+		for i := range ownIds {
+			ownIds[i] = managedDoc.ResourceId
+		}
+		soleOps, deleted, err := ms.resourceCatalog.RemoveManyOps(ownIds)
+		if err != nil {
+			return nil, errors.Annotatef(err, "cannot release resource with path %q", managedPath)
+		}
+		var resourcePath string
+		if resourcePath, removed = deleted[managedDoc.ResourceId]; !removed {
+			// Other paths share the data, so nothing is removed.
+			return nil, jujutxn.ErrNoOperations
+		}
+		if ms.softDeleteWindow > 0 {
+			// The record keeps its references until it is purged.
+			return []txn.Op{{
+				C:      ms.managedResourceCollection.Name,
+				Id:     managedDoc.Id,
+				Assert: managedResourceUnchanged(managedDoc),
+				Update: bson.D{{"$set", bson.D{{"deletedtime", ms.clock.Now()}}}},
+			}, {
+				C:      resourceCatalogCollection,
+				Id:     managedDoc.ResourceId,
+				Assert: bson.D{{"refcount", bson.D{{"$lte", own}}}},
+			}}, nil
+		}
+		releaseOps, paths, err := ms.releaseOps(otherIds)
+		if err != nil {
+			return nil, err
+		}
+		deletedPaths = paths
+		if resourcePath != "" {
+			deletedPaths = append(deletedPaths, resourcePath)
+		}
+		ops := []txn.Op{{
+			C:      ms.managedResourceCollection.Name,
+			Id:     managedDoc.Id,
+			Assert: managedResourceUnchanged(managedDoc),
+			Remove: true,
+		}}
+		ops = append(ops, soleOps...)
+		ops = append(ops, versionOps...)
+		return append(ops, releaseOps...), nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); errors.IsNotFound(err) {
+		return false, err
+	} else if err != nil {
+		return false, errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	if !removed {
+		return false, nil
+	}
+	for _, resourcePath := range deletedPaths {
+		if err := ms.removeStored(resourcePath); err != nil {
+			return true, errors.Annotatef(err, "cannot delete resource %q at storage path %q", managedPath, resourcePath)
+		}
+	}
+	event := AuditEvent{
+		Operation: AuditRemove,
+		EnvUUID:   envUUID,
+		Path:      path,
+	}
+	event.Hash, event.HashAlgorithm = catalogDoc.hash()
+	if catalogDoc.Path != "" {
+		event.Length = catalogDoc.Length
+	}
+	return true, ms.audit(event)
+}
+
+// RemoveForUser is defined on the ManagedStorage interface.
+func (ms *managedStorage) RemoveForUser(user, path string) error {
+	return ms.remove("", user, path)
+}
+
+// RemoveGlobal is defined on the ManagedStorage interface.
+func (ms *managedStorage) RemoveGlobal(path string) error {
+	return ms.remove("", "", path)
+}
+
+// remove is the internal implementation of the Remove methods,
+// deleting the data at path namespaced to envUUID and user.
+func (ms *managedStorage) remove(envUUID, user, path string) (err error) {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	start := time.Now()
+	defer func() {
+		ms.observer.ObserveRemove(time.Since(start), err)
+	}()
+
+	managedPath, err := ms.resourceStoragePath(envUUID, user, path)
+	if err != nil {
+		return err
+	}
+	if ms.softDeleteWindow > 0 {
+		return ms.softRemove(envUUID, user, path, managedPath)
+	}
+	var doc managedResourceDoc
+	if err := ms.managedResourceCollection.FindId(managedPath).One(&doc); err == mgo.ErrNotFound {
+		return errors.NotFoundf("resource at path %q", managedPath)
+	} else if err != nil {
+		return errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	event := AuditEvent{
+		Operation: AuditRemove,
+		EnvUUID:   envUUID,
+		User:      user,
+		Path:      path,
+	}
+	event.Hash, event.HashAlgorithm = resourceIdHash(doc.ResourceId)
+	if ms.auditing() {
+		// The catalog entry may be deleted once the reference
+		// to it is released, so its length is read first.
+		if r, err := ms.resourceCatalog.Get(doc.ResourceId); err == nil {
+			event.Length = r.Length
+		}
+	}
+	// The record, the versions of its data and the references they
+	// hold are removed together; if deleting the data no longer
+	// referenced fails, it is left for GarbageCollect.
+	if err := ms.removeManagedDoc(doc); err != nil {
 		return err
 	}
+	return ms.audit(event)
+}
 
-	// First remove the managed resource catalog entry.
-	var resourceId string
+// removeManagedRecord removes the managed resource record at
+// managedPath, returning the id of the resource it referenced.
+func (ms *managedStorage) removeManagedRecord(managedPath string) (resourceId string, err error) {
 	buildTxn := func(attempt int) ([]txn.Op, error) {
 		var removeManagedResourceOps []txn.Op
 		resourceId, removeManagedResourceOps, err = ms.removeResourceTxn(managedPath)
@@ -354,25 +2113,258 @@ func (ms *managedStorage) RemoveForEnvironment(envUUID, path string) (err error)
 	txnRunner := txnRunner(ms.db)
 	if err := txnRunner.Run(buildTxn); err != nil {
 		if err == mgo.ErrNotFound {
-			return errors.NotFoundf("resource at path %q", managedPath)
+			return "", errors.NotFoundf("resource at path %q", managedPath)
+		}
+		return "", errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	return resourceId, nil
+}
+
+// removeManagedDoc removes the managed resource record doc, provided it
+// has not been changed since it was read, along with the versions of its
+// data, releasing the resources they reference in the same transaction,
+// and then deletes the data if it is no longer referenced. If the record
+// has changed, a NotFound error is returned.
+func (ms *managedStorage) removeManagedDoc(doc managedResourceDoc) error {
+	var deletedPaths []string
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		if attempt > 0 {
+			query := append(bson.D{{"_id", doc.Id}}, managedResourceUnchanged(doc)...)
+			if n, err := ms.managedResourceCollection.Find(query).Count(); err != nil {
+				return nil, err
+			} else if n == 0 {
+				return nil, errors.NotFoundf("resource at path %q", doc.Path)
+			}
+		}
+		versionOps, versionIds, err := ms.versionRemoveOps(doc.Id)
+		if err != nil {
+			return nil, err
+		}
+		var releaseOps []txn.Op
+		releaseOps, deletedPaths, err = ms.releaseOps(append([]string{doc.ResourceId}, versionIds...))
+		if err != nil {
+			return nil, err
 		}
+		ops := []txn.Op{{
+			C:      ms.managedResourceCollection.Name,
+			Id:     doc.Id,
+			Assert: managedResourceUnchanged(doc),
+			Remove: true,
+		}}
+		ops = append(ops, versionOps...)
+		return append(ops, releaseOps...), nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); errors.IsNotFound(err) {
+		return err
+	} else if err != nil {
 		return errors.Annotate(err, "cannot update managed resource catalog")
 	}
+	for _, resourcePath := range deletedPaths {
+		if err := ms.removeStored(resourcePath); err != nil && !errors.IsNotFound(err) {
+			return errors.Annotatef(err, "cannot delete resource %q at storage path %q", doc.Path, resourcePath)
+		}
+	}
+	return nil
+}
+
+// releaseOps returns the operations to release one reference to the
+// resource with each of the given ids, which may be repeated, along
+// with the storage paths of the data which is no longer referenced once
+// they are applied. Ids without a resource catalog entry are ignored.
+func (ms *managedStorage) releaseOps(resourceIds []string) ([]txn.Op, []string, error) {
+	ops, deleted, err := ms.resourceCatalog.RemoveManyOps(resourceIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	var deletedPaths []string
+	for _, path := range deleted {
+		// Entries whose upload never completed have no data.
+		if path != "" {
+			deletedPaths = append(deletedPaths, path)
+		}
+	}
+	sort.Strings(deletedPaths)
+	return ops, deletedPaths, nil
+}
+
+// managedResourceUnchanged returns the assertion that
+// a managed resource record has not changed from doc.
+func managedResourceUnchanged(doc managedResourceDoc) bson.D {
+	assert := bson.D{{"resourceid", doc.ResourceId}}
+	if !doc.ExpiryTime.IsZero() {
+		assert = append(assert, bson.DocElem{"expirytime", doc.ExpiryTime})
+	}
+	if !doc.DeletedTime.IsZero() {
+		assert = append(assert, bson.DocElem{"deletedtime", doc.DeletedTime})
+	} else {
+		assert = append(assert, bson.DocElem{"deletedtime", bson.D{{"$exists", false}}})
+	}
+	return assert
+}
 
-	// Now remove the resource catalog entry.
+// releaseResource removes the reference to the resource catalog entry with
+// the given id which was held by the managed resource at managedPath, and
+// deletes the data if there are no more references to it.
+func (ms *managedStorage) releaseResource(managedPath, resourceId string) error {
 	wasDeleted, resourcePath, err := ms.resourceCatalog.Remove(resourceId)
 	if err != nil {
 		return errors.Annotatef(err, "cannot delete resource %q from resource catalog", resourceId)
 	}
 	// If the there are no more references to the data, delete from the resource store.
 	if wasDeleted {
-		if err := ms.resourceStore.Remove(resourcePath); err != nil {
+		if err := ms.removeStored(resourcePath); err != nil {
 			return errors.Annotatef(err, "cannot delete resource %q at storage path %q", managedPath, resourcePath)
 		}
 	}
 	return nil
 }
 
+// removeAllBatchSize is the maximum number of managed resource
+// records removed in a single transaction by RemoveAllForEnvironment
+// and PurgeExpired.
+var removeAllBatchSize = 100
+
+// RemoveAllForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) RemoveAllForEnvironment(envUUID string) (int, error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, err
+	}
+	if envUUID == "" {
+		return 0, errors.NotValidf("empty environment UUID")
+	}
+	prefix, err := ms.resourceStoragePath(envUUID, "", "")
+	if err != nil {
+		return 0, err
+	}
+	var docs []managedResourceDoc
+	query := bson.D{{"path", bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix+"/")}}}
+	if err := ms.managedResourceCollection.Find(query).All(&docs); err != nil {
+		return 0, errors.Annotate(err, "cannot read managed resource records")
+	}
+	removed, failures, auditErr := ms.removeDocs(docs, AuditRemove)
+	if err := ms.removeVersionsForPrefix(prefix + "/"); err != nil {
+		failures = append(failures, err.Error())
+	}
+	if len(failures) > 0 {
+		return removed, errors.Errorf(
+			"cannot remove %d resources for environment %q: %s",
+			len(failures), envUUID, strings.Join(failures, "; "),
+		)
+	}
+	return removed, auditErr
+}
+
+// PurgeExpired is defined on the ManagedStorage interface.
+func (ms *managedStorage) PurgeExpired() (int, error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, err
+	}
+	var docs []managedResourceDoc
+	query := bson.D{{"expirytime", bson.D{{"$lte", ms.clock.Now()}}}}
+	if err := ms.managedResourceCollection.Find(query).All(&docs); err != nil {
+		return 0, errors.Annotate(err, "cannot read managed resource records")
+	}
+	removed, failures, auditErr := ms.removeDocs(docs, AuditPurge)
+	if len(failures) > 0 {
+		return removed, errors.Errorf(
+			"cannot purge %d expired resources: %s",
+			len(failures), strings.Join(failures, "; "),
+		)
+	}
+	return removed, auditErr
+}
+
+// removeDocs removes the given managed resource records in batches of
+// removeAllBatchSize, returning the number of records removed along with
+// a description of each failure. The removal of each record is audited
+// with the given operation; the first error returned when auditing is
+// returned as auditErr.
+func (ms *managedStorage) removeDocs(docs []managedResourceDoc, operation AuditOperation) (removed int, failures []string, auditErr error) {
+	for len(docs) > 0 {
+		batch := docs
+		if len(batch) > removeAllBatchSize {
+			batch = batch[:removeAllBatchSize]
+		}
+		docs = docs[len(batch):]
+		events := ms.removalEvents(batch, operation)
+		n, removedDocs, batchFailures := ms.removeBatch(batch)
+		removed += n
+		failures = append(failures, batchFailures...)
+		for i, ok := range removedDocs {
+			if !ok || events == nil {
+				continue
+			}
+			if err := ms.audit(events[i]); err != nil && auditErr == nil {
+				auditErr = err
+			}
+		}
+	}
+	return removed, failures, auditErr
+}
+
+// removeBatch removes the given managed resource records, along with the
+// versions of their data, and releases the resources they reference, in
+// a single transaction, so that if it is
+// interrupted either all or none of the records are removed and reference
+// counts decremented. The data no longer referenced is then deleted; if
+// that is interrupted, the data is left for GarbageCollect. If the
+// transaction cannot be applied, the records are removed one at a time,
+// each along with its reference, so the removal may safely be run again.
+// Records which have changed since they were read are left alone.
+// The number of records removed is returned, along with whether each
+// of them was removed and a description of each failure.
+func (ms *managedStorage) removeBatch(docs []managedResourceDoc) (removed int, removedDocs []bool, failures []string) {
+	removedDocs = make([]bool, len(docs))
+	ops := make([]txn.Op, len(docs))
+	resourceIds := make([]string, len(docs))
+	managedPaths := make([]string, len(docs))
+	for i, doc := range docs {
+		ops[i] = txn.Op{
+			C:      ms.managedResourceCollection.Name,
+			Id:     doc.Id,
+			Assert: managedResourceUnchanged(doc),
+			Remove: true,
+		}
+		resourceIds[i] = doc.ResourceId
+		managedPaths[i] = doc.Id
+	}
+	versionOps, versionIds, err := ms.versionRemoveOps(managedPaths...)
+	var releaseOps []txn.Op
+	var deletedPaths []string
+	if err == nil {
+		ops = append(ops, versionOps...)
+		releaseOps, deletedPaths, err = ms.releaseOps(append(resourceIds, versionIds...))
+	}
+	if err == nil {
+		err = txnRunner(ms.db).RunTransaction(append(ops, releaseOps...))
+	}
+	if err != nil {
+		logger.Debugf("cannot remove managed resource records in bulk, removing individually: %v", err)
+		for i, doc := range docs {
+			err := ms.removeManagedDoc(doc)
+			if errors.IsNotFound(err) {
+				// Removed or changed concurrently.
+				continue
+			} else if err != nil {
+				failures = append(failures, fmt.Sprintf("resource at path %q: %v", doc.Path, err))
+				continue
+			}
+			removedDocs[i] = true
+			removed++
+		}
+		return removed, removedDocs, failures
+	}
+	for _, resourcePath := range deletedPaths {
+		if err := ms.removeStored(resourcePath); err != nil && !errors.IsNotFound(err) {
+			failures = append(failures, fmt.Sprintf("resource at storage path %q: %v", resourcePath, err))
+		}
+	}
+	for i := range removedDocs {
+		removedDocs[i] = true
+	}
+	return len(docs), removedDocs, failures
+}
+
 func (ms *managedStorage) putResourceTxn(managedResource ManagedResource, resourceId string) (string, []txn.Op, error) {
 	return putResourceTxn(ms.managedResourceCollection, managedResource, resourceId)
 }
@@ -397,12 +2389,39 @@ var putResourceTxn = func(coll *mgo.Collection, managedResource ManagedResource,
 		C:      coll.Name,
 		Id:     doc.Id,
 		Assert: txn.DocExists,
-		Update: bson.D{{"$set",
-			bson.D{{"path", doc.Path}, {"resourceid", resourceId}},
-		}},
+		Update: managedResourceUpdate(doc),
 	}}, nil
 }
 
+// managedResourceUpdate returns the update which overwrites
+// an existing managed resource record with doc.
+func managedResourceUpdate(doc managedResourceDoc) bson.D {
+	set := bson.D{{"path", doc.Path}, {"resourceid", doc.ResourceId}, {"contenttype", doc.ContentType}}
+	var unset bson.D
+	if doc.Filename == "" {
+		unset = append(unset, bson.DocElem{"filename", 1})
+	} else {
+		set = append(set, bson.DocElem{"filename", doc.Filename})
+	}
+	if doc.ExpiryTime.IsZero() {
+		unset = append(unset, bson.DocElem{"expirytime", 1})
+	} else {
+		set = append(set, bson.DocElem{"expirytime", doc.ExpiryTime})
+	}
+	if len(doc.Labels) == 0 {
+		unset = append(unset, bson.DocElem{"labels", 1})
+	} else {
+		set = append(set, bson.DocElem{"labels", doc.Labels})
+	}
+	// Overwriting a soft-deleted record replaces it.
+	unset = append(unset, bson.DocElem{"deletedtime", 1})
+	update := bson.D{{"$set", set}}
+	if len(unset) > 0 {
+		update = append(update, bson.DocElem{"$unset", unset})
+	}
+	return update
+}
+
 func (ms *managedStorage) removeResourceTxn(managedPath string) (string, []txn.Op, error) {
 	var existingDoc managedResourceDoc
 	if err := ms.managedResourceCollection.FindId(managedPath).One(&existingDoc); err != nil {
@@ -416,24 +2435,89 @@ func (ms *managedStorage) removeResourceTxn(managedPath string) (string, []txn.O
 	}}, nil
 }
 
+// moveResourceTxn returns the operations to replace the managed resource record
+// at srcManagedPath with one at dstManagedPath referencing the same resource.
+// The versions of the data move with it, replacing any left at dstManagedPath,
+// whose references are released; the storage paths of the data no longer
+// referenced once the operations are applied are returned, along with
+// the id of the resource moved.
+func (ms *managedStorage) moveResourceTxn(srcManagedPath, dstManagedPath string) (string, []txn.Op, []string, error) {
+	var srcDoc managedResourceDoc
+	if err := ms.managedResourceCollection.FindId(srcManagedPath).One(&srcDoc); err == mgo.ErrNotFound || srcDoc.expired(ms.clock.Now()) {
+		return "", nil, nil, errors.NotFoundf("resource at path %q", srcManagedPath)
+	} else if err != nil {
+		return "", nil, nil, err
+	}
+	count, err := ms.managedResourceCollection.FindId(dstManagedPath).Count()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if count > 0 {
+		return "", nil, nil, errors.AlreadyExistsf("resource at path %q", dstManagedPath)
+	}
+	staleOps, staleIds, err := ms.versionRemoveOps(dstManagedPath)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	releaseOps, deletedPaths, err := ms.releaseOps(staleIds)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	moveOps, err := ms.versionMoveOps(srcManagedPath, dstManagedPath)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dstResource := ManagedResource{
+		EnvUUID:     srcDoc.EnvUUID,
+		User:        srcDoc.User,
+		Path:        dstManagedPath,
+		ContentType: srcDoc.ContentType,
+		Filename:    srcDoc.Filename,
+		ExpiryTime:  srcDoc.ExpiryTime,
+		Labels:      srcDoc.Labels,
+	}
+	ops := []txn.Op{{
+		C:      ms.managedResourceCollection.Name,
+		Id:     srcDoc.Id,
+		Assert: bson.D{{"resourceid", srcDoc.ResourceId}},
+		Remove: true,
+	}, {
+		C:      ms.managedResourceCollection.Name,
+		Id:     dstManagedPath,
+		Assert: txn.DocMissing,
+		Insert: newManagedResourceDoc(dstResource, srcDoc.ResourceId),
+	}}
+	ops = append(ops, staleOps...)
+	ops = append(ops, releaseOps...)
+	return srcDoc.ResourceId, append(ops, moveOps...), deletedPaths, nil
+}
+
 var (
 	requestExpiry = 60 * time.Second
 )
 
 // putResponse is used when responding to a put request.
 type putResponse struct {
-	requestId  int64
-	sha384Hash string
+	requestId    int64
+	token        string
+	sha384Hashes []string
 }
 
 // PutRequest is to record a request to put a file pending proof of access.
 type PutRequest struct {
-	expiryTime   time.Time
-	resourceId   string
-	envUUID      string
-	user         string
-	path         string
-	expectedHash string
+	expiryTime     time.Time
+	resourceId     string
+	envUUID        string
+	user           string
+	path           string
+	token          string
+	expectedHashes []string
+}
+
+// ByteRange describes a range of bytes within some data.
+type ByteRange struct {
+	Start  int64
+	Length int64
 }
 
 // RequestResponse is returned by a put request to inform the caller
@@ -442,25 +2526,106 @@ type RequestResponse struct {
 	RequestId   int64
 	RangeStart  int64
 	RangeLength int64
+
+	// Ranges holds every range over which a hash must be calculated,
+	// in the order the hashes must be supplied in the response. The
+	// first range is the same as RangeStart and RangeLength; there is
+	// more than one only if the storage challenges multiple ranges.
+	Ranges []ByteRange
+
+	// Token is the single-use challenge token which
+	// must be supplied when responding to the request.
+	Token string
+}
+
+// StoredReference identifies the stored data to which a reference
+// has been created, as returned by ResourceCatalog.Put.
+type StoredReference struct {
+	// ResourceId is the id of the resource catalog entry for the data.
+	ResourceId string
+
+	// ResourcePath is the path of the data in the resource storage.
+	ResourcePath string
 }
 
-// NewPutResponse creates a new putResponse for the given requestId and hashes.
-func NewPutResponse(requestId int64, sha384hash string) putResponse {
+// NewPutResponse creates a new putResponse for the given requestId, challenge token and hashes.
+// A hash must be supplied for each of the request's ranges, in order.
+func NewPutResponse(requestId int64, token string, sha384hashes ...string) putResponse {
 	return putResponse{
-		requestId:  requestId,
-		sha384Hash: sha384hash,
+		requestId:    requestId,
+		token:        token,
+		sha384Hashes: sha384hashes,
+	}
+}
+
+// newChallengeToken returns a random token binding
+// a put response to the request it answers.
+func (ms *managedStorage) newChallengeToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(ms.randSource, buf); err != nil {
+		return "", errors.Annotate(err, "cannot generate challenge token")
 	}
+	return fmt.Sprintf("%x", buf), nil
 }
 
-// calculateExpectedHash picks a random range of bytes from the data cataloged by resourceId
-// and calculates a sha384 checksum of that data.
-func (ms *managedStorage) calculateExpectedHash(resourceId, path string) (string, int64, int64, error) {
-	rdr, length, err := ms.getResource(resourceId, path)
+// calculateExpectedHashes picks ms.challengeRanges disjoint random ranges of
+// bytes from the data cataloged by resourceId and calculates a sha384
+// checksum of the data in each.
+func (ms *managedStorage) calculateExpectedHashes(resourceId, path string) ([]string, []ByteRange, error) {
+	rdr, length, err := ms.getResource(context.Background(), resourceId, path)
 	if err != nil {
-		return "", 0, 0, err
+		return nil, nil, err
 	}
 	defer rdr.Close()
-	rangeLength := rand.Int63n(length)
+	if length == 0 {
+		// There is no data to prove access to, so the range is empty.
+		return []string{fmt.Sprintf("%x", sha512.Sum384(nil))}, []ByteRange{{}}, nil
+	}
+	// Each range is chosen from within its own segment of the data,
+	// so that the ranges cannot overlap.
+	numRanges := int64(ms.challengeRanges)
+	if numRanges > length {
+		numRanges = length
+	}
+	segmentLength := length / numRanges
+	// The ranges are read in order, so offset tracks the position
+	// of rdr for storage whose readers cannot seek.
+	var offset int64
+	var hashes []string
+	var ranges []ByteRange
+	for i := int64(0); i < numRanges; i++ {
+		segmentStart := i * segmentLength
+		if i == numRanges-1 {
+			// The last segment takes any remainder.
+			segmentLength = length - segmentStart
+		}
+		r, err := ms.randomRange(segmentLength)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.Start += segmentStart
+		hash, err := rangeHash(rdr, offset, r)
+		if err != nil {
+			return nil, nil, err
+		}
+		offset = r.Start + r.Length
+		hashes = append(hashes, hash)
+		ranges = append(ranges, r)
+	}
+	return hashes, ranges, nil
+}
+
+// randomRange picks a random range of bytes from data of the given length.
+func (ms *managedStorage) randomRange(length int64) (ByteRange, error) {
+	if length <= MinChallengeLength {
+		// Any shorter range would be easily guessed, so all of
+		// the data must be proven.
+		return ByteRange{Length: length}, nil
+	}
+	rangeLength, err := ms.randInt63n(length)
+	if err != nil {
+		return ByteRange{}, err
+	}
 	// Restrict the minimum range to 512 or length/2, whichever is smaller.
 	minLength := int64(512)
 	if minLength > length/2 {
@@ -473,23 +2638,51 @@ func (ms *managedStorage) calculateExpectedHash(resourceId, path string) (string
 	if rangeLength > 2048 {
 		rangeLength = 2048
 	}
-	start := rand.Int63n(length - rangeLength)
-	_, err = rdr.(io.ReadSeeker).Seek(start, 0)
+	start, err := ms.randInt63n(length - rangeLength)
 	if err != nil {
-		return "", 0, 0, err
+		return ByteRange{}, err
+	}
+	return ByteRange{Start: start, Length: rangeLength}, nil
+}
+
+// rangeHash returns the sha384 checksum of the bytes in r read from rdr,
+// which is positioned at offset. If rdr cannot seek, r must not start
+// before offset.
+func rangeHash(rdr io.Reader, offset int64, r ByteRange) (string, error) {
+	if seeker, ok := rdr.(io.Seeker); ok {
+		if _, err := seeker.Seek(r.Start, io.SeekStart); err != nil {
+			return "", err
+		}
+	} else if r.Start < offset {
+		return "", errors.Errorf("cannot read range at offset %d from unseekable data at offset %d", r.Start, offset)
+	} else if _, err := io.CopyN(ioutil.Discard, rdr, r.Start-offset); err != nil {
+		return "", err
 	}
 	sha384hash := sha512.New384()
-	dataRdr := io.LimitReader(rdr, rangeLength)
-	dataRdr = io.TeeReader(dataRdr, sha384hash)
-	if _, err = ioutil.ReadAll(dataRdr); err != nil {
-		return "", 0, 0, err
+	if _, err := io.Copy(sha384hash, io.LimitReader(rdr, r.Length)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+}
+
+// randInt63n returns a uniformly distributed random number in [0, n),
+// read from the storage's source of randomness.
+func (ms *managedStorage) randInt63n(n int64) (int64, error) {
+	if n <= 0 {
+		return 0, errors.NotValidf("random number range %d", n)
+	}
+	v, err := cryptorand.Int(ms.randSource, big.NewInt(n))
+	if err != nil {
+		return 0, errors.Annotate(err, "cannot generate random number")
 	}
-	sha384hashHex := fmt.Sprintf("%x", sha384hash.Sum(nil))
-	return sha384hashHex, start, rangeLength, nil
+	return v.Int64(), nil
 }
 
 // PutForEnvironmentRequest is defined on the ManagedStorage interface.
-func (ms *managedStorage) PutForEnvironmentRequest(envUUID, path string, hash string) (*RequestResponse, error) {
+func (ms *managedStorage) PutForEnvironmentRequest(envUUID, path string, hash string) (_ *RequestResponse, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
 	ms.requestMutex.Lock()
 	defer ms.requestMutex.Unlock()
 
@@ -499,19 +2692,27 @@ func (ms *managedStorage) PutForEnvironmentRequest(envUUID, path string, hash st
 	if err != nil {
 		return nil, err
 	}
-	expectedHash, rangeStart, rangeLength, err := ms.calculateExpectedHash(resourceId, path)
+	if err := ms.verifyDedup(hash, -1); err != nil {
+		return nil, err
+	}
+	expectedHashes, ranges, err := ms.calculateExpectedHashes(resourceId, path)
 	if err != nil {
 		return nil, errors.Annotatef(err, "cannot calculate response hashes for resource at path %q", path)
 	}
+	token, err := ms.newChallengeToken()
+	if err != nil {
+		return nil, err
+	}
 
 	requestId := ms.nextRequestId
 	ms.nextRequestId++
 	putRequest := PutRequest{
-		expiryTime:   time.Now().Add(requestExpiry),
-		envUUID:      envUUID,
-		path:         path,
-		resourceId:   resourceId,
-		expectedHash: expectedHash,
+		expiryTime:     ms.clock.Now().Add(requestExpiry),
+		envUUID:        envUUID,
+		path:           path,
+		resourceId:     resourceId,
+		token:          token,
+		expectedHashes: expectedHashes,
 	}
 	ms.queuedRequests[requestId] = putRequest
 	// If this is the only request queued up, start the timer to
@@ -521,11 +2722,43 @@ func (ms *managedStorage) PutForEnvironmentRequest(envUUID, path string, hash st
 	}
 	return &RequestResponse{
 		RequestId:   requestId,
-		RangeStart:  rangeStart,
-		RangeLength: rangeLength,
+		RangeStart:  ranges[0].Start,
+		RangeLength: ranges[0].Length,
+		Ranges:      ranges,
+		Token:       token,
 	}, nil
 }
 
+// CanDedup is defined on the ManagedStorage interface.
+func (ms *managedStorage) CanDedup(hash string) (_ bool, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return false, err
+	}
+	_, err = ms.resourceCatalog.Find(hash)
+	if errors.IsNotFound(err) || IsUploadPending(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Annotate(err, "cannot query resource catalog")
+	}
+	return true, nil
+}
+
+// CanDedupMany is defined on the ManagedStorage interface.
+func (ms *managedStorage) CanDedupMany(hashes []string) (map[string]bool, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	found, err := ms.resourceCatalog.FindMany(hashes)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot query resource catalog")
+	}
+	result := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		_, result[hash] = found[hash]
+	}
+	return result, nil
+}
+
 // Wrap time.AfterFunc so we can patch for testing.
 var afterFunc = func(d time.Duration, f func()) *time.Timer {
 	return time.AfterFunc(d, f)
@@ -533,8 +2766,8 @@ var afterFunc = func(d time.Duration, f func()) *time.Timer {
 
 func (ms *managedStorage) updatePollTimer(nextRequestIdToExpire int64) {
 	firstUnexpiredRequest := ms.queuedRequests[nextRequestIdToExpire]
-	waitInterval := firstUnexpiredRequest.expiryTime.Sub(time.Now())
-	afterFunc(waitInterval, func() {
+	waitInterval := firstUnexpiredRequest.expiryTime.Sub(ms.clock.Now())
+	ms.pollTimer = afterFunc(waitInterval, func() {
 		ms.processRequestExpiry(nextRequestIdToExpire)
 	})
 }
@@ -562,9 +2795,10 @@ func (ms *managedStorage) processRequestExpiry(requestId int64) {
 	}
 }
 
-// ErrRequestExpired is used to indicate that a put request has already expired
-// when an attempt is made to supply a response.
-var ErrRequestExpired = fmt.Errorf("request expired")
+// ErrRequestExpired is used to indicate that a put request has already expired,
+// or has already been responded to, when an attempt is made to supply a response.
+// It satisfies juju/errors.IsNotValid.
+var ErrRequestExpired = errors.NewNotValid(nil, "request expired")
 
 // ErrResponseMismatch is used to indicate that a put response did not contain
 // the expected checksums.
@@ -574,41 +2808,116 @@ var ErrResponseMismatch = fmt.Errorf("response checksums do not match")
 // put response could be acted on.
 var ErrResourceDeleted = fmt.Errorf("resource was deleted")
 
-// PutResponse is defined on the ManagedStorage interface.
-func (ms *managedStorage) ProofOfAccessResponse(response putResponse) error {
+// ProofOfAccessResponse is defined on the ManagedStorage interface.
+func (ms *managedStorage) ProofOfAccessResponse(response putResponse) (err error) {
+	_, err = ms.proofOfAccessResponse(response)
+	return err
+}
+
+// ProofOfAccessResponseReference is defined on the ManagedStorage interface.
+func (ms *managedStorage) ProofOfAccessResponseReference(response putResponse) (StoredReference, error) {
+	return ms.proofOfAccessResponse(response)
+}
+
+// proofOfAccessResponse is the internal implementation of the
+// ProofOfAccessResponse methods, returning the stored data now
+// referenced at the path of the request responded to.
+func (ms *managedStorage) proofOfAccessResponse(response putResponse) (_ StoredReference, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return StoredReference{}, err
+	}
+	start := time.Now()
+	var length int64
+	defer func() {
+		ms.observer.ObserveProofOfAccess(length, time.Since(start), err)
+	}()
 	ms.requestMutex.Lock()
 	request, ok := ms.queuedRequests[response.requestId]
 	delete(ms.queuedRequests, response.requestId)
 	ms.requestMutex.Unlock()
-	if !ok {
-		return ErrRequestExpired
+	// The timer removing expired requests may not have fired yet,
+	// so the expiry time is checked too.
+	if !ok || !ms.clock.Now().Before(request.expiryTime) {
+		return StoredReference{}, ErrRequestExpired
+	}
+	// The request is consumed regardless of whether the token matches,
+	// so that tokens cannot be guessed by repeated attempts.
+	if response.token == "" || response.token != request.token {
+		return StoredReference{}, errors.NotValidf("challenge token for request %d", response.requestId)
+	}
+	if len(response.sha384Hashes) != len(request.expectedHashes) {
+		return StoredReference{}, ErrResponseMismatch
 	}
-	if request.expectedHash != response.sha384Hash {
-		return ErrResponseMismatch
+	for i, hash := range request.expectedHashes {
+		if response.sha384Hashes[i] != hash {
+			return StoredReference{}, ErrResponseMismatch
+		}
 	}
 	// Sanity check - ensure resource hasn't been deleted between when the put request
 	// was made and now.
 	resource, err := ms.resourceCatalog.Get(request.resourceId)
 	if errors.IsNotFound(err) {
-		return ErrResourceDeleted
+		return StoredReference{}, ErrResourceDeleted
 	} else if err != nil {
-		return errors.Annotate(err, "confirming resource exists")
+		return StoredReference{}, errors.Annotate(err, "confirming resource exists")
 	}
-
-	// Increment the resource catalog reference count.
-	resourceId, resourcePath, err := ms.resourceCatalog.Put(resource.SHA384Hash, resource.Length)
+	ref, err := ms.addProvenReference(request)
 	if err != nil {
-		return errors.Annotate(err, "cannot update resource catalog")
+		return StoredReference{}, err
+	}
+	length = resource.Length
+	err = ms.audit(AuditEvent{
+		Operation:     AuditProofOfAccess,
+		EnvUUID:       request.envUUID,
+		User:          request.user,
+		Path:          request.path,
+		Hash:          resource.Hash,
+		HashAlgorithm: resource.HashAlgorithm,
+		Length:        resource.Length,
+	})
+	if err != nil {
+		return StoredReference{}, err
+	}
+	return ref, nil
+}
+
+// addProvenReference records a reference at the path of request to the
+// resource, access to which has been proven in response to request,
+// returning the stored data now referenced.
+func (ms *managedStorage) addProvenReference(request PutRequest) (_ StoredReference, err error) {
+	// Increment the resource catalog reference count, by id
+	// for the same reason as CopyForEnvironment.
+	resourceId := request.resourceId
+	resourcePath, err := ms.resourceCatalog.AddRef(resourceId)
+	if errors.IsNotFound(err) {
+		// The entry has been deleted from underneath us.
+		return StoredReference{}, ErrResourceDeleted
+	} else if err != nil {
+		return StoredReference{}, errors.Annotate(err, "cannot update resource catalog")
 	}
 	defer cleanupResourceCatalog(ms.resourceCatalog, resourceId, &err)
-	// We expect an existing catalog entry else it has been deleted from underneath us.
-	if resourcePath == "" || resourceId != request.resourceId {
-		return ErrResourceDeleted
+	if resourcePath == "" {
+		return StoredReference{}, ErrResourceDeleted
 	}
 
 	managedPath, err := ms.resourceStoragePath(request.envUUID, request.user, request.path)
 	if err != nil {
-		return err
+		return StoredReference{}, err
+	}
+	// The data is not sent with a proof of access response,
+	// so its content type is detected from the stored copy.
+	contentType, err := ms.storedContentType(resourcePath)
+	if err != nil {
+		return StoredReference{}, err
+	}
+	managedResource := ManagedResource{
+		EnvUUID:     request.envUUID,
+		User:        request.user,
+		Path:        managedPath,
+		ContentType: contentType,
+	}
+	if err := ms.putResourceReference(managedResource, request.resourceId, nil); err != nil {
+		return StoredReference{}, err
 	}
-	return ms.putResourceReference(request.envUUID, managedPath, request.resourceId)
+	return StoredReference{ResourceId: resourceId, ResourcePath: resourcePath}, nil
 }
@@ -5,10 +5,16 @@ package blobstore_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -141,7 +147,32 @@ func (s *managedStorageSuite) TestGetPendingUpload(c *gc.C) {
 	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
 	c.Assert(err, gc.IsNil)
 	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
-	c.Assert(err, gc.Equals, blobstore.ErrUploadPending)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrUploadPending)
+}
+
+func (s *managedStorageSuite) TestGetPendingUploadElapsed(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+
+	now = now.Add(10 * time.Minute)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, blobstore.IsUploadPending)
+	c.Assert(err, gc.ErrorMatches, `Resource not available because upload is not yet complete: resource at path "environs/env/path/to/blob" \(pending for 10m0s\)`)
+	pendingErr, ok := err.(*blobstore.UploadPendingError)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(*pendingErr, jc.DeepEquals, blobstore.UploadPendingError{
+		Path:    "environs/env/path/to/blob",
+		Elapsed: 10 * time.Minute,
+	})
 }
 
 func (s *managedStorageSuite) TestPutPendingUpload(c *gc.C) {
@@ -269,6 +300,108 @@ func (s *managedStorageSuite) TestPutForEnvironmentAndCheckHash(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 }
 
+func (s *managedStorageSuite) TestPutForEnvironmentAndCheckHashMalformed(c *gc.C) {
+	blob := []byte("data")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	decoded, err := hex.DecodeString(hash)
+	c.Assert(err, jc.ErrorIsNil)
+	for _, checkHash := range []string{
+		base64.StdEncoding.EncodeToString(decoded),
+		hash[:len(hash)-2],
+		hash + "00",
+		strings.ToUpper(hash),
+		"wrong",
+	} {
+		// No data is read when the hash is malformed.
+		rdr := bytes.NewReader(blob)
+		err := s.managedStorage.PutForEnvironmentAndCheckHash("env", "/some/path", rdr, int64(len(blob)), checkHash)
+		c.Check(err, gc.ErrorMatches, `malformed sha384 hash ".*" not valid`)
+		c.Check(err, jc.Satisfies, errors.IsNotValid)
+		c.Check(rdr.Len(), gc.Equals, len(blob))
+	}
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentReturningHash(c *gc.C) {
+	// Passing -1 for the size of the data consumes it until EOF,
+	// and the returned hash describes what was stored.
+	blob := []byte("data")
+	hash, err := s.managedStorage.PutForEnvironmentReturningHash("env", "/some/path", bytes.NewReader(blob), -1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(hash, gc.Equals, calculateCheckSum(c, 0, int64(len(blob)), blob))
+	s.assertGet(c, "/some/path", blob)
+}
+
+func (s *managedStorageSuite) newSHA256ManagedStorage(c *gc.C) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		HashAlgorithm:   blobstore.SHA256,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func (s *managedStorageSuite) TestNewManagedStorageWithParamsInvalidHashAlgorithm(c *gc.C) {
+	_, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		HashAlgorithm:   "md5",
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid managed storage params: hash algorithm "md5" not valid`)
+}
+
+func (s *managedStorageSuite) TestNewManagedStorageWithParamsNegativeChallengeRanges(c *gc.C) {
+	_, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ChallengeRanges: -1,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid managed storage params: negative ChallengeRanges not valid`)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentAndCheckHashSHA256(c *gc.C) {
+	ms := s.newSHA256ManagedStorage(c)
+	blob := []byte("data")
+	sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := ms.PutForEnvironmentAndCheckHash("env", "/some/path", bytes.NewReader(blob), int64(len(blob)), sha384Hash)
+	c.Assert(err, gc.ErrorMatches, `malformed sha256 hash ".*" not valid`)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256(blob))
+	err = ms.PutForEnvironmentAndCheckHash("env", "/some/path", bytes.NewReader(blob), int64(len(blob)), sha256Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	metadata, err := ms.StatForEnvironment("env", "/some/path")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata, gc.Equals, blobstore.Metadata{
+		Length:        int64(len(blob)),
+		Hash:          sha256Hash,
+		HashAlgorithm: blobstore.SHA256,
+		ContentType:   "text/plain; charset=utf-8",
+	})
+
+	r, _, err := ms.GetForEnvironmentVerified("env", "/some/path")
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+	c.Assert(r.Close(), jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutSameDataDifferentHashAlgorithms(c *gc.C) {
+	blob := []byte("data")
+	err := s.managedStorage.PutForEnvironment("env", "/some/path", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	ms := s.newSHA256ManagedStorage(c)
+	err = ms.PutForEnvironment("env", "/another/path", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Data hashed using different algorithms is catalogued separately.
+	s.assertResourceCatalogCount(c, 2)
+	s.assertGet(c, "/some/path", blob)
+	s.assertGet(c, "/another/path", blob)
+}
+
 func (s *managedStorageSuite) TestPutForEnvironmentAndCheckHashEmptyHash(c *gc.C) {
 	// Passing "" as the hash to PutForEnvironmentAndCheckHash will elide
 	// the hash check.
@@ -287,17 +420,217 @@ func (s *managedStorageSuite) TestPutForEnvironmentUnknownLen(c *gc.C) {
 	s.assertGet(c, "/some/path", blob)
 }
 
+// emptySHA384 is the SHA-384 hash of empty data.
+const emptySHA384 = "38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b"
+
+func (s *managedStorageSuite) TestPutForEnvironmentEmpty(c *gc.C) {
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/empty", bytes.NewReader(nil), 0)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/another", bytes.NewReader(nil), -1)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutGlobal("/path/to/empty", bytes.NewReader(nil), 0)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/empty", []byte{})
+	s.assertGet(c, "/path/to/another", []byte{})
+
+	// All empty data shares a single catalog entry, with the hash of empty data.
+	s.assertResourceCatalogCount(c, 1)
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/empty")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Length, gc.Equals, int64(0))
+	c.Assert(metadata.SHA384Hash, gc.Equals, emptySHA384)
+	count, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/empty")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 3)
+
+	// Empty data is not written to the resource storage.
+	var rd resourceDocStub
+	err = s.db.C("storedResources").FindId(emptySHA384).One(&rd)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.resourceStorage.Get(rd.Path)
+	c.Assert(err, gc.NotNil)
+
+	for _, path := range []string{"/path/to/empty", "/path/to/another"} {
+		err = s.managedStorage.RemoveForEnvironment("env", path)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	err = s.managedStorage.RemoveGlobal("/path/to/empty")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutRequestEmpty(c *gc.C) {
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/empty", bytes.NewReader(nil), 0)
+	c.Assert(err, jc.ErrorIsNil)
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "/path/to/another", emptySHA384)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(reqResp.Ranges, jc.DeepEquals, []blobstore.ByteRange{{}})
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, emptySHA384)
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/another", []byte{})
+}
+
+func (s *managedStorageSuite) TestPutRequestTiny(c *gc.C) {
+	blob := []byte("x")
+	sha384Hash := s.putTestBlob(c, "path/to/blob", blob)
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	// The whole of the data is challenged.
+	c.Assert(reqResp.Ranges, jc.DeepEquals, []blobstore.ByteRange{{Start: 0, Length: 1}})
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, emptySHA384)
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, gc.NotNil)
+
+	reqResp, err = s.managedStorage.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	response = blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, calculateCheckSum(c, 0, 1, blob))
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "path/to/another", blob)
+}
+
+func (s *managedStorageSuite) TestPutRequestShortClamped(c *gc.C) {
+	ms := s.newMultiRangeManagedStorage(c, 3)
+	blob := make([]byte, 3*blobstore.MinChallengeLength)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	sha384Hash := s.putTestBlob(c, "path/to/blob", blob)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	// Each segment is short enough to be challenged in full.
+	c.Assert(reqResp.Ranges, jc.DeepEquals, []blobstore.ByteRange{
+		{Start: 0, Length: blobstore.MinChallengeLength},
+		{Start: blobstore.MinChallengeLength, Length: blobstore.MinChallengeLength},
+		{Start: 2 * blobstore.MinChallengeLength, Length: blobstore.MinChallengeLength},
+	})
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentUnknownLenSpilled(c *gc.C) {
+	// Data larger than the upload buffer is spilled to a temporary
+	// file, which is removed once the data is stored.
+	tempDir := c.MkDir()
+	s.PatchEnvironment("TMPDIR", tempDir)
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  s.resourceStorage,
+		UploadBufferSize: 2,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	blob := []byte("data")
+	err = ms.PutForEnvironment("env", "/some/path", bytes.NewReader(blob), -1)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/some/path", blob)
+	infos, err := ioutil.ReadDir(tempDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTempDir(c *gc.C) {
+	tempDir := c.MkDir()
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  s.resourceStorage,
+		UploadBufferSize: 2,
+		TempDir:          tempDir,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The data is spilled to the temporary directory as it is read, and
+	// the file is removed when the put is cancelled part way through.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		defer pw.Close()
+		pw.Write([]byte("some data"))
+		// The data first written has been buffered once more is read.
+		pw.Write([]byte("more data"))
+		infos, err := ioutil.ReadDir(tempDir)
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(infos, gc.HasLen, 1)
+		if len(infos) == 1 {
+			c.Check(infos[0].Mode().Perm(), gc.Equals, os.FileMode(0600))
+		}
+		cancel()
+	}()
+	err = ms.PutForEnvironmentWithContext(ctx, "env", "/some/path", pr, -1)
+	c.Assert(errors.Cause(err), gc.Equals, context.Canceled)
+	infos, err := ioutil.ReadDir(tempDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+	s.assertResourceCatalogCount(c, 0)
+}
+
 func (s *managedStorageSuite) TestPutForEnvironmentOverLong(c *gc.C) {
 	// Passing a size to PutForEnvironment that exceeds the actual
-	// size of the data will result in metadata recording the actual
-	// size.
+	// size of the data results in an error, and nothing is stored.
 	blob := []byte("data")
 	rdr := bytes.NewReader(blob)
 	err := s.managedStorage.PutForEnvironment("env", "/some/path", rdr, int64(len(blob)+1))
+	c.Assert(err, gc.ErrorMatches, "cannot calculate data checksums: expected 5 bytes, got 4")
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/some/path")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentUnderLong(c *gc.C) {
+	// Passing a size to PutForEnvironment that is less than the actual
+	// size of the data results in an error, and nothing is stored.
+	blob := []byte("data")
+	rdr := bytes.NewReader(blob)
+	err := s.managedStorage.PutForEnvironment("env", "/some/path", rdr, int64(len(blob)-1))
+	c.Assert(err, gc.ErrorMatches, "cannot calculate data checksums: expected 3 bytes, got more")
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/some/path")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentUnderLongNotDrained(c *gc.C) {
+	// The excess data is not read beyond what is needed to detect it.
+	rdr := bytes.NewReader(make([]byte, 1<<20))
+	err := s.managedStorage.PutForEnvironment("env", "/some/path", rdr, 10)
+	c.Assert(err, gc.ErrorMatches, "cannot calculate data checksums: expected 10 bytes, got more")
+	c.Assert(rdr.Len() > 0, jc.IsTrue)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithContextCancelled(c *gc.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rdr := strings.NewReader("data")
+	err := s.managedStorage.PutForEnvironmentWithContext(ctx, "env", "/some/path", rdr, int64(rdr.Len()))
+	c.Assert(errors.Cause(err), gc.Equals, context.Canceled)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/some/path")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithContext(c *gc.C) {
+	blob := []byte("data")
+	rdr := bytes.NewReader(blob)
+	err := s.managedStorage.PutForEnvironmentWithContext(context.Background(), "env", "/some/path", rdr, int64(len(blob)))
 	c.Assert(err, jc.ErrorIsNil)
 	s.assertGet(c, "/some/path", blob)
 }
 
+func (s *managedStorageSuite) TestGetForEnvironmentWithContextCancelled(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	ctx, cancel := context.WithCancel(context.Background())
+	r, length, err := s.managedStorage.GetForEnvironmentWithContext(ctx, "env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	cancel()
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, context.Canceled)
+
+	_, _, err = s.managedStorage.GetForEnvironmentWithContext(ctx, "env", "/path/to/blob")
+	c.Assert(err, gc.Equals, context.Canceled)
+}
+
 func (s *managedStorageSuite) assertGet(c *gc.C, path string, blob []byte) {
 	r, length, err := s.managedStorage.GetForEnvironment("env", path)
 	c.Assert(err, gc.IsNil)
@@ -314,112 +647,1359 @@ func (s *managedStorageSuite) TestGet(c *gc.C) {
 	s.assertGet(c, "/path/to/blob", blob)
 }
 
+func (s *managedStorageSuite) TestGetCompressed(c *gc.C) {
+	ms := blobstore.NewManagedStorage(s.db, blobstore.NewCompressingStorage(s.resourceStorage))
+	blob := []byte(strings.Repeat("some resource\n", 100))
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	// The length reported is that of the uncompressed data.
+	r, length, err := ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+}
+
 func (s *managedStorageSuite) TestGetNonExistent(c *gc.C) {
 	_, _, err := s.managedStorage.GetForEnvironment("env", "/path/to/nowhere")
 	c.Assert(err, jc.Satisfies, errors.IsNotFound)
 }
 
-func (s *managedStorageSuite) TestRemove(c *gc.C) {
+func (s *managedStorageSuite) TestStat(c *gc.C) {
 	blob := []byte("some resource")
-	resPath := s.assertPut(c, "/path/to/blob", blob)
-	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	s.assertPut(c, "/path/to/blob", blob)
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/blob")
 	c.Assert(err, gc.IsNil)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	c.Assert(metadata, gc.Equals, blobstore.Metadata{
+		Length:        int64(len(blob)),
+		SHA384Hash:    hash,
+		Hash:          hash,
+		HashAlgorithm: blobstore.SHA384,
+		ContentType:   "text/plain; charset=utf-8",
+	})
+}
 
-	// Check the data and catalog entry really are removed.
-	_, _, err = s.managedStorage.GetForEnvironment("env", "path/to/blob")
-	c.Assert(err, jc.Satisfies, errors.IsNotFound)
-	_, err = s.resourceStorage.Get(resPath)
-	c.Assert(err, gc.NotNil)
+func (s *managedStorageSuite) TestStatContentType(c *gc.C) {
+	blob := []byte("<html><body>hello</body></html>")
+	err := s.managedStorage.PutForEnvironmentWithMeta("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), blobstore.PutMeta{
+		ContentType: "application/x-custom",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	// The same data stored elsewhere without a content type has it detected.
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
 
-	s.assertResourceCatalogCount(c, 0)
-}
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ContentType, gc.Equals, "application/x-custom")
+	metadata, err = s.managedStorage.StatForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ContentType, gc.Equals, "text/html; charset=utf-8")
 
-func (s *managedStorageSuite) TestRemoveNonExistent(c *gc.C) {
-	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/nowhere")
-	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	// Copies and moves keep the content type of their source.
+	err = s.managedStorage.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.MoveForEnvironment("env", "/path/to/copy", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	metadata, err = s.managedStorage.StatForEnvironment("env", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ContentType, gc.Equals, "application/x-custom")
 }
 
-func (s *managedStorageSuite) TestRemoveDifferentPathKeepsData(c *gc.C) {
+func (s *managedStorageSuite) TestPutOverwritesContentType(c *gc.C) {
 	blob := []byte("some resource")
-	s.assertPut(c, "/path/to/blob", blob)
-	s.assertPut(c, "/anotherpath/to/blob", blob)
-	s.assertResourceCatalogCount(c, 1)
-	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
-	c.Assert(err, gc.IsNil)
-	s.assertGet(c, "/anotherpath/to/blob", blob)
-	s.assertResourceCatalogCount(c, 1)
+	err := s.managedStorage.PutForEnvironmentWithMeta("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), blobstore.PutMeta{
+		ContentType: "application/x-custom",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ContentType, gc.Equals, "text/plain; charset=utf-8")
 }
 
-func (s *managedStorageSuite) TestPutRace(c *gc.C) {
+func (s *managedStorageSuite) TestStatFilename(c *gc.C) {
 	blob := []byte("some resource")
-	beforeFunc := func() {
-		s.assertPut(c, "/path/to/blob", blob)
-	}
-	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
-	anotherblob := []byte("another resource")
-	s.assertPut(c, "/path/to/blob", anotherblob)
+	err := s.managedStorage.PutForEnvironmentWithMeta("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), blobstore.PutMeta{
+		Filename: "resource.txt",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	// The same data stored elsewhere has its own filename, or none.
+	err = s.managedStorage.PutForEnvironmentWithMeta("env", "/path/to/other", bytes.NewReader(blob), int64(len(blob)), blobstore.PutMeta{
+		Filename: "other.txt",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertPut(c, "/path/to/another", blob)
 	s.assertResourceCatalogCount(c, 1)
-}
-
-func (s *managedStorageSuite) TestPutDeleteRace(c *gc.C) {
-	blob := []byte("some resource")
-	s.assertPut(c, "/path/to/blob", blob)
-	beforeFunc := func() {
-		err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
-		c.Assert(err, gc.IsNil)
+	for path, filename := range map[string]string{
+		"/path/to/blob":    "resource.txt",
+		"/path/to/other":   "other.txt",
+		"/path/to/another": "",
+	} {
+		metadata, err := s.managedStorage.StatForEnvironment("env", path)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(metadata.Filename, gc.Equals, filename)
+		c.Check(metadata.ContentType, gc.Equals, "text/plain; charset=utf-8")
 	}
-	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
-	anotherblob := []byte("another resource")
-	s.assertPut(c, "/path/to/blob", anotherblob)
-	s.assertResourceCatalogCount(c, 1)
-}
 
-func (s *managedStorageSuite) TestPutRaceWhereCatalogEntryRemoved(c *gc.C) {
-	blob := []byte("some resource")
-	// Remove the resource catalog entry with the resourceId that we are about
-	// to write to a managed resource entry.
-	beforeFunc := []func(){
-		nil, //  resourceCatalog Put()
-		nil, //  managedResource Put()
-		func() {
-			// Shamelessly exploit our knowledge of how ids are made.
-			sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
-			_, _, err := blobstore.GetResourceCatalog(s.managedStorage).Remove(sha384Hash)
-			c.Assert(err, gc.IsNil)
-		},
-	}
-	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc...).Check()
-	rdr := bytes.NewReader(blob)
-	err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", rdr, int64(len(blob)))
-	c.Assert(err, gc.ErrorMatches, "unexpected deletion .*")
-	s.assertResourceCatalogCount(c, 0)
-}
+	// Copies, moves and appends keep the filename of their source.
+	err = s.managedStorage.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.MoveForEnvironment("env", "/path/to/copy", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.AppendForEnvironment("env", "/path/to/moved", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Filename, gc.Equals, "resource.txt")
 
-func (s *managedStorageSuite) TestRemoveRace(c *gc.C) {
-	blob := []byte("some resource")
+	// Storing data again without a filename clears it.
 	s.assertPut(c, "/path/to/blob", blob)
-	beforeFunc := func() {
-		err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
-		c.Assert(err, gc.IsNil)
-	}
-	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
-	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
-	c.Assert(err, jc.Satisfies, errors.IsNotFound)
-	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
-	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	metadata, err = s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Filename, gc.Equals, "")
 }
 
-func (s *managedStorageSuite) TestPutRequestNotFound(c *gc.C) {
-	_, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", "sha384")
+func (s *managedStorageSuite) TestStatNonExistent(c *gc.C) {
+	_, err := s.managedStorage.StatForEnvironment("env", "/path/to/nowhere")
 	c.Assert(err, jc.Satisfies, errors.IsNotFound)
 }
 
-func (s *managedStorageSuite) putTestRandomBlob(c *gc.C, path string) (blob []byte, sha384HashHex string) {
-	id := bson.NewObjectId().Hex()
-	blob = []byte(id)
-	return blob, s.putTestBlob(c, path, blob)
-}
-
+func (s *managedStorageSuite) TestStatPendingUpload(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, gc.IsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, gc.IsNil)
+	_, err = s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrUploadPending)
+}
+
+func (s *managedStorageSuite) TestExistsForEnvironment(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	exists, err := s.managedStorage.ExistsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(exists, jc.IsTrue)
+}
+
+func (s *managedStorageSuite) TestExistsForEnvironmentNonExistent(c *gc.C) {
+	exists, err := s.managedStorage.ExistsForEnvironment("env", "/path/to/nowhere")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(exists, jc.IsFalse)
+}
+
+func (s *managedStorageSuite) TestExistsForEnvironmentPendingUpload(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+	exists, err := s.managedStorage.ExistsForEnvironment("env", "/path/to/blob")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrUploadPending)
+	c.Assert(exists, jc.IsFalse)
+}
+
+func (s *managedStorageSuite) TestListForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	anotherBlob := []byte("another resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/another", anotherBlob)
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Manually set up an entry whose upload has not yet completed.
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/pending",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+
+	infos, err := s.managedStorage.ListForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	blobHash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	anotherBlobHash := calculateCheckSum(c, 0, int64(len(anotherBlob)), anotherBlob)
+	c.Assert(infos, jc.SameContents, []blobstore.ResourceInfo{{
+		Path:          "/path/to/blob",
+		Length:        int64(len(blob)),
+		SHA384Hash:    blobHash,
+		Hash:          blobHash,
+		HashAlgorithm: blobstore.SHA384,
+		ContentType:   "text/plain; charset=utf-8",
+	}, {
+		Path:          "/path/to/another",
+		Length:        int64(len(anotherBlob)),
+		SHA384Hash:    anotherBlobHash,
+		Hash:          anotherBlobHash,
+		HashAlgorithm: blobstore.SHA384,
+		ContentType:   "text/plain; charset=utf-8",
+	}, {
+		Path:    "/path/to/pending",
+		Pending: true,
+	}})
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentEmpty(c *gc.C) {
+	infos, err := s.managedStorage.ListForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) assertListPrefix(c *gc.C, prefix string, expected ...string) {
+	infos, err := s.managedStorage.ListForEnvironmentPrefix("env", prefix)
+	c.Assert(err, jc.ErrorIsNil)
+	paths := make([]string, len(infos))
+	for i, info := range infos {
+		paths[i] = info.Path
+	}
+	c.Assert(paths, jc.SameContents, expected)
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentPrefix(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/agent-binaries/1.25.0", blob)
+	s.assertPut(c, "/agent-binaries/1.25.1", blob)
+	s.assertPut(c, "/agent-binaries-old/1.24.0", blob)
+	s.assertPut(c, "/charms/mysql", blob)
+	err := s.managedStorage.PutForEnvironment("another-env", "/agent-binaries/1.25.0", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.assertListPrefix(c, "agent-binaries/", "/agent-binaries/1.25.0", "/agent-binaries/1.25.1")
+	s.assertListPrefix(c, "/agent-binaries/", "/agent-binaries/1.25.0", "/agent-binaries/1.25.1")
+	s.assertListPrefix(c, "agent-binaries", "/agent-binaries/1.25.0", "/agent-binaries/1.25.1", "/agent-binaries-old/1.24.0")
+	s.assertListPrefix(c, "agent-binaries/1.25.1", "/agent-binaries/1.25.1")
+	s.assertListPrefix(c, "agent.binaries")
+	s.assertListPrefix(c, "", "/agent-binaries/1.25.0", "/agent-binaries/1.25.1", "/agent-binaries-old/1.24.0", "/charms/mysql")
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentPrefixInvalid(c *gc.C) {
+	_, err := s.managedStorage.ListForEnvironmentPrefix("", "agent-binaries/")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentIter(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	iter, err := s.managedStorage.ListForEnvironmentIter("env")
+	c.Assert(err, jc.ErrorIsNil)
+	var info blobstore.ResourceInfo
+	c.Assert(iter.Next(&info), jc.IsTrue)
+	c.Assert(info.Path, gc.Equals, "/path/to/blob")
+	c.Assert(iter.Next(&info), jc.IsFalse)
+	c.Assert(iter.Close(), jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentInvalid(c *gc.C) {
+	_, err := s.managedStorage.ListForEnvironment("")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = s.managedStorage.ListForEnvironment("env/123")
+	c.Assert(err, gc.ErrorMatches, `.* cannot contain "/"`)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentToWriter(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	var buf bytes.Buffer
+	n, err := s.managedStorage.GetForEnvironmentToWriter("env", "/path/to/blob", &buf)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(n, gc.Equals, int64(len(blob)))
+	c.Assert(buf.Bytes(), gc.DeepEquals, blob)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentToWriterNonExistent(c *gc.C) {
+	var buf bytes.Buffer
+	n, err := s.managedStorage.GetForEnvironmentToWriter("env", "/path/to/nowhere", &buf)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(n, gc.Equals, int64(0))
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentToWriterPending(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	_, err := s.managedStorage.ReserveForEnvironment("env", "/path/to/blob", hash, int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	var buf bytes.Buffer
+	_, err = s.managedStorage.GetForEnvironmentToWriter("env", "/path/to/blob", &buf)
+	c.Assert(err, jc.Satisfies, blobstore.IsUploadPending)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentToWriterError(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	n, err := s.managedStorage.GetForEnvironmentToWriter("env", "/path/to/blob", &failingWriter{limit: 4})
+	c.Assert(err, gc.ErrorMatches, `cannot copy resource at path "/path/to/blob": tee failed`)
+	c.Assert(n, gc.Equals, int64(0))
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentVerified(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	r, length, err := s.managedStorage.GetForEnvironmentVerified("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+	c.Assert(r.Close(), jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentVerifiedCorrupted(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	// Corrupt the stored data behind the catalog's back.
+	corrupted := []byte("some resourcf")
+	_, err := s.resourceStorage.Put(resPath, bytes.NewReader(corrupted), int64(len(corrupted)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	r, _, err := s.managedStorage.GetForEnvironmentVerified("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrChecksumMismatch)
+	c.Assert(errors.Cause(r.Close()), gc.Equals, blobstore.ErrChecksumMismatch)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentVerifiedNonExistent(c *gc.C) {
+	_, _, err := s.managedStorage.GetForEnvironmentVerified("env", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentIfChanged(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	expectedHash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	for _, knownHash := range []string{"", "other"} {
+		r, length, hash, err := s.managedStorage.GetForEnvironmentIfChanged("env", "/path/to/blob", knownHash)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(length, gc.Equals, int64(len(blob)))
+		c.Assert(hash, gc.Equals, expectedHash)
+		data, err := ioutil.ReadAll(r)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(data, gc.DeepEquals, blob)
+		c.Assert(r.Close(), jc.ErrorIsNil)
+	}
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentIfChangedNotModified(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	// The data is not opened, so removing it makes no difference.
+	err := s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+
+	knownHash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	r, _, hash, err := s.managedStorage.GetForEnvironmentIfChanged("env", "/path/to/blob", knownHash)
+	c.Assert(err, gc.ErrorMatches, `resource at path "environs/env/path/to/blob": not modified`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrNotModified)
+	c.Assert(r, gc.IsNil)
+	c.Assert(hash, gc.Equals, knownHash)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentIfChangedNonExistent(c *gc.C) {
+	_, _, _, err := s.managedStorage.GetForEnvironmentIfChanged("env", "/path/to/nowhere", "hash")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) assertGetRange(c *gc.C, path string, offset, length int64, expected []byte) {
+	r, err := s.managedStorage.GetRangeForEnvironment("env", path, offset, length)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, expected)
+}
+
+func (s *managedStorageSuite) TestGetRangeForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertGetRange(c, "/path/to/blob", 0, 4, blob[:4])
+	s.assertGetRange(c, "/path/to/blob", 5, 8, blob[5:])
+	s.assertGetRange(c, "/path/to/blob", 13, 0, []byte{})
+}
+
+func (s *managedStorageSuite) TestGetRangeForEnvironmentSpanningChunks(c *gc.C) {
+	// GridFS stores data in chunks of 255KiB.
+	blob := make([]byte, 600*1024)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertGetRange(c, "/path/to/blob", 300*1024, 300*1024, blob[300*1024:])
+	s.assertGetRange(c, "/path/to/blob", 250*1024, 10*1024, blob[250*1024:260*1024])
+}
+
+func (s *managedStorageSuite) TestGetRangeForEnvironmentOutOfRange(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	_, err := s.managedStorage.GetRangeForEnvironment("env", "/path/to/blob", 10, 4)
+	c.Assert(err, gc.ErrorMatches, `range with offset 10 and length 4 of 13 bytes at path "/path/to/blob": range out of bounds`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrOutOfRange)
+	_, err = s.managedStorage.GetRangeForEnvironment("env", "/path/to/blob", 14, 0)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrOutOfRange)
+}
+
+func (s *managedStorageSuite) TestGetRangeForEnvironmentInvalid(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	_, err := s.managedStorage.GetRangeForEnvironment("env", "/path/to/blob", -1, 4)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = s.managedStorage.GetRangeForEnvironment("env", "/path/to/blob", 0, -1)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestGetRangeForEnvironmentNonExistent(c *gc.C) {
+	_, err := s.managedStorage.GetRangeForEnvironment("env", "/path/to/nowhere", 0, 0)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGetSeekerForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	r, length, err := s.managedStorage.GetSeekerForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	offset, err := r.Seek(5, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(offset, gc.Equals, int64(5))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob[5:])
+	_, err = r.Seek(0, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	data, err = ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+}
+
+func (s *managedStorageSuite) TestGetSeekerForEnvironmentNotSupported(c *gc.C) {
+	ms := blobstore.NewManagedStorage(s.db, unseekableStorage{s.resourceStorage})
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = ms.GetSeekerForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotSupported)
+	c.Assert(err, gc.ErrorMatches, `seeking within data at path "/path/to/blob" not supported`)
+}
+
+// unseekableStorage hides any Seek method of the readers
+// returned by the ResourceStorage it wraps.
+type unseekableStorage struct {
+	blobstore.ResourceStorage
+}
+
+func (s unseekableStorage) Get(path string) (io.ReadCloser, error) {
+	r, err := s.ResourceStorage.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ io.ReadCloser }{r}, nil
+}
+
+func (s *managedStorageSuite) TestGetSeekerForEnvironmentNonExistent(c *gc.C) {
+	_, _, err := s.managedStorage.GetSeekerForEnvironment("env", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestRemove(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.IsNil)
+
+	// Check the data and catalog entry really are removed.
+	_, _, err = s.managedStorage.GetForEnvironment("env", "path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, gc.NotNil)
+
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveNonExistent(c *gc.C) {
+	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestRemoveDifferentPathKeepsData(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/anotherpath/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.IsNil)
+	s.assertGet(c, "/anotherpath/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestRemoveForEnvironmentIfSole(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	removed, err := s.managedStorage.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, jc.IsTrue)
+
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, gc.NotNil)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveForEnvironmentIfSoleShared(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/anotherpath/to/blob", blob)
+	removed, err := s.managedStorage.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, jc.IsFalse)
+
+	// Nothing is changed.
+	s.assertGet(c, "/path/to/blob", blob)
+	count, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 2)
+
+	// Once the other path is removed, the data may be.
+	err = s.managedStorage.RemoveForEnvironment("env", "/anotherpath/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	removed, err = s.managedStorage.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, jc.IsTrue)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveForEnvironmentIfSoleNonExistent(c *gc.C) {
+	removed, err := s.managedStorage.RemoveForEnvironmentIfSole("env", "/path/to/nowhere")
+	c.Assert(err, gc.ErrorMatches, `resource at path "environs/env/path/to/nowhere" not found`)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(removed, jc.IsFalse)
+}
+
+func (s *managedStorageSuite) TestRemoveForEnvironmentIfSoleRace(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	// Another path comes to share the data as it is removed.
+	beforeFunc := func() {
+		s.assertPut(c, "/anotherpath/to/blob", blob)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	removed, err := s.managedStorage.RemoveForEnvironmentIfSole("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, jc.IsFalse)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertGet(c, "/anotherpath/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestPutForUser(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForUser("user", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var mrDoc managedResourceDocStub
+	err = s.db.C("managedStoredResources").Find(bson.D{{"path", "users/user/path/to/blob"}}).One(&mrDoc)
+	c.Assert(err, jc.ErrorIsNil)
+
+	r, length, err := s.managedStorage.GetForUser("user", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+	c.Assert(length, gc.Equals, int64(len(blob)))
+
+	// The data is not visible to other users or environments.
+	_, _, err = s.managedStorage.GetForUser("another", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	_, _, err = s.managedStorage.GetForEnvironment("user", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutForUserAndCheckHash(c *gc.C) {
+	blob := []byte("data")
+	rdr := bytes.NewReader(blob)
+	wrongHash := calculateCheckSum(c, 0, 5, []byte("wrong"))
+	err := s.managedStorage.PutForUserAndCheckHash("user", "/some/path", rdr, int64(len(blob)), wrongHash)
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+
+	rdr.Seek(0, 0)
+	sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err = s.managedStorage.PutForUserAndCheckHash("user", "/some/path", rdr, int64(len(blob)), sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutForUserSharesEnvironmentData(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.PutForUser("user", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+
+	// Removing the environment reference leaves the user's data intact.
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+	r, _, err := s.managedStorage.GetForUser("user", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+
+	err = s.managedStorage.RemoveForUser("user", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+	_, _, err = s.managedStorage.GetForUser("user", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGetForUserPendingUpload(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, gc.IsNil)
+	managedResource := blobstore.ManagedResource{
+		User: "user",
+		Path: "users/user/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, gc.IsNil)
+	_, _, err = s.managedStorage.GetForUser("user", "/path/to/blob")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrUploadPending)
+}
+
+func (s *managedStorageSuite) TestRemoveForUserNonExistent(c *gc.C) {
+	err := s.managedStorage.RemoveForUser("user", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutGlobal(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.PutGlobal("/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	var mrDoc managedResourceDocStub
+	err = s.db.C("managedStoredResources").Find(bson.D{{"path", "global/path/to/blob"}}).One(&mrDoc)
+	c.Assert(err, jc.ErrorIsNil)
+
+	r, length, err := s.managedStorage.GetGlobal("/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+	c.Assert(length, gc.Equals, int64(len(blob)))
+}
+
+func (s *managedStorageSuite) TestPutGlobalAndCheckHash(c *gc.C) {
+	blob := []byte("data")
+	rdr := bytes.NewReader(blob)
+	wrongHash := calculateCheckSum(c, 0, 5, []byte("wrong"))
+	err := s.managedStorage.PutGlobalAndCheckHash("/some/path", rdr, int64(len(blob)), wrongHash)
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+
+	rdr.Seek(0, 0)
+	sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err = s.managedStorage.PutGlobalAndCheckHash("/some/path", rdr, int64(len(blob)), sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutGlobalSharesData(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.PutForUser("user", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutGlobal("/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.RemoveForUser("user", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+	r, err := s.resourceStorage.Get(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+
+	err = s.managedStorage.RemoveGlobal("/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *managedStorageSuite) TestRemoveGlobalNonExistent(c *gc.C) {
+	err := s.managedStorage.RemoveGlobal("/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestCopyForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/copy", blob)
+	s.assertResourceCatalogCount(c, 1)
+
+	// The copy remains after the original is removed.
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/copy", blob)
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *managedStorageSuite) TestCopyForEnvironmentOtherHashAlgorithm(c *gc.C) {
+	// Data stored using one hash algorithm may be copied once
+	// the storage is configured to use another.
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	ms := s.newSHA256ManagedStorage(c)
+	err := ms.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/copy", blob)
+	count, err := ms.RefCountForEnvironment("env", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 2)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestCopyForEnvironmentOverwrites(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/copy", []byte("another resource"))
+	s.assertResourceCatalogCount(c, 2)
+	err := s.managedStorage.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/copy", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestCopyForEnvironmentNonExistent(c *gc.C) {
+	err := s.managedStorage.CopyForEnvironment("env", "/path/to/nowhere", "/path/to/copy")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestCopyForEnvironmentPendingUpload(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.CopyForEnvironment("env", "/path/to/blob", "/path/to/copy")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrUploadPending)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/moved", blob)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 1)
+
+	// The reference count is unchanged, so a single remove deletes the data.
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentDestinationExists(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	s.assertPut(c, "/path/to/moved", []byte("another resource"))
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/moved")
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	s.assertGet(c, "/path/to/blob", []byte("some resource"))
+	s.assertGet(c, "/path/to/moved", []byte("another resource"))
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentSamePath(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentNonExistent(c *gc.C) {
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/nowhere", "/path/to/moved")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentSourceRemovedRace(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	beforeFunc := func() {
+		err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/moved")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/moved")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentConcurrentRead(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	beforeFunc := func() {
+		// A read of the source path before the move is applied sees the data.
+		s.assertGet(c, "/path/to/blob", blob)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/moved", blob)
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironment(c *gc.C) {
+	s.PatchValue(blobstore.RemoveAllBatchSize, 2)
+	blob := []byte("some resource")
+	anotherBlob := []byte("another resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	anotherResPath := s.assertPut(c, "/path/to/another", anotherBlob)
+	s.assertPut(c, "/path/to/copy", blob)
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	removed, err := s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 3)
+	infos, err := s.managedStorage.ListForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+
+	// Data still referenced by another environment is kept.
+	assertGet(c, s.resourceStorage, resPath, string(blob))
+	_, err = s.resourceStorage.Get(anotherResPath)
+	c.Assert(err, gc.NotNil)
+	s.assertResourceCatalogCount(c, 1)
+	r, _, err := s.managedStorage.GetForEnvironment("another-env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironmentEmpty(c *gc.C) {
+	removed, err := s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironmentInvalid(c *gc.C) {
+	_, err := s.managedStorage.RemoveAllForEnvironment("")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironmentRace(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/another", []byte("another resource"))
+	// Removing a path concurrently aborts the batch, but the
+	// remaining paths are still removed individually.
+	beforeFunc := func() {
+		err := s.managedStorage.RemoveForEnvironment("env", "/path/to/another")
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	removed, err := s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironmentReleasesInSameTransaction(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/copy", blob)
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	// Once the first transaction is applied, the records are gone
+	// and the reference count already reflects their removal.
+	afterFunc := func() {
+		infos, err := s.managedStorage.ListForEnvironment("env")
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(infos, gc.HasLen, 0)
+		rc := blobstore.GetResourceCatalog(s.managedStorage)
+		hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+		id, err := rc.Find(hash)
+		c.Assert(err, jc.ErrorIsNil)
+		count, err := rc.RefCount(id)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(count, gc.Equals, 1)
+	}
+	defer txntesting.SetAfterHooks(c, s.txnRunner, afterFunc).Check()
+	removed, err := s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 2)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironmentConcurrentReference(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	// Referencing the data concurrently aborts the batch, and the
+	// path is removed individually, leaving the new reference.
+	beforeFunc := func() {
+		err := s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	removed, err := s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 1)
+	assertGet(c, s.resourceStorage, resPath, string(blob))
+
+	// Running the removal again does nothing more.
+	removed, err = s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentIfAbsent(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentIfAbsent("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+
+	anotherBlob := []byte("another resource")
+	err = s.managedStorage.PutForEnvironmentIfAbsent("env", "/path/to/blob", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentIfAbsentExpired(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	now = now.Add(time.Hour)
+
+	anotherBlob := []byte("another resource")
+	err = s.managedStorage.PutForEnvironmentIfAbsent("env", "/path/to/blob", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", anotherBlob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentIfAbsentRace(c *gc.C) {
+	blob := []byte("some resource")
+	anotherBlob := []byte("another resource")
+	beforeFunc := func() {
+		err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	err := s.managedStorage.PutForEnvironmentIfAbsent("env", "/path/to/blob", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentIfMatch(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+
+	anotherBlob := []byte("another resource")
+	err := s.managedStorage.PutForEnvironmentIfMatch("env", "/path/to/blob", hash, bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", anotherBlob)
+	s.assertResourceCatalogCount(c, 1)
+
+	// The hash no longer matches.
+	err = s.managedStorage.PutForEnvironmentIfMatch("env", "/path/to/blob", hash, bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `resource at path "/path/to/blob" has changed: precondition failed`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrPreconditionFailed)
+	s.assertGet(c, "/path/to/blob", anotherBlob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentIfMatchNonExistent(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutForEnvironmentIfMatch("env", "/path/to/blob", hash, bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrPreconditionFailed)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentIfMatchRace(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	racingBlob := []byte("racing resource")
+	beforeFunc := func() {
+		err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(racingBlob), int64(len(racingBlob)))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	anotherBlob := []byte("another resource")
+	err := s.managedStorage.PutForEnvironmentIfMatch("env", "/path/to/blob", hash, bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrPreconditionFailed)
+	s.assertGet(c, "/path/to/blob", racingBlob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) patchTimeNow(now *time.Time) {
+	s.PatchValue(blobstore.TimeNow, func() time.Time {
+		return *now
+	})
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithTTL(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+
+	// Once expired, the data is no longer visible, even before it is purged.
+	now = now.Add(time.Hour)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	_, err = s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	exists, err := s.managedStorage.ExistsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(exists, jc.IsFalse)
+	infos, err := s.managedStorage.ListForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithTTLInvalid(c *gc.C) {
+	err := s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(nil), 0, 0)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTee(c *gc.C) {
+	blob := []byte("some resource")
+	var tee bytes.Buffer
+	err := s.managedStorage.PutForEnvironmentTee("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), &tee)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(tee.Bytes(), jc.DeepEquals, blob)
+	s.assertGet(c, "/path/to/blob", blob)
+}
+
+// failingWriter is an io.Writer which fails
+// once more than limit bytes have been written.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		return 0, errors.New("tee failed")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTeeError(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentTee("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), &failingWriter{limit: 4})
+	c.Assert(err, gc.ErrorMatches, "cannot write data to tee: tee failed")
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTeeNil(c *gc.C) {
+	err := s.managedStorage.PutForEnvironmentTee("env", "/path/to/blob", bytes.NewReader(nil), 0, nil)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentOverwritesTTL(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertPut(c, "/path/to/blob", blob)
+
+	now = now.Add(2 * time.Hour)
+	s.assertGet(c, "/path/to/blob", blob)
+	removed, err := s.managedStorage.PurgeExpired()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestPurgeExpired(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/expiring", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	anotherBlob := []byte("another resource")
+	err = s.managedStorage.PutForEnvironmentWithTTL("another-env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)), 2*time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertRefCount(c, "env", "/path/to/blob", 2)
+
+	now = now.Add(time.Hour)
+	removed, err := s.managedStorage.PurgeExpired()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	// The data is still referenced by the path which has not expired.
+	s.assertRefCount(c, "env", "/path/to/blob", 1)
+	s.assertGet(c, "/path/to/blob", blob)
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 2)
+
+	now = now.Add(time.Hour)
+	removed, err = s.managedStorage.PurgeExpired()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentKeepsTTL(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentWithTTL("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.CopyForEnvironment("env", "/path/to/moved", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+
+	now = now.Add(time.Hour)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/moved")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertGet(c, "/path/to/copy", blob)
+}
+
+func (s *managedStorageSuite) assertRefCount(c *gc.C, envUUID, path string, expected int) {
+	count, err := s.managedStorage.RefCountForEnvironment(envUUID, path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, expected)
+}
+
+func (s *managedStorageSuite) TestRefCountForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertRefCount(c, "env", "/path/to/blob", 1)
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutGlobal("/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertRefCount(c, "env", "/path/to/blob", 3)
+
+	// Removing the data from one environment leaves it referenced elsewhere.
+	err = s.managedStorage.RemoveForEnvironment("another-env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertRefCount(c, "env", "/path/to/blob", 2)
+	s.assertGet(c, "/path/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestRefCountForEnvironmentNonExistent(c *gc.C) {
+	_, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestGarbageCollect(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	// Simulate a process dying between storing data and completing the upload.
+	_, err := s.resourceStorage.Put("orphan", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Recently written data is left alone.
+	removed, err := s.managedStorage.GarbageCollect(time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+	_, err = s.resourceStorage.Get("orphan")
+	c.Assert(err, jc.ErrorIsNil)
+
+	removed, err = s.managedStorage.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	_, err = s.resourceStorage.Get("orphan")
+	c.Assert(err, gc.NotNil)
+	assertGet(c, s.resourceStorage, resPath, string(blob))
+	s.assertGet(c, "/path/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestGarbageCollectSkipsPendingUpload(c *gc.C) {
+	// Data which is stored but whose upload is not yet complete
+	// is not referenced, so is only protected by its age.
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	_, _, err := rc.Put("foo", 4)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.resourceStorage.Put("uploading", strings.NewReader("data"), 4)
+	c.Assert(err, jc.ErrorIsNil)
+	removed, err := s.managedStorage.GarbageCollect(time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+	_, err = s.resourceStorage.Get("uploading")
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestGarbageCollectNotSupported(c *gc.C) {
+	ms := blobstore.NewManagedStorage(s.db, unlistableStorage{s.resourceStorage})
+	_, err := ms.GarbageCollect(0)
+	c.Assert(err, jc.Satisfies, errors.IsNotSupported)
+}
+
+// unlistableStorage hides any List method of the ResourceStorage it wraps.
+type unlistableStorage struct {
+	blobstore.ResourceStorage
+}
+
+func (s *managedStorageSuite) TestPutRace(c *gc.C) {
+	blob := []byte("some resource")
+	beforeFunc := func() {
+		s.assertPut(c, "/path/to/blob", blob)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	anotherblob := []byte("another resource")
+	s.assertPut(c, "/path/to/blob", anotherblob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutDeleteRace(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	beforeFunc := func() {
+		err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+		c.Assert(err, gc.IsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	anotherblob := []byte("another resource")
+	s.assertPut(c, "/path/to/blob", anotherblob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutRaceWhereCatalogEntryRemoved(c *gc.C) {
+	blob := []byte("some resource")
+	// Remove the resource catalog entry with the resourceId that we are about
+	// to write to a managed resource entry.
+	beforeFunc := []func(){
+		nil, //  resourceCatalog Put()
+		nil, //  managedResource Put()
+		func() {
+			// Shamelessly exploit our knowledge of how ids are made.
+			sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+			_, _, err := blobstore.GetResourceCatalog(s.managedStorage).Remove(sha384Hash)
+			c.Assert(err, gc.IsNil)
+		},
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc...).Check()
+	rdr := bytes.NewReader(blob)
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", rdr, int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, "unexpected deletion .*")
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveRace(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	beforeFunc := func() {
+		err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+		c.Assert(err, gc.IsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, beforeFunc).Check()
+	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestCanDedup(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	canDedup, err := s.managedStorage.CanDedup(hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(canDedup, jc.IsFalse)
+
+	s.assertPut(c, "/path/to/blob", blob)
+	canDedup, err = s.managedStorage.CanDedup(hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(canDedup, jc.IsTrue)
+	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestCanDedupMany(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	s.assertPut(c, "/path/to/blob", blob)
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	_, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+
+	canDedup, err := s.managedStorage.CanDedupMany([]string{hash, "foo", "bar"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(canDedup, jc.DeepEquals, map[string]bool{hash: true, "foo": false, "bar": false})
+}
+
+func (s *managedStorageSuite) TestCanDedupPendingUpload(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	_, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	canDedup, err := s.managedStorage.CanDedup("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(canDedup, jc.IsFalse)
+}
+
+func (s *managedStorageSuite) TestPutRequestRandSource(c *gc.C) {
+	blob, hash := s.putTestRandomBlob(c, "path/to/blob")
+	newRequest := func() *blobstore.RequestResponse {
+		ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+			Database:        s.db,
+			ResourceStorage: s.resourceStorage,
+			RandSource:      rand.New(rand.NewSource(42)),
+		})
+		c.Assert(err, jc.ErrorIsNil)
+		resp, err := ms.PutForEnvironmentRequest("env", "path/to/blob", hash)
+		c.Assert(err, jc.ErrorIsNil)
+		return resp
+	}
+	// The same source of randomness results in the same byte range.
+	resp := newRequest()
+	c.Assert(newRequest(), jc.DeepEquals, resp)
+	c.Assert(resp.RangeStart+resp.RangeLength <= int64(len(blob)), jc.IsTrue)
+}
+
+func (s *managedStorageSuite) TestPutRequestNotFound(c *gc.C) {
+	_, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", "sha384")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) putTestRandomBlob(c *gc.C, path string) (blob []byte, sha384HashHex string) {
+	id := bson.NewObjectId().Hex()
+	blob = []byte(id)
+	return blob, s.putTestBlob(c, path, blob)
+}
+
 func (s *managedStorageSuite) putTestBlob(c *gc.C, path string, blob []byte) (sha384HashHex string) {
 	rdr := bytes.NewReader(blob)
 	err := s.managedStorage.PutForEnvironment("env", path, rdr, int64(len(blob)))
@@ -442,12 +2022,166 @@ func (s *managedStorageSuite) TestPutRequestResponseHashMismatch(c *gc.C) {
 	_, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
 	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", sha384Hash)
 	c.Assert(err, gc.IsNil)
-	response := blobstore.NewPutResponse(reqResp.RequestId, "notsha384")
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, "notsha384")
 	err = s.managedStorage.ProofOfAccessResponse(response)
 	c.Assert(err, gc.Equals, blobstore.ErrResponseMismatch)
 	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
 }
 
+func (s *managedStorageSuite) TestPutRequestResponseBadToken(c *gc.C) {
+	blob, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", sha384Hash)
+	c.Assert(err, gc.IsNil)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	c.Assert(reqResp.Token, gc.Not(gc.Equals), "")
+	response := blobstore.NewPutResponse(reqResp.RequestId, "bad-token", sha384Response)
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	c.Assert(err, gc.Not(gc.Equals), blobstore.ErrResponseMismatch)
+
+	// The request is consumed, so the correct token no longer works.
+	response = blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutRequestResponseReplayed(c *gc.C) {
+	blob, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", sha384Hash)
+	c.Assert(err, gc.IsNil)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.managedStorage.ProofOfAccessResponse(response)
+	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+
+	// A fresh request has a different token, so the old response cannot be reused.
+	reqResp2, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reqResp2.Token, gc.Not(gc.Equals), reqResp.Token)
+	staleResponse := blobstore.NewPutResponse(reqResp2.RequestId, reqResp.Token, sha384Response)
+	err = s.managedStorage.ProofOfAccessResponse(staleResponse)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestPutRequestSingleRangeByDefault(c *gc.C) {
+	_, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(reqResp.Ranges, jc.DeepEquals, []blobstore.ByteRange{{
+		Start:  reqResp.RangeStart,
+		Length: reqResp.RangeLength,
+	}})
+}
+
+func (s *managedStorageSuite) newMultiRangeManagedStorage(c *gc.C, ranges int) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ChallengeRanges: ranges,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func (s *managedStorageSuite) TestPutRequestMultipleRanges(c *gc.C) {
+	ms := s.newMultiRangeManagedStorage(c, 3)
+	blob := make([]byte, 10000)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	sha384Hash := s.putTestBlob(c, "path/to/blob", blob)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(reqResp.Ranges, gc.HasLen, 3)
+	c.Assert(reqResp.RangeStart, gc.Equals, reqResp.Ranges[0].Start)
+	c.Assert(reqResp.RangeLength, gc.Equals, reqResp.Ranges[0].Length)
+	var hashes []string
+	var end int64
+	for _, r := range reqResp.Ranges {
+		// The ranges are disjoint, and in order.
+		c.Assert(r.Start >= end, jc.IsTrue)
+		end = r.Start + r.Length
+		hashes = append(hashes, calculateCheckSum(c, r.Start, r.Length, blob))
+	}
+	c.Assert(end <= int64(len(blob)), jc.IsTrue)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, hashes...)
+	err = ms.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "path/to/another", blob)
+}
+
+func (s *managedStorageSuite) TestPutRequestMultipleRangesUnseekable(c *gc.C) {
+	// Storage whose readers cannot seek has the ranges read in turn.
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: unseekableStorage{s.resourceStorage},
+		ChallengeRanges: 3,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	blob := make([]byte, 10000)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	sha384Hash := s.putTestBlob(c, "path/to/blob", blob)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	var hashes []string
+	for _, r := range reqResp.Ranges {
+		hashes = append(hashes, calculateCheckSum(c, r.Start, r.Length, blob))
+	}
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, hashes...)
+	err = ms.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "path/to/another", blob)
+}
+
+func (s *managedStorageSuite) TestPutRequestMultipleRangesMismatch(c *gc.C) {
+	ms := s.newMultiRangeManagedStorage(c, 2)
+	blob, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
+	for i, badHashes := range [][]string{nil, {"bad"}, {"", "bad"}, {"", "", ""}} {
+		c.Logf("test %d", i)
+		reqResp, err := ms.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(reqResp.Ranges, gc.HasLen, 2)
+		hashes := make([]string, len(badHashes))
+		for j := range badHashes {
+			hashes[j] = badHashes[j]
+			if hashes[j] == "" && j < len(reqResp.Ranges) {
+				r := reqResp.Ranges[j]
+				hashes[j] = calculateCheckSum(c, r.Start, r.Length, blob)
+			}
+		}
+		response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, hashes...)
+		err = ms.ProofOfAccessResponse(response)
+		c.Assert(err, gc.Equals, blobstore.ErrResponseMismatch)
+	}
+	_, _, err := s.managedStorage.GetForEnvironment("env", "path/to/another")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutRequestMoreRangesThanBytes(c *gc.C) {
+	ms := s.newMultiRangeManagedStorage(c, 10)
+	blob := []byte("abc")
+	sha384Hash := s.putTestBlob(c, "path/to/blob", blob)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(reqResp.Ranges, gc.HasLen, 3)
+	var hashes []string
+	for _, r := range reqResp.Ranges {
+		hashes = append(hashes, calculateCheckSum(c, r.Start, r.Length, blob))
+	}
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, hashes...)
+	err = ms.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "path/to/another", blob)
+}
+
 func (s *managedStorageSuite) assertPutRequestSingle(c *gc.C, blob []byte, resourceCount int) {
 	if blob == nil {
 		id := bson.NewObjectId().Hex()
@@ -460,7 +2194,7 @@ func (s *managedStorageSuite) assertPutRequestSingle(c *gc.C, blob []byte, resou
 	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "path/to/blob", sha384Hash)
 	c.Assert(err, gc.IsNil)
 	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
-	response := blobstore.NewPutResponse(reqResp.RequestId, sha384Response)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
 	err = s.managedStorage.ProofOfAccessResponse(response)
 	c.Assert(err, gc.IsNil)
 	s.assertGet(c, "path/to/blob", blob)
@@ -495,6 +2229,26 @@ func (s *managedStorageSuite) TestPutRequestSingle(c *gc.C) {
 	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
 }
 
+func (s *managedStorageSuite) TestProofOfAccessResponseReference(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	sha384Hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	reqResp, err := s.managedStorage.PutForEnvironmentRequest("env", "/path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	ref, err := s.managedStorage.ProofOfAccessResponseReference(response)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ref, jc.DeepEquals, blobstore.StoredReference{
+		ResourceId:   sha384Hash,
+		ResourcePath: resPath,
+	})
+	s.assertGet(c, "/path/to/another", blob)
+
+	_, err = s.managedStorage.ProofOfAccessResponseReference(response)
+	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
+}
+
 func (s *managedStorageSuite) TestPutRequestLarge(c *gc.C) {
 	ch := make(chan struct{})
 	s.PatchValue(blobstore.AfterFunc, patchedAfterFunc(ch))
@@ -529,7 +2283,7 @@ func (s *managedStorageSuite) TestPutRequestMultiSequential(c *gc.C) {
 }
 
 func (s *managedStorageSuite) checkPutResponse(c *gc.C, index int, wg *sync.WaitGroup,
-	requestId int64, sha384Hash string, blob []byte) {
+	requestId int64, token, sha384Hash string, blob []byte) {
 
 	// After a random time, respond to a previously queued put request and check the result.
 	go func() {
@@ -539,7 +2293,7 @@ func (s *managedStorageSuite) checkPutResponse(c *gc.C, index int, wg *sync.Wait
 		if expectError {
 			sha384Hash = "bad"
 		}
-		response := blobstore.NewPutResponse(requestId, sha384Hash)
+		response := blobstore.NewPutResponse(requestId, token, sha384Hash)
 		err := s.managedStorage.ProofOfAccessResponse(response)
 		if expectError {
 			c.Check(err, gc.NotNil)
@@ -575,7 +2329,7 @@ func (s *managedStorageSuite) queuePutRequests(c *gc.C, done chan struct{}) {
 				continue
 			}
 			sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
-			s.checkPutResponse(c, i, &wg, reqResp.RequestId, sha384Response, blob)
+			s.checkPutResponse(c, i, &wg, reqResp.RequestId, reqResp.Token, sha384Response, blob)
 		}
 		wg.Wait()
 		close(done)
@@ -621,7 +2375,7 @@ func (s *managedStorageSuite) TestPutRequestExpired(c *gc.C) {
 	// Trigger the request timeout.
 	ch <- trigger
 	<-ch
-	response := blobstore.NewPutResponse(reqResp.RequestId, sha384Response)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
 	err = s.managedStorage.ProofOfAccessResponse(response)
 	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
 	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
@@ -636,7 +2390,7 @@ func (s *managedStorageSuite) TestPutRequestExpiredWithRealTimeAfter(c *gc.C) {
 	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
 	// Wait for request timer to trigger.
 	time.Sleep(7 * time.Millisecond)
-	response := blobstore.NewPutResponse(reqResp.RequestId, sha384Response)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
 	err = s.managedStorage.ProofOfAccessResponse(response)
 	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
 	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
@@ -659,8 +2413,8 @@ func (s *managedStorageSuite) TestPutRequestExpiredMulti(c *gc.C) {
 	ch <- trigger
 	<-ch
 	c.Assert(blobstore.RequestQueueLength(s.managedStorage), gc.Equals, 0)
-	response := blobstore.NewPutResponse(reqResp.RequestId, sha384Response)
-	response2 := blobstore.NewPutResponse(reqResp2.RequestId, sha384Response2)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	response2 := blobstore.NewPutResponse(reqResp2.RequestId, reqResp2.Token, sha384Response2)
 	err = s.managedStorage.ProofOfAccessResponse(response)
 	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
 	err = s.managedStorage.ProofOfAccessResponse(response2)
@@ -675,7 +2429,7 @@ func (s *managedStorageSuite) TestPutRequestDeleted(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 
 	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
-	response := blobstore.NewPutResponse(reqResp.RequestId, sha384Response)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
 	err = s.managedStorage.ProofOfAccessResponse(response)
 	c.Assert(err, gc.Equals, blobstore.ErrResourceDeleted)
 }
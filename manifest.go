@@ -0,0 +1,148 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// Manifest describes all the data stored for an environment, without the
+// data itself. It is encoded as JSON to be kept alongside backups or
+// reviewed in audits.
+type Manifest struct {
+	EnvUUID string          `json:"env-uuid"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes the data stored at a path.
+type ManifestEntry struct {
+	// Path is the path at which the data is stored,
+	// relative to the environment.
+	Path string `json:"path"`
+
+	// Hash is the hex-encoded hash of the data, calculated
+	// using HashAlgorithm, and Length its size in bytes.
+	// Neither is known while the data is being uploaded.
+	Hash          string        `json:"hash,omitempty"`
+	HashAlgorithm HashAlgorithm `json:"hash-algorithm,omitempty"`
+	Length        int64         `json:"length"`
+
+	ContentType string            `json:"content-type,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+
+	// Pending is true if the data is still being uploaded.
+	Pending bool `json:"pending,omitempty"`
+}
+
+// ManifestReconciliation describes how the data stored for an
+// environment differs from a Manifest. All paths are ordered.
+type ManifestReconciliation struct {
+	// Missing holds the paths in the manifest at which nothing is stored.
+	Missing []string
+
+	// Extra holds the paths at which data is stored
+	// which are not in the manifest.
+	Extra []string
+
+	// Mismatched holds the paths whose entries in
+	// the manifest do not describe the data stored.
+	Mismatched []ManifestMismatch
+}
+
+// ManifestMismatch describes a path whose entry in a
+// Manifest does not describe the data stored there.
+type ManifestMismatch struct {
+	Path string
+
+	// Expected is the entry in the manifest, and
+	// Actual the entry describing the data stored.
+	Expected, Actual ManifestEntry
+}
+
+// ManifestForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ManifestForEnvironment(envUUID string) (Manifest, error) {
+	if err := ms.checkOpen(); err != nil {
+		return Manifest{}, err
+	}
+	envPrefix, query, err := ms.environmentPathQuery(envUUID, "")
+	if err != nil {
+		return Manifest{}, err
+	}
+	manifest := Manifest{EnvUUID: envUUID, Entries: []ManifestEntry{}}
+	iter := ms.managedResourceCollection.Find(query).Sort("_id").Iter()
+	var doc managedResourceDoc
+	for iter.Next(&doc) {
+		info, ok, err := ms.resourceInfo(doc, envPrefix)
+		if err != nil {
+			iter.Close()
+			return Manifest{}, err
+		} else if !ok {
+			continue
+		}
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Path:          info.Path,
+			Hash:          info.Hash,
+			HashAlgorithm: info.HashAlgorithm,
+			Length:        info.Length,
+			ContentType:   doc.ContentType,
+			Filename:      doc.Filename,
+			Labels:        doc.Labels,
+			Pending:       info.Pending,
+		})
+		doc = managedResourceDoc{}
+	}
+	if err := iter.Close(); err != nil {
+		return Manifest{}, errors.Annotate(err, "cannot read managed resource records")
+	}
+	return manifest, nil
+}
+
+// ReconcileFromManifest is defined on the ManagedStorage interface.
+func (ms *managedStorage) ReconcileFromManifest(manifest Manifest) (ManifestReconciliation, error) {
+	current, err := ms.ManifestForEnvironment(manifest.EnvUUID)
+	if err != nil {
+		return ManifestReconciliation{}, err
+	}
+	expected := make(map[string]ManifestEntry)
+	for _, entry := range manifest.Entries {
+		if _, ok := expected[entry.Path]; ok {
+			return ManifestReconciliation{}, errors.NotValidf("manifest with repeated path %q", entry.Path)
+		}
+		expected[entry.Path] = entry
+	}
+	var result ManifestReconciliation
+	for _, actual := range current.Entries {
+		entry, ok := expected[actual.Path]
+		if !ok {
+			result.Extra = append(result.Extra, actual.Path)
+			continue
+		}
+		delete(expected, actual.Path)
+		if !manifestEntriesEqual(entry, actual) {
+			result.Mismatched = append(result.Mismatched, ManifestMismatch{
+				Path:     actual.Path,
+				Expected: entry,
+				Actual:   actual,
+			})
+		}
+	}
+	for path := range expected {
+		result.Missing = append(result.Missing, path)
+	}
+	sort.Strings(result.Missing)
+	return result, nil
+}
+
+// manifestEntriesEqual returns whether a and b describe the same data,
+// treating empty and absent labels alike, as they are once encoded.
+func manifestEntriesEqual(a, b ManifestEntry) bool {
+	if len(a.Labels) == 0 && len(b.Labels) == 0 {
+		a.Labels, b.Labels = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestManifestForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.PutForEnvironmentWithLabels("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), map[string]string{"arch": "amd64"})
+	c.Assert(err, jc.ErrorIsNil)
+	anotherBlob := []byte("<html></html>")
+	err = s.managedStorage.PutForEnvironmentWithMeta("env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)), blobstore.PutMeta{
+		Filename: "index.html",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	s.putInterrupted(c, "/path/to/pending", "resource-path", []byte("pending resource"), nil)
+	err = s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	manifest, err := s.managedStorage.ManifestForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(manifest, jc.DeepEquals, blobstore.Manifest{
+		EnvUUID: "env",
+		Entries: []blobstore.ManifestEntry{{
+			Path:          "/path/to/another",
+			Hash:          calculateCheckSum(c, 0, int64(len(anotherBlob)), anotherBlob),
+			HashAlgorithm: blobstore.SHA384,
+			Length:        int64(len(anotherBlob)),
+			ContentType:   "text/html; charset=utf-8",
+			Filename:      "index.html",
+		}, {
+			Path:          "/path/to/blob",
+			Hash:          calculateCheckSum(c, 0, int64(len(blob)), blob),
+			HashAlgorithm: blobstore.SHA384,
+			Length:        int64(len(blob)),
+			ContentType:   "text/plain; charset=utf-8",
+			Labels:        map[string]string{"arch": "amd64"},
+		}, {
+			Path:    "/path/to/pending",
+			Pending: true,
+		}},
+	})
+
+	// The manifest survives being encoded.
+	data, err := json.Marshal(manifest)
+	c.Assert(err, jc.ErrorIsNil)
+	var decoded blobstore.Manifest
+	err = json.Unmarshal(data, &decoded)
+	c.Assert(err, jc.ErrorIsNil)
+	report, err := s.managedStorage.ReconcileFromManifest(decoded)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(report, jc.DeepEquals, blobstore.ManifestReconciliation{})
+}
+
+func (s *managedStorageSuite) TestManifestForEnvironmentEmpty(c *gc.C) {
+	manifest, err := s.managedStorage.ManifestForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(manifest, jc.DeepEquals, blobstore.Manifest{EnvUUID: "env", Entries: []blobstore.ManifestEntry{}})
+	_, err = s.managedStorage.ManifestForEnvironment("")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestReconcileFromManifest(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	s.assertPut(c, "/path/to/changed", []byte("some resource"))
+	s.assertPut(c, "/path/to/removed", []byte("some resource"))
+	manifest, err := s.managedStorage.ManifestForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.assertPut(c, "/path/to/added", []byte("another resource"))
+	s.assertPut(c, "/path/to/changed", []byte("changed resource"))
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/removed")
+	c.Assert(err, jc.ErrorIsNil)
+	current, err := s.managedStorage.ManifestForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+
+	report, err := s.managedStorage.ReconcileFromManifest(manifest)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(report, jc.DeepEquals, blobstore.ManifestReconciliation{
+		Missing: []string{"/path/to/removed"},
+		Extra:   []string{"/path/to/added"},
+		Mismatched: []blobstore.ManifestMismatch{{
+			Path:     "/path/to/changed",
+			Expected: manifest.Entries[1],
+			Actual:   current.Entries[2],
+		}},
+	})
+}
+
+func (s *managedStorageSuite) TestReconcileFromManifestRepeatedPath(c *gc.C) {
+	entry := blobstore.ManifestEntry{Path: "/path/to/blob"}
+	_, err := s.managedStorage.ReconcileFromManifest(blobstore.Manifest{
+		EnvUUID: "env",
+		Entries: []blobstore.ManifestEntry{entry, entry},
+	})
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
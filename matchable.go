@@ -0,0 +1,20 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrNotFound matches, using the standard library's errors.Is,
+	// the errors returned by ManagedStorage and ResourceCatalog
+	// methods which satisfy juju/errors.IsNotFound.
+	ErrNotFound error = errors.NotFound
+
+	// ErrAlreadyExists matches, using the standard library's errors.Is,
+	// the errors returned by ManagedStorage and ResourceCatalog
+	// methods which satisfy juju/errors.IsAlreadyExists.
+	ErrAlreadyExists error = errors.AlreadyExists
+)
@@ -0,0 +1,81 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	stderrors "errors"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestErrorsIsNotFound(c *gc.C) {
+	_, _, err := s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(stderrors.Is(err, blobstore.ErrNotFound), jc.IsTrue)
+	c.Assert(stderrors.Is(err, blobstore.ErrAlreadyExists), jc.IsFalse)
+	// The error still satisfies juju/errors, and its message is unchanged.
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(err, gc.ErrorMatches, `resource at path "environs/env/path/to/blob" not found`)
+
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(stderrors.Is(err, blobstore.ErrNotFound), jc.IsTrue)
+	_, err = blobstore.GetResourceCatalog(s.managedStorage).Get("missing")
+	c.Assert(stderrors.Is(err, blobstore.ErrNotFound), jc.IsTrue)
+}
+
+func (s *managedStorageSuite) TestErrorsIsAlreadyExists(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.PutForEnvironmentIfAbsent("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(stderrors.Is(err, blobstore.ErrAlreadyExists), jc.IsTrue)
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+}
+
+func (s *managedStorageSuite) TestErrorsIsNotModified(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	_, _, _, err := s.managedStorage.GetForEnvironmentIfChanged("env", "/path/to/blob", hash)
+	c.Assert(stderrors.Is(err, blobstore.ErrNotModified), jc.IsTrue)
+	c.Assert(stderrors.Is(err, blobstore.ErrNotFound), jc.IsFalse)
+}
+
+func (s *managedStorageSuite) TestErrorsIsUploadPending(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = rc.Get(id)
+	c.Assert(err, gc.Equals, blobstore.ErrUploadPending)
+
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/blob",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(stderrors.Is(err, blobstore.ErrUploadPending), jc.IsTrue)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrUploadPending)
+	var pendingErr *blobstore.UploadPendingError
+	c.Assert(stderrors.As(err, &pendingErr), jc.IsTrue)
+}
+
+func (s *managedStorageSuite) TestErrorsIsChecksumMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	corrupted := []byte("some resourcf")
+	_, err := s.resourceStorage.Put(resPath, bytes.NewReader(corrupted), int64(len(corrupted)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, _, err := s.managedStorage.GetForEnvironmentVerified("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	c.Assert(stderrors.Is(err, blobstore.ErrChecksumMismatch), jc.IsTrue)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrChecksumMismatch)
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+type memStorage struct {
+	mu    sync.RWMutex
+	blobs map[string]memBlob
+	clock Clock
+}
+
+// memBlob holds data stored in a memStorage.
+type memBlob struct {
+	data     []byte
+	modified time.Time
+}
+
+var (
+	_ ResourceStorage       = (*memStorage)(nil)
+	_ ResourceStorageLister = (*memStorage)(nil)
+)
+
+// NewMemResourceStorage returns a ResourceStorage instance which holds
+// data in memory. It is intended for use in tests.
+func NewMemResourceStorage() ResourceStorage {
+	return NewMemResourceStorageWithClock(WallClock)
+}
+
+// NewMemResourceStorageWithClock is the same as NewMemResourceStorage
+// except that the modification times recorded for the data written are
+// supplied by clock. It should be the Clock given to the ManagedStorage
+// using the storage, so that garbage collection measures the age of data
+// against the same time.
+func NewMemResourceStorageWithClock(clock Clock) ResourceStorage {
+	return &memStorage{
+		blobs: make(map[string]memBlob),
+		clock: clock,
+	}
+}
+
+// memReader is a seekable io.ReadCloser over an in-memory blob.
+type memReader struct {
+	*bytes.Reader
+}
+
+// Close is defined on io.Closer.
+func (memReader) Close() error {
+	return nil
+}
+
+// Get is defined on ResourceStorage.
+func (m *memStorage) Get(path string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blob, ok := m.blobs[path]
+	if !ok {
+		return nil, errors.NotFoundf("resource at path %q", path)
+	}
+	return memReader{bytes.NewReader(blob.data)}, nil
+}
+
+// Put is defined on ResourceStorage.
+func (m *memStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	var buf bytes.Buffer
+	sha384hash := sha512.New384()
+	if _, err := io.CopyN(io.MultiWriter(&buf, sha384hash), r, length); err != nil {
+		return "", errors.Annotatef(err, "failed to write data")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[path] = memBlob{data: buf.Bytes(), modified: m.clock.Now()}
+	return fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+}
+
+// Remove is defined on ResourceStorage.
+func (m *memStorage) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, path)
+	return nil
+}
+
+// List is defined on ResourceStorageLister.
+func (m *memStorage) List() ([]StoredResource, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make([]StoredResource, 0, len(m.blobs))
+	for path, blob := range m.blobs {
+		result = append(result, StoredResource{
+			Path:     path,
+			Modified: blob.modified,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&memStorageSuite{})
+
+type memStorageSuite struct {
+	testing.IsolationSuite
+	stor blobstore.ResourceStorage
+}
+
+func (s *memStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.stor = blobstore.NewMemResourceStorage()
+}
+
+func (s *memStorageSuite) assertPut(c *gc.C, path, data string) {
+	checksum, err := s.stor.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(checksum, gc.Equals, fmt.Sprintf("%x", sha512.Sum384([]byte(data))))
+	assertGet(c, s.stor, path, data)
+}
+
+func (s *memStorageSuite) TestPut(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+}
+
+func (s *memStorageSuite) TestPutSameFileOverwrites(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	s.assertPut(c, "/path/to/file", "hello again")
+}
+
+func (s *memStorageSuite) TestPutShortRead(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("short"), 100)
+	c.Assert(err, gc.ErrorMatches, "failed to write data: EOF")
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *memStorageSuite) TestGetNonExistent(c *gc.C) {
+	_, err := s.stor.Get("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *memStorageSuite) TestGetSeekable(c *gc.C) {
+	s.assertPut(c, "/path/to/file", "hello world")
+	r, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	_, err = r.(io.Seeker).Seek(6, 0)
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "world")
+}
+
+func (s *memStorageSuite) TestRemove(c *gc.C) {
+	path := "/path/to/file"
+	s.assertPut(c, path, "hello world")
+	err := s.stor.Remove(path)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get(path)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *memStorageSuite) TestRemoveNonExistent(c *gc.C) {
+	err := s.stor.Remove("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *memStorageSuite) TestList(c *gc.C) {
+	assertList(c, s.stor)
+	s.assertPut(c, "/path/to/file", "hello world")
+	s.assertPut(c, "/path/to/another", "hello again")
+	assertList(c, s.stor, "/path/to/file", "/path/to/another")
+}
+
+func (s *memStorageSuite) TestListClock(c *gc.C) {
+	clock := &fakeClock{time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.stor = blobstore.NewMemResourceStorageWithClock(clock)
+	s.assertPut(c, "/path/to/file", "hello world")
+	infos, err := s.stor.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Modified, gc.Equals, clock.now)
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+
+	jujutxn "github.com/juju/txn"
+)
+
+// MergeAcrossAlgorithms is defined on the ManagedStorage interface.
+func (ms *managedStorage) MergeAcrossAlgorithms() (merged int, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, err
+	}
+	var docs []resourceDoc
+	query := bson.D{{"path", bson.D{{"$ne", ""}}}}
+	if err := ms.db.C(resourceCatalogCollection).Find(query).Select(bson.D{{"data", 0}}).All(&docs); err != nil {
+		return 0, errors.Annotate(err, "cannot read resource catalog")
+	}
+	var failures []string
+	for _, doc := range docs {
+		if _, alg := doc.hash(); alg == ms.hashAlgorithm {
+			continue
+		}
+		ok, err := ms.mergeResource(doc)
+		if err != nil {
+			failures = append(failures, err.Error())
+		} else if ok {
+			merged++
+		}
+	}
+	if len(failures) > 0 {
+		return merged, errors.Errorf(
+			"cannot merge %d resources: %s",
+			len(failures), strings.Join(failures, "; "),
+		)
+	}
+	return merged, nil
+}
+
+// mergeResource merges the catalog entry described by doc, which is
+// hashed using another algorithm, into the entry for the same data
+// hashed using the storage's algorithm, returning whether it did so.
+// It does not if there is no such entry, or its upload is not complete.
+func (ms *managedStorage) mergeResource(doc resourceDoc) (bool, error) {
+	hash, err := ms.storedHash(doc.Path, doc.Length, ms.hashAlgorithm)
+	if err != nil {
+		return false, errors.Annotatef(err, "cannot hash resource %q", doc.Id)
+	}
+	targetId := resourceDocId(ms.hashAlgorithm, hash)
+	catalog := ms.db.C(resourceCatalogCollection)
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		if attempt > 0 {
+			if err := catalog.FindId(doc.Id).Select(bson.D{{"data", 0}}).One(&doc); err == mgo.ErrNotFound {
+				return nil, jujutxn.ErrNoOperations
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		var target resourceDoc
+		if err := catalog.FindId(targetId).Select(bson.D{{"data", 0}}).One(&target); err == mgo.ErrNotFound {
+			return nil, jujutxn.ErrNoOperations
+		} else if err != nil {
+			return nil, err
+		}
+		if target.Path == "" || target.Length != doc.Length {
+			// The upload is still in progress, or the data
+			// is not the same; either way, it is left alone.
+			return nil, jujutxn.ErrNoOperations
+		}
+		ops := []txn.Op{{
+			C:      catalog.Name,
+			Id:     doc.Id,
+			Assert: bson.D{{"path", doc.Path}, {"refcount", doc.RefCount}},
+			Remove: true,
+		}, {
+			C:      catalog.Name,
+			Id:     targetId,
+			Assert: bson.D{{"path", target.Path}},
+			Update: bson.D{{"$inc", bson.D{{"refcount", doc.RefCount}}}},
+		}}
+		refOps, err := ms.moveReferencesOps(doc.Id, targetId)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, refOps...), nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); err == jujutxn.ErrNoOperations {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Annotatef(err, "cannot merge resource %q into %q", doc.Id, targetId)
+	}
+	// The duplicate data is not removed here, since it may still be being
+	// read through the merged entry; it is left to GarbageCollect.
+	logger.Debugf("merged resource %q into %q", doc.Id, targetId)
+	return true, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) TestMergeAcrossAlgorithms(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/other", []byte("another resource"))
+	ms := s.newSHA256ManagedStorage(c)
+	err := ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 3)
+
+	merged, err := ms.MergeAcrossAlgorithms()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(merged, gc.Equals, 1)
+
+	// Only the entry with a duplicate hashed using
+	// the storage's algorithm is merged.
+	s.assertResourceCatalogCount(c, 2)
+	count, err := ms.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 2)
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+	assertManagedGet(c, ms, "/path/to/another", blob)
+	s.assertGet(c, "/path/to/other", []byte("another resource"))
+
+	// The duplicate data is left for garbage collection.
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Merging again has nothing to do.
+	merged, err = ms.MergeAcrossAlgorithms()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(merged, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestMergeAcrossAlgorithmsRemoveAfterMerge(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	ms := s.newSHA256ManagedStorage(c)
+	err := ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = ms.MergeAcrossAlgorithms()
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The merged references are counted, so the
+	// entry remains until both have been removed.
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/another", blob)
+	err = ms.RemoveForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+}
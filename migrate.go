@@ -0,0 +1,116 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// MigrationProgress describes the progress of a MigrateStorage call.
+type MigrationProgress struct {
+	// Path is the storage path of the data just processed.
+	Path string
+
+	// Skipped is true if the data was already present
+	// in the destination, so was not copied.
+	Skipped bool
+
+	// Done is the number of resources processed so far,
+	// out of Total.
+	Done, Total int
+
+	// BytesCopied is the number of bytes copied so far.
+	BytesCopied int64
+}
+
+// MigrateStorage copies the data of every completed resource in catalog
+// from one ResourceStorage to another. Each copy is verified by reading it
+// back from the destination and checking it against the hash recorded in
+// the catalog; a copy which does not match is removed, and an error whose
+// cause is ErrChecksumMismatch is returned.
+//
+// Data is copied to the same storage path, so the catalog remains valid for
+// either storage and does not need to be updated. Data already present and
+// verified in the destination is skipped, so an interrupted migration may be
+// resumed by calling MigrateStorage again. Data added to the source while a
+// migration is in progress may be missed; to migrate without downtime, run
+// MigrateStorage, switch writers to the destination, and then run it again.
+//
+// If progress is non-nil, it is called after each resource is processed.
+func MigrateStorage(ctx context.Context, from, to ResourceStorage, catalog ResourceCatalog, progress func(MigrationProgress)) error {
+	resources, err := catalog.List()
+	if err != nil {
+		return errors.Annotate(err, "cannot list resources to migrate")
+	}
+	var status MigrationProgress
+	for _, r := range resources {
+		if r.Path != "" && r.Path != emptyResourcePath && !isInlinePath(r.Path) {
+			status.Total++
+		}
+	}
+	for _, r := range resources {
+		if r.Path == "" {
+			// The upload is not complete, so there is nothing to copy yet.
+			continue
+		}
+		if r.Path == emptyResourcePath || isInlinePath(r.Path) {
+			// Empty data, and data held inline, is not held in the resource storage.
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		status.Path = r.Path
+		status.Skipped = verifyStoredResource(ctx, to, r) == nil
+		if !status.Skipped {
+			if err := migrateResource(ctx, from, to, r); err != nil {
+				return errors.Annotatef(err, "cannot migrate resource at storage path %q", r.Path)
+			}
+			status.BytesCopied += r.Length
+		}
+		status.Done++
+		if progress != nil {
+			progress(status)
+		}
+	}
+	return nil
+}
+
+// migrateResource copies the data of r from one storage to
+// another, and verifies that it has arrived intact.
+func migrateResource(ctx context.Context, from, to ResourceStorage, r *Resource) (err error) {
+	rdr, err := from.Get(r.Path)
+	if err != nil {
+		return errors.Annotate(err, "cannot read data")
+	}
+	defer rdr.Close()
+	if _, err := to.Put(r.Path, &contextReader{ctx, rdr}, r.Length); err != nil {
+		return errors.Annotate(err, "cannot write data")
+	}
+	defer cleanupResource(to, r.Path, &err)
+	return verifyStoredResource(ctx, to, r)
+}
+
+// verifyStoredResource returns an error if the data of r is
+// not held in the storage, or does not match its recorded hash.
+func verifyStoredResource(ctx context.Context, stor ResourceStorage, r *Resource) error {
+	rdr, err := stor.Get(r.Path)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	hash := r.HashAlgorithm.New()
+	n, err := io.Copy(hash, &contextReader{ctx, rdr})
+	if err != nil {
+		return errors.Annotate(err, "cannot read data")
+	}
+	if n != r.Length || fmt.Sprintf("%x", hash.Sum(nil)) != r.Hash {
+		return errors.Annotate(ErrChecksumMismatch, "copied data")
+	}
+	return nil
+}
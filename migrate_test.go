@@ -0,0 +1,133 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"context"
+	"crypto/sha256"
+	stderrors "errors"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&migrateSuite{})
+
+type migrateSuite struct {
+	testing.IsolationSuite
+	from    blobstore.ResourceStorage
+	to      blobstore.ResourceStorage
+	catalog *fakeCatalog
+}
+
+// fakeCatalog is a ResourceCatalog which only supports listing.
+type fakeCatalog struct {
+	blobstore.ResourceCatalog
+	resources []*blobstore.Resource
+}
+
+func (f *fakeCatalog) List() ([]*blobstore.Resource, error) {
+	return f.resources, nil
+}
+
+func (s *migrateSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.from = blobstore.NewMemResourceStorage()
+	s.to = blobstore.NewMemResourceStorage()
+	s.catalog = &fakeCatalog{}
+}
+
+func (s *migrateSuite) addResource(c *gc.C, path, data string) {
+	_, err := s.from.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	s.catalog.resources = append(s.catalog.resources,
+		blobstore.NewResource(path, blobstore.SHA256, hash, int64(len(data))))
+}
+
+func (s *migrateSuite) migrate(c *gc.C) ([]blobstore.MigrationProgress, error) {
+	var progress []blobstore.MigrationProgress
+	err := blobstore.MigrateStorage(context.Background(), s.from, s.to, s.catalog, func(p blobstore.MigrationProgress) {
+		progress = append(progress, p)
+	})
+	return progress, err
+}
+
+func (s *migrateSuite) TestMigrateStorage(c *gc.C) {
+	s.addResource(c, "abc", "hello")
+	s.addResource(c, "def", "world!")
+	// Pending uploads have no data to migrate.
+	s.catalog.resources = append(s.catalog.resources,
+		blobstore.NewResource("", blobstore.SHA256, "pending", 10))
+	// Nor does empty data, which is not held in the resource storage.
+	s.catalog.resources = append(s.catalog.resources,
+		blobstore.NewResource("empty", blobstore.SHA256, "empty", 0))
+
+	progress, err := s.migrate(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(progress, jc.DeepEquals, []blobstore.MigrationProgress{
+		{Path: "abc", Done: 1, Total: 2, BytesCopied: 5},
+		{Path: "def", Done: 2, Total: 2, BytesCopied: 11},
+	})
+	assertGet(c, s.to, "abc", "hello")
+	assertGet(c, s.to, "def", "world!")
+}
+
+func (s *migrateSuite) TestMigrateStorageResumes(c *gc.C) {
+	s.addResource(c, "abc", "hello")
+	s.addResource(c, "def", "world!")
+	_, err := s.to.Put("abc", strings.NewReader("hello"), 5)
+	c.Assert(err, jc.ErrorIsNil)
+	// Data which does not match the catalog is copied again.
+	_, err = s.to.Put("def", strings.NewReader("w0rld!"), 6)
+	c.Assert(err, jc.ErrorIsNil)
+
+	progress, err := s.migrate(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(progress, jc.DeepEquals, []blobstore.MigrationProgress{
+		{Path: "abc", Skipped: true, Done: 1, Total: 2},
+		{Path: "def", Done: 2, Total: 2, BytesCopied: 6},
+	})
+	assertGet(c, s.to, "def", "world!")
+}
+
+func (s *migrateSuite) TestMigrateStorageCorruptSource(c *gc.C) {
+	s.addResource(c, "abc", "hello")
+	_, err := s.from.Put("abc", strings.NewReader("hullo"), 5)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.migrate(c)
+	c.Assert(err, gc.ErrorMatches, `cannot migrate resource at storage path "abc": copied data: checksum mismatch`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrChecksumMismatch)
+	c.Assert(stderrors.Is(err, blobstore.ErrChecksumMismatch), jc.IsTrue)
+	// The bad copy is removed.
+	_, err = s.to.Get("abc")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *migrateSuite) TestMigrateStorageMissingSource(c *gc.C) {
+	s.catalog.resources = []*blobstore.Resource{
+		blobstore.NewResource("abc", blobstore.SHA256, "hash", 5),
+	}
+	_, err := s.migrate(c)
+	c.Assert(err, gc.ErrorMatches, `cannot migrate resource at storage path "abc": cannot read data: .*`)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(stderrors.Is(err, blobstore.ErrNotFound), jc.IsTrue)
+}
+
+func (s *migrateSuite) TestMigrateStorageCancelled(c *gc.C) {
+	s.addResource(c, "abc", "hello")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := blobstore.MigrateStorage(ctx, s.from, s.to, s.catalog, nil)
+	c.Assert(err, gc.Equals, context.Canceled)
+	_, err = s.to.Get("abc")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
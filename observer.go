@@ -0,0 +1,115 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Observer is notified of the operations performed by a ManagedStorage,
+// so that metrics such as latency and failure rates may be collected.
+// Implementations must be safe for concurrent use, and should return
+// quickly since they are called synchronously.
+type Observer interface {
+	// ObservePut is called when an attempt to store data completes. bytes
+	// is the number of bytes read from the caller, and err is the result.
+	// deduplicated is true if the data was already stored, so the put
+	// referred to it rather than writing the data again.
+	ObservePut(bytes int64, deduplicated bool, dur time.Duration, err error)
+
+	// ObserveGet is called when a read of stored data completes: when the
+	// reader returned is closed, or when the data cannot be opened. bytes
+	// is the length of the data, and dur includes the time spent reading
+	// it. err is the error opening the data, if any, otherwise the first
+	// error other than io.EOF returned when reading it.
+	ObserveGet(bytes int64, dur time.Duration, err error)
+
+	// ObserveRemove is called when an attempt to remove data completes.
+	ObserveRemove(dur time.Duration, err error)
+
+	// ObserveProofOfAccess is called when a proof of access response has
+	// been processed. If err is nil, a reference to the existing data was
+	// created without it being transferred; bytes is its length.
+	ObserveProofOfAccess(bytes int64, dur time.Duration, err error)
+}
+
+// nopObserver is an Observer which does nothing.
+type nopObserver struct{}
+
+// ObservePut is defined on the Observer interface.
+func (nopObserver) ObservePut(int64, bool, time.Duration, error) {}
+
+// ObserveGet is defined on the Observer interface.
+func (nopObserver) ObserveGet(int64, time.Duration, error) {}
+
+// ObserveRemove is defined on the Observer interface.
+func (nopObserver) ObserveRemove(time.Duration, error) {}
+
+// ObserveProofOfAccess is defined on the Observer interface.
+func (nopObserver) ObserveProofOfAccess(int64, time.Duration, error) {}
+
+// observeGet arranges for a get started at start to be reported to the
+// storage's Observer once the reader returned is closed, or immediately
+// if the get failed with err. The reader returned may still be used to
+// seek if rdr can be.
+func (ms *managedStorage) observeGet(start time.Time, rdr io.ReadCloser, length int64, err error) io.ReadCloser {
+	if err != nil {
+		ms.observer.ObserveGet(length, time.Since(start), err)
+		return rdr
+	}
+	observed := &observedReadCloser{
+		ReadCloser: rdr,
+		observe: func(err error) {
+			ms.observer.ObserveGet(length, time.Since(start), err)
+		},
+	}
+	if seeker, ok := rdr.(io.Seeker); ok {
+		return &observedReadSeekCloser{observed, seeker}
+	}
+	return observed
+}
+
+// observedReadCloser is an io.ReadCloser which calls observe
+// with the first error reading the data, if any, when closed.
+type observedReadCloser struct {
+	io.ReadCloser
+	observe func(err error)
+
+	mu   sync.Mutex
+	err  error
+	once sync.Once
+}
+
+// Read is defined on io.Reader.
+func (r *observedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+// Close is defined on io.Closer.
+func (r *observedReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.observe(r.err)
+	})
+	return err
+}
+
+// observedReadSeekCloser is an observedReadCloser
+// which forwards Seek to the underlying reader.
+type observedReadSeekCloser struct {
+	*observedReadCloser
+	io.Seeker
+}
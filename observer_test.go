@@ -0,0 +1,165 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// observation records a single call to an Observer.
+type observation struct {
+	op           string
+	bytes        int64
+	deduplicated bool
+	err          error
+}
+
+// recordingObserver is an Observer which records the operations it is notified of.
+type recordingObserver struct {
+	mu           sync.Mutex
+	observations []observation
+}
+
+func (o *recordingObserver) record(op string, bytes int64, deduplicated bool, dur time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if dur < 0 {
+		panic("negative duration")
+	}
+	o.observations = append(o.observations, observation{op, bytes, deduplicated, err})
+}
+
+func (o *recordingObserver) ObservePut(bytes int64, deduplicated bool, dur time.Duration, err error) {
+	o.record("put", bytes, deduplicated, dur, err)
+}
+
+func (o *recordingObserver) ObserveGet(bytes int64, dur time.Duration, err error) {
+	o.record("get", bytes, false, dur, err)
+}
+
+func (o *recordingObserver) ObserveRemove(dur time.Duration, err error) {
+	o.record("remove", 0, false, dur, err)
+}
+
+func (o *recordingObserver) ObserveProofOfAccess(bytes int64, dur time.Duration, err error) {
+	o.record("proof-of-access", bytes, false, dur, err)
+}
+
+// take returns the observations recorded so far, and forgets them.
+func (o *recordingObserver) take() []observation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	observations := o.observations
+	o.observations = nil
+	return observations
+}
+
+func (s *managedStorageSuite) newObservedManagedStorage(c *gc.C) (blobstore.ManagedStorage, *recordingObserver) {
+	observer := &recordingObserver{}
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		Observer:        observer,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms, observer
+}
+
+func (s *managedStorageSuite) TestObserver(c *gc.C) {
+	ms, observer := s.newObservedManagedStorage(c)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	r, length, err := ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(observer.take(), jc.DeepEquals, []observation{
+		{op: "put", bytes: int64(len(blob))},
+		{op: "get", bytes: int64(len(blob))},
+		{op: "remove"},
+	})
+}
+
+func (s *managedStorageSuite) TestObserverDeduplicatedPut(c *gc.C) {
+	ms, observer := s.newObservedManagedStorage(c)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(observer.take(), jc.DeepEquals, []observation{
+		{op: "put", bytes: int64(len(blob))},
+		{op: "put", bytes: int64(len(blob)), deduplicated: true},
+	})
+}
+
+func (s *managedStorageSuite) TestObserverGetObservedOnClose(c *gc.C) {
+	ms, observer := s.newObservedManagedStorage(c)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	observer.take()
+
+	r, _, err := ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+	c.Assert(observer.take(), gc.HasLen, 0)
+	r.Close()
+	r.Close()
+	c.Assert(observer.take(), jc.DeepEquals, []observation{
+		{op: "get", bytes: int64(len(blob))},
+	})
+}
+
+func (s *managedStorageSuite) TestObserverErrors(c *gc.C) {
+	ms, observer := s.newObservedManagedStorage(c)
+	_, _, getErr := ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(getErr, jc.Satisfies, errors.IsNotFound)
+	removeErr := ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(removeErr, jc.Satisfies, errors.IsNotFound)
+	putErr := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader([]byte("short")), 10)
+	c.Assert(putErr, gc.NotNil)
+
+	c.Assert(observer.take(), jc.DeepEquals, []observation{
+		{op: "get", err: getErr},
+		{op: "remove", err: removeErr},
+		{op: "put", err: putErr},
+	})
+}
+
+func (s *managedStorageSuite) TestObserverProofOfAccess(c *gc.C) {
+	blob, sha384Hash := s.putTestRandomBlob(c, "path/to/blob")
+	ms, observer := s.newObservedManagedStorage(c)
+	reqResp, err := ms.PutForEnvironmentRequest("env", "path/to/another", sha384Hash)
+	c.Assert(err, jc.ErrorIsNil)
+	sha384Response := calculateCheckSum(c, reqResp.RangeStart, reqResp.RangeLength, blob)
+	response := blobstore.NewPutResponse(reqResp.RequestId, reqResp.Token, sha384Response)
+	err = ms.ProofOfAccessResponse(response)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The response was consumed, so a second attempt fails.
+	err = ms.ProofOfAccessResponse(response)
+	c.Assert(err, gc.Equals, blobstore.ErrRequestExpired)
+
+	c.Assert(observer.take(), jc.DeepEquals, []observation{
+		{op: "proof-of-access", bytes: int64(len(blob))},
+		{op: "proof-of-access", err: blobstore.ErrRequestExpired},
+	})
+}
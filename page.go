@@ -0,0 +1,69 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ListForEnvironmentPage is defined on the ManagedStorage interface.
+func (ms *managedStorage) ListForEnvironmentPage(envUUID, cursor string, limit int) (_ []ResourceInfo, nextCursor string, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, "", err
+	}
+	if limit < 1 {
+		return nil, "", errors.NotValidf("limit %d", limit)
+	}
+	envPrefix, query, err := ms.environmentPathQuery(envUUID, "")
+	if err != nil {
+		return nil, "", err
+	}
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", errors.NotValidf("cursor %q", cursor)
+		}
+		query = append(query, bson.DocElem{"_id", bson.D{{"$gt", envPrefix + string(after)}}})
+	}
+	// Data no longer visible is excluded by the query, so that
+	// it does not count towards the limit.
+	query = append(query, liveRecordQuery(ms.clock.Now())...)
+	// The managed path is the record's id, so ordering by it is stable and
+	// uses the id index. One more record is read than is returned, to find
+	// out whether there is another page.
+	var docs []managedResourceDoc
+	if err := ms.managedResourceCollection.Find(query).Sort("_id").Limit(limit + 1).All(&docs); err != nil {
+		return nil, "", errors.Annotate(err, "cannot read managed resource records")
+	}
+	if len(docs) > limit {
+		docs = docs[:limit]
+		nextCursor = base64.RawURLEncoding.EncodeToString([]byte(docs[limit-1].Id[len(envPrefix):]))
+	}
+	result := make([]ResourceInfo, 0, len(docs))
+	for _, doc := range docs {
+		info, ok, err := ms.resourceInfo(doc, envPrefix)
+		if err != nil {
+			return nil, "", err
+		} else if ok {
+			result = append(result, info)
+		}
+	}
+	return result, nextCursor, nil
+}
+
+// liveRecordQuery returns the query elements matching the managed
+// resource records which are neither soft-deleted nor expired at now.
+func liveRecordQuery(now time.Time) bson.D {
+	return bson.D{
+		{"deletedtime", bson.D{{"$exists", false}}},
+		{"$or", []bson.D{
+			{{"expirytime", bson.D{{"$exists", false}}}},
+			{{"expirytime", bson.D{{"$gt", now}}}},
+		}},
+	}
+}
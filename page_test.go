@@ -0,0 +1,91 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+// listPages returns the paths of all the entries for the environment,
+// read in pages of limit entries, calling between after each page.
+func (s *managedStorageSuite) listPages(c *gc.C, limit int, between func()) []string {
+	var paths []string
+	cursor := ""
+	for {
+		entries, next, err := s.managedStorage.ListForEnvironmentPage("env", cursor, limit)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(len(entries) <= limit, jc.IsTrue)
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		if next == "" {
+			return paths
+		}
+		cursor = next
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentPage(c *gc.C) {
+	var expected []string
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		s.assertPut(c, fmt.Sprintf("/path/to/blob%d", i), []byte("some resource"))
+	}
+	for i := 0; i < 5; i++ {
+		expected = append(expected, fmt.Sprintf("/path/to/blob%d", i))
+	}
+	s.assertPut(c, "/path/to/other", []byte("another resource"))
+	expected = append(expected, "/path/to/other")
+	for _, limit := range []int{1, 2, 3, 6, 10} {
+		c.Check(s.listPages(c, limit, nil), jc.DeepEquals, expected, gc.Commentf("limit %d", limit))
+	}
+
+	entries, next, err := s.managedStorage.ListForEnvironmentPage("env", "", 1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(next, gc.Not(gc.Equals), "")
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].Length, gc.Equals, int64(len("some resource")))
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentPageEmpty(c *gc.C) {
+	entries, next, err := s.managedStorage.ListForEnvironmentPage("env", "", 10)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 0)
+	c.Assert(next, gc.Equals, "")
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentPageConcurrentChanges(c *gc.C) {
+	for _, path := range []string{"/b", "/d", "/f", "/h"} {
+		s.assertPut(c, path, []byte("some resource"))
+	}
+	// Storing data before and after the cursor, and removing data already
+	// listed, neither repeats nor skips the entries not changed.
+	changed := false
+	paths := s.listPages(c, 2, func() {
+		if changed {
+			return
+		}
+		changed = true
+		s.assertPut(c, "/a", []byte("some resource"))
+		s.assertPut(c, "/g", []byte("some resource"))
+		err := s.managedStorage.RemoveForEnvironment("env", "/b")
+		c.Assert(err, jc.ErrorIsNil)
+	})
+	c.Assert(paths, jc.DeepEquals, []string{"/b", "/d", "/f", "/g", "/h"})
+}
+
+func (s *managedStorageSuite) TestListForEnvironmentPageInvalid(c *gc.C) {
+	_, _, err := s.managedStorage.ListForEnvironmentPage("env", "", 0)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, _, err = s.managedStorage.ListForEnvironmentPage("env", "not a cursor!", 10)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, _, err = s.managedStorage.ListForEnvironmentPage("", "", 10)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// uploadProgressCollection is the name of the collection
+	// which stores the uploadProgressDoc records.
+	uploadProgressCollection = "uploadProgress"
+)
+
+// progressUpdateInterval is the minimum time between updates to
+// the progress recorded for a put. It is a variable so that it
+// may be patched for testing.
+var progressUpdateInterval = time.Second
+
+// progressStaleAfter is the time after which progress which has
+// not been updated is assumed to belong to a put which died.
+var progressStaleAfter = time.Minute
+
+// uploadProgressDoc records the progress of a put which is in progress.
+// The records are advisory and short-lived, so they are written directly
+// rather than using transactions. Each put has its own record, so that
+// concurrent puts to the same path do not overwrite each other's.
+type uploadProgressDoc struct {
+	// Id identifies the put which recorded the progress.
+	Id      string    `bson:"_id"`
+	Path    string    `bson:"path"`
+	Written int64     `bson:"written"`
+	Length  int64     `bson:"length"`
+	Updated time.Time `bson:"updated"`
+}
+
+// uploadProgress records the progress of a single put.
+type uploadProgress struct {
+	collection *mgo.Collection
+	clock      Clock
+	doc        uploadProgressDoc
+}
+
+// startProgress records that a put of length bytes to managedPath
+// has started. The caller must call finish once the put is done.
+func (ms *managedStorage) startProgress(managedPath string, length int64) *uploadProgress {
+	p := &uploadProgress{
+		collection: ms.db.C(uploadProgressCollection),
+		clock:      ms.clock,
+		doc: uploadProgressDoc{
+			Id:      bson.NewObjectId().Hex(),
+			Path:    managedPath,
+			Length:  length,
+			Updated: ms.clock.Now(),
+		},
+	}
+	if err := p.collection.Insert(p.doc); err != nil {
+		logger.Debugf("cannot record progress of put to %q: %v", managedPath, err)
+	}
+	// Remove any progress left behind by puts to the path which died.
+	stale := bson.D{
+		{"path", managedPath},
+		{"updated", bson.D{{"$lt", p.doc.Updated.Add(-progressStaleAfter)}}},
+	}
+	if _, err := p.collection.RemoveAll(stale); err != nil {
+		logger.Debugf("cannot remove stale progress of puts to %q: %v", managedPath, err)
+	}
+	return p
+}
+
+// reader returns a reader which reads from r, recording
+// the number of bytes read as the progress of the put.
+func (p *uploadProgress) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, progress: p, count: true}
+}
+
+// keepAlive returns a reader which reads from r, refreshing the
+// recorded progress of the written bytes received, so that it is not taken
+// to be stale while the data is written to the resource storage.
+func (p *uploadProgress) keepAlive(r io.Reader, written int64) io.Reader {
+	return &progressReader{r: r, progress: p, n: written}
+}
+
+// update records that written bytes have been read, if the progress
+// has not been recorded within progressUpdateInterval.
+func (p *uploadProgress) update(written int64) {
+	now := p.clock.Now()
+	if now.Sub(p.doc.Updated) < progressUpdateInterval {
+		return
+	}
+	p.doc.Written, p.doc.Updated = written, now
+	update := bson.D{{"$set", bson.D{{"written", written}, {"updated", now}}}}
+	err := p.collection.UpdateId(p.doc.Id, update)
+	if err != nil && err != mgo.ErrNotFound {
+		logger.Debugf("cannot record progress of put to %q: %v", p.doc.Path, err)
+	}
+}
+
+// finish removes the record of the put's progress.
+func (p *uploadProgress) finish() {
+	err := p.collection.RemoveId(p.doc.Id)
+	if err != nil && err != mgo.ErrNotFound {
+		logger.Debugf("cannot remove progress of put to %q: %v", p.doc.Path, err)
+	}
+}
+
+// progressReader is a reader returned by uploadProgress.reader
+// or keepAlive. If count is false, the bytes read are not counted.
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	count    bool
+	progress *uploadProgress
+}
+
+// Read is defined on io.Reader.
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.count {
+		r.n += int64(n)
+	}
+	r.progress.update(r.n)
+	return n, err
+}
+
+// progressCallbackInterval is the number of bytes read between calls
+// to the progress callback passed to PutForEnvironmentWithProgress.
+// It is a variable so that it may be patched for testing.
+var progressCallbackInterval int64 = 4 * 1024 * 1024
+
+// PutForEnvironmentWithProgress is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentWithProgress(
+	envUUID, path string, r io.Reader, length int64, progress func(bytesWritten int64),
+) (err error) {
+	if progress == nil {
+		return errors.NotValidf("nil progress callback")
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{progressFunc: progress})
+	return err
+}
+
+// progressFuncReader is a reader which calls progress with the number
+// of bytes read each time progressCallbackInterval more have been read.
+type progressFuncReader struct {
+	r        io.Reader
+	progress func(int64)
+	n        int64
+	reported int64
+}
+
+// Read is defined on io.Reader.
+func (r *progressFuncReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n-r.reported >= progressCallbackInterval {
+		r.reported = r.n
+		r.progress(r.n)
+	}
+	return n, err
+}
+
+// finish calls progress with the number of bytes read, once all the data
+// has been read, unless it has already been called with that number.
+func (r *progressFuncReader) finish() {
+	if r.n != r.reported || r.n == 0 {
+		r.reported = r.n
+		r.progress(r.n)
+	}
+}
+
+// PendingProgressForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) PendingProgressForEnvironment(envUUID, path string) (int64, int64, error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return 0, 0, err
+	}
+	// If there are several puts to the path in progress,
+	// report the one whose progress was recorded last.
+	var doc uploadProgressDoc
+	query := bson.D{
+		{"path", managedPath},
+		{"updated", bson.D{{"$gte", ms.clock.Now().Add(-progressStaleAfter)}}},
+	}
+	err = ms.db.C(uploadProgressCollection).Find(query).Sort("-updated").One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, 0, errors.NotFoundf("upload to path %q", managedPath)
+	} else if err != nil {
+		return 0, 0, errors.Annotate(err, "cannot read upload progress")
+	}
+	return doc.Written, doc.Length, nil
+}
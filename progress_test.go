@@ -0,0 +1,159 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing/iotest"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// progressCheckingReader is a reader which yields its data a few bytes at
+// a time, recording the progress reported for the put reading it before
+// each read.
+type progressCheckingReader struct {
+	c        *gc.C
+	ms       blobstore.ManagedStorage
+	path     string
+	data     io.Reader
+	progress [][2]int64
+}
+
+func (r *progressCheckingReader) Read(p []byte) (int, error) {
+	written, total, err := r.ms.PendingProgressForEnvironment("env", r.path)
+	r.c.Assert(err, jc.ErrorIsNil)
+	r.progress = append(r.progress, [2]int64{written, total})
+	if len(p) > 5 {
+		p = p[:5]
+	}
+	return r.data.Read(p)
+}
+
+func (s *managedStorageSuite) TestPendingProgressForEnvironment(c *gc.C) {
+	s.PatchValue(blobstore.ProgressUpdateInterval, time.Duration(0))
+	blob := "some resource"
+	r := &progressCheckingReader{
+		c:    c,
+		ms:   s.managedStorage,
+		path: "/path/to/blob",
+		data: strings.NewReader(blob),
+	}
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", r, int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.progress[:4], jc.DeepEquals, [][2]int64{{0, 13}, {5, 13}, {10, 13}, {13, 13}})
+
+	// Once the put is done, there is no progress to report.
+	_, _, err = s.managedStorage.PendingProgressForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPendingProgressForEnvironmentUnknownLength(c *gc.C) {
+	s.PatchValue(blobstore.ProgressUpdateInterval, time.Duration(0))
+	r := &progressCheckingReader{
+		c:    c,
+		ms:   s.managedStorage,
+		path: "/path/to/blob",
+		data: strings.NewReader("some resource"),
+	}
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", r, -1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.progress[:2], jc.DeepEquals, [][2]int64{{0, -1}, {5, -1}})
+}
+
+func (s *managedStorageSuite) TestPendingProgressForEnvironmentFailedPut(c *gc.C) {
+	s.PatchValue(blobstore.ProgressUpdateInterval, time.Duration(0))
+	r := &progressCheckingReader{
+		c:    c,
+		ms:   s.managedStorage,
+		path: "/path/to/blob",
+		data: strings.NewReader("short"),
+	}
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", r, 10)
+	c.Assert(err, gc.ErrorMatches, "cannot calculate data checksums: expected 10 bytes, got 5")
+	_, _, err = s.managedStorage.PendingProgressForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+// putBeforeReadReader is a reader which makes a put to path
+// before its first read.
+type putBeforeReadReader struct {
+	c    *gc.C
+	ms   blobstore.ManagedStorage
+	path string
+	data io.Reader
+	done bool
+}
+
+func (r *putBeforeReadReader) Read(p []byte) (int, error) {
+	if !r.done {
+		r.done = true
+		err := r.ms.PutForEnvironment("env", r.path, strings.NewReader("other resource"), 14)
+		r.c.Check(err, jc.ErrorIsNil)
+	}
+	return r.data.Read(p)
+}
+
+func (s *managedStorageSuite) TestPendingProgressForEnvironmentConcurrentPuts(c *gc.C) {
+	s.PatchValue(blobstore.ProgressUpdateInterval, time.Duration(0))
+	blob := "some resource"
+	r := &progressCheckingReader{
+		c:    c,
+		ms:   s.managedStorage,
+		path: "/path/to/blob",
+		data: &putBeforeReadReader{
+			c:    c,
+			ms:   s.managedStorage,
+			path: "/path/to/blob",
+			data: strings.NewReader(blob),
+		},
+	}
+	// The put made while the first is in progress
+	// does not disturb the first put's progress.
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/blob", r, int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.progress[:4], jc.DeepEquals, [][2]int64{{0, 13}, {5, 13}, {10, 13}, {13, 13}})
+}
+
+func (s *managedStorageSuite) TestPendingProgressForEnvironmentNotFound(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	_, _, err := s.managedStorage.PendingProgressForEnvironment("env", "/path/to/blob")
+	c.Assert(err, gc.ErrorMatches, `upload to path "environs/env/path/to/blob" not found`)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithProgress(c *gc.C) {
+	s.PatchValue(blobstore.ProgressCallbackInterval, int64(10))
+	blob := []byte(strings.Repeat("x", 25))
+	for _, length := range []int64{int64(len(blob)), -1} {
+		var reported []int64
+		err := s.managedStorage.PutForEnvironmentWithProgress("env", "/path/to/blob", iotest.OneByteReader(bytes.NewReader(blob)), length, func(n int64) {
+			reported = append(reported, n)
+		})
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(reported, jc.DeepEquals, []int64{10, 20, 25}, gc.Commentf("length %d", length))
+		s.assertGet(c, "/path/to/blob", blob)
+	}
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithProgressEmpty(c *gc.C) {
+	var reported []int64
+	err := s.managedStorage.PutForEnvironmentWithProgress("env", "/path/to/blob", strings.NewReader(""), 0, func(n int64) {
+		reported = append(reported, n)
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(reported, jc.DeepEquals, []int64{0})
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentWithProgressNil(c *gc.C) {
+	err := s.managedStorage.PutForEnvironmentWithProgress("env", "/path/to/blob", strings.NewReader("data"), 4, nil)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,32 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// PutForEnvironmentFromFile is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentFromFile(envUUID, path, filename string) (err error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return errors.NewNotFound(err, "")
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !info.Mode().IsRegular() {
+		return errors.NewNotValid(nil, fmt.Sprintf("%q is not a regular file", filename))
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, f, info.Size(), putOptions{})
+	return errors.Annotatef(err, "cannot store file %q", filename)
+}
@@ -0,0 +1,52 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) TestPutForEnvironmentFromFile(c *gc.C) {
+	blob := []byte("some resource")
+	filename := filepath.Join(c.MkDir(), "blob")
+	err := ioutil.WriteFile(filename, blob, 0644)
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.managedStorage.PutForEnvironmentFromFile("env", "/path/to/blob", filename)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+	metadata, err := s.managedStorage.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Length, gc.Equals, int64(len(blob)))
+	c.Assert(metadata.SHA384Hash, gc.Equals, calculateCheckSum(c, 0, int64(len(blob)), blob))
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentFromFileEmpty(c *gc.C) {
+	filename := filepath.Join(c.MkDir(), "empty")
+	err := ioutil.WriteFile(filename, nil, 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForEnvironmentFromFile("env", "/path/to/empty", filename)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/empty", []byte{})
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentFromFileNotFound(c *gc.C) {
+	filename := filepath.Join(c.MkDir(), "missing")
+	err := s.managedStorage.PutForEnvironmentFromFile("env", "/path/to/blob", filename)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentFromFileDirectory(c *gc.C) {
+	dir := c.MkDir()
+	err := s.managedStorage.PutForEnvironmentFromFile("env", "/path/to/blob", dir)
+	c.Assert(err, gc.ErrorMatches, `".*" is not a regular file`)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	s.assertResourceCatalogCount(c, 0)
+}
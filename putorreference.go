@@ -0,0 +1,92 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// PutOrReferenceForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutOrReferenceForEnvironment(
+	envUUID, path string, hash string, length int64, source func() (io.Reader, error),
+) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	if err := ms.hashAlgorithm.checkHashFormat(hash); err != nil {
+		return err
+	}
+	if length < 0 {
+		return errors.NotValidf("negative length")
+	}
+	referenced, err := ms.referenceStored(envUUID, path, hash, length)
+	if err != nil {
+		return err
+	}
+	if referenced {
+		return ms.audit(AuditEvent{
+			Operation:     AuditPut,
+			EnvUUID:       envUUID,
+			Path:          path,
+			Hash:          hash,
+			HashAlgorithm: ms.hashAlgorithm,
+			Length:        length,
+		})
+	}
+	r, err := source()
+	if err != nil {
+		return errors.Annotatef(err, "cannot open data for %q", path)
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{checkHash: hash})
+	return err
+}
+
+// referenceStored records a reference at path, namespaced to the
+// environment, to the data with the given hash and length, returning
+// whether it did so. It does not if no such data is fully stored.
+func (ms *managedStorage) referenceStored(envUUID, path, hash string, length int64) (_ bool, err error) {
+	if _, err := ms.resourceCatalog.Find(hash); errors.IsNotFound(err) || IsUploadPending(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Annotate(err, "cannot query resource catalog")
+	}
+	if err := ms.verifyDedup(hash, length); err != nil {
+		return false, err
+	}
+	resourceId, resourcePath, err := ms.resourceCatalog.Put(hash, length)
+	if err != nil {
+		return false, errors.Annotate(err, "cannot update resource catalog")
+	}
+	defer cleanupResourceCatalog(ms.resourceCatalog, resourceId, &err)
+	if resourcePath == "" {
+		// The data was removed since it was found, and is being stored
+		// again; the reference taken is released, and the data uploaded.
+		if _, _, err := ms.resourceCatalog.Remove(resourceId); err != nil {
+			return false, errors.Annotate(err, "cannot update resource catalog")
+		}
+		return false, nil
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return false, err
+	}
+	// The data is not supplied, so its content
+	// type is detected from the stored copy.
+	contentType, err := ms.storedContentType(resourcePath)
+	if err != nil {
+		return false, err
+	}
+	managedResource := ManagedResource{
+		EnvUUID:     envUUID,
+		Path:        managedPath,
+		ContentType: contentType,
+	}
+	if err := ms.putResourceReference(managedResource, resourceId, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
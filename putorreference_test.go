@@ -0,0 +1,92 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) TestPutOrReferenceForEnvironmentStored(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/other", hash, int64(len(blob)), func() (io.Reader, error) {
+		c.Fatalf("data read although already stored")
+		return nil, nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/other", blob)
+	s.assertResourceCatalogCount(c, 1)
+
+	// The data remains referenced by the new path.
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/other", blob)
+}
+
+func (s *managedStorageSuite) TestPutOrReferenceForEnvironmentNotStored(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	called := 0
+	err := s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/blob", hash, int64(len(blob)), func() (io.Reader, error) {
+		called++
+		return bytes.NewReader(blob), nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(called, gc.Equals, 1)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestPutOrReferenceForEnvironmentUploadMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, 5, []byte("wrong"))
+	err := s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/blob", hash, int64(len(blob)), func() (io.Reader, error) {
+		return bytes.NewReader(blob), nil
+	})
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutOrReferenceForEnvironmentSourceError(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/blob", hash, int64(len(blob)), func() (io.Reader, error) {
+		return nil, errors.New("boom")
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot open data for "/path/to/blob": boom`)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutOrReferenceForEnvironmentLengthMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/other", hash, 1, func() (io.Reader, error) {
+		c.Fatalf("data read although already stored")
+		return nil, nil
+	})
+	c.Assert(err, gc.ErrorMatches, "cannot update resource catalog: length mismatch .*")
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPutOrReferenceForEnvironmentInvalid(c *gc.C) {
+	source := func() (io.Reader, error) {
+		c.Fatalf("data read although arguments invalid")
+		return nil, nil
+	}
+	err := s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/blob", "wrong", 1, source)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	hash := calculateCheckSum(c, 0, 1, []byte("x"))
+	err = s.managedStorage.PutOrReferenceForEnvironment("env", "/path/to/blob", hash, -1, source)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
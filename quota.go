@@ -0,0 +1,76 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+)
+
+// QuotaProvider supplies the storage limits applied to environments.
+type QuotaProvider interface {
+	// QuotaForEnvironment returns the maximum number of bytes of data
+	// which may be stored for the environment. A negative value means
+	// there is no limit.
+	QuotaForEnvironment(envUUID string) (int64, error)
+}
+
+// ErrQuotaExceeded is used to indicate that data was not stored
+// because it would take an environment over its storage quota.
+var ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+
+// checkQuota returns an error whose cause is ErrQuotaExceeded if storing
+// length bytes of data with the given hash would take the environment over
+// its quota. Data which is already stored is not counted, since storing it
+// again only adds a reference to it.
+//
+// The check is not made atomically with the put, so concurrent puts for
+// the same environment may together exceed the quota.
+func (ms *managedStorage) checkQuota(envUUID, hash string, length int64) error {
+	if ms.quotaProvider == nil || envUUID == "" || length == 0 {
+		return nil
+	}
+	if _, err := ms.resourceCatalog.Find(hash); err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) && !IsUploadPending(err) {
+		return errors.Annotate(err, "cannot check for existing data")
+	}
+	limit, err := ms.quotaProvider.QuotaForEnvironment(envUUID)
+	if err != nil {
+		return errors.Annotatef(err, "cannot get quota for environment %q", envUUID)
+	}
+	if limit < 0 {
+		return nil
+	}
+	used, err := ms.environmentStoredBytes(envUUID)
+	if err != nil {
+		return err
+	}
+	if used+length > limit {
+		return errors.Annotatef(ErrQuotaExceeded,
+			"storing %d bytes for environment %q with %d of %d bytes used",
+			length, envUUID, used, limit,
+		)
+	}
+	return nil
+}
+
+// environmentStoredBytes returns the total length of the distinct
+// data referenced by the environment's managed resources.
+func (ms *managedStorage) environmentStoredBytes(envUUID string) (int64, error) {
+	refs, err := ms.environmentReferences(envUUID)
+	if err != nil {
+		return 0, err
+	}
+	docs, err := ms.catalogDocs(refs)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, doc := range docs {
+		total += doc.Length
+	}
+	return total, nil
+}
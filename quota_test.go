@@ -0,0 +1,95 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// fakeQuotaProvider is a QuotaProvider returning
+// the limits held in a map, or no limit.
+type fakeQuotaProvider map[string]int64
+
+func (f fakeQuotaProvider) QuotaForEnvironment(envUUID string) (int64, error) {
+	if envUUID == "broken" {
+		return 0, fmt.Errorf("no quota for you")
+	}
+	if limit, ok := f[envUUID]; ok {
+		return limit, nil
+	}
+	return -1, nil
+}
+
+func (s *managedStorageSuite) newQuotaManagedStorage(c *gc.C, quotas map[string]int64) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		QuotaProvider:   fakeQuotaProvider(quotas),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func (s *managedStorageSuite) TestPutQuotaExceeded(c *gc.C) {
+	ms := s.newQuotaManagedStorage(c, map[string]int64{"env": 20})
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	anotherBlob := []byte("another resource")
+	err = ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, gc.ErrorMatches, `storing 16 bytes for environment "env" with 13 of 20 bytes used: quota exceeded`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrQuotaExceeded)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 1)
+
+	// Other environments are not affected.
+	err = ms.PutForEnvironment("another-env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutQuotaDedup(c *gc.C) {
+	ms := s.newQuotaManagedStorage(c, map[string]int64{"env": 20})
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	// Storing the same data again only adds a reference, so does not count.
+	err = ms.PutForEnvironment("env", "/path/to/copy", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Data stored by another environment does not count either.
+	anotherBlob := []byte("another resource")
+	err = ms.PutForEnvironment("another-env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutQuotaFreedByRemove(c *gc.C) {
+	ms := s.newQuotaManagedStorage(c, map[string]int64{"env": 20})
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	anotherBlob := []byte("another resource")
+	err = ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *managedStorageSuite) TestPutQuotaError(c *gc.C) {
+	ms := s.newQuotaManagedStorage(c, nil)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("broken", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `cannot get quota for environment "broken": no quota for you`)
+	s.assertResourceCatalogCount(c, 0)
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// ErrRangeOrder is used to indicate that a reader returned by
+// GetRangesForEnvironment was read after a later one, from data
+// which does not support seeking.
+var ErrRangeOrder = fmt.Errorf("range read out of order")
+
+// GetRangesForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetRangesForEnvironment(envUUID, path string, ranges []ByteRange) ([]io.ReadCloser, error) {
+	if len(ranges) == 0 {
+		return nil, errors.NotValidf("empty ranges")
+	}
+	for i, r := range ranges {
+		if r.Start < 0 || r.Length < 0 {
+			return nil, errors.NotValidf("range with offset %d and length %d", r.Start, r.Length)
+		}
+		if i > 0 {
+			if prev := ranges[i-1]; r.Start < prev.Start+prev.Length {
+				return nil, errors.NotValidf("range with offset %d overlapping or preceding previous range", r.Start)
+			}
+		}
+	}
+	rdr, size, err := ms.get(context.Background(), envUUID, "", path)
+	if err != nil {
+		return nil, err
+	}
+	if last := ranges[len(ranges)-1]; last.Start > size || last.Length > size-last.Start {
+		rdr.Close()
+		return nil, errors.Annotatef(ErrOutOfRange, "range with offset %d and length %d of %d bytes at path %q", last.Start, last.Length, size, path)
+	}
+	src := &multiRangeSource{rdr: rdr, open: len(ranges)}
+	readers := make([]io.ReadCloser, len(ranges))
+	for i, r := range ranges {
+		readers[i] = &multiRangeReader{src: src, r: r}
+	}
+	return readers, nil
+}
+
+// multiRangeSource holds the data from which the ranges
+// returned by GetRangesForEnvironment are read.
+type multiRangeSource struct {
+	mu     sync.Mutex
+	rdr    io.ReadCloser
+	offset int64
+	open   int
+}
+
+// readAt reads into p from the data at offset.
+func (src *multiRangeSource) readAt(p []byte, offset int64) (int, error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if offset != src.offset {
+		// Seek if we can, so that storage such as GridFS can go straight
+		// to the relevant chunk rather than reading all the data between.
+		if seeker, ok := src.rdr.(io.Seeker); ok {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return 0, errors.Annotatef(err, "cannot seek to offset %d", offset)
+			}
+		} else if offset < src.offset {
+			return 0, errors.Annotatef(ErrRangeOrder, "cannot read offset %d after offset %d", offset, src.offset)
+		} else if _, err := io.CopyN(ioutil.Discard, src.rdr, offset-src.offset); err != nil {
+			return 0, errors.Annotatef(err, "cannot skip to offset %d", offset)
+		}
+		src.offset = offset
+	}
+	n, err := src.rdr.Read(p)
+	src.offset += int64(n)
+	return n, err
+}
+
+// release closes the data once all the readers have been closed.
+func (src *multiRangeSource) release() error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.open--; src.open > 0 {
+		return nil
+	}
+	return src.rdr.Close()
+}
+
+// multiRangeReader is a reader over one of the
+// ranges returned by GetRangesForEnvironment.
+type multiRangeReader struct {
+	src    *multiRangeSource
+	r      ByteRange
+	read   int64
+	closed bool
+}
+
+// Read is defined on io.Reader.
+func (r *multiRangeReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read from closed range")
+	}
+	remaining := r.r.Length - r.read
+	if remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.src.readAt(p, r.r.Start+r.read)
+	r.read += int64(n)
+	if err == io.EOF && r.read < r.r.Length {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close is defined on io.Closer.
+func (r *multiRangeReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.src.release()
+}
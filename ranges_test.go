@@ -0,0 +1,106 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestGetRangesForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	readers, err := s.managedStorage.GetRangesForEnvironment("env", "/path/to/blob", []blobstore.ByteRange{
+		{Start: 0, Length: 4},
+		{Start: 5, Length: 3},
+		{Start: 10, Length: 3},
+		{Start: 13, Length: 0},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(readers, gc.HasLen, 4)
+	for i, expected := range []string{"some", "res", "rce", ""} {
+		data, err := ioutil.ReadAll(readers[i])
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(string(data), gc.Equals, expected)
+		c.Check(readers[i].Close(), jc.ErrorIsNil)
+	}
+}
+
+func (s *managedStorageSuite) TestGetRangesForEnvironmentSpanningChunks(c *gc.C) {
+	// GridFS stores data in chunks of 255KiB.
+	blob := make([]byte, 600*1024)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	s.assertPut(c, "/path/to/blob", blob)
+	ranges := []blobstore.ByteRange{
+		{Start: 250 * 1024, Length: 10 * 1024},
+		{Start: 500 * 1024, Length: 100 * 1024},
+	}
+	readers, err := s.managedStorage.GetRangesForEnvironment("env", "/path/to/blob", ranges)
+	c.Assert(err, jc.ErrorIsNil)
+	for i, r := range ranges {
+		data, err := ioutil.ReadAll(readers[i])
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(data, gc.DeepEquals, blob[r.Start:r.Start+r.Length])
+		readers[i].Close()
+	}
+}
+
+func (s *managedStorageSuite) TestGetRangesForEnvironmentPartlyRead(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	readers, err := s.managedStorage.GetRangesForEnvironment("env", "/path/to/blob", []blobstore.ByteRange{
+		{Start: 0, Length: 4},
+		{Start: 5, Length: 8},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer readers[0].Close()
+	defer readers[1].Close()
+	// The unread remainder of a range is skipped.
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(readers[0], buf)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(buf), gc.Equals, "so")
+	data, err := ioutil.ReadAll(readers[1])
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "resource")
+}
+
+func (s *managedStorageSuite) TestGetRangesForEnvironmentOutOfRange(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	_, err := s.managedStorage.GetRangesForEnvironment("env", "/path/to/blob", []blobstore.ByteRange{
+		{Start: 0, Length: 4},
+		{Start: 10, Length: 4},
+	})
+	c.Assert(err, gc.ErrorMatches, `range with offset 10 and length 4 of 13 bytes at path "/path/to/blob": range out of bounds`)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrOutOfRange)
+}
+
+func (s *managedStorageSuite) TestGetRangesForEnvironmentInvalid(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	for _, ranges := range [][]blobstore.ByteRange{
+		nil,
+		{{Start: -1, Length: 4}},
+		{{Start: 0, Length: -1}},
+		{{Start: 0, Length: 4}, {Start: 2, Length: 4}},
+		{{Start: 5, Length: 4}, {Start: 0, Length: 4}},
+	} {
+		_, err := s.managedStorage.GetRangesForEnvironment("env", "/path/to/blob", ranges)
+		c.Check(err, jc.Satisfies, errors.IsNotValid)
+	}
+}
+
+func (s *managedStorageSuite) TestGetRangesForEnvironmentNonExistent(c *gc.C) {
+	_, err := s.managedStorage.GetRangesForEnvironment("env", "/path/to/nowhere", []blobstore.ByteRange{{}})
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
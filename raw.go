@@ -0,0 +1,50 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// GetForEnvironmentRaw is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentRaw(envUUID, path string) (rc io.ReadCloser, length int64, encoding string, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, "", err
+	}
+	start := time.Now()
+	defer func() {
+		rc = ms.observeGet(start, rc, length, err)
+	}()
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	resource, err := ms.catalogEntry(resourceId, managedPath)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	ctx := context.Background()
+	getter, ok := ms.resourceStore.(ResourceStorageRawGetter)
+	if !ok || resource.Path == emptyResourcePath || isInlinePath(resource.Path) {
+		rdr, err := ms.openStoredWithContext(ctx, resource.Path)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		return ms.throttleReadCloser(ctx, rdr), resource.Length, "", nil
+	}
+	rdr, length, encoding, err := getter.GetRaw(resource.Path)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if encoding == "" {
+		length = resource.Length
+	}
+	return ms.throttleReadCloser(ctx, rdr), length, encoding, nil
+}
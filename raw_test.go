@@ -0,0 +1,63 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestGetForEnvironmentRawCompressed(c *gc.C) {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: blobstore.NewCompressingStorage(s.resourceStorage),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	blob := []byte(strings.Repeat("key: value\n", 1000))
+	err = ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	r, length, encoding, err := ms.GetForEnvironmentRaw("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(encoding, gc.Equals, "gzip")
+	compressed, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(int64(len(compressed)), gc.Equals, length)
+	c.Assert(length < int64(len(blob)), jc.IsTrue)
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(zr)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+
+	// GetForEnvironment still decompresses the data.
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentRawUncompressed(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	r, length, encoding, err := s.managedStorage.GetForEnvironmentRaw("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(encoding, gc.Equals, "")
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+}
+
+func (s *managedStorageSuite) TestGetForEnvironmentRawNotFound(c *gc.C) {
+	_, _, _, err := s.managedStorage.GetForEnvironmentRaw("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// GetReaderAtForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetReaderAtForEnvironment(envUUID, path string) (_ io.ReaderAt, length int64, closeFunc func() error, err error) {
+	ctx := context.Background()
+	rdr, length, err := ms.getUnthrottled(ctx, envUUID, "", path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var ra io.ReaderAt
+	switch r := rdr.(type) {
+	case io.ReaderAt:
+		ra = r
+	case io.ReadSeeker:
+		// Storage such as GridFS can seek straight to the relevant
+		// chunk, so each read is made from where it is needed.
+		ra = &seekingReaderAt{r: r}
+	default:
+		defer rdr.Close()
+		if length > ms.uploadBufferSize {
+			logger.Warningf("buffering %d bytes of data at path %q on disk for random access", length, path)
+		}
+		b := newUploadBuffer(ms.uploadBufferSize, ms.tempDir)
+		if _, err := io.Copy(b, ms.throttle(ctx, rdr)); err != nil {
+			b.Close()
+			return nil, 0, nil, errors.Annotatef(err, "cannot buffer data at path %q", path)
+		}
+		if err := b.finishWrite(); err != nil {
+			b.Close()
+			return nil, 0, nil, errors.Annotatef(err, "cannot buffer data at path %q", path)
+		}
+		// The data has been read within the throttle rate already.
+		return b, length, b.Close, nil
+	}
+	if ms.throttleRate > 0 {
+		ra = &throttledReaderAt{bucket: newTokenBucket(ctx, ms.throttleRate, ms.throttleBurst), r: ra}
+	}
+	return ra, length, rdr.Close, nil
+}
+
+// seekingReaderAt is an io.ReaderAt which reads from a ReadSeeker,
+// seeking to the offset of each read. Reads are serialised, since
+// each moves the position of the underlying reader.
+type seekingReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+// ReadAt is defined on io.ReaderAt.
+func (r *seekingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.r.Seek(off, io.SeekStart); err != nil {
+		return 0, errors.Annotatef(err, "cannot seek to offset %d", off)
+	}
+	// Unlike Read, ReadAt must fill p unless it returns an error,
+	// which is io.EOF if the end of the data is reached.
+	n, err := io.ReadFull(r.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// throttledReaderAt is an io.ReaderAt whose reads are limited
+// by a tokenBucket, which is shared between concurrent reads.
+type throttledReaderAt struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+	r      io.ReaderAt
+}
+
+// ReadAt is defined on io.ReaderAt.
+func (r *throttledReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if waitErr := r.bucket.take(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// zipBlob returns a zip archive holding a file with the given name and data.
+func zipBlob(c *gc.C, name, data string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = io.WriteString(w, data)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(zw.Close(), jc.ErrorIsNil)
+	return buf.Bytes()
+}
+
+// assertZipReaderAt checks that the zip archive at path, as read through
+// a ReaderAt, holds a file with the given name and data.
+func assertZipReaderAt(c *gc.C, ms blobstore.ManagedStorage, path, name, data string) {
+	r, length, closeFunc, err := ms.GetReaderAtForEnvironment("env", path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer closeFunc()
+	zr, err := zip.NewReader(r, length)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(zr.File, gc.HasLen, 1)
+	c.Assert(zr.File[0].Name, gc.Equals, name)
+	f, err := zr.File[0].Open()
+	c.Assert(err, jc.ErrorIsNil)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(content), gc.Equals, data)
+
+	// Reads past the end of the data report io.EOF.
+	buf := make([]byte, 10)
+	n, err := r.ReadAt(buf, length-5)
+	c.Assert(err, gc.Equals, io.EOF)
+	c.Assert(n, gc.Equals, 5)
+}
+
+func (s *managedStorageSuite) TestGetReaderAtForEnvironment(c *gc.C) {
+	data := strings.Repeat("some content\n", 100)
+	blob := zipBlob(c, "file.txt", data)
+	s.assertPut(c, "/path/to/archive.zip", blob)
+	assertZipReaderAt(c, s.managedStorage, "/path/to/archive.zip", "file.txt", data)
+}
+
+func (s *managedStorageSuite) TestGetReaderAtForEnvironmentBuffered(c *gc.C) {
+	tempDir := c.MkDir()
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  unseekableStorage{s.resourceStorage},
+		UploadBufferSize: 100,
+		TempDir:          tempDir,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	data := strings.Repeat("some content\n", 100)
+	blob := zipBlob(c, "file.txt", data)
+	err = ms.PutForEnvironment("env", "/path/to/archive.zip", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	assertZipReaderAt(c, ms, "/path/to/archive.zip", "file.txt", data)
+
+	// The data spilled to disk is removed once the reader is closed.
+	files, err := ioutil.ReadDir(tempDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(files, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestGetReaderAtForEnvironmentNonExistent(c *gc.C) {
+	_, _, _, err := s.managedStorage.GetReaderAtForEnvironment("env", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
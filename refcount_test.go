@@ -0,0 +1,117 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	jujutxn "github.com/juju/txn"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// runConcurrently calls f with each of 0 to n-1 in its own
+// goroutine, returning the errors returned, indexed likewise.
+func runConcurrently(n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// maxContendedAttempts is the number of times retryContended calls
+// a function failing because of contention before giving up.
+const maxContendedAttempts = 10
+
+// retryContended calls f until it returns an error other than one
+// caused by contention with concurrent transactions, or it has been
+// called maxContendedAttempts times, when the last error is returned.
+func retryContended(f func() error) error {
+	var err error
+	for a := 0; a < maxContendedAttempts; a++ {
+		if err = f(); errors.Cause(err) != jujutxn.ErrExcessiveContention {
+			return err
+		}
+	}
+	return errors.Annotatef(err, "still contended after %d attempts", maxContendedAttempts)
+}
+
+func (s *managedStorageSuite) TestConcurrentPutRemoveSameData(c *gc.C) {
+	const goroutines, iterations = 8, 5
+	blob := []byte("some resource")
+	errs := runConcurrently(goroutines, func(i int) error {
+		for j := 0; j < iterations; j++ {
+			path := fmt.Sprintf("/path/to/blob-%d-%d", i, j)
+			err := s.managedStorage.PutForEnvironment("env", path, bytes.NewReader(blob), int64(len(blob)))
+			if errors.Cause(err) == jujutxn.ErrExcessiveContention {
+				// A failed put is cleaned up, so leaves nothing to remove.
+				continue
+			} else if err != nil {
+				return errors.Annotatef(err, "cannot put %q", path)
+			}
+			err = retryContended(func() error {
+				return s.managedStorage.RemoveForEnvironment("env", path)
+			})
+			if err != nil {
+				return errors.Annotatef(err, "cannot remove %q", path)
+			}
+		}
+		return nil
+	})
+	for _, err := range errs {
+		c.Check(err, jc.ErrorIsNil)
+	}
+	// No references were lost, so the catalog entry and
+	// the stored data were removed with the last one.
+	s.assertResourceCatalogCount(c, 0)
+	stored, err := s.resourceStorage.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stored, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestConcurrentCatalogPutRemove(c *gc.C) {
+	const goroutines, iterations = 8, 10
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("hash", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	errs := runConcurrently(goroutines, func(int) error {
+		for j := 0; j < iterations; j++ {
+			if err := retryContended(func() error {
+				_, _, err := rc.Put("hash", 100)
+				return err
+			}); err != nil {
+				return err
+			}
+			if err := retryContended(func() error {
+				_, _, err := rc.Remove(id)
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, err := range errs {
+		c.Check(err, jc.ErrorIsNil)
+	}
+	count, err := rc.RefCount(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 1)
+	wasDeleted, _, err := rc.Remove(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(wasDeleted, jc.IsTrue)
+	s.assertResourceCatalogCount(c, 0)
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Reference identifies a path which refers to stored data.
+type Reference struct {
+	// EnvUUID is the environment to which the path is
+	// namespaced, or empty if it is not namespaced to one.
+	EnvUUID string
+
+	// User is the user to which the path is namespaced, or empty if
+	// it is not namespaced to one. If neither EnvUUID nor User is set,
+	// the path is in global storage.
+	User string
+
+	// Path is the path relative to its namespace.
+	Path string
+}
+
+// ReferrersForHash is defined on the ManagedStorage interface.
+func (ms *managedStorage) ReferrersForHash(hash string) ([]Reference, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	// The catalog entry is looked up by id rather than with Find,
+	// so that references to data still being uploaded are included.
+	resourceId := resourceDocId(ms.hashAlgorithm, hash)
+	if _, err := ms.resourceCatalog.RefCount(resourceId); errors.IsNotFound(err) {
+		return nil, errors.NotFoundf("resource with %s=%q", ms.hashAlgorithm, hash)
+	} else if err != nil {
+		return nil, errors.Annotate(err, "cannot query resource catalog")
+	}
+	return ms.referencesTo(resourceId)
+}
+
+// referencesTo returns the paths which refer to the
+// resource catalog entry with the given id.
+func (ms *managedStorage) referencesTo(resourceId string) ([]Reference, error) {
+	var docs []managedResourceDoc
+	query := bson.D{{"resourceid", resourceId}}
+	if err := ms.managedResourceCollection.Find(query).All(&docs); err != nil {
+		return nil, errors.Annotate(err, "cannot read managed resource records")
+	}
+	refs := make([]Reference, 0, len(docs))
+	for _, doc := range docs {
+		if doc.expired(ms.clock.Now()) {
+			continue
+		}
+		namespace, err := ms.resourceStoragePath(doc.EnvUUID, doc.User, "")
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, Reference{
+			EnvUUID: doc.EnvUUID,
+			User:    doc.User,
+			Path:    strings.TrimPrefix(doc.Path, namespace),
+		})
+	}
+	return refs, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) TestReferrersForHash(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/same", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForUser("fred", "/fred/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutGlobal("/global/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertPut(c, "/path/to/another", []byte("another resource"))
+
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	refs, err := s.managedStorage.ReferrersForHash(hash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(refs, jc.SameContents, []blobstore.Reference{
+		{EnvUUID: "env", Path: "/path/to/blob"},
+		{EnvUUID: "another-env", Path: "/path/to/same"},
+		{User: "fred", Path: "/fred/blob"},
+		{Path: "/global/blob"},
+	})
+
+	// Reference counts are not affected.
+	count, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 4)
+}
+
+func (s *managedStorageSuite) TestReferrersForHashPending(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/pending",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+
+	refs, err := s.managedStorage.ReferrersForHash("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(refs, jc.DeepEquals, []blobstore.Reference{{EnvUUID: "env", Path: "/path/to/pending"}})
+}
+
+func (s *managedStorageSuite) TestReferrersForHashUnreferenced(c *gc.C) {
+	// A catalog entry whose references have all gone is reported
+	// as having no referrers, rather than as not found.
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	_, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	refs, err := s.managedStorage.ReferrersForHash("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(refs, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestReferrersForHashNotFound(c *gc.C) {
+	_, err := s.managedStorage.ReferrersForHash("foo")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+
+	jujutxn "github.com/juju/txn"
+)
+
+// RehashCatalog is defined on the ManagedStorage interface.
+func (ms *managedStorage) RehashCatalog(target HashAlgorithm, report func(id string, err error)) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	if err := target.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+	if report == nil {
+		report = func(string, error) {}
+	}
+	// The ids are read up front since entries are inserted into
+	// the catalog as they are converted.
+	var ids []struct {
+		Id string `bson:"_id"`
+	}
+	catalog := ms.db.C(resourceCatalogCollection)
+	if err := catalog.Find(nil).Select(bson.D{{"_id", 1}}).All(&ids); err != nil {
+		return errors.Annotate(err, "cannot read resource catalog")
+	}
+	for _, id := range ids {
+		err := ms.rehashResource(id.Id, target)
+		if err == errAlreadyRehashed {
+			continue
+		}
+		report(id.Id, err)
+	}
+	return nil
+}
+
+// errAlreadyRehashed is used internally to indicate that a catalog
+// entry is already hashed using the target algorithm.
+var errAlreadyRehashed = fmt.Errorf("already rehashed")
+
+// rehashResource replaces the catalog entry with the given id with one
+// keyed on the hash of its data calculated using target. If an entry with
+// that hash already exists, the references are merged into it and the
+// data held for the replaced entry is removed.
+func (ms *managedStorage) rehashResource(id string, target HashAlgorithm) error {
+	catalog := ms.db.C(resourceCatalogCollection)
+	// Unlike other reads of the catalog, any data held inline is read,
+	// since it is moved to the new entry.
+	var doc resourceDoc
+	if err := catalog.FindId(id).One(&doc); err == mgo.ErrNotFound {
+		// Removed since the ids were read.
+		return errAlreadyRehashed
+	} else if err != nil {
+		return errors.Annotatef(err, "cannot read catalog entry %q", id)
+	}
+	if _, alg := doc.hash(); alg == target {
+		return errAlreadyRehashed
+	}
+	if doc.Path == "" {
+		// There is no data to hash until the upload is complete.
+		return doc.uploadPendingError(ms.clock.Now())
+	}
+	hash, err := ms.storedHash(doc.Path, doc.Length, target)
+	if err != nil {
+		return err
+	}
+	newDoc := newResourceDoc(target, hash, doc.Length)
+	newDoc.Path = doc.Path
+	newDoc.RefCount = doc.RefCount
+	newDoc.Created = doc.Created
+	newDoc.CRC32C = doc.CRC32C
+	newDoc.Data = doc.Data
+
+	var mergedPath string
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		mergedPath = ""
+		if attempt > 0 {
+			if err := catalog.FindId(id).One(&doc); err == mgo.ErrNotFound {
+				return nil, jujutxn.ErrNoOperations
+			} else if err != nil {
+				return nil, err
+			}
+			newDoc.RefCount = doc.RefCount
+		}
+		ops := []txn.Op{{
+			C:      catalog.Name,
+			Id:     doc.Id,
+			Assert: bson.D{{"path", doc.Path}, {"refcount", doc.RefCount}},
+			Remove: true,
+		}}
+		var existing resourceDoc
+		if err := catalog.FindId(newDoc.Id).Select(bson.D{{"data", 0}}).One(&existing); err == mgo.ErrNotFound {
+			ops = append(ops, txn.Op{
+				C:      catalog.Name,
+				Id:     newDoc.Id,
+				Assert: txn.DocMissing,
+				Insert: newDoc,
+			})
+		} else if err != nil {
+			return nil, err
+		} else if existing.Length != doc.Length {
+			return nil, errors.Errorf("length mismatch in resource document %d != %d", existing.Length, doc.Length)
+		} else {
+			update := bson.D{{"$inc", bson.D{{"refcount", doc.RefCount}}}}
+			if existing.Path == "" {
+				// The data is still being uploaded for the existing
+				// entry, so use the data already stored; the upload
+				// will find the entry complete, and discard its copy.
+				set := bson.D{{"path", doc.Path}}
+				if doc.Data != nil {
+					set = append(set, bson.DocElem{"data", doc.Data})
+				}
+				update = append(update, bson.DocElem{"$set", set})
+			} else if existing.Path != doc.Path {
+				mergedPath = doc.Path
+			}
+			ops = append(ops, txn.Op{
+				C:      catalog.Name,
+				Id:     newDoc.Id,
+				Assert: bson.D{{"path", existing.Path}},
+				Update: update,
+			})
+		}
+		refOps, err := ms.moveReferencesOps(doc.Id, newDoc.Id)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, refOps...), nil
+	}
+	txnRunner := txnRunner(ms.db)
+	if err := txnRunner.Run(buildTxn); err == jujutxn.ErrNoOperations {
+		return errAlreadyRehashed
+	} else if err != nil {
+		return errors.Annotatef(err, "cannot update catalog entry %q", id)
+	}
+	if mergedPath != "" {
+		if err := ms.removeStored(mergedPath); err != nil && !errors.IsNotFound(err) {
+			return errors.Annotatef(err, "cannot remove duplicate data at storage path %q", mergedPath)
+		}
+	}
+	return nil
+}
+
+// moveReferencesOps returns the operations to make the managed resources
+// and versions which refer to the catalog entry with id oldId refer to
+// that with id newId instead.
+func (ms *managedStorage) moveReferencesOps(oldId, newId string) ([]txn.Op, error) {
+	var refs []managedResourceDoc
+	query := bson.D{{"resourceid", oldId}}
+	if err := ms.managedResourceCollection.Find(query).Select(bson.D{{"_id", 1}}).All(&refs); err != nil {
+		return nil, err
+	}
+	var ops []txn.Op
+	for _, ref := range refs {
+		ops = append(ops, txn.Op{
+			C:      ms.managedResourceCollection.Name,
+			Id:     ref.Id,
+			Assert: bson.D{{"resourceid", oldId}},
+			Update: bson.D{{"$set", bson.D{{"resourceid", newId}}}},
+		})
+	}
+	versionOps, err := ms.rehashVersionOps(oldId, newId)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, versionOps...), nil
+}
+
+// storedHash returns the hash, calculated using algorithm, of the data
+// at resourcePath, which is expected to be length bytes long.
+func (ms *managedStorage) storedHash(resourcePath string, length int64, algorithm HashAlgorithm) (string, error) {
+	rdr, err := ms.openStored(resourcePath)
+	if err != nil {
+		return "", errors.Annotatef(err, "cannot read data at storage path %q", resourcePath)
+	}
+	defer rdr.Close()
+	hash := algorithm.New()
+	n, err := io.Copy(hash, rdr)
+	if err != nil {
+		return "", errors.Annotatef(err, "cannot read data at storage path %q", resourcePath)
+	}
+	if n != length {
+		return "", errors.Annotatef(ErrChecksumMismatch,
+			"expected %d bytes at storage path %q, read %d", length, resourcePath, n)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
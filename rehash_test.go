@@ -0,0 +1,132 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// rehashResults records the results reported by RehashCatalog.
+type rehashResults map[string]error
+
+func (r rehashResults) report(id string, err error) {
+	r[id] = err
+}
+
+func (s *managedStorageSuite) TestRehashCatalog(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	s.assertPut(c, "/path/to/another", []byte("some resource"))
+	err := s.managedStorage.PutForEnvironment("env", "/path/to/empty", bytes.NewReader(nil), 0)
+	c.Assert(err, jc.ErrorIsNil)
+
+	results := make(rehashResults)
+	err = s.managedStorage.RehashCatalog(blobstore.SHA256, results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 2)
+	for id, err := range results {
+		c.Check(err, jc.ErrorIsNil, gc.Commentf("id %q", id))
+	}
+	s.assertResourceCatalogCount(c, 2)
+
+	// The data is now found using the new hash.
+	ms := s.newSHA256ManagedStorage(c)
+	blob := []byte("some resource")
+	metadata, err := ms.StatForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Hash, gc.Equals, fmt.Sprintf("%x", sha256.Sum256(blob)))
+	c.Assert(metadata.HashAlgorithm, gc.Equals, blobstore.SHA256)
+	count, err := ms.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 2)
+	r, _, err := ms.GetForEnvironmentVerified("env", "/path/to/another")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.Close(), jc.ErrorIsNil)
+	r, _, err = ms.GetForEnvironment("env", "/path/to/empty")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.Close(), jc.ErrorIsNil)
+
+	// Converting again has nothing to do.
+	results = make(rehashResults)
+	err = s.managedStorage.RehashCatalog(blobstore.SHA256, results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestRehashCatalogMergesCollisions(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	ms := s.newSHA256ManagedStorage(c)
+	err := ms.PutForEnvironment("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 2)
+
+	err = s.managedStorage.RehashCatalog(blobstore.SHA256, nil)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The references are merged into the existing entry,
+	// and the duplicate data is removed.
+	s.assertResourceCatalogCount(c, 1)
+	count, err := ms.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 2)
+	_, err = s.resourceStorage.Get(resPath)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	for _, path := range []string{"/path/to/blob", "/path/to/another"} {
+		r, _, err := ms.GetForEnvironmentVerified("env", path)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(r.Close(), jc.ErrorIsNil)
+	}
+
+	// Removing both references removes the merged entry.
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/another")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRehashCatalogUploadPending(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+
+	results := make(rehashResults)
+	err = s.managedStorage.RehashCatalog(blobstore.SHA256, results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[id], jc.Satisfies, blobstore.IsUploadPending)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestRehashCatalogMissingData(c *gc.C) {
+	resPath := s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	err := s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+
+	results := make(rehashResults)
+	err = s.managedStorage.RehashCatalog(blobstore.SHA256, results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 1)
+	for _, err := range results {
+		c.Assert(err, gc.ErrorMatches, `cannot read data at storage path ".*": .*`)
+	}
+	// The entry is left unchanged.
+	count, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 1)
+}
+
+func (s *managedStorageSuite) TestRehashCatalogInvalidAlgorithm(c *gc.C) {
+	err := s.managedStorage.RehashCatalog("md5", nil)
+	c.Assert(err, gc.ErrorMatches, `hash algorithm "md5" not valid`)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
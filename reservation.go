@@ -0,0 +1,163 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const (
+	// reservationCollection is the name of the collection
+	// which stores the reservationDoc records.
+	reservationCollection = "uploadReservations"
+)
+
+// reservationDoc records a path reserved for data to be uploaded later.
+type reservationDoc struct {
+	Id      string `bson:"_id"`
+	EnvUUID string `bson:"envuuid"`
+	Path    string `bson:"path"`
+	// ResourceId is the id of the resource catalog entry
+	// referenced by the path while the upload is pending.
+	ResourceId string `bson:"resourceid"`
+	Hash       string `bson:"hash"`
+	Length     int64  `bson:"length"`
+}
+
+// ReserveForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ReserveForEnvironment(envUUID, path, hash string, length int64) (_ string, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return "", err
+	}
+	if hash == "" {
+		return "", errors.NotValidf("empty hash")
+	}
+	if length < 0 {
+		return "", errors.NotValidf("reservation length %d", length)
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return "", err
+	}
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		return "", errors.Annotate(err, "cannot generate upload token")
+	}
+	resourceId, _, err := ms.resourceCatalog.Put(hash, length)
+	if err != nil {
+		return "", errors.Annotate(err, "cannot update resource catalog")
+	}
+	defer func() {
+		// The catalog entry is pending, so cleanupResourceCatalog
+		// would leave it alone; the reference taken is released here.
+		if err == nil {
+			return
+		}
+		if _, _, removeErr := ms.resourceCatalog.Remove(resourceId); removeErr != nil && !errors.IsNotFound(removeErr) {
+			err = errors.Annotatef(err, "cannot clean up after failed reservation because: %v", removeErr)
+		}
+	}()
+
+	// The path refers to the catalog entry while the upload is pending,
+	// so that it cannot be claimed by anyone else, and readers see that
+	// the upload is pending. The record is written directly, since
+	// putResourceReference expects the catalog entry to be complete.
+	// The reservation lapses if it is not completed within the grace
+	// period given to pending uploads, so that the entry may then be
+	// compacted once the record is purged.
+	managedResource := ManagedResource{
+		EnvUUID:    envUUID,
+		Path:       managedPath,
+		ExpiryTime: ms.clock.Now().Add(pendingUploadGracePeriod),
+	}
+	existingResourceId, err := ms.putManagedResource(managedResource, resourceId, ifAbsent(path))
+	if err != nil {
+		return "", err
+	}
+	if existingResourceId != "" {
+		// An expired record was replaced.
+		if err := ms.releaseResource(managedPath, existingResourceId); err != nil {
+			return "", errors.Annotatef(err, "cannot remove old resource catalog entry with id %q", existingResourceId)
+		}
+	}
+	doc := reservationDoc{
+		Id:         uuid.String(),
+		EnvUUID:    envUUID,
+		Path:       path,
+		ResourceId: resourceId,
+		Hash:       hash,
+		Length:     length,
+	}
+	ops := []txn.Op{{
+		C:      reservationCollection,
+		Id:     doc.Id,
+		Assert: txn.DocMissing,
+		Insert: doc,
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil {
+		if _, removeErr := ms.removeManagedRecord(managedPath); removeErr != nil {
+			logger.Errorf("cannot release reserved path %q: %v", managedPath, removeErr)
+		}
+		return "", errors.Annotate(err, "cannot record reservation")
+	}
+	return doc.Id, nil
+}
+
+// CompleteForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) CompleteForEnvironment(uploadToken string, r io.Reader, length int64) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	var doc reservationDoc
+	if err := ms.db.C(reservationCollection).FindId(uploadToken).One(&doc); err == mgo.ErrNotFound {
+		return errors.NotFoundf("reservation %q", uploadToken)
+	} else if err != nil {
+		return errors.Annotatef(err, "cannot load reservation %q", uploadToken)
+	}
+	if length >= 0 && length != doc.Length {
+		return errors.NotValidf("length %d for reservation of %d bytes", length, doc.Length)
+	}
+	if _, err := ms.resourceCatalog.RefCount(doc.ResourceId); errors.IsNotFound(err) {
+		// The pending catalog entry was compacted away.
+		return errors.NewNotFound(nil, fmt.Sprintf("reservation %q has expired", uploadToken))
+	} else if err != nil {
+		return errors.Annotate(err, "cannot query resource catalog")
+	}
+	managedPath, err := ms.resourceStoragePath(doc.EnvUUID, "", doc.Path)
+	if err != nil {
+		return err
+	}
+	var managedDoc managedResourceDoc
+	if err := ms.managedResourceCollection.FindId(managedPath).One(&managedDoc); err == nil &&
+		managedDoc.ResourceId == doc.ResourceId && managedDoc.expired(ms.clock.Now()) {
+		return errors.NewNotFound(nil, fmt.Sprintf("reservation %q has expired", uploadToken))
+	} else if err != nil && err != mgo.ErrNotFound {
+		return errors.Annotatef(err, "cannot load record for resource with path %q", managedPath)
+	}
+	// The data replaces the reservation's reference, provided
+	// the path has not been removed or replaced since.
+	if _, err := ms.put(context.Background(), doc.EnvUUID, "", doc.Path, r, doc.Length, putOptions{
+		checkHash: doc.Hash,
+		condition: ifMatch(doc.Path, doc.ResourceId),
+	}); err != nil {
+		return err
+	}
+	ops := []txn.Op{{
+		C:      reservationCollection,
+		Id:     doc.Id,
+		Assert: txn.DocExists,
+		Remove: true,
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil && err != txn.ErrAborted {
+		return errors.Annotatef(err, "cannot remove completed reservation %q", uploadToken)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	stderrors "errors"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) reserve(c *gc.C, path string, blob []byte) string {
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	token, err := s.managedStorage.ReserveForEnvironment("env", path, hash, int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(token, gc.Not(gc.Equals), "")
+	return token
+}
+
+func (s *managedStorageSuite) TestReserveForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	token := s.reserve(c, "/path/to/blob", blob)
+
+	// Until the upload is complete, readers see that it is pending.
+	_, _, err := s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, blobstore.IsUploadPending)
+
+	// Nobody else may claim the path.
+	err = s.managedStorage.PutForEnvironmentIfAbsent("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	_, err = s.managedStorage.ReserveForEnvironment("env", "/path/to/blob", "hash", 10)
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+
+	err = s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+	count, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 1)
+
+	// The token may only be used once.
+	err = s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestReserveForEnvironmentExistingPath(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	other := []byte("other resource")
+	hash := calculateCheckSum(c, 0, int64(len(other)), other)
+	_, err := s.managedStorage.ReserveForEnvironment("env", "/path/to/blob", hash, int64(len(other)))
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	// The pending catalog entry created for the reservation is removed.
+	s.assertResourceCatalogCount(c, 1)
+	s.assertGet(c, "/path/to/blob", []byte("some resource"))
+}
+
+func (s *managedStorageSuite) TestCompleteForEnvironmentHashMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	token := s.reserve(c, "/path/to/blob", blob)
+	other := []byte("some-resource")
+	err := s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(other), int64(len(other)))
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+
+	// The reservation remains, so the correct data may be supplied.
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, blobstore.IsUploadPending)
+	err = s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(blob), -1)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+}
+
+func (s *managedStorageSuite) TestCompleteForEnvironmentLengthMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	token := s.reserve(c, "/path/to/blob", blob)
+	err := s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(blob), 5)
+	c.Assert(err, gc.ErrorMatches, "length 5 for reservation of 13 bytes not valid")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestCompleteForEnvironmentPathRemoved(c *gc.C) {
+	blob := []byte("some resource")
+	token := s.reserve(c, "/path/to/blob", blob)
+	err := s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrPreconditionFailed)
+	c.Assert(stderrors.Is(err, blobstore.ErrPreconditionFailed), jc.IsTrue)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestCompleteForEnvironmentExpired(c *gc.C) {
+	blob := []byte("some resource")
+	token := s.reserve(c, "/path/to/blob", blob)
+	now := time.Now().Add(48 * time.Hour)
+	s.patchTimeNow(&now)
+	_, err := blobstore.GetResourceCatalog(s.managedStorage).CompactReferences()
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.managedStorage.CompleteForEnvironment(token, bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, gc.ErrorMatches, `reservation ".*" has expired`)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestReserveForEnvironmentInvalid(c *gc.C) {
+	_, err := s.managedStorage.ReserveForEnvironment("env", "/path/to/blob", "", 10)
+	c.Assert(err, gc.ErrorMatches, "empty hash not valid")
+	_, err = s.managedStorage.ReserveForEnvironment("env", "/path/to/blob", "hash", -1)
+	c.Assert(err, gc.ErrorMatches, "reservation length -1 not valid")
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestCompleteForEnvironmentUnknownToken(c *gc.C) {
+	err := s.managedStorage.CompleteForEnvironment("unknown", bytes.NewReader(nil), 0)
+	c.Assert(err, gc.ErrorMatches, `reservation "unknown" not found`)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
@@ -4,6 +4,10 @@
 package blobstore
 
 import (
+	"fmt"
+	"sort"
+	"time"
+
 	"github.com/juju/errors"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -12,7 +16,8 @@ import (
 
 var (
 	// ErrUploadPending is used to indicate that the underlying resource for a catalog entry
-	// is not yet fully uploaded.
+	// is not yet fully uploaded. It is returned by the ResourceCatalog, and is the cause
+	// of every UploadPendingError.
 	ErrUploadPending = errors.New("Resource not available because upload is not yet complete")
 
 	// errUploadedConcurrently is used to indicate that another client uploaded the
@@ -20,13 +25,69 @@ var (
 	errUploadedConcurrently = errors.AlreadyExistsf("resource")
 )
 
+// UploadPendingError is returned by ManagedStorage when the underlying resource
+// for a managed path is not yet fully uploaded. Its cause is ErrUploadPending, so
+// it may be detected using IsUploadPending or by comparing errors.Cause with
+// ErrUploadPending.
+type UploadPendingError struct {
+	// Path is the managed path of the data being uploaded,
+	// or empty if the error does not relate to a managed path.
+	Path string
+
+	// Elapsed is the time since the upload started. It is zero
+	// if the upload started before start times were recorded.
+	Elapsed time.Duration
+}
+
+// Error is defined on the error interface.
+func (e *UploadPendingError) Error() string {
+	msg := ErrUploadPending.Error()
+	if e.Path != "" {
+		msg = fmt.Sprintf("%s: resource at path %q", msg, e.Path)
+	}
+	if e.Elapsed > 0 {
+		msg = fmt.Sprintf("%s (pending for %v)", msg, e.Elapsed)
+	}
+	return msg
+}
+
+// Cause returns ErrUploadPending, so that errors.Cause
+// of an UploadPendingError is ErrUploadPending.
+func (e *UploadPendingError) Cause() error {
+	return ErrUploadPending
+}
+
+// Unwrap returns ErrUploadPending, so that the standard
+// library's errors.Is matches it against ErrUploadPending.
+func (e *UploadPendingError) Unwrap() error {
+	return ErrUploadPending
+}
+
+// IsUploadPending reports whether the cause of err is ErrUploadPending.
+func IsUploadPending(err error) bool {
+	return err != nil && errors.Cause(err) == ErrUploadPending
+}
+
 // Resource is a catalog entry for stored data.
 // It contains the path where the data is stored as well as
 // a hash of the data which are used for de-duping.
 type Resource struct {
+	// SHA384Hash is the hex-encoded SHA-384 hash of the data.
+	// It is only set if HashAlgorithm is SHA384.
 	SHA384Hash string
-	Path       string
-	Length     int64
+
+	// Hash is the hex-encoded hash of the data, calculated
+	// using HashAlgorithm.
+	Hash          string
+	HashAlgorithm HashAlgorithm
+
+	Path   string
+	Length int64
+
+	// CRC32C is the hex-encoded CRC-32C checksum of the data, used
+	// for fast integrity checks. It is not set for resources stored
+	// before it was recorded.
+	CRC32C string
 }
 
 // resourceDoc is the persistent representation of a Resource.
@@ -34,38 +95,107 @@ type resourceDoc struct {
 	Id string `bson:"_id"`
 	// Path is the storage path of the resource, which will be
 	// the empty string until the upload has been completed.
-	Path       string `bson:"path"`
-	SHA384Hash string `bson:"sha384hash"`
-	Length     int64  `bson:"length"`
-	RefCount   int64  `bson:"refcount"`
+	Path string `bson:"path"`
+	// SHA384Hash is only set for resources hashed using SHA-384.
+	SHA384Hash string `bson:"sha384hash,omitempty"`
+	// Hash and HashAlgorithm are not set for resources
+	// catalogued before the algorithm was configurable;
+	// those are hashed using SHA-384.
+	Hash          string        `bson:"hash,omitempty"`
+	HashAlgorithm HashAlgorithm `bson:"hashalgorithm,omitempty"`
+	Length        int64         `bson:"length"`
+	RefCount      int64         `bson:"refcount"`
+	// Created is the time the resource was first catalogued. It is
+	// not set for resources catalogued before it was recorded.
+	Created time.Time `bson:"created,omitempty"`
+	// CRC32C is recorded once the data has been stored.
+	CRC32C string `bson:"crc32c,omitempty"`
+	// Unverified is set if the hash was supplied by the
+	// client which stored the data, and has not been checked.
+	Unverified bool `bson:"unverified,omitempty"`
+	// PendingPath is the storage path to which the data is being
+	// uploaded. It is recorded before the upload starts, so that an
+	// upload interrupted before being recorded as complete may be
+	// finished by FinalizePendingUploads.
+	PendingPath string `bson:"pendingpath,omitempty"`
+	// PendingSince is the time at which PendingPath was recorded. The
+	// put uploading to PendingPath holds a lease on uploading the data
+	// until uploadLeaseDuration has passed, so that puts of the same
+	// data by other processes wait for it rather than upload the data
+	// again. It is not set for entries recorded before leases were.
+	PendingSince time.Time `bson:"pendingsince,omitempty"`
+	// Data holds the data itself if it is held inline,
+	// rather than in the resource storage.
+	Data []byte `bson:"data,omitempty"`
+}
+
+// uploadPendingError returns the error used to indicate that the upload
+// of the resource described by doc is not complete at the given time.
+func (doc *resourceDoc) uploadPendingError(now time.Time) *UploadPendingError {
+	err := &UploadPendingError{}
+	if !doc.Created.IsZero() {
+		err.Elapsed = now.Sub(doc.Created)
+	}
+	return err
+}
+
+// hash returns the hash recorded in the document,
+// and the algorithm used to calculate it.
+func (doc *resourceDoc) hash() (string, HashAlgorithm) {
+	if doc.HashAlgorithm == "" {
+		return doc.SHA384Hash, SHA384
+	}
+	return doc.Hash, doc.HashAlgorithm
 }
 
 // resourceCatalog is a mongo backed ResourceCatalog instance.
 type resourceCatalog struct {
-	collection *mgo.Collection
+	collection    *mgo.Collection
+	hashAlgorithm HashAlgorithm
+	clock         Clock
 }
 
 var _ ResourceCatalog = (*resourceCatalog)(nil)
 
 // newResource constructs a Resource from its attributes.
-func newResource(path, sha384hash string, length int64) *Resource {
-	return &Resource{
-		Path:       path,
-		Length:     length,
-		SHA384Hash: sha384hash,
+func newResource(path string, algorithm HashAlgorithm, hash string, length int64) *Resource {
+	r := &Resource{
+		Path:          path,
+		Length:        length,
+		Hash:          hash,
+		HashAlgorithm: algorithm,
 	}
+	if algorithm == SHA384 {
+		r.SHA384Hash = hash
+	}
+	return r
 }
 
-// newResourceDoc constructs a resourceDoc from a sha384 hash.
+// newResourceDoc constructs a resourceDoc from a hash calculated using algorithm.
 // This is used when writing new data to the resource store.
 // Path is opaque and is generated using a bson object id.
-func newResourceDoc(sha384Hash string, length int64) resourceDoc {
-	return resourceDoc{
-		Id:         sha384Hash,
-		SHA384Hash: sha384Hash,
-		RefCount:   1,
-		Length:     length,
+func newResourceDoc(algorithm HashAlgorithm, hash string, length int64) resourceDoc {
+	doc := resourceDoc{
+		Id:            resourceDocId(algorithm, hash),
+		Hash:          hash,
+		HashAlgorithm: algorithm,
+		RefCount:      1,
+		Length:        length,
+	}
+	if algorithm == SHA384 {
+		doc.SHA384Hash = hash
+	}
+	return doc
+}
+
+// resourceDocId returns the id of the resourceDoc for data with the given hash.
+// SHA-384 hashes are used as is for compatibility with existing catalog entries;
+// other hashes are qualified with the algorithm so that they cannot collide.
+func resourceDocId(algorithm HashAlgorithm, hash string) string {
+	if algorithm == SHA384 {
+		return hash
 	}
+	return string(algorithm) + ":" + hash
 }
 
 const (
@@ -74,18 +204,26 @@ const (
 	resourceCatalogCollection = "storedResources"
 )
 
-// newResourceCatalog creates a new ResourceCatalog
-// storing resource entries in the mongo database.
-func newResourceCatalog(db *mgo.Database) ResourceCatalog {
+// newResourceCatalog creates a new ResourceCatalog storing resource entries
+// in the mongo database, keyed on hashes calculated using algorithm.
+func newResourceCatalog(db *mgo.Database, algorithm HashAlgorithm) ResourceCatalog {
+	return newResourceCatalogWithClock(db, algorithm, WallClock)
+}
+
+// newResourceCatalogWithClock is the same as newResourceCatalog,
+// except that the current time is supplied by clock.
+func newResourceCatalogWithClock(db *mgo.Database, algorithm HashAlgorithm, clock Clock) ResourceCatalog {
 	return &resourceCatalog{
-		collection: db.C(resourceCatalogCollection),
+		collection:    db.C(resourceCatalogCollection),
+		hashAlgorithm: algorithm,
+		clock:         clock,
 	}
 }
 
 // Get is defined on the ResourceCatalog interface.
 func (rc *resourceCatalog) Get(id string) (*Resource, error) {
 	var doc resourceDoc
-	if err := rc.collection.FindId(id).One(&doc); err == mgo.ErrNotFound {
+	if err := rc.collection.FindId(id).Select(bson.D{{"data", 0}}).One(&doc); err == mgo.ErrNotFound {
 		return nil, errors.NotFoundf("resource with id %q", id)
 	} else if err != nil {
 		return nil, err
@@ -93,14 +231,17 @@ func (rc *resourceCatalog) Get(id string) (*Resource, error) {
 	if doc.Path == "" {
 		return nil, ErrUploadPending
 	}
-	return newResource(doc.Path, doc.SHA384Hash, doc.Length), nil
+	hash, algorithm := doc.hash()
+	r := newResource(doc.Path, algorithm, hash, doc.Length)
+	r.CRC32C = doc.CRC32C
+	return r, nil
 }
 
 // Find is defined on the ResourceCatalog interface.
 func (rc *resourceCatalog) Find(hash string) (string, error) {
 	var doc resourceDoc
-	if err := rc.collection.Find(checksumMatch(hash)).One(&doc); err == mgo.ErrNotFound {
-		return "", errors.NotFoundf("resource with sha384=%q", hash)
+	if err := rc.collection.Find(rc.checksumMatch(hash)).Select(bson.D{{"data", 0}}).One(&doc); err == mgo.ErrNotFound {
+		return "", errors.NotFoundf("resource with %s=%q", rc.hashAlgorithm, hash)
 	} else if err != nil {
 		return "", err
 	}
@@ -110,6 +251,59 @@ func (rc *resourceCatalog) Find(hash string) (string, error) {
 	return doc.Id, nil
 }
 
+// FindMany is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) FindMany(hashes []string) (map[string]string, error) {
+	// Resource ids are derived from their hashes, so the
+	// lookup may use the index on id.
+	ids := make([]string, len(hashes))
+	for i, hash := range hashes {
+		ids[i] = resourceDocId(rc.hashAlgorithm, hash)
+	}
+	query := bson.D{
+		{"_id", bson.D{{"$in", ids}}},
+		{"path", bson.D{{"$ne", ""}}},
+	}
+	found := make(map[string]string)
+	var doc resourceDoc
+	iter := rc.collection.Find(query).Select(bson.D{{"_id", 1}}).Iter()
+	for iter.Next(&doc) {
+		hash, _ := resourceIdHash(doc.Id)
+		found[hash] = doc.Id
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource catalog")
+	}
+	return found, nil
+}
+
+// List is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) List() ([]*Resource, error) {
+	var resources []*Resource
+	var doc resourceDoc
+	iter := rc.collection.Find(nil).Select(bson.D{{"data", 0}}).Iter()
+	for iter.Next(&doc) {
+		hash, algorithm := doc.hash()
+		r := newResource(doc.Path, algorithm, hash, doc.Length)
+		r.CRC32C = doc.CRC32C
+		resources = append(resources, r)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource catalog")
+	}
+	return resources, nil
+}
+
+// RefCount is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) RefCount(id string) (int, error) {
+	var doc resourceDoc
+	if err := rc.collection.FindId(id).Select(bson.D{{"data", 0}}).One(&doc); err == mgo.ErrNotFound {
+		return 0, errors.NotFoundf("resource with id %q", id)
+	} else if err != nil {
+		return 0, err
+	}
+	return int(doc.RefCount), nil
+}
+
 // Put is defined on the ResourceCatalog interface.
 func (rc *resourceCatalog) Put(hash string, length int64) (id, path string, err error) {
 	buildTxn := func(attempt int) (ops []txn.Op, err error) {
@@ -123,6 +317,30 @@ func (rc *resourceCatalog) Put(hash string, length int64) (id, path string, err
 	return id, path, nil
 }
 
+// AddRef is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) AddRef(id string) (path string, err error) {
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var doc resourceDoc
+		if err := rc.collection.FindId(id).Select(bson.D{{"data", 0}}).One(&doc); err == mgo.ErrNotFound {
+			return nil, errors.NotFoundf("resource with id %q", id)
+		} else if err != nil {
+			return nil, err
+		}
+		path = doc.Path
+		return []txn.Op{{
+			C:      rc.collection.Name,
+			Id:     doc.Id,
+			Assert: txn.DocExists,
+			Update: bson.D{{"$inc", bson.D{{"refcount", 1}}}},
+		}}, nil
+	}
+	txnRunner := txnRunner(rc.collection.Database)
+	if err := txnRunner.Run(buildTxn); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
 // UploadComplete is defined on the ResourceCatalog interface.
 func (rc *resourceCatalog) UploadComplete(id, path string) error {
 	buildTxn := func(attempt int) (ops []txn.Op, err error) {
@@ -135,6 +353,26 @@ func (rc *resourceCatalog) UploadComplete(id, path string) error {
 	return txnRunner.Run(buildTxn)
 }
 
+// MovePath is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) MovePath(id, oldPath, newPath string) error {
+	ops := []txn.Op{{
+		C:      rc.collection.Name,
+		Id:     id,
+		Assert: bson.D{{"path", oldPath}},
+		Update: bson.D{{"$set", bson.D{{"path", newPath}}}},
+	}}
+	txnRunner := txnRunner(rc.collection.Database)
+	if err := txnRunner.RunTransaction(ops); err == txn.ErrAborted {
+		if n, err := rc.collection.FindId(id).Count(); err == nil && n == 0 {
+			return errors.NotFoundf("resource with id %q", id)
+		}
+		return errors.Annotatef(ErrPreconditionFailed, "resource with id %q is not at path %q", id, oldPath)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
 // Remove is defined on the ResourceCatalog interface.
 func (rc *resourceCatalog) Remove(id string) (wasDeleted bool, path string, err error) {
 	buildTxn := func(attempt int) (ops []txn.Op, err error) {
@@ -147,8 +385,106 @@ func (rc *resourceCatalog) Remove(id string) (wasDeleted bool, path string, err
 	return wasDeleted, path, txnRunner.Run(buildTxn)
 }
 
-func checksumMatch(hash string) bson.D {
-	return bson.D{{"sha384hash", hash}}
+// RemoveManyOps is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) RemoveManyOps(ids []string) (ops []txn.Op, deletedPaths map[string]string, err error) {
+	counts := make(map[string]int64)
+	for _, id := range ids {
+		counts[id]++
+	}
+	// The operations are returned in a consistent order.
+	sortedIds := make([]string, 0, len(counts))
+	for id := range counts {
+		sortedIds = append(sortedIds, id)
+	}
+	sort.Strings(sortedIds)
+	deletedPaths = make(map[string]string)
+	for _, id := range sortedIds {
+		wasDeleted, path, idOps, err := rc.resourceDecRefByOps(id, counts[id])
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, nil, errors.Annotatef(err, "cannot load catalog entry for resource %q", id)
+		}
+		if wasDeleted {
+			deletedPaths[id] = path
+		}
+		ops = append(ops, idOps...)
+	}
+	return ops, deletedPaths, nil
+}
+
+// pendingReferenced returns whether the pending resource with the given id
+// is referenced by a managed resource record which has not expired, or by
+// a version record, in which case it must be kept until its upload is
+// completed. Soft-deleted records count, since they may be restored.
+func pendingReferenced(db *mgo.Database, resourceId string, now time.Time) (bool, error) {
+	query := bson.D{{"resourceid", resourceId}, {"$or", []bson.D{
+		{{"expirytime", bson.D{{"$exists", false}}}},
+		{{"expirytime", bson.D{{"$gt", now}}}},
+	}}}
+	if n, err := db.C(managedResourceCollection).Find(query).Count(); err != nil || n > 0 {
+		return n > 0, err
+	}
+	n, err := db.C(resourceVersionCollection).Find(bson.D{{"resourceid", resourceId}}).Count()
+	return n > 0, err
+}
+
+// pendingUploadGracePeriod is the time after which a Resource entry
+// whose upload has not completed is assumed to have been abandoned.
+var pendingUploadGracePeriod = 24 * time.Hour
+
+// CompactReferences is defined on the ResourceCatalog interface.
+func (rc *resourceCatalog) CompactReferences() (int, error) {
+	// Pending entries catalogued before creation times were recorded
+	// are not matched, since there is no knowing how long they have
+	// been pending.
+	cutoff := rc.clock.Now().Add(-pendingUploadGracePeriod)
+	query := bson.D{{"$or", []bson.D{
+		{{"refcount", bson.D{{"$lte", 0}}}},
+		{{"path", ""}, {"created", bson.D{{"$lt", cutoff}}}},
+	}}}
+	var docs []resourceDoc
+	if err := rc.collection.Find(query).Select(bson.D{{"data", 0}}).All(&docs); err != nil {
+		return 0, errors.Annotate(err, "cannot read resource catalog")
+	}
+	txnRunner := txnRunner(rc.collection.Database)
+	cleaned := 0
+	for _, doc := range docs {
+		if doc.RefCount > 0 {
+			// A pending entry may be referenced by a path whose data
+			// is yet to be supplied, as with a reservation.
+			if referenced, err := pendingReferenced(rc.collection.Database, doc.Id, rc.clock.Now()); err != nil {
+				return cleaned, errors.Annotatef(err, "cannot check references to resource with id %q", doc.Id)
+			} else if referenced {
+				continue
+			}
+		}
+		// The entry is only removed if it has not been referenced
+		// or completed since it was read.
+		ops := []txn.Op{{
+			C:      rc.collection.Name,
+			Id:     doc.Id,
+			Assert: bson.D{{"refcount", doc.RefCount}, {"path", doc.Path}},
+			Remove: true,
+		}}
+		if err := txnRunner.RunTransaction(ops); err == txn.ErrAborted {
+			continue
+		} else if err != nil {
+			return cleaned, errors.Annotatef(err, "cannot remove resource with id %q", doc.Id)
+		}
+		logger.Debugf("compacted resource with id %q", doc.Id)
+		cleaned++
+	}
+	return cleaned, nil
+}
+
+// checksumMatch returns a query matching the resource with the given
+// hash, calculated using the catalog's hash algorithm.
+func (rc *resourceCatalog) checksumMatch(hash string) bson.D {
+	if rc.hashAlgorithm == SHA384 {
+		return bson.D{{"sha384hash", hash}}
+	}
+	return bson.D{{"hashalgorithm", rc.hashAlgorithm}, {"hash", hash}}
 }
 
 func (rc *resourceCatalog) resourceIncRefOps(hash string, length int64) (
@@ -156,15 +492,16 @@ func (rc *resourceCatalog) resourceIncRefOps(hash string, length int64) (
 ) {
 	var doc resourceDoc
 	exists := false
-	checksumMatchTerm := checksumMatch(hash)
-	err = rc.collection.Find(checksumMatchTerm).One(&doc)
+	checksumMatchTerm := rc.checksumMatch(hash)
+	err = rc.collection.Find(checksumMatchTerm).Select(bson.D{{"data", 0}}).One(&doc)
 	if err != nil && err != mgo.ErrNotFound {
 		return "", "", nil, err
 	} else if err == nil {
 		exists = true
 	}
 	if !exists {
-		doc := newResourceDoc(hash, length)
+		doc := newResourceDoc(rc.hashAlgorithm, hash, length)
+		doc.Created = rc.clock.Now()
 		return doc.Id, "", []txn.Op{{
 			C:      rc.collection.Name,
 			Id:     doc.Id,
@@ -185,7 +522,7 @@ func (rc *resourceCatalog) resourceIncRefOps(hash string, length int64) (
 
 func (rc *resourceCatalog) uploadCompleteOps(id, path string) ([]txn.Op, error) {
 	var doc resourceDoc
-	if err := rc.collection.FindId(id).One(&doc); err != nil {
+	if err := rc.collection.FindId(id).Select(bson.D{{"data", 0}}).One(&doc); err != nil {
 		return nil, err
 	}
 	if doc.Path != "" {
@@ -195,27 +532,41 @@ func (rc *resourceCatalog) uploadCompleteOps(id, path string) ([]txn.Op, error)
 		C:      rc.collection.Name,
 		Id:     doc.Id,
 		Assert: bson.D{{"path", ""}}, // doc exists, path is unset
-		Update: bson.D{{"$set", bson.D{{"path", path}}}},
+		Update: bson.D{
+			{"$set", bson.D{{"path", path}}},
+			{"$unset", bson.D{{"pendingpath", 1}, {"pendingsince", 1}}},
+		},
 	}}, nil
 }
 
 func (rc *resourceCatalog) resourceDecRefOps(id string) (wasDeleted bool, path string, ops []txn.Op, err error) {
+	return rc.resourceDecRefByOps(id, 1)
+}
+
+// resourceDecRefByOps returns the operations to decrement the reference count
+// of the resource with the given id by count, deleting it if no references remain.
+// The count is only changed by $inc, and the entry only deleted if its count is
+// unchanged since it was read, so concurrent puts and removals of the same data
+// cannot lose updates; a transaction whose assertion fails is rebuilt from the
+// current count. The entry must not be modified outside of a transaction, so
+// findAndModify cannot be used instead.
+func (rc *resourceCatalog) resourceDecRefByOps(id string, count int64) (wasDeleted bool, path string, ops []txn.Op, err error) {
 	var doc resourceDoc
-	if err = rc.collection.FindId(id).One(&doc); err != nil {
+	if err = rc.collection.FindId(id).Select(bson.D{{"data", 0}}).One(&doc); err != nil {
 		return false, "", nil, err
 	}
-	if doc.RefCount == 1 {
+	if doc.RefCount <= count {
 		return true, doc.Path, []txn.Op{{
 			C:      rc.collection.Name,
 			Id:     doc.Id,
-			Assert: bson.D{{"refcount", 1}},
+			Assert: bson.D{{"refcount", doc.RefCount}},
 			Remove: true,
 		}}, nil
 	}
 	return false, doc.Path, []txn.Op{{
 		C:      rc.collection.Name,
 		Id:     doc.Id,
-		Assert: bson.D{{"refcount", bson.D{{"$gt", 1}}}},
-		Update: bson.D{{"$inc", bson.D{{"refcount", -1}}}},
+		Assert: bson.D{{"refcount", bson.D{{"$gt", count}}}},
+		Update: bson.D{{"$inc", bson.D{{"refcount", -count}}}},
 	}}, nil
 }
@@ -4,6 +4,8 @@
 package blobstore_test
 
 import (
+	"time"
+
 	"github.com/juju/errors"
 	"github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
@@ -12,6 +14,7 @@ import (
 	gc "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	mgotxn "gopkg.in/mgo.v2/txn"
 
 	"github.com/juju/blobstore"
 )
@@ -41,7 +44,7 @@ func (s *resourceCatalogSuite) SetUpTest(c *gc.C) {
 	s.MgoSuite.SetUpTest(c)
 	db := s.Session.DB("blobstore")
 	s.collection = db.C("storedResources")
-	s.rCatalog = blobstore.NewResourceCatalog(db)
+	s.rCatalog = blobstore.NewResourceCatalog(db, blobstore.SHA384)
 
 	// For testing, we need to ensure there's a single txnRunner for all operations.
 	s.txnRunner = txn.NewRunner(txn.RunnerParams{Database: db})
@@ -139,6 +142,147 @@ func (s *resourceCatalogSuite) TestFind(c *gc.C) {
 	c.Assert(foundId, gc.Equals, id)
 }
 
+func (s *resourceCatalogSuite) TestFindMany(c *gc.C) {
+	id, _, err := s.rCatalog.Put("sha384foo", 100)
+	c.Assert(err, gc.IsNil)
+	err = s.rCatalog.UploadComplete(id, "wherever")
+	c.Assert(err, gc.IsNil)
+	// Pending uploads are omitted.
+	_, _, err = s.rCatalog.Put("sha384bar", 100)
+	c.Assert(err, gc.IsNil)
+
+	found, err := s.rCatalog.FindMany([]string{"sha384foo", "sha384bar", "sha384baz"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, jc.DeepEquals, map[string]string{"sha384foo": id})
+
+	found, err = s.rCatalog.FindMany(nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.HasLen, 0)
+}
+
+func (s *resourceCatalogSuite) TestFindManyHashAlgorithm(c *gc.C) {
+	sha256Catalog := blobstore.NewResourceCatalog(s.Session.DB("blobstore"), blobstore.SHA256)
+	id, _, err := sha256Catalog.Put("sha256foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	err = sha256Catalog.UploadComplete(id, "wherever")
+	c.Assert(err, jc.ErrorIsNil)
+
+	found, err := sha256Catalog.FindMany([]string{"sha256foo"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, jc.DeepEquals, map[string]string{"sha256foo": id})
+	// Entries hashed using another algorithm are not matched.
+	found, err = s.rCatalog.FindMany([]string{"sha256foo"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.HasLen, 0)
+}
+
+func (s *resourceCatalogSuite) TestGetRecordsHashAlgorithm(c *gc.C) {
+	id, _, err := s.rCatalog.Put("sha384foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.rCatalog.UploadComplete(id, "wherever")
+	c.Assert(err, jc.ErrorIsNil)
+	r, err := s.rCatalog.Get(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r, jc.DeepEquals, &blobstore.Resource{
+		SHA384Hash:    "sha384foo",
+		Hash:          "sha384foo",
+		HashAlgorithm: blobstore.SHA384,
+		Path:          "wherever",
+		Length:        100,
+	})
+}
+
+func (s *resourceCatalogSuite) TestGetLegacyRecord(c *gc.C) {
+	// Records written before the hash algorithm was recorded hold SHA-384 hashes.
+	err := s.collection.Insert(bson.D{
+		{"_id", "sha384foo"},
+		{"path", "wherever"},
+		{"sha384hash", "sha384foo"},
+		{"length", 100},
+		{"refcount", 1},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	r, err := s.rCatalog.Get("sha384foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.Hash, gc.Equals, "sha384foo")
+	c.Assert(r.HashAlgorithm, gc.Equals, blobstore.SHA384)
+	id, err := s.rCatalog.Find("sha384foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(id, gc.Equals, "sha384foo")
+}
+
+func (s *resourceCatalogSuite) TestPutDifferentHashAlgorithms(c *gc.C) {
+	sha256Catalog := blobstore.NewResourceCatalog(s.Session.DB("blobstore"), blobstore.SHA256)
+	id, _ := s.assertPut(c, true, "foo")
+	sha256Id, _, err := sha256Catalog.Put("foo", 200)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(sha256Id, gc.Not(gc.Equals), id)
+	s.assertRefCount(c, id, 1)
+	s.assertRefCount(c, sha256Id, 1)
+
+	err = sha256Catalog.UploadComplete(sha256Id, "wherever")
+	c.Assert(err, jc.ErrorIsNil)
+	r, err := sha256Catalog.Get(sha256Id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.SHA384Hash, gc.Equals, "")
+	c.Assert(r.Hash, gc.Equals, "foo")
+	c.Assert(r.HashAlgorithm, gc.Equals, blobstore.SHA256)
+	foundId, err := sha256Catalog.Find("foo")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(foundId, gc.Equals, sha256Id)
+	_, err = s.rCatalog.Find("foo")
+	c.Assert(err, gc.Equals, blobstore.ErrUploadPending)
+}
+
+func (s *resourceCatalogSuite) TestRefCount(c *gc.C) {
+	id, _ := s.assertPut(c, true, "sha384foo")
+	count, err := s.rCatalog.RefCount(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 1)
+	s.assertPut(c, false, "sha384foo")
+	count, err = s.rCatalog.RefCount(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 2)
+}
+
+func (s *resourceCatalogSuite) TestAddRef(c *gc.C) {
+	id, _ := s.assertPut(c, true, "sha384foo")
+	path, err := s.rCatalog.AddRef(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(path, gc.Equals, "")
+	err = s.rCatalog.UploadComplete(id, "wherever")
+	c.Assert(err, jc.ErrorIsNil)
+	path, err = s.rCatalog.AddRef(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(path, gc.Equals, "wherever")
+	count, err := s.rCatalog.RefCount(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 3)
+}
+
+func (s *resourceCatalogSuite) TestAddRefNonExistent(c *gc.C) {
+	_, err := s.rCatalog.AddRef(bson.NewObjectId().Hex())
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *resourceCatalogSuite) TestList(c *gc.C) {
+	s.assertPut(c, true, "sha384foo")
+	id, _ := s.assertPut(c, true, "sha384bar")
+	err := s.rCatalog.UploadComplete(id, "wherever")
+	c.Assert(err, jc.ErrorIsNil)
+	resources, err := s.rCatalog.List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(resources, jc.SameContents, []*blobstore.Resource{
+		blobstore.NewResource("", blobstore.SHA384, "sha384foo", 200),
+		blobstore.NewResource("wherever", blobstore.SHA384, "sha384bar", 200),
+	})
+}
+
+func (s *resourceCatalogSuite) TestRefCountNonExistent(c *gc.C) {
+	_, err := s.rCatalog.RefCount(bson.NewObjectId().Hex())
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
 func (s *resourceCatalogSuite) TestUploadComplete(c *gc.C) {
 	id, _, err := s.rCatalog.Put("sha384foo", 100)
 	c.Assert(err, gc.IsNil)
@@ -152,6 +296,24 @@ func (s *resourceCatalogSuite) TestUploadComplete(c *gc.C) {
 	s.asserGetUploaded(c, id, "sha384foo", 100)
 }
 
+func (s *resourceCatalogSuite) TestMovePath(c *gc.C) {
+	id, _, err := s.rCatalog.Put("sha384foo", 100)
+	c.Assert(err, gc.IsNil)
+	err = s.rCatalog.UploadComplete(id, "wherever")
+	c.Assert(err, gc.IsNil)
+	err = s.rCatalog.MovePath(id, "wherever", "elsewhere")
+	c.Assert(err, gc.IsNil)
+	r, err := s.rCatalog.Get(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(r.Path, gc.Equals, "elsewhere")
+
+	// The path must be as expected.
+	err = s.rCatalog.MovePath(id, "wherever", "somewhere")
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrPreconditionFailed)
+	err = s.rCatalog.MovePath("unknown", "wherever", "somewhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
 func (s *resourceCatalogSuite) TestRemoveOnlyRecord(c *gc.C) {
 	id, path := s.assertPut(c, true, "sha384foo")
 	wasDeleted, removedPath, err := s.rCatalog.Remove(id)
@@ -186,6 +348,43 @@ func (s *resourceCatalogSuite) TestRemoveLastCopy(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `resource with id ".*" not found`)
 }
 
+func (s *resourceCatalogSuite) TestRemoveManyOps(c *gc.C) {
+	id, path := s.assertPut(c, true, "sha384foo")
+	s.assertPut(c, false, "sha384foo")
+	s.assertPut(c, false, "sha384foo")
+	anotherId, anotherPath := s.assertPut(c, true, "sha384bar")
+	ops, deletedPaths, err := s.rCatalog.RemoveManyOps([]string{id, id, anotherId, "missing"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(deletedPaths, jc.DeepEquals, map[string]string{anotherId: anotherPath})
+	// Nothing changes until the operations are run.
+	s.assertRefCount(c, id, 3)
+	err = s.txnRunner.RunTransaction(ops)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertRefCount(c, id, 1)
+	_, err = s.rCatalog.Get(anotherId)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	ops, deletedPaths, err = s.rCatalog.RemoveManyOps([]string{id})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(deletedPaths, jc.DeepEquals, map[string]string{id: path})
+	err = s.txnRunner.RunTransaction(ops)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.rCatalog.Get(id)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *resourceCatalogSuite) TestRemoveManyOpsChanged(c *gc.C) {
+	id, _ := s.assertPut(c, true, "sha384foo")
+	ops, deletedPaths, err := s.rCatalog.RemoveManyOps([]string{id})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(deletedPaths, gc.HasLen, 1)
+	// Another reference is added before the operations are run.
+	s.assertPut(c, false, "sha384foo")
+	err = s.txnRunner.RunTransaction(ops)
+	c.Assert(err, gc.Equals, mgotxn.ErrAborted)
+	s.assertRefCount(c, id, 2)
+}
+
 func (s *resourceCatalogSuite) TestRemoveNonExistent(c *gc.C) {
 	_, _, err := s.rCatalog.Remove(bson.NewObjectId().Hex())
 	c.Assert(err, gc.ErrorMatches, `resource with id ".*" not found`)
@@ -259,3 +458,89 @@ func (s *resourceCatalogSuite) TestUploadCompleteDeleted(c *gc.C) {
 	err = s.rCatalog.UploadComplete(id, "wherever")
 	c.Assert(err, jc.Satisfies, errors.IsNotFound)
 }
+
+func (s *resourceCatalogSuite) TestCompactReferences(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.PatchValue(blobstore.TimeNow, func() time.Time { return now })
+	s.PatchValue(blobstore.PendingUploadGracePeriod, time.Hour)
+
+	unreferencedId, _ := s.assertPut(c, true, "unreferenced")
+	err := s.collection.UpdateId(unreferencedId, bson.D{{"$set", bson.D{{"refcount", 0}}}})
+	c.Assert(err, gc.IsNil)
+	abandonedId, _ := s.assertPut(c, true, "abandoned")
+	now = now.Add(90 * time.Minute)
+	pendingId, _ := s.assertPut(c, true, "pending")
+	uploadedId, _ := s.assertPut(c, true, "uploaded")
+	err = s.rCatalog.UploadComplete(uploadedId, "wherever")
+	c.Assert(err, gc.IsNil)
+
+	cleaned, err := s.rCatalog.CompactReferences()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cleaned, gc.Equals, 2)
+	for _, id := range []string{unreferencedId, abandonedId} {
+		_, err = s.rCatalog.Get(id)
+		c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	}
+	s.assertGetPending(c, pendingId)
+	s.asserGetUploaded(c, uploadedId, "uploaded", 200)
+
+	// Compacting again has nothing to do.
+	cleaned, err = s.rCatalog.CompactReferences()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cleaned, gc.Equals, 0)
+}
+
+func (s *resourceCatalogSuite) TestCompactReferencesKeepsReferencedPending(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.PatchValue(blobstore.TimeNow, func() time.Time { return now })
+	s.PatchValue(blobstore.PendingUploadGracePeriod, time.Hour)
+	referencedId, _ := s.assertPut(c, true, "referenced")
+	err := s.Session.DB("blobstore").C("managedStoredResources").Insert(bson.D{
+		{"_id", "environs/env/path/to/blob"},
+		{"path", "environs/env/path/to/blob"},
+		{"resourceid", referencedId},
+	})
+	c.Assert(err, gc.IsNil)
+	expiredId, _ := s.assertPut(c, true, "expired")
+	err = s.Session.DB("blobstore").C("managedStoredResources").Insert(bson.D{
+		{"_id", "environs/env/path/to/expired"},
+		{"path", "environs/env/path/to/expired"},
+		{"resourceid", expiredId},
+		{"expirytime", now.Add(30 * time.Minute)},
+	})
+	c.Assert(err, gc.IsNil)
+	now = now.Add(90 * time.Minute)
+
+	// Only the entry referenced by a live record is kept.
+	cleaned, err := s.rCatalog.CompactReferences()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cleaned, gc.Equals, 1)
+	s.assertGetPending(c, referencedId)
+	_, err = s.rCatalog.Get(expiredId)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *resourceCatalogSuite) TestCompactReferencesKeepsLegacyPending(c *gc.C) {
+	id, _ := s.assertPut(c, true, "sha384foo")
+	err := s.collection.UpdateId(id, bson.D{{"$unset", bson.D{{"created", 1}}}})
+	c.Assert(err, gc.IsNil)
+	s.PatchValue(blobstore.PendingUploadGracePeriod, time.Duration(0))
+	cleaned, err := s.rCatalog.CompactReferences()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cleaned, gc.Equals, 0)
+	s.assertGetPending(c, id)
+}
+
+func (s *resourceCatalogSuite) TestCompactReferencesConcurrentUploadComplete(c *gc.C) {
+	id, _ := s.assertPut(c, true, "sha384foo")
+	s.PatchValue(blobstore.PendingUploadGracePeriod, -time.Hour)
+	complete := func() {
+		err := s.rCatalog.UploadComplete(id, "wherever")
+		c.Assert(err, gc.IsNil)
+	}
+	defer txntesting.SetBeforeHooks(c, s.txnRunner, complete).Check()
+	cleaned, err := s.rCatalog.CompactReferences()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cleaned, gc.Equals, 0)
+	s.asserGetUploaded(c, id, "sha384foo", 200)
+}
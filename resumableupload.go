@@ -0,0 +1,272 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+const (
+	// uploadSessionCollection is the name of the collection
+	// which stores the uploadSessionDoc records.
+	uploadSessionCollection = "uploadSessions"
+)
+
+// uploadSessionDoc records the progress of a resumable upload.
+type uploadSessionDoc struct {
+	Id      string `bson:"_id"`
+	EnvUUID string `bson:"envuuid"`
+	Path    string `bson:"path"`
+	Length  int64  `bson:"length"`
+	// Received is the number of bytes received so far.
+	Received int64 `bson:"received"`
+	// Chunks holds the storage paths of the data received so far, in order.
+	Chunks []string `bson:"chunks"`
+	// Updated is when the upload was started or last appended to.
+	Updated time.Time `bson:"updated"`
+}
+
+// uploadSessions returns the collection holding the upload records.
+func (ms *managedStorage) uploadSessions() *mgo.Collection {
+	return ms.db.C(uploadSessionCollection)
+}
+
+// uploadSession loads the record for the upload with the given handle.
+func (ms *managedStorage) uploadSession(handle string) (*uploadSessionDoc, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	var doc uploadSessionDoc
+	if err := ms.uploadSessions().FindId(handle).One(&doc); err == mgo.ErrNotFound {
+		return nil, errors.NotFoundf("upload %q", handle)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot load upload %q", handle)
+	}
+	// An abandoned upload may not yet have been removed by GarbageCollect.
+	if !ms.clock.Now().Before(doc.Updated.Add(ms.uploadSessionTTL)) {
+		return nil, errors.NotFoundf("upload %q", handle)
+	}
+	return &doc, nil
+}
+
+// BeginUploadForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) BeginUploadForEnvironment(envUUID, path string, length int64) (string, error) {
+	if err := ms.checkOpen(); err != nil {
+		return "", err
+	}
+	if length < 0 {
+		return "", errors.NotValidf("upload length %d", length)
+	}
+	if _, err := ms.resourceStoragePath(envUUID, "", path); err != nil {
+		return "", err
+	}
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		return "", errors.Annotate(err, "cannot generate upload handle")
+	}
+	doc := uploadSessionDoc{
+		Id:      uuid.String(),
+		EnvUUID: envUUID,
+		Path:    path,
+		Length:  length,
+		Chunks:  []string{},
+		Updated: ms.clock.Now(),
+	}
+	ops := []txn.Op{{
+		C:      uploadSessionCollection,
+		Id:     doc.Id,
+		Assert: txn.DocMissing,
+		Insert: doc,
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil {
+		return "", errors.Annotate(err, "cannot record upload")
+	}
+	return doc.Id, nil
+}
+
+// UploadOffset is defined on the ManagedStorage interface.
+func (ms *managedStorage) UploadOffset(handle string) (int64, error) {
+	doc, err := ms.uploadSession(handle)
+	if err != nil {
+		return 0, err
+	}
+	return doc.Received, nil
+}
+
+// AppendUpload is defined on the ManagedStorage interface.
+func (ms *managedStorage) AppendUpload(handle string, offset int64, r io.Reader) (err error) {
+	doc, err := ms.uploadSession(handle)
+	if err != nil {
+		return err
+	}
+	if offset != doc.Received {
+		return errors.NotValidf("offset %d for upload %q which has received %d bytes", offset, handle, doc.Received)
+	}
+	remaining := doc.Length - doc.Received
+	// Read one byte more than remains so that excess data is detected.
+	dataFile, n, _, err := ms.preprocessUpload(io.LimitReader(r, remaining+1), -1, "")
+	if err != nil {
+		return errors.Annotate(err, "cannot read upload data")
+	}
+	defer dataFile.Close()
+	if n > remaining {
+		return errors.NotValidf("data exceeding upload length %d", doc.Length)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	chunkPath := fmt.Sprintf("uploads/%s/%d", handle, offset)
+	if _, err := ms.resourceStore.Put(chunkPath, dataFile, n); err != nil {
+		return errors.Annotatef(err, "cannot store upload data at storage path %q", chunkPath)
+	}
+	defer cleanupResource(ms.resourceStore, chunkPath, &err)
+	ops := []txn.Op{{
+		C:      uploadSessionCollection,
+		Id:     handle,
+		Assert: bson.D{{"received", offset}},
+		Update: bson.D{
+			{"$set", bson.D{{"received", offset + n}, {"updated", ms.clock.Now()}}},
+			{"$push", bson.D{{"chunks", chunkPath}}},
+		},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err == txn.ErrAborted {
+		return errors.NotValidf("offset %d for upload %q which has been appended to concurrently", offset, handle)
+	} else if err != nil {
+		return errors.Annotatef(err, "cannot update upload %q", handle)
+	}
+	return nil
+}
+
+// CompleteUpload is defined on the ManagedStorage interface.
+func (ms *managedStorage) CompleteUpload(handle string) (err error) {
+	doc, err := ms.uploadSession(handle)
+	if err != nil {
+		return err
+	}
+	if doc.Received != doc.Length {
+		return errors.Errorf("upload %q incomplete: received %d of %d bytes", handle, doc.Received, doc.Length)
+	}
+	readers := make([]io.Reader, len(doc.Chunks))
+	for i, chunkPath := range doc.Chunks {
+		rdr, err := ms.resourceStore.Get(chunkPath)
+		if err != nil {
+			return errors.Annotatef(err, "cannot read upload data at storage path %q", chunkPath)
+		}
+		defer rdr.Close()
+		readers[i] = rdr
+	}
+	if _, err := ms.put(context.Background(), doc.EnvUUID, "", doc.Path, io.MultiReader(readers...), doc.Length, putOptions{}); err != nil {
+		return err
+	}
+
+	// The data is stored, so the upload record and its data are no longer needed.
+	ops := []txn.Op{{
+		C:      uploadSessionCollection,
+		Id:     handle,
+		Assert: txn.DocExists,
+		Remove: true,
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil && err != txn.ErrAborted {
+		return errors.Annotatef(err, "cannot remove completed upload %q", handle)
+	}
+	ms.removeUploadChunks(doc.Chunks)
+	return nil
+}
+
+// AbortUploadForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) AbortUploadForEnvironment(envUUID, handle string) error {
+	var doc *uploadSessionDoc
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var err error
+		if doc, err = ms.uploadSession(handle); err != nil {
+			return nil, err
+		}
+		if doc.EnvUUID != envUUID {
+			return nil, errors.NotFoundf("upload %q", handle)
+		}
+		// Chunks appended concurrently must be removed too.
+		return []txn.Op{{
+			C:      uploadSessionCollection,
+			Id:     handle,
+			Assert: bson.D{{"received", doc.Received}},
+			Remove: true,
+		}}, nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); err != nil {
+		return errors.Annotatef(err, "cannot abort upload %q", handle)
+	}
+	ms.removeUploadChunks(doc.Chunks)
+	return nil
+}
+
+// expireUploadSessions removes the uploads which have been idle for longer
+// than the storage's upload session TTL, along with their data, returning
+// the number of items of data removed.
+func (ms *managedStorage) expireUploadSessions() (int, error) {
+	cutoff := ms.clock.Now().Add(-ms.uploadSessionTTL)
+	var docs []uploadSessionDoc
+	if err := ms.uploadSessions().Find(bson.D{{"updated", bson.D{{"$lte", cutoff}}}}).All(&docs); err != nil {
+		return 0, errors.Annotate(err, "cannot read upload records")
+	}
+	removed := 0
+	for _, doc := range docs {
+		ops := []txn.Op{{
+			C:      uploadSessionCollection,
+			Id:     doc.Id,
+			Assert: bson.D{{"updated", doc.Updated}},
+			Remove: true,
+		}}
+		if err := txnRunner(ms.db).RunTransaction(ops); err == txn.ErrAborted {
+			// Appended to concurrently, so no longer idle.
+			continue
+		} else if err != nil {
+			return removed, errors.Annotatef(err, "cannot remove abandoned upload %q", doc.Id)
+		}
+		logger.Debugf("removing upload %q for path %q abandoned after receiving %d of %d bytes", doc.Id, doc.Path, doc.Received, doc.Length)
+		removed += ms.removeUploadChunks(doc.Chunks)
+	}
+	return removed, nil
+}
+
+// removeUploadChunks deletes the data received by an upload which is no
+// longer needed, returning the number of chunks removed.
+func (ms *managedStorage) removeUploadChunks(chunkPaths []string) int {
+	removed := 0
+	for _, chunkPath := range chunkPaths {
+		if err := ms.resourceStore.Remove(chunkPath); err != nil && !errors.IsNotFound(err) {
+			// The data will be removed by garbage collection.
+			logger.Warningf("cannot remove upload data at storage path %q: %v", chunkPath, err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// uploadStoragePaths returns the set of storage paths
+// holding data received by uploads in progress.
+func (ms *managedStorage) uploadStoragePaths() (map[string]bool, error) {
+	iter := ms.uploadSessions().Find(nil).Select(bson.D{{"chunks", 1}}).Iter()
+	paths := make(map[string]bool)
+	var doc uploadSessionDoc
+	for iter.Next(&doc) {
+		for _, chunkPath := range doc.Chunks {
+			paths[chunkPath] = true
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Annotate(err, "cannot read upload records")
+	}
+	return paths, nil
+}
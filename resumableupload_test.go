@@ -0,0 +1,120 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) assertUploadOffset(c *gc.C, handle string, expected int64) {
+	offset, err := s.managedStorage.UploadOffset(handle)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(offset, gc.Equals, expected)
+}
+
+func (s *managedStorageSuite) TestResumableUpload(c *gc.C) {
+	blob := []byte("some resource")
+	handle, err := s.managedStorage.BeginUploadForEnvironment("env", "/path/to/blob", int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertUploadOffset(c, handle, 0)
+
+	err = s.managedStorage.AppendUpload(handle, 0, bytes.NewReader(blob[:5]))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertUploadOffset(c, handle, 5)
+	err = s.managedStorage.CompleteUpload(handle)
+	c.Assert(err, gc.ErrorMatches, `upload ".*" incomplete: received 5 of 13 bytes`)
+
+	// Nothing is visible until the upload is complete.
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	err = s.managedStorage.AppendUpload(handle, 5, bytes.NewReader(blob[5:]))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertUploadOffset(c, handle, int64(len(blob)))
+	err = s.managedStorage.CompleteUpload(handle)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+
+	_, err = s.managedStorage.UploadOffset(handle)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	// Only the completed resource remains in storage.
+	removed, err := s.managedStorage.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestResumableUploadWrongOffset(c *gc.C) {
+	handle, err := s.managedStorage.BeginUploadForEnvironment("env", "/path/to/blob", 10)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.AppendUpload(handle, 5, strings.NewReader("data"))
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	s.assertUploadOffset(c, handle, 0)
+}
+
+func (s *managedStorageSuite) TestResumableUploadTooLong(c *gc.C) {
+	handle, err := s.managedStorage.BeginUploadForEnvironment("env", "/path/to/blob", 4)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.AppendUpload(handle, 0, strings.NewReader("too much data"))
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	s.assertUploadOffset(c, handle, 0)
+}
+
+func (s *managedStorageSuite) TestResumableUploadNotFound(c *gc.C) {
+	_, err := s.managedStorage.UploadOffset("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	err = s.managedStorage.AppendUpload("missing", 0, strings.NewReader("data"))
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	err = s.managedStorage.CompleteUpload("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestResumableUploadInvalidLength(c *gc.C) {
+	_, err := s.managedStorage.BeginUploadForEnvironment("env", "/path/to/blob", -1)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestGarbageCollectKeepsUploadInProgress(c *gc.C) {
+	handle, err := s.managedStorage.BeginUploadForEnvironment("env", "/path/to/blob", 8)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.AppendUpload(handle, 0, strings.NewReader("data"))
+	c.Assert(err, jc.ErrorIsNil)
+	removed, err := s.managedStorage.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+
+	err = s.managedStorage.AppendUpload(handle, 4, strings.NewReader("more"))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.CompleteUpload(handle)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", []byte("datamore"))
+}
+
+func (s *managedStorageSuite) TestResumableUploadAbort(c *gc.C) {
+	handle, err := s.managedStorage.BeginUploadForEnvironment("env", "/path/to/blob", 10)
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.AppendUpload(handle, 0, strings.NewReader("data"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.managedStorage.AbortUploadForEnvironment("other", handle)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertUploadOffset(c, handle, 4)
+
+	err = s.managedStorage.AbortUploadForEnvironment("env", handle)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.managedStorage.UploadOffset(handle)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	err = s.managedStorage.AbortUploadForEnvironment("env", handle)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	// The data received has been removed.
+	removed, err := s.managedStorage.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 0)
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// RetryPolicy describes how operations which fail
+// with transient errors are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an operation is attempted,
+	// including the first attempt. Values less than 1 are treated as 1.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. The delay
+	// doubles after each subsequent failed attempt.
+	BaseDelay time.Duration
+}
+
+// Wrap time.Sleep so we can patch for testing.
+var retrySleep = time.Sleep
+
+type retryingStorage struct {
+	inner  ResourceStorage
+	policy RetryPolicy
+}
+
+var (
+	_ ResourceStorage       = (*retryingStorage)(nil)
+	_ ResourceStorageLister = (*retryingStorage)(nil)
+)
+
+// NewRetryingStorage returns a ResourceStorage instance which retries
+// operations on inner that fail with transient errors, as described by
+// policy. Errors satisfying errors.IsNotFound, errors.IsAlreadyExists,
+// errors.IsNotValid or errors.IsNotSupported are not considered transient,
+// nor are those caused by context.Canceled, context.DeadlineExceeded,
+// ErrChecksumMismatch or ErrDecryptionFailed.
+//
+// Put is only retried if the reader also implements io.Seeker, so that
+// it can be rewound to where the failed attempt started reading.
+func NewRetryingStorage(inner ResourceStorage, policy RetryPolicy) ResourceStorage {
+	return &retryingStorage{inner: inner, policy: policy}
+}
+
+// isTransient returns whether an operation failing with err may succeed if retried.
+// An operation which was cancelled or timed out, or which read data failing
+// its integrity check, would fail in the same way again.
+func isTransient(err error) bool {
+	switch errors.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded, ErrChecksumMismatch, ErrDecryptionFailed:
+		return false
+	}
+	return !errors.IsNotFound(err) &&
+		!errors.IsAlreadyExists(err) &&
+		!errors.IsNotValid(err) &&
+		!errors.IsNotSupported(err)
+}
+
+// retry calls f until it succeeds, it fails with an error which is not
+// transient, or the maximum number of attempts has been made. If rewind
+// is non-nil, it is called before each retry, and its error is returned
+// if it fails.
+func (s *retryingStorage) retry(what string, f func() error, rewind func() error) error {
+	delay := s.policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isTransient(err) || attempt >= s.policy.MaxAttempts {
+			return err
+		}
+		logger.Debugf("attempt %d to %s failed, retrying in %v: %v", attempt, what, delay, err)
+		retrySleep(delay)
+		delay *= 2
+		if rewind != nil {
+			if err := rewind(); err != nil {
+				return errors.Annotatef(err, "cannot rewind data to %s", what)
+			}
+		}
+	}
+}
+
+// Get is defined on ResourceStorage.
+func (s *retryingStorage) Get(path string) (r io.ReadCloser, err error) {
+	err = s.retry("get "+path, func() error {
+		r, err = s.inner.Get(path)
+		return err
+	}, nil)
+	return r, err
+}
+
+// Put is defined on ResourceStorage.
+func (s *retryingStorage) Put(path string, r io.Reader, length int64) (checksum string, err error) {
+	put := func() error {
+		checksum, err = s.inner.Put(path, r, length)
+		return err
+	}
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return checksum, put()
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// The reader cannot be rewound, so a failed put cannot be retried.
+		return checksum, put()
+	}
+	err = s.retry("put "+path, put, func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	})
+	return checksum, err
+}
+
+// Remove is defined on ResourceStorage.
+func (s *retryingStorage) Remove(path string) error {
+	return s.retry("remove "+path, func() error {
+		return s.inner.Remove(path)
+	}, nil)
+}
+
+// List is defined on ResourceStorageLister.
+func (s *retryingStorage) List() (resources []StoredResource, err error) {
+	lister, ok := s.inner.(ResourceStorageLister)
+	if !ok {
+		return nil, errors.NotSupportedf("listing unlistable resource storage")
+	}
+	err = s.retry("list", func() error {
+		resources, err = lister.List()
+		return err
+	}, nil)
+	return resources, err
+}
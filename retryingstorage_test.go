@@ -0,0 +1,191 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&retryingStorageSuite{})
+
+type retryingStorageSuite struct {
+	testing.IsolationSuite
+	inner  *flakyStorage
+	stor   blobstore.ResourceStorage
+	delays []time.Duration
+}
+
+func (s *retryingStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.inner = &flakyStorage{ResourceStorage: blobstore.NewMemResourceStorage()}
+	s.stor = blobstore.NewRetryingStorage(s.inner, blobstore.RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Second,
+	})
+	s.delays = nil
+	s.PatchValue(blobstore.RetrySleep, func(d time.Duration) {
+		s.delays = append(s.delays, d)
+	})
+}
+
+// flakyStorage is a ResourceStorage which fails the
+// next operations with the errors in errs.
+type flakyStorage struct {
+	blobstore.ResourceStorage
+	errs  []error
+	calls int
+}
+
+func (s *flakyStorage) nextError() error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *flakyStorage) Get(path string) (io.ReadCloser, error) {
+	if err := s.nextError(); err != nil {
+		return nil, err
+	}
+	return s.ResourceStorage.Get(path)
+}
+
+func (s *flakyStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	if err := s.nextError(); err != nil {
+		// Consume some of the data, as a failed write might.
+		io.CopyN(ioutil.Discard, r, 2)
+		return "", err
+	}
+	return s.ResourceStorage.Put(path, r, length)
+}
+
+func (s *flakyStorage) Remove(path string) error {
+	if err := s.nextError(); err != nil {
+		return err
+	}
+	return s.ResourceStorage.Remove(path)
+}
+
+var errTransient = fmt.Errorf("connection reset")
+
+func (s *retryingStorageSuite) TestPutRetries(c *gc.C) {
+	s.inner.errs = []error{errTransient, errTransient}
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.inner.calls, gc.Equals, 3)
+	c.Assert(s.delays, jc.DeepEquals, []time.Duration{time.Second, 2 * time.Second})
+	assertGet(c, s.stor, "/path/to/file", "hello world")
+}
+
+func (s *retryingStorageSuite) TestPutRewindsFromStartOffset(c *gc.C) {
+	r := strings.NewReader("xxhello world")
+	_, err := r.Seek(2, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	s.inner.errs = []error{errTransient}
+	_, err = s.stor.Put("/path/to/file", r, 11)
+	c.Assert(err, jc.ErrorIsNil)
+	assertGet(c, s.stor, "/path/to/file", "hello world")
+}
+
+func (s *retryingStorageSuite) TestPutNotSeekable(c *gc.C) {
+	s.inner.errs = []error{errTransient}
+	r := ioutil.NopCloser(strings.NewReader("hello world"))
+	_, err := s.stor.Put("/path/to/file", r, 11)
+	c.Assert(err, gc.Equals, errTransient)
+	c.Assert(s.inner.calls, gc.Equals, 1)
+	c.Assert(s.delays, gc.HasLen, 0)
+}
+
+func (s *retryingStorageSuite) TestPutGivesUp(c *gc.C) {
+	s.inner.errs = []error{errTransient, errTransient, errTransient, errTransient}
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, gc.Equals, errTransient)
+	c.Assert(s.inner.calls, gc.Equals, 3)
+	c.Assert(s.delays, jc.DeepEquals, []time.Duration{time.Second, 2 * time.Second})
+}
+
+func (s *retryingStorageSuite) TestPutAlreadyExistsNotRetried(c *gc.C) {
+	s.inner.errs = []error{errors.AlreadyExistsf("file")}
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, jc.Satisfies, errors.IsAlreadyExists)
+	c.Assert(s.inner.calls, gc.Equals, 1)
+}
+
+func (s *retryingStorageSuite) TestPermanentErrorsNotRetried(c *gc.C) {
+	for i, permanent := range []error{
+		context.Canceled,
+		errors.Annotate(context.DeadlineExceeded, "put"),
+		errors.Annotate(blobstore.ErrChecksumMismatch, "put"),
+		blobstore.ErrDecryptionFailed,
+	} {
+		c.Logf("test %d: %v", i, permanent)
+		s.inner.calls = 0
+		s.inner.errs = []error{permanent}
+		_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+		c.Assert(err, gc.Equals, permanent)
+		c.Assert(s.inner.calls, gc.Equals, 1)
+		c.Assert(s.delays, gc.HasLen, 0)
+	}
+}
+
+func (s *retryingStorageSuite) TestGetRetries(c *gc.C) {
+	_, err := s.inner.ResourceStorage.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, jc.ErrorIsNil)
+	s.inner.errs = []error{errTransient}
+	assertGet(c, s.stor, "/path/to/file", "hello world")
+	c.Assert(s.inner.calls, gc.Equals, 2)
+	c.Assert(s.delays, jc.DeepEquals, []time.Duration{time.Second})
+}
+
+func (s *retryingStorageSuite) TestGetNotFoundNotRetried(c *gc.C) {
+	_, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(s.inner.calls, gc.Equals, 1)
+	c.Assert(s.delays, gc.HasLen, 0)
+}
+
+func (s *retryingStorageSuite) TestRemoveRetries(c *gc.C) {
+	_, err := s.inner.ResourceStorage.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, jc.ErrorIsNil)
+	s.inner.errs = []error{errTransient}
+	err = s.stor.Remove("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.inner.calls, gc.Equals, 2)
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *retryingStorageSuite) TestSingleAttempt(c *gc.C) {
+	stor := blobstore.NewRetryingStorage(s.inner, blobstore.RetryPolicy{})
+	s.inner.errs = []error{errTransient}
+	err := stor.Remove("/path/to/file")
+	c.Assert(err, gc.Equals, errTransient)
+	c.Assert(s.inner.calls, gc.Equals, 1)
+}
+
+func (s *retryingStorageSuite) TestList(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("hello world"), 11)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.(blobstore.ResourceStorageLister).List()
+	// flakyStorage hides the lister implemented by its embedded storage.
+	c.Assert(err, jc.Satisfies, errors.IsNotSupported)
+
+	stor := blobstore.NewRetryingStorage(s.inner.ResourceStorage, blobstore.RetryPolicy{})
+	assertList(c, stor, "/path/to/file")
+}
@@ -0,0 +1,283 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package s3storage provides a blobstore.ResourceStorage which stores
+// data in an S3 bucket. It is kept apart from the blobstore package so
+// that only those using it depend on the AWS SDK.
+package s3storage
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/juju/errors"
+	"github.com/juju/loggo"
+
+	"github.com/juju/blobstore"
+)
+
+var logger = loggo.GetLogger("juju.storage.s3")
+
+// Config holds the parameters used to construct an S3-backed ResourceStorage.
+type Config struct {
+	// Bucket is the name of the bucket in which data is stored.
+	Bucket string
+
+	// Region is the region in which the bucket resides.
+	Region string
+
+	// AccessKey and SecretKey are the credentials used to access the bucket.
+	AccessKey string
+	SecretKey string
+
+	// Endpoint, if set, overrides the default S3 endpoint for the region.
+	// This allows S3-compatible services to be used.
+	Endpoint string
+
+	// Prefix, if set, is prepended to the key of each object stored, so
+	// that the bucket may be shared. Only objects whose keys start with
+	// it are listed. Without a prefix the bucket may hold objects stored
+	// by others, so the storage cannot be listed or garbage collected.
+	Prefix string
+}
+
+// Validate returns an error if the config is not valid.
+func (cfg Config) Validate() error {
+	if cfg.Bucket == "" {
+		return errors.NotValidf("empty bucket")
+	}
+	if cfg.Region == "" {
+		return errors.NotValidf("empty region")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return errors.NotValidf("missing credentials")
+	}
+	return nil
+}
+
+type s3Storage struct {
+	bucket   string
+	prefix   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+var (
+	_ blobstore.ResourceStorage       = (*s3Storage)(nil)
+	_ blobstore.ResourceStorageLister = (*s3Storage)(nil)
+)
+
+// NewResourceStorage returns a ResourceStorage instance which stores data
+// as objects in an S3 bucket. Large payloads, and those whose length is not
+// known, are uploaded in multiple parts.
+func NewResourceStorage(cfg Config) (blobstore.ResourceStorage, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Annotate(err, "invalid S3 config")
+	}
+	awsConfig := aws.NewConfig().
+		WithRegion(cfg.Region).
+		WithCredentials(credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""))
+	if cfg.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot create S3 session")
+	}
+	client := s3.New(sess)
+	return &s3Storage{
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+	}, nil
+}
+
+// objectKey returns the key of the S3 object holding the data at path.
+func (s *s3Storage) objectKey(path string) string {
+	return s.prefix + strings.TrimPrefix(path, "/")
+}
+
+// isS3NotFound returns whether err indicates that an S3 object does not exist.
+func isS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	return false
+}
+
+// Get is defined on ResourceStorage.
+// The returned reader also implements io.Seeker; seeking
+// causes subsequent reads to request data from the new offset.
+func (s *s3Storage) Get(path string) (io.ReadCloser, error) {
+	r := &s3Reader{storage: s, key: s.objectKey(path)}
+	out, err := r.getObject(nil)
+	if isS3NotFound(err) {
+		return nil, errors.NotFoundf("S3 object %q", path)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "failed to get S3 object %q", path)
+	}
+	r.size = aws.Int64Value(out.ContentLength)
+	r.body = out.Body
+	return r, nil
+}
+
+// Put is defined on ResourceStorage.
+// If length is negative, all the data is read from r; the
+// upload manager then stores it in as many parts as it needs.
+func (s *s3Storage) Put(path string, r io.Reader, length int64) (string, error) {
+	sha384hash := sha512.New384()
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	body := &countingReader{r: io.TeeReader(r, sha384hash)}
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(path)),
+		Body:   body,
+	})
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to upload S3 object %q", path)
+	}
+	if length >= 0 && body.n != length {
+		if removeErr := s.Remove(path); removeErr != nil {
+			logger.Warningf("error cleaning up after failed write: %v", removeErr)
+		}
+		return "", errors.Annotatef(io.EOF, "failed to write data")
+	}
+	return fmt.Sprintf("%x", sha384hash.Sum(nil)), nil
+}
+
+// Remove is defined on ResourceStorage.
+func (s *s3Storage) Remove(path string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(path)),
+	})
+	if isS3NotFound(err) {
+		return errors.NotFoundf("S3 object %q", path)
+	} else if err != nil {
+		return errors.Annotatef(err, "failed to remove S3 object %q", path)
+	}
+	return nil
+}
+
+// List is defined on ResourceStorageLister.
+// Only the objects under the configured prefix are listed, and
+// an error satisfying errors.IsNotSupported is returned if there
+// is no prefix, since the bucket may hold objects stored by others.
+func (s *s3Storage) List() ([]blobstore.StoredResource, error) {
+	if s.prefix == "" {
+		return nil, errors.NotSupportedf("listing S3 bucket %q without a key prefix", s.bucket)
+	}
+	var result []blobstore.StoredResource
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			result = append(result, blobstore.StoredResource{
+				Path:     strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix),
+				Modified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to list S3 bucket %q", s.bucket)
+	}
+	return result, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read is defined on io.Reader.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// s3Reader is an io.ReadSeeker over an S3 object.
+type s3Reader struct {
+	storage *s3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+// getObject requests the object's data, starting from the
+// specified byte range if it is not nil.
+func (r *s3Reader) getObject(byteRange *string) (*s3.GetObjectOutput, error) {
+	return r.storage.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.storage.bucket),
+		Key:    aws.String(r.key),
+		Range:  byteRange,
+	})
+}
+
+// Read is defined on io.Reader.
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		out, err := r.getObject(aws.String(fmt.Sprintf("bytes=%d-", r.offset)))
+		if err != nil {
+			return 0, errors.Annotatef(err, "failed to get S3 object %q", r.key)
+		}
+		r.body = out.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek is defined on io.Seeker.
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.NotValidf("whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.NotValidf("negative offset %d", offset)
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close is defined on io.Closer.
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,310 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package s3storage_test
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+	"github.com/juju/blobstore/s3storage"
+)
+
+var _ = gc.Suite(&s3StorageSuite{})
+
+type s3StorageSuite struct {
+	testing.IsolationSuite
+	server *fakeS3Server
+	stor   blobstore.ResourceStorage
+}
+
+func (s *s3StorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.server = newFakeS3Server()
+	s.AddCleanup(func(*gc.C) { s.server.Close() })
+	stor, err := s3storage.NewResourceStorage(s3storage.Config{
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Endpoint:  s.server.URL,
+		Prefix:    "juju/",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	s.stor = stor
+}
+
+func assertGet(c *gc.C, stor blobstore.ResourceStorage, path, expected string) {
+	r, err := stor.Get(path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, []byte(expected))
+}
+
+// assertList asserts that stor holds data at exactly the expected paths.
+func assertList(c *gc.C, stor blobstore.ResourceStorage, expected ...string) {
+	infos, err := stor.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.ErrorIsNil)
+	var paths []string
+	for _, info := range infos {
+		c.Check(info.Modified.IsZero(), jc.IsFalse)
+		paths = append(paths, info.Path)
+	}
+	c.Assert(paths, jc.SameContents, expected)
+}
+
+func (s *s3StorageSuite) assertPut(c *gc.C, path string, data []byte) {
+	checksum, err := s.stor.Put(path, bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(checksum, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+	assertGet(c, s.stor, path, string(data))
+}
+
+func (s *s3StorageSuite) TestConfigValidation(c *gc.C) {
+	for i, test := range []struct {
+		cfg s3storage.Config
+		err string
+	}{{
+		cfg: s3storage.Config{Region: "r", AccessKey: "a", SecretKey: "s"},
+		err: "invalid S3 config: empty bucket not valid",
+	}, {
+		cfg: s3storage.Config{Bucket: "b", AccessKey: "a", SecretKey: "s"},
+		err: "invalid S3 config: empty region not valid",
+	}, {
+		cfg: s3storage.Config{Bucket: "b", Region: "r", AccessKey: "a"},
+		err: "invalid S3 config: missing credentials not valid",
+	}} {
+		c.Logf("test %d", i)
+		_, err := s3storage.NewResourceStorage(test.cfg)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (s *s3StorageSuite) TestPut(c *gc.C) {
+	s.assertPut(c, "/path/to/file", []byte("hello world"))
+	c.Assert(s.server.object("bucket/juju/path/to/file"), gc.DeepEquals, []byte("hello world"))
+}
+
+func (s *s3StorageSuite) TestPutSameFileOverwrites(c *gc.C) {
+	s.assertPut(c, "/path/to/file", []byte("hello world"))
+	s.assertPut(c, "/path/to/file", []byte("hello again"))
+}
+
+func (s *s3StorageSuite) TestPutMultipart(c *gc.C) {
+	data := bytes.Repeat([]byte("blobalob"), 1024*1024)
+	s.assertPut(c, "/path/to/file", data)
+	c.Assert(s.server.multipartUploads, gc.Equals, 1)
+}
+
+func (s *s3StorageSuite) TestPutUnknownLength(c *gc.C) {
+	data := bytes.Repeat([]byte("blobalob"), 1024*1024)
+	checksum, err := s.stor.Put("/path/to/file", ioutil.NopCloser(bytes.NewReader(data)), -1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(checksum, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+	c.Assert(s.server.multipartUploads, gc.Equals, 1)
+	assertGet(c, s.stor, "/path/to/file", string(data))
+}
+
+func (s *s3StorageSuite) TestPutShortRead(c *gc.C) {
+	_, err := s.stor.Put("/path/to/file", strings.NewReader("short"), 100)
+	c.Assert(err, gc.ErrorMatches, "failed to write data: EOF")
+	_, err = s.stor.Get("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *s3StorageSuite) TestGetNonExistent(c *gc.C) {
+	_, err := s.stor.Get("missing")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *s3StorageSuite) TestGetSeek(c *gc.C) {
+	s.assertPut(c, "/path/to/file", []byte("hello world"))
+	r, err := s.stor.Get("/path/to/file")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	_, err = r.(io.Seeker).Seek(6, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "world")
+}
+
+func (s *s3StorageSuite) TestList(c *gc.C) {
+	assertList(c, s.stor)
+	s.assertPut(c, "/path/to/file", []byte("hello world"))
+	s.assertPut(c, "/path/to/another", []byte("hello again"))
+	assertList(c, s.stor, "path/to/file", "path/to/another")
+}
+
+func (s *s3StorageSuite) TestListScopedToPrefix(c *gc.C) {
+	s.assertPut(c, "/path/to/file", []byte("hello world"))
+	s.server.put("bucket/other/path/to/file", []byte("not ours"))
+	assertList(c, s.stor, "path/to/file")
+}
+
+func (s *s3StorageSuite) TestListWithoutPrefix(c *gc.C) {
+	stor, err := s3storage.NewResourceStorage(s3storage.Config{
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Endpoint:  s.server.URL,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = stor.(blobstore.ResourceStorageLister).List()
+	c.Assert(err, jc.Satisfies, errors.IsNotSupported)
+	c.Assert(err, gc.ErrorMatches, `listing S3 bucket "bucket" without a key prefix not supported`)
+}
+
+func (s *s3StorageSuite) TestRemove(c *gc.C) {
+	path := "/path/to/file"
+	s.assertPut(c, path, []byte("hello world"))
+	err := s.stor.Remove(path)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get(path)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *s3StorageSuite) TestRemoveNonExistent(c *gc.C) {
+	err := s.stor.Remove("/path/to/file")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+// fakeS3Server is a minimal in-memory implementation of the
+// S3 object API, using path-style addressing.
+type fakeS3Server struct {
+	*httptest.Server
+
+	mu               sync.Mutex
+	objects          map[string][]byte
+	uploads          map[string]map[int][]byte
+	multipartUploads int
+}
+
+func newFakeS3Server() *fakeS3Server {
+	srv := &fakeS3Server{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+func (srv *fakeS3Server) object(key string) []byte {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.objects[key]
+}
+
+func (srv *fakeS3Server) put(key string, data []byte) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.objects[key] = data
+}
+
+func (srv *fakeS3Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	key := strings.TrimPrefix(req.URL.Path, "/")
+	query := req.URL.Query()
+	uploadId := query.Get("uploadId")
+	switch {
+	case req.Method == "POST" && uploadId == "":
+		uploadId = strconv.Itoa(len(srv.uploads) + 1)
+		srv.uploads[uploadId] = make(map[int][]byte)
+		srv.multipartUploads++
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadId)
+	case req.Method == "PUT" && uploadId != "":
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := ioutil.ReadAll(req.Body)
+		srv.uploads[uploadId][partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, partNumber))
+	case req.Method == "POST" && uploadId != "":
+		parts := srv.uploads[uploadId]
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		srv.objects[key] = data
+		delete(srv.uploads, uploadId)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case req.Method == "DELETE" && uploadId != "":
+		delete(srv.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "PUT":
+		data, _ := ioutil.ReadAll(req.Body)
+		srv.objects[key] = data
+	case req.Method == "GET" && query.Get("list-type") == "2":
+		srv.list(w, key, query.Get("prefix"))
+	case req.Method == "GET":
+		data, ok := srv.objects[key]
+		if !ok {
+			srv.notFound(w)
+			return
+		}
+		status := http.StatusOK
+		if byteRange := req.Header.Get("Range"); byteRange != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(byteRange, "bytes="), "-"))
+			data = data[start:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		w.Write(data)
+	case req.Method == "DELETE":
+		if _, ok := srv.objects[key]; !ok {
+			srv.notFound(w)
+			return
+		}
+		delete(srv.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list writes a single page listing all objects in bucket
+// whose keys start with prefix.
+func (srv *fakeS3Server) list(w http.ResponseWriter, bucket, prefix string) {
+	var keys []string
+	for key := range srv.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><KeyCount>%d</KeyCount><IsTruncated>false</IsTruncated>", bucket, len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>",
+			strings.TrimPrefix(key, bucket+"/"), time.Now().UTC().Format(time.RFC3339), len(srv.objects[key]))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (srv *fakeS3Server) notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// environmentStorage is an EnvironmentStorage which delegates
+// to a ManagedStorage, passing the environment's UUID.
+type environmentStorage struct {
+	ms      ManagedStorage
+	envUUID string
+}
+
+var _ EnvironmentStorage = (*environmentStorage)(nil)
+
+// ScopedForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ScopedForEnvironment(envUUID string) (EnvironmentStorage, error) {
+	if envUUID == "" {
+		return nil, errors.NotValidf("empty environment UUID")
+	}
+	if strings.Contains(envUUID, "/") {
+		return nil, errors.NotValidf("environment UUID %q", envUUID)
+	}
+	return &environmentStorage{ms: ms, envUUID: envUUID}, nil
+}
+
+// EnvUUID is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) EnvUUID() string {
+	return s.envUUID
+}
+
+// Get is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Get(path string) (io.ReadCloser, int64, error) {
+	return s.ms.GetForEnvironment(s.envUUID, path)
+}
+
+// GetWithContext is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) GetWithContext(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	return s.ms.GetForEnvironmentWithContext(ctx, s.envUUID, path)
+}
+
+// Stat is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Stat(path string) (Metadata, error) {
+	return s.ms.StatForEnvironment(s.envUUID, path)
+}
+
+// Exists is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Exists(path string) (bool, error) {
+	return s.ms.ExistsForEnvironment(s.envUUID, path)
+}
+
+// List is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) List() ([]ResourceInfo, error) {
+	return s.ms.ListForEnvironment(s.envUUID)
+}
+
+// ListPrefix is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) ListPrefix(prefix string) ([]ResourceInfo, error) {
+	return s.ms.ListForEnvironmentPrefix(s.envUUID, prefix)
+}
+
+// Put is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Put(path string, r io.Reader, length int64) error {
+	return s.ms.PutForEnvironment(s.envUUID, path, r, length)
+}
+
+// PutAndCheckHash is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) PutAndCheckHash(path string, r io.Reader, length int64, checkHash string) error {
+	return s.ms.PutForEnvironmentAndCheckHash(s.envUUID, path, r, length, checkHash)
+}
+
+// PutWithContext is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) PutWithContext(ctx context.Context, path string, r io.Reader, length int64) error {
+	return s.ms.PutForEnvironmentWithContext(ctx, s.envUUID, path, r, length)
+}
+
+// Remove is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Remove(path string) error {
+	return s.ms.RemoveForEnvironment(s.envUUID, path)
+}
+
+// Copy is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Copy(srcPath, dstPath string) error {
+	return s.ms.CopyForEnvironment(s.envUUID, srcPath, dstPath)
+}
+
+// Move is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Move(srcPath, dstPath string) error {
+	return s.ms.MoveForEnvironment(s.envUUID, srcPath, dstPath)
+}
+
+// RemoveAll is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) RemoveAll() (int, error) {
+	return s.ms.RemoveAllForEnvironment(s.envUUID)
+}
+
+// Usage is defined on the EnvironmentStorage interface.
+func (s *environmentStorage) Usage() (Usage, error) {
+	return s.ms.UsageForEnvironment(s.envUUID)
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) TestScopedForEnvironment(c *gc.C) {
+	stor, err := s.managedStorage.ScopedForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(stor.EnvUUID(), gc.Equals, "env")
+
+	blob := []byte("some resource")
+	err = stor.Put("/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	// The data is namespaced to the environment.
+	s.assertGet(c, "/path/to/blob", blob)
+	_, _, err = s.managedStorage.GetForEnvironment("another-env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	err = stor.Copy("/path/to/blob", "/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	r, length, err := stor.Get("/path/to/copy")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(blob)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, blob)
+
+	infos, err := stor.List()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 2)
+	err = stor.Remove("/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	exists, err := stor.Exists("/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(exists, jc.IsFalse)
+	removed, err := stor.RemoveAll()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestScopedForEnvironmentInvalid(c *gc.C) {
+	_, err := s.managedStorage.ScopedForEnvironment("")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = s.managedStorage.ScopedForEnvironment("env/other")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultScrubRate is the maximum number of bytes per second read
+// by ScrubForEnvironment, if not otherwise specified.
+const DefaultScrubRate = 10 << 20
+
+// ScrubForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ScrubForEnvironment(
+	ctx context.Context, envUUID string, report func(path string, ok bool, err error),
+) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	envPrefix, query, err := ms.environmentPathQuery(envUUID, "")
+	if err != nil {
+		return err
+	}
+	// The records are read up front, since checking the data may
+	// take long enough for a cursor over them to time out.
+	var docs []managedResourceDoc
+	fields := bson.D{{"path", 1}, {"resourceid", 1}, {"expirytime", 1}, {"deletedtime", 1}}
+	if err := ms.managedResourceCollection.Find(query).Select(fields).All(&docs); err != nil {
+		return errors.Annotate(err, "cannot read managed resource records")
+	}
+	bucket := ms.scrubBucket(ctx)
+	for _, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if doc.expired(ms.clock.Now()) {
+			continue
+		}
+		path := strings.TrimPrefix(doc.Path, envPrefix)
+		r, err := ms.resourceCatalog.Get(doc.ResourceId)
+		if errors.IsNotFound(err) || IsUploadPending(err) {
+			// Only data which is fully stored can be checked.
+			continue
+		} else if err != nil {
+			report(path, false, errors.Annotatef(err, "cannot load catalog entry for resource with path %q", doc.Path))
+			continue
+		}
+		err = ms.scrubResource(bucket, doc.Path, r)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		report(path, err == nil, err)
+	}
+	return nil
+}
+
+// scrubResource reads the data for the catalog entry r, referenced
+// by the managed resource at managedPath, returning an error whose
+// cause is ErrChecksumMismatch if it does not match the entry's hash.
+func (ms *managedStorage) scrubResource(bucket *tokenBucket, managedPath string, r *Resource) error {
+	rdr, err := ms.openStored(r.Path)
+	if err != nil {
+		return errors.Annotatef(err, "cannot read resource %q at storage path %q", managedPath, r.Path)
+	}
+	defer rdr.Close()
+	verifier := &verifyingReader{
+		ReadCloser: rdr,
+		path:       managedPath,
+		hash:       r.HashAlgorithm.New(),
+		expected:   r.Hash,
+	}
+	_, err = io.Copy(ioutil.Discard, &throttledReader{bucket, verifier})
+	return err
+}
+
+// scrubBucket returns the tokenBucket limiting the rate at which data
+// is read when checking stored data. A second's worth of data may be
+// read without waiting.
+func (ms *managedStorage) scrubBucket(ctx context.Context) *tokenBucket {
+	return newTokenBucket(ctx, ms.scrubRate, ms.scrubRate)
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// scrubResults records the results reported by ScrubForEnvironment.
+type scrubResults map[string]error
+
+func (r scrubResults) report(path string, ok bool, err error) {
+	if ok != (err == nil) {
+		panic("inconsistent scrub result")
+	}
+	r[path] = err
+}
+
+func (s *managedStorageSuite) TestScrubForEnvironment(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	resPath := s.assertPut(c, "/path/to/corrupt", []byte("another resource"))
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/other", bytes.NewReader([]byte("other")), 5)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Corrupt the stored data.
+	err = s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.resourceStorage.Put(resPath, bytes.NewReader([]byte("corrupt resource")), 16)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Manually set up an entry whose upload has not yet completed.
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/pending",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+
+	results := make(scrubResults)
+	err = s.managedStorage.ScrubForEnvironment(context.Background(), "env", results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 2)
+	c.Assert(results["/path/to/blob"], jc.ErrorIsNil)
+	c.Assert(results["/path/to/corrupt"], gc.ErrorMatches, `resource at path "environs/env/path/to/corrupt": checksum mismatch`)
+	c.Assert(errors.Cause(results["/path/to/corrupt"]), gc.Equals, blobstore.ErrChecksumMismatch)
+}
+
+func (s *managedStorageSuite) TestScrubForEnvironmentMissingData(c *gc.C) {
+	resPath := s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	err := s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	results := make(scrubResults)
+	err = s.managedStorage.ScrubForEnvironment(context.Background(), "env", results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results["/path/to/blob"], gc.ErrorMatches, `cannot read resource "environs/env/path/to/blob" at storage path ".*": .*`)
+}
+
+func (s *managedStorageSuite) TestScrubForEnvironmentCancelled(c *gc.C) {
+	s.assertPut(c, "/path/to/blob", []byte("some resource"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := make(scrubResults)
+	err := s.managedStorage.ScrubForEnvironment(ctx, "env", results.report)
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(results, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestScrubForEnvironmentCancelledWhileWaiting(c *gc.C) {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ScrubRate:       1,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader([]byte("some resource")), 13)
+	c.Assert(err, jc.ErrorIsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	})
+	results := make(scrubResults)
+	err = ms.ScrubForEnvironment(ctx, "env", results.report)
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(results, gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestScrubForEnvironmentRateLimited(c *gc.C) {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ScrubRate:       4,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader([]byte("some resource")), 13)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The clock does not move, so after the first second's
+	// worth of data each wait is for the debt accrued so far.
+	now := time.Now()
+	s.patchTimeNow(&now)
+	var waits []time.Duration
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	})
+	results := make(scrubResults)
+	err = ms.ScrubForEnvironment(context.Background(), "env", results.report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results["/path/to/blob"], jc.ErrorIsNil)
+	c.Assert(len(waits) >= 3, jc.IsTrue)
+	c.Assert(waits[:3], jc.DeepEquals, []time.Duration{
+		time.Second, 2 * time.Second, 2250 * time.Millisecond,
+	})
+}
+
+func (s *managedStorageSuite) TestScrubForEnvironmentInvalid(c *gc.C) {
+	err := s.managedStorage.ScrubForEnvironment(context.Background(), "", scrubResults{}.report)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
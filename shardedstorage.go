@@ -0,0 +1,181 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"hash/fnv"
+	"io"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+type shardedStorage struct {
+	shards      []ResourceStorage
+	hashToShard func(path string) int
+}
+
+var (
+	_ ResourceStorage       = (*shardedStorage)(nil)
+	_ ResourceStorageLister = (*shardedStorage)(nil)
+)
+
+// ShardForPath returns the index of the shard, out of n, which holds
+// the data at path under the default placement used by NewShardedStorage.
+// If n is not positive, no shard can hold the data, and -1 is returned.
+func ShardForPath(path string, n int) int {
+	if n < 1 {
+		return -1
+	}
+	h := fnv.New32a()
+	io.WriteString(h, path)
+	return int(h.Sum32() % uint32(n))
+}
+
+// NewShardedStorage returns a ResourceStorage instance which spreads data
+// across shards, so that more data may be held than fits in any one of them.
+// The data at each path is held by the shard whose index is returned by
+// hashToShard, which must always return the same index for a path. If
+// hashToShard is nil, paths are placed using ShardForPath.
+//
+// ManagedStorage de-dupes data before it is written to the resource storage,
+// so sharding does not affect de-duping by a ManagedStorage. The sharded
+// storage does not itself detect identical data held by different shards.
+//
+// Changing the shards or their placement makes data already stored
+// unreachable until it is moved; see ShardRebalance and ShardRebalanceRing.
+func NewShardedStorage(shards []ResourceStorage, hashToShard func(path string) int) ResourceStorage {
+	if hashToShard == nil {
+		n := len(shards)
+		hashToShard = func(path string) int {
+			return ShardForPath(path, n)
+		}
+	}
+	return &shardedStorage{shards: shards, hashToShard: hashToShard}
+}
+
+// shard returns the shard which holds the data at path.
+func (s *shardedStorage) shard(path string) (ResourceStorage, error) {
+	if len(s.shards) == 0 {
+		return nil, errors.NotValidf("sharded storage with no shards")
+	}
+	i := s.hashToShard(path)
+	if i < 0 || i >= len(s.shards) {
+		return nil, errors.NotValidf("shard %d of %d for path %q", i, len(s.shards), path)
+	}
+	if s.shards[i] == nil {
+		return nil, errors.NotValidf("nil shard %d for path %q", i, path)
+	}
+	return s.shards[i], nil
+}
+
+// Get is defined on ResourceStorage.
+func (s *shardedStorage) Get(path string) (io.ReadCloser, error) {
+	shard, err := s.shard(path)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Get(path)
+}
+
+// Put is defined on ResourceStorage.
+func (s *shardedStorage) Put(path string, r io.Reader, length int64) (string, error) {
+	shard, err := s.shard(path)
+	if err != nil {
+		return "", err
+	}
+	return shard.Put(path, r, length)
+}
+
+// Remove is defined on ResourceStorage.
+func (s *shardedStorage) Remove(path string) error {
+	shard, err := s.shard(path)
+	if err != nil {
+		return err
+	}
+	return shard.Remove(path)
+}
+
+// List is defined on ResourceStorageLister. It fails with an error
+// satisfying errors.IsNotSupported unless every shard is listable.
+func (s *shardedStorage) List() ([]StoredResource, error) {
+	var result []StoredResource
+	for i := range s.shards {
+		resources, err := s.listShard(i)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, resources...)
+	}
+	return result, nil
+}
+
+// listShard returns a description of the data held by the i'th shard.
+// A nil shard, removed from a ConsistentHashRing, holds no data.
+func (s *shardedStorage) listShard(i int) ([]StoredResource, error) {
+	if s.shards[i] == nil {
+		return nil, nil
+	}
+	lister, ok := s.shards[i].(ResourceStorageLister)
+	if !ok {
+		return nil, errors.NotSupportedf("listing unlistable shard %d", i)
+	}
+	resources, err := lister.List()
+	if err != nil {
+		return nil, errors.Annotatef(err, "cannot list shard %d", i)
+	}
+	return resources, nil
+}
+
+// ShardMove describes data which must be moved between shards.
+type ShardMove struct {
+	// Path is the storage path of the data.
+	Path string
+
+	// From is the index of the shard which holds the data, and To
+	// the index of the shard which should hold it.
+	From, To int
+}
+
+// ShardRebalance returns the moves needed for the data held by stor, which
+// must have been returned by NewShardedStorage, to be placed by ShardForPath
+// across newShardCount shards, ordered by path. Data already held by the
+// shard it belongs in is not included. Every shard must be listable.
+//
+// The moves are not made; the caller should copy the data for each move
+// to its new shard before switching to the new placement, and remove it
+// from its old shard afterwards.
+func ShardRebalance(stor ResourceStorage, newShardCount int) ([]ShardMove, error) {
+	s, ok := stor.(*shardedStorage)
+	if !ok {
+		return nil, errors.NotValidf("rebalancing unsharded resource storage")
+	}
+	if newShardCount < 1 {
+		return nil, errors.NotValidf("shard count %d", newShardCount)
+	}
+	return s.rebalance(func(path string) int {
+		return ShardForPath(path, newShardCount)
+	})
+}
+
+// rebalance returns the moves needed for the data held by
+// the shards to be placed by hashToShard, ordered by path.
+func (s *shardedStorage) rebalance(hashToShard func(path string) int) ([]ShardMove, error) {
+	var moves []ShardMove
+	for i := range s.shards {
+		resources, err := s.listShard(i)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resources {
+			if to := hashToShard(r.Path); to != i {
+				moves = append(moves, ShardMove{Path: r.Path, From: i, To: to})
+			}
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Path < moves[j].Path
+	})
+	return moves, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&shardedStorageSuite{})
+
+type shardedStorageSuite struct {
+	testing.IsolationSuite
+	shards []blobstore.ResourceStorage
+	stor   blobstore.ResourceStorage
+}
+
+func (s *shardedStorageSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.shards = []blobstore.ResourceStorage{
+		blobstore.NewMemResourceStorage(),
+		blobstore.NewMemResourceStorage(),
+		blobstore.NewMemResourceStorage(),
+	}
+	s.stor = blobstore.NewShardedStorage(s.shards, nil)
+}
+
+func (s *shardedStorageSuite) put(c *gc.C, path, data string) {
+	_, err := s.stor.Put(path, strings.NewReader(data), int64(len(data)))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *shardedStorageSuite) TestPutGetRemove(c *gc.C) {
+	for i := 0; i < 20; i++ {
+		s.put(c, fmt.Sprintf("path-%d", i), fmt.Sprintf("data-%d", i))
+	}
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("path-%d", i)
+		assertGet(c, s.stor, path, fmt.Sprintf("data-%d", i))
+		// The data is held only by the shard the path is placed in.
+		for j, shard := range s.shards {
+			_, err := shard.Get(path)
+			if j == blobstore.ShardForPath(path, len(s.shards)) {
+				c.Check(err, jc.ErrorIsNil)
+			} else {
+				c.Check(err, jc.Satisfies, errors.IsNotFound)
+			}
+		}
+	}
+	err := s.stor.Remove("path-0")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.stor.Get("path-0")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *shardedStorageSuite) TestSpreadsData(c *gc.C) {
+	for i := 0; i < 30; i++ {
+		s.put(c, fmt.Sprintf("path-%d", i), "data")
+	}
+	for i := range s.shards {
+		infos, err := s.shards[i].(blobstore.ResourceStorageLister).List()
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(infos, gc.Not(gc.HasLen), 0)
+	}
+}
+
+func (s *shardedStorageSuite) TestHashToShard(c *gc.C) {
+	s.stor = blobstore.NewShardedStorage(s.shards, func(path string) int {
+		return len(path) - 1
+	})
+	s.put(c, "ab", "data")
+	assertList(c, s.shards[1], "ab")
+	assertList(c, s.shards[0])
+
+	_, err := s.stor.Put("abcd", strings.NewReader("data"), 4)
+	c.Assert(err, gc.ErrorMatches, `shard 3 of 3 for path "abcd" not valid`)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *shardedStorageSuite) TestNoShards(c *gc.C) {
+	stor := blobstore.NewShardedStorage(nil, nil)
+	_, err := stor.Put("path", strings.NewReader("data"), 4)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	_, err = stor.Get("path")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	err = stor.Remove("path")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	c.Assert(blobstore.ShardForPath("path", 0), gc.Equals, -1)
+}
+
+func (s *shardedStorageSuite) TestNilShard(c *gc.C) {
+	s.shards[1] = nil
+	s.stor = blobstore.NewShardedStorage(s.shards, func(path string) int {
+		return len(path) - 1
+	})
+	_, err := s.stor.Put("ab", strings.NewReader("data"), 4)
+	c.Assert(err, gc.ErrorMatches, `nil shard 1 for path "ab" not valid`)
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *shardedStorageSuite) TestList(c *gc.C) {
+	s.put(c, "path-1", "data")
+	s.put(c, "path-2", "data")
+	s.put(c, "path-3", "data")
+	assertList(c, s.stor, "path-1", "path-2", "path-3")
+}
+
+func (s *shardedStorageSuite) TestShardRebalance(c *gc.C) {
+	var paths []string
+	for i := 0; i < 30; i++ {
+		path := fmt.Sprintf("path-%d", i)
+		paths = append(paths, path)
+		s.put(c, path, "data")
+	}
+	moves, err := blobstore.ShardRebalance(s.stor, 4)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(moves, gc.Not(gc.HasLen), 0)
+	moved := make(map[string]blobstore.ShardMove)
+	for _, move := range moves {
+		moved[move.Path] = move
+	}
+	for _, path := range paths {
+		from, to := blobstore.ShardForPath(path, 3), blobstore.ShardForPath(path, 4)
+		move, ok := moved[path]
+		if from == to {
+			c.Check(ok, jc.IsFalse)
+		} else {
+			c.Check(move, jc.DeepEquals, blobstore.ShardMove{Path: path, From: from, To: to})
+		}
+	}
+
+	// Nothing moves if the shard count is unchanged.
+	moves, err = blobstore.ShardRebalance(s.stor, 3)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(moves, gc.HasLen, 0)
+}
+
+func (s *shardedStorageSuite) TestShardRebalanceInvalid(c *gc.C) {
+	_, err := blobstore.ShardRebalance(s.shards[0], 4)
+	c.Assert(err, gc.ErrorMatches, "rebalancing unsharded resource storage not valid")
+	_, err = blobstore.ShardRebalance(s.stor, 0)
+	c.Assert(err, gc.ErrorMatches, "shard count 0 not valid")
+}
@@ -0,0 +1,115 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// softRemove marks the managed resource record at managedPath as deleted
+// rather than removing it. The record keeps its reference to the resource,
+// so the data is retained until the record is purged by PurgeDeleted.
+func (ms *managedStorage) softRemove(envUUID, user, path, managedPath string) error {
+	var resourceId string
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var doc managedResourceDoc
+		if err := ms.managedResourceCollection.FindId(managedPath).One(&doc); err == mgo.ErrNotFound || doc.expired(ms.clock.Now()) {
+			return nil, errors.NotFoundf("resource at path %q", managedPath)
+		} else if err != nil {
+			return nil, err
+		}
+		resourceId = doc.ResourceId
+		return []txn.Op{{
+			C:      ms.managedResourceCollection.Name,
+			Id:     doc.Id,
+			Assert: managedResourceUnchanged(doc),
+			Update: bson.D{{"$set", bson.D{{"deletedtime", ms.clock.Now()}}}},
+		}}, nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); errors.IsNotFound(err) {
+		return err
+	} else if err != nil {
+		return errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	event := AuditEvent{
+		Operation: AuditRemove,
+		EnvUUID:   envUUID,
+		User:      user,
+		Path:      path,
+	}
+	event.Hash, event.HashAlgorithm = resourceIdHash(resourceId)
+	if ms.auditing() {
+		if r, err := ms.resourceCatalog.Get(resourceId); err == nil {
+			event.Length = r.Length
+		}
+	}
+	return ms.audit(event)
+}
+
+// UndeleteForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) UndeleteForEnvironment(envUUID, path string) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return err
+	}
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var doc managedResourceDoc
+		err := ms.managedResourceCollection.FindId(managedPath).One(&doc)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		// Records deleted before the window started may not have
+		// been purged yet, but can no longer be restored.
+		if err == mgo.ErrNotFound || doc.DeletedTime.IsZero() || !doc.DeletedTime.After(ms.softDeleteCutoff()) {
+			return nil, errors.NotFoundf("deleted resource at path %q", managedPath)
+		}
+		return []txn.Op{{
+			C:      ms.managedResourceCollection.Name,
+			Id:     doc.Id,
+			Assert: managedResourceUnchanged(doc),
+			Update: bson.D{{"$unset", bson.D{{"deletedtime", 1}}}},
+		}}, nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); errors.IsNotFound(err) {
+		return err
+	} else if err != nil {
+		return errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	return nil
+}
+
+// PurgeDeleted is defined on the ManagedStorage interface.
+func (ms *managedStorage) PurgeDeleted() (int, error) {
+	if err := ms.checkOpen(); err != nil {
+		return 0, err
+	}
+	var docs []managedResourceDoc
+	query := bson.D{{"deletedtime", bson.D{{"$lte", ms.softDeleteCutoff()}}}}
+	if err := ms.managedResourceCollection.Find(query).All(&docs); err != nil {
+		return 0, errors.Annotate(err, "cannot read managed resource records")
+	}
+	removed, failures, auditErr := ms.removeDocs(docs, AuditPurge)
+	if len(failures) > 0 {
+		return removed, errors.Errorf(
+			"cannot purge %d deleted resources: %s",
+			len(failures), strings.Join(failures, "; "),
+		)
+	}
+	return removed, auditErr
+}
+
+// softDeleteCutoff returns the time at or before which
+// soft-deleted records may no longer be restored.
+func (ms *managedStorage) softDeleteCutoff() time.Time {
+	return ms.clock.Now().Add(-ms.softDeleteWindow)
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) newSoftDeleteManagedStorage(c *gc.C, window time.Duration) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  s.resourceStorage,
+		SoftDeleteWindow: window,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func assertManagedGet(c *gc.C, ms blobstore.ManagedStorage, path string, expected []byte) {
+	r, _, err := ms.GetForEnvironment("env", path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, expected)
+}
+
+func (s *managedStorageSuite) TestSoftDeleteUndelete(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	ms := s.newSoftDeleteManagedStorage(c, time.Hour)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	infos, err := ms.ListForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	// The data is retained while it may be restored.
+	s.assertResourceCatalogCount(c, 1)
+
+	now = now.Add(30 * time.Minute)
+	err = ms.UndeleteForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/blob", blob)
+	purged, err := ms.PurgeDeleted()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(purged, gc.Equals, 0)
+}
+
+func (s *managedStorageSuite) TestUndeleteNotDeleted(c *gc.C) {
+	ms := s.newSoftDeleteManagedStorage(c, time.Hour)
+	err := ms.UndeleteForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	blob := []byte("some resource")
+	err = ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.UndeleteForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestPurgeDeleted(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	ms := s.newSoftDeleteManagedStorage(c, time.Hour)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	now = now.Add(time.Hour)
+	// Once the window has passed, the data can no longer be
+	// restored, even before it is purged.
+	err = ms.UndeleteForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	purged, err := ms.PurgeDeleted()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(purged, gc.Equals, 1)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestSoftDeletedPathOverwritten(c *gc.C) {
+	ms := s.newSoftDeleteManagedStorage(c, time.Hour)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = ms.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+
+	anotherBlob := []byte("another resource")
+	err = ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(anotherBlob), int64(len(anotherBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	assertManagedGet(c, ms, "/path/to/blob", anotherBlob)
+	s.assertResourceCatalogCount(c, 1)
+	err = ms.UndeleteForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *managedStorageSuite) TestNewManagedStorageWithParamsNegativeSoftDeleteWindow(c *gc.C) {
+	_, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:         s.db,
+		ResourceStorage:  s.resourceStorage,
+		SoftDeleteWindow: -time.Second,
+	})
+	c.Assert(err, gc.ErrorMatches, "invalid managed storage params: negative SoftDeleteWindow not valid")
+}
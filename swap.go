@@ -0,0 +1,44 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// SwapForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) SwapForEnvironment(envUUID, path string, r io.Reader, length int64) (err error) {
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{swap: true})
+	return err
+}
+
+// swapResourceReference points the managed resource record at the resource
+// with the given id, releasing the reference held by any record it replaces
+// in the same transaction. Data no longer referenced is not deleted, so
+// that reads of it already under way are not disturbed.
+func (ms *managedStorage) swapResourceReference(managedResource ManagedResource, resourceId string) error {
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		existingResourceId, ops, err := ms.putResourceTxn(managedResource, resourceId)
+		if err != nil || existingResourceId == "" {
+			return ops, err
+		}
+		// The reference released must be the one replaced.
+		ops[0].Assert = bson.D{{"resourceid", existingResourceId}}
+		releaseOps, _, err := ms.releaseOps([]string{existingResourceId})
+		if err != nil {
+			return nil, err
+		}
+		return append(ops, releaseOps...), nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); err != nil {
+		return errors.Annotate(err, "cannot update managed resource catalog")
+	}
+	logger.Debugf("managed resource entry swapped at path %q -> %q", managedResource.Path, resourceId)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *managedStorageSuite) TestSwapForEnvironment(c *gc.C) {
+	oldBlob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", oldBlob)
+	r, _, err := s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+
+	newBlob := []byte("another resource")
+	err = s.managedStorage.SwapForEnvironment("env", "/path/to/blob", bytes.NewReader(newBlob), int64(len(newBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", newBlob)
+	s.assertResourceCatalogCount(c, 1)
+
+	// A read of the old data already under way completes.
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, oldBlob)
+
+	// The old data is left for garbage collection.
+	s.assertStoredCount(c, 2)
+	removed, err := s.managedStorage.GarbageCollect(0)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	s.assertStoredCount(c, 1)
+	s.assertGet(c, "/path/to/blob", newBlob)
+}
+
+func (s *managedStorageSuite) TestSwapForEnvironmentShared(c *gc.C) {
+	oldBlob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", oldBlob)
+	s.assertPut(c, "/path/to/other", oldBlob)
+	newBlob := []byte("another resource")
+	err := s.managedStorage.SwapForEnvironment("env", "/path/to/blob", bytes.NewReader(newBlob), int64(len(newBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", newBlob)
+	s.assertGet(c, "/path/to/other", oldBlob)
+	s.assertResourceCatalogCount(c, 2)
+
+	// Swapping in the same data leaves the references unchanged.
+	err = s.managedStorage.SwapForEnvironment("env", "/path/to/other", bytes.NewReader(oldBlob), int64(len(oldBlob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/other", oldBlob)
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+}
+
+func (s *managedStorageSuite) TestSwapForEnvironmentNew(c *gc.C) {
+	blob := []byte("some resource")
+	err := s.managedStorage.SwapForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+	s.assertResourceCatalogCount(c, 1)
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttleSleep waits for the given duration, or until ctx is done.
+// It is a variable so that it may be patched for testing.
+var throttleSleep = func(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// tokenBucket limits the rate at which data is transferred to rate
+// bytes per second, while allowing bursts of up to burst bytes.
+// If rate is not positive, transfers are not limited.
+type tokenBucket struct {
+	ctx    context.Context
+	rate   int64
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a tokenBucket which starts full, so that
+// the first burst bytes may be transferred without waiting.
+func newTokenBucket(ctx context.Context, rate, burst int64) *tokenBucket {
+	return &tokenBucket{
+		ctx:    ctx,
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   timeNow(),
+	}
+}
+
+// take removes n tokens from the bucket, waiting until the
+// bucket has refilled if that leaves it in debt.
+func (b *tokenBucket) take(n int) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	now := timeNow()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return nil
+	}
+	d := time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	return throttleSleep(b.ctx, d)
+}
+
+// throttledReader is a reader whose reads are limited by a tokenBucket.
+// Reads fail once the bucket's context is done.
+type throttledReader struct {
+	bucket *tokenBucket
+	r      io.Reader
+}
+
+// Read is defined on io.Reader.
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if err := r.bucket.ctx.Err(); err != nil {
+		return 0, err
+	}
+	// Never read more than a burst at once, so that
+	// the limit is applied smoothly.
+	if r.bucket.rate > 0 && int64(len(p)) > r.bucket.burst {
+		p = p[:r.bucket.burst]
+	}
+	n, err := r.r.Read(p)
+	if waitErr := r.bucket.take(n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+// throttledReadCloser is a ReadCloser whose reads are throttled.
+type throttledReadCloser struct {
+	throttledReader
+	io.Closer
+}
+
+// throttledReadSeekCloser is a throttledReadCloser which can seek,
+// so that throttling does not hide the Seek method of the reader
+// it wraps. Seeking transfers no data, so is not throttled.
+type throttledReadSeekCloser struct {
+	throttledReadCloser
+	seeker io.Seeker
+}
+
+// Seek is defined on io.Seeker.
+func (r *throttledReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	return r.seeker.Seek(offset, whence)
+}
+
+// throttle returns a reader which reads from r no faster than the
+// storage's throttle rate, or r itself if throughput is not limited.
+func (ms *managedStorage) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if ms.throttleRate <= 0 {
+		return r
+	}
+	return &throttledReader{newTokenBucket(ctx, ms.throttleRate, ms.throttleBurst), r}
+}
+
+// throttleReadCloser is the same as throttle, for readers which must be
+// closed. If r can seek, so can the reader returned.
+func (ms *managedStorage) throttleReadCloser(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if ms.throttleRate <= 0 {
+		return r
+	}
+	throttled := throttledReadCloser{throttledReader{newTokenBucket(ctx, ms.throttleRate, ms.throttleBurst), r}, r}
+	if seeker, ok := r.(io.Seeker); ok {
+		return &throttledReadSeekCloser{throttled, seeker}
+	}
+	return &throttled
+}
@@ -0,0 +1,199 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&throttleSuite{})
+
+// throttleSleep is the unpatched throttle sleep function.
+var throttleSleep = *blobstore.ThrottleSleep
+
+type throttleSuite struct {
+	testing.IsolationSuite
+	now   time.Time
+	waits []time.Duration
+}
+
+func (s *throttleSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.waits = nil
+	s.patchClock()
+}
+
+// patchClock patches the clock used by throttled readers so
+// that it only moves when a reader waits, or when advanced.
+func (s *throttleSuite) patchClock() {
+	s.now = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.PatchValue(blobstore.TimeNow, func() time.Time {
+		return s.now
+	})
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		s.waits = append(s.waits, d)
+		s.now = s.now.Add(d)
+		return ctx.Err()
+	})
+}
+
+func (s *throttleSuite) TestThrottledReader(c *gc.C) {
+	r := blobstore.NewThrottledReader(context.Background(), strings.NewReader("0123456789abcdefghij"), 4, 8)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "0123456789abcdefghij")
+	// The first 8 bytes are a burst; the rest are read at 4 bytes per second.
+	c.Assert(s.waits, jc.DeepEquals, []time.Duration{2 * time.Second, time.Second})
+}
+
+func (s *throttleSuite) TestThrottledReaderBurstAfterIdle(c *gc.C) {
+	r := blobstore.NewThrottledReader(context.Background(), strings.NewReader("0123456789abcdefghij"), 4, 8)
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Idling refills the bucket, but no further than the burst size.
+	s.now = s.now.Add(time.Minute)
+	_, err = io.ReadFull(r, buf)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.waits, gc.HasLen, 0)
+	_, err = io.ReadFull(r, buf[:4])
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.waits, jc.DeepEquals, []time.Duration{time.Second})
+}
+
+func (s *throttleSuite) TestThrottledReaderCancelled(c *gc.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	})
+	r := blobstore.NewThrottledReader(ctx, strings.NewReader("0123456789abcdefghij"), 1, 1)
+	buf := make([]byte, 8)
+	// The first byte is within the burst, and the second must be waited for.
+	n, err := r.Read(buf)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	n, err = r.Read(buf)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(err, gc.Equals, context.Canceled)
+	n, err = r.Read(buf)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(err, gc.Equals, context.Canceled)
+}
+
+func (s *throttleSuite) TestThrottledReaderCancelledWaitsPromptly(c *gc.C) {
+	// With the real sleep, a long wait is cut short by cancellation.
+	s.PatchValue(blobstore.ThrottleSleep, throttleSleep)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r := blobstore.NewThrottledReader(ctx, strings.NewReader("0123456789abcdefghij"), 1, 1)
+	start := time.Now()
+	_, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < 5*time.Second, jc.IsTrue)
+}
+
+func (s *managedStorageSuite) newThrottledManagedStorage(c *gc.C, rate, burst int64) blobstore.ManagedStorage {
+	ms, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ThrottleRate:    rate,
+		ThrottleBurst:   burst,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return ms
+}
+
+func (s *managedStorageSuite) TestThrottledPutAndGet(c *gc.C) {
+	ms := s.newThrottledManagedStorage(c, 4, 0)
+	now := time.Now()
+	s.patchTimeNow(&now)
+	var waits []time.Duration
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		now = now.Add(d)
+		return nil
+	})
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	// The burst defaults to one second's worth of data.
+	c.Assert(waits, jc.DeepEquals, []time.Duration{time.Second, time.Second, 250 * time.Millisecond})
+
+	waits = nil
+	r, _, err := ms.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.Close(), jc.ErrorIsNil)
+	c.Assert(data, gc.DeepEquals, blob)
+	c.Assert(waits, jc.DeepEquals, []time.Duration{time.Second, time.Second, 250 * time.Millisecond})
+}
+
+func (s *managedStorageSuite) TestThrottledGetSeeker(c *gc.C) {
+	ms := s.newThrottledManagedStorage(c, 1<<20, 0)
+	blob := []byte("some resource")
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Throttling does not prevent seeking.
+	r, _, err := ms.GetSeekerForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	_, err = r.Seek(5, io.SeekStart)
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "resource")
+}
+
+func (s *managedStorageSuite) TestThrottledGetCancelled(c *gc.C) {
+	ms := s.newThrottledManagedStorage(c, 1, 0)
+	blob := []byte("some resource")
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		return nil
+	})
+	err := ms.PutForEnvironment("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.PatchValue(blobstore.ThrottleSleep, func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	})
+	r, _, err := ms.GetForEnvironmentWithContext(ctx, "env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, context.Canceled)
+}
+
+func (s *managedStorageSuite) TestNewManagedStorageWithParamsNegativeThrottle(c *gc.C) {
+	_, err := blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ThrottleRate:    -1,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid managed storage params: negative ThrottleRate not valid`)
+	_, err = blobstore.NewManagedStorageWithParams(blobstore.ManagedStorageParams{
+		Database:        s.db,
+		ResourceStorage: s.resourceStorage,
+		ThrottleBurst:   -1,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid managed storage params: negative ThrottleBurst not valid`)
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+)
+
+// PutForEnvironmentTrustingHash is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentTrustingHash(envUUID, path string, r io.Reader, length int64, hash string) (err error) {
+	if err := ms.hashAlgorithm.checkHashFormat(hash); err != nil {
+		return err
+	}
+	_, err = ms.put(context.Background(), envUUID, "", path, r, length, putOptions{trustedHash: hash})
+	return err
+}
+
+// ChecksumForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ChecksumForEnvironment(envUUID, path string) (string, error) {
+	if err := ms.checkOpen(); err != nil {
+		return "", err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return "", err
+	}
+	resourceId, err := ms.resourceIdForPath(managedPath)
+	if err != nil {
+		return "", err
+	}
+	var doc resourceDoc
+	if err := ms.db.C(resourceCatalogCollection).FindId(resourceId).Select(bson.D{{"data", 0}}).One(&doc); err == mgo.ErrNotFound {
+		return "", errors.NotFoundf("resource at path %q", managedPath)
+	} else if err != nil {
+		return "", errors.Annotatef(err, "cannot load catalog entry for resource with path %q", managedPath)
+	}
+	if doc.Path == "" {
+		pendingErr := doc.uploadPendingError(ms.clock.Now())
+		pendingErr.Path = managedPath
+		return "", pendingErr
+	}
+	hash, alg := doc.hash()
+	if !doc.Unverified {
+		return hash, nil
+	}
+	// The recorded hash is only as good as the word of the client
+	// which stored the data, so the hash is calculated instead.
+	return ms.storedHash(doc.Path, doc.Length, alg)
+}
+
+// markUnverified flags the catalog entry with the given id as having
+// a hash which has not been checked, provided the entry's data is still
+// that stored at resourcePath.
+func (ms *managedStorage) markUnverified(resourceId, resourcePath string) error {
+	ops := []txn.Op{{
+		C:      resourceCatalogCollection,
+		Id:     resourceId,
+		Assert: bson.D{{"path", resourcePath}},
+		Update: bson.D{{"$set", bson.D{{"unverified", true}}}},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil && err != txn.ErrAborted {
+		return err
+	}
+	return nil
+}
+
+// VerifyTrustedHashes is defined on the ManagedStorage interface.
+func (ms *managedStorage) VerifyTrustedHashes(ctx context.Context, report func(hash string, err error)) error {
+	if err := ms.checkOpen(); err != nil {
+		return err
+	}
+	// The entries are read up front, since checking the data may
+	// take long enough for a cursor over them to time out.
+	var docs []resourceDoc
+	query := bson.D{{"unverified", true}}
+	if err := ms.db.C(resourceCatalogCollection).Find(query).Select(bson.D{{"data", 0}}).All(&docs); err != nil {
+		return errors.Annotate(err, "cannot read resource catalog")
+	}
+	bucket := ms.scrubBucket(ctx)
+	for i := range docs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hash, _ := docs[i].hash()
+		err := ms.verifyTrustedHash(bucket, &docs[i])
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		report(hash, err)
+	}
+	return nil
+}
+
+// verifyTrustedHash reads the data for the catalog entry doc, and clears
+// the entry's unverified flag if the data matches the entry's hash.
+// Otherwise an error whose cause is ErrChecksumMismatch is returned.
+func (ms *managedStorage) verifyTrustedHash(bucket *tokenBucket, doc *resourceDoc) error {
+	rdr, err := ms.openStored(doc.Path)
+	if err != nil {
+		return errors.Annotatef(err, "cannot read data at storage path %q", doc.Path)
+	}
+	defer rdr.Close()
+	hash, alg := doc.hash()
+	verifier := &verifyingReader{
+		ReadCloser: rdr,
+		path:       doc.Path,
+		hash:       alg.New(),
+		expected:   hash,
+	}
+	n, err := io.Copy(ioutil.Discard, &throttledReader{bucket, verifier})
+	if err != nil {
+		return err
+	}
+	if n != doc.Length {
+		return errors.Annotatef(ErrChecksumMismatch,
+			"expected %d bytes at storage path %q, read %d", doc.Length, doc.Path, n)
+	}
+	ops := []txn.Op{{
+		C:      resourceCatalogCollection,
+		Id:     doc.Id,
+		Assert: bson.D{{"path", doc.Path}},
+		Update: bson.D{{"$unset", bson.D{{"unverified", nil}}}},
+	}}
+	if err := txnRunner(ms.db).RunTransaction(ops); err != nil && err != txn.ErrAborted {
+		return errors.Annotatef(err, "cannot record verification of data at storage path %q", doc.Path)
+	}
+	return nil
+}
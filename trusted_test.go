@@ -0,0 +1,134 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+// verifyTrustedHashes runs VerifyTrustedHashes, returning the reported results.
+func (s *managedStorageSuite) verifyTrustedHashes(c *gc.C) map[string]error {
+	results := make(map[string]error)
+	err := s.managedStorage.VerifyTrustedHashes(context.Background(), func(hash string, err error) {
+		results[hash] = err
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return results
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTrustingHash(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutForEnvironmentTrustingHash("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), hash)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertGet(c, "/path/to/blob", blob)
+
+	c.Assert(s.verifyTrustedHashes(c), jc.DeepEquals, map[string]error{hash: nil})
+	// Once verified, the data is not checked again.
+	c.Assert(s.verifyTrustedHashes(c), gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTrustingHashMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	other := []byte("some-resource")
+	hash := calculateCheckSum(c, 0, int64(len(other)), other)
+	err := s.managedStorage.PutForEnvironmentTrustingHash("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), hash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The data is stored under the wrong hash, so the data with
+	// that hash is de-duped to it.
+	err = s.managedStorage.PutForEnvironment("env", "/path/to/other", bytes.NewReader(other), int64(len(other)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+
+	results := s.verifyTrustedHashes(c)
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(errors.Cause(results[hash]), gc.Equals, blobstore.ErrChecksumMismatch)
+	// The data remains unverified.
+	c.Assert(s.verifyTrustedHashes(c), gc.HasLen, 1)
+
+	r, _, err := s.managedStorage.GetForEnvironmentVerified("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = bytes.NewBuffer(nil).ReadFrom(r)
+	c.Assert(errors.Cause(err), gc.Equals, blobstore.ErrChecksumMismatch)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTrustingHashLengthMismatch(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutForEnvironmentTrustingHash("env", "/path/to/blob", bytes.NewReader(blob), 5, hash)
+	c.Assert(err, gc.NotNil)
+	_, _, err = s.managedStorage.GetForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTrustingHashExistingData(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	err := s.managedStorage.PutForEnvironmentTrustingHash("env", "/path/to/another", bytes.NewReader(blob), int64(len(blob)), hash)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 1)
+	// The stored data was hashed when it was first stored.
+	c.Assert(s.verifyTrustedHashes(c), gc.HasLen, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentTrustingHashInvalid(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	for _, hash := range []string{"", "hash", "abcd", strings.ToUpper(hash)} {
+		err := s.managedStorage.PutForEnvironmentTrustingHash("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), hash)
+		c.Assert(err, gc.ErrorMatches, `malformed sha384 hash ".*" not valid`)
+		c.Assert(err, jc.Satisfies, errors.IsNotValid)
+	}
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestChecksumForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	resPath := s.assertPut(c, "/path/to/blob", blob)
+	// The recorded hash is returned without reading the data.
+	err := s.resourceStorage.Remove(resPath)
+	c.Assert(err, jc.ErrorIsNil)
+	hash, err := s.managedStorage.ChecksumForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(hash, gc.Equals, calculateCheckSum(c, 0, int64(len(blob)), blob))
+}
+
+func (s *managedStorageSuite) TestChecksumForEnvironmentTrustedHash(c *gc.C) {
+	blob := []byte("some resource")
+	other := []byte("some-resource")
+	trustedHash := calculateCheckSum(c, 0, int64(len(other)), other)
+	err := s.managedStorage.PutForEnvironmentTrustingHash("env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)), trustedHash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The unverified hash is not believed.
+	hash, err := s.managedStorage.ChecksumForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(hash, gc.Equals, calculateCheckSum(c, 0, int64(len(blob)), blob))
+}
+
+func (s *managedStorageSuite) TestChecksumForEnvironmentPending(c *gc.C) {
+	blob := []byte("some resource")
+	hash := calculateCheckSum(c, 0, int64(len(blob)), blob)
+	_, err := s.managedStorage.ReserveForEnvironment("env", "/path/to/blob", hash, int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.managedStorage.ChecksumForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.Satisfies, blobstore.IsUploadPending)
+	c.Assert(err, gc.ErrorMatches, `.*resource at path "environs/env/path/to/blob".*`)
+}
+
+func (s *managedStorageSuite) TestChecksumForEnvironmentNonExistent(c *gc.C) {
+	_, err := s.managedStorage.ChecksumForEnvironment("env", "/path/to/nowhere")
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultUploadBufferSize is the number of bytes of uploaded data
+// held in memory before it is spilled to a temporary file, if not
+// otherwise specified.
+const DefaultUploadBufferSize = 1 << 20
+
+// uploadBuffer holds uploaded data while its length and checksum
+// are calculated. Data is held in memory until it exceeds the
+// buffer's threshold, after which it is spilled to a temporary file.
+// Once written, the data is read back using the Read, ReadAt and
+// Seek methods; Close must be called to release the temporary file.
+type uploadBuffer struct {
+	threshold int64
+	dir       string
+	data      []byte
+	file      *os.File
+	rdr       interface {
+		io.ReadSeeker
+		io.ReaderAt
+	}
+}
+
+// newUploadBuffer returns an uploadBuffer holding up to threshold bytes in
+// memory. If threshold is negative, all data is written to a temporary file.
+// Temporary files are created in dir, or os.TempDir if dir is empty.
+func newUploadBuffer(threshold int64, dir string) *uploadBuffer {
+	return &uploadBuffer{threshold: threshold, dir: dir}
+}
+
+// Write is defined on io.Writer.
+func (b *uploadBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && int64(len(b.data)+len(p)) > b.threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// readFromChunkSize is the most data read into memory
+// by each read made by ReadFrom.
+const readFromChunkSize = 32 * 1024
+
+// ReadFrom is defined on io.ReaderFrom. It is used by io.Copy to read
+// data directly into the buffer's memory, rather than copying it through
+// an intermediate buffer. Once the data is spilled, the rest is read by
+// the temporary file's own ReadFrom.
+func (b *uploadBuffer) ReadFrom(r io.Reader) (n int64, err error) {
+	// Data is read into memory until there is more than the threshold allows.
+	for b.file == nil {
+		if int64(len(b.data)) > b.threshold {
+			if err := b.spill(); err != nil {
+				return n, err
+			}
+			break
+		}
+		// Nothing more than one byte beyond the threshold is read into
+		// memory, that being enough to show that the data must spill.
+		size := int64(readFromChunkSize)
+		if limit := b.threshold + 1 - int64(len(b.data)); limit < size {
+			size = limit
+		}
+		if int64(cap(b.data)-len(b.data)) < size {
+			newCap := 2*int64(cap(b.data)) + readFromChunkSize
+			if newCap > b.threshold+1 {
+				newCap = b.threshold + 1
+			}
+			grown := make([]byte, len(b.data), newCap)
+			copy(grown, b.data)
+			b.data = grown
+		}
+		m, err := r.Read(b.data[len(b.data) : int64(len(b.data))+size])
+		b.data = b.data[:len(b.data)+m]
+		n += int64(m)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+	m, err := b.file.ReadFrom(r)
+	return n + m, err
+}
+
+// spill moves the data held in memory to a temporary file,
+// which is readable and writable only by its owner.
+func (b *uploadBuffer) spill() error {
+	f, err := ioutil.TempFile(b.dir, "juju-resource")
+	if err != nil {
+		return err
+	}
+	b.file = f
+	if _, err := f.Write(b.data); err != nil {
+		return err
+	}
+	b.data = nil
+	return nil
+}
+
+// spilled reports whether the data has been spilled to a temporary file.
+func (b *uploadBuffer) spilled() bool {
+	return b.file != nil
+}
+
+// finishWrite prepares the buffer for its data to be read.
+func (b *uploadBuffer) finishWrite() error {
+	if b.file == nil {
+		b.rdr = bytes.NewReader(b.data)
+		return nil
+	}
+	if _, err := b.file.Seek(0, 0); err != nil {
+		return err
+	}
+	b.rdr = b.file
+	return nil
+}
+
+// Read is defined on io.Reader.
+func (b *uploadBuffer) Read(p []byte) (int, error) {
+	return b.rdr.Read(p)
+}
+
+// ReadAt is defined on io.ReaderAt.
+func (b *uploadBuffer) ReadAt(p []byte, off int64) (int, error) {
+	return b.rdr.ReadAt(p, off)
+}
+
+// Seek is defined on io.Seeker.
+func (b *uploadBuffer) Seek(offset int64, whence int) (int64, error) {
+	return b.rdr.Seek(offset, whence)
+}
+
+// Close releases the buffered data, removing any temporary file.
+// It may be called at any point, including part way through writing.
+func (b *uploadBuffer) Close() error {
+	b.data = nil
+	if b.file == nil {
+		return nil
+	}
+	f := b.file
+	b.file, b.rdr = nil, nil
+	f.Close()
+	return os.Remove(f.Name())
+}
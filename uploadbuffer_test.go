@@ -0,0 +1,179 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+var _ = gc.Suite(&uploadBufferSuite{})
+
+type uploadBufferSuite struct {
+	testing.IsolationSuite
+	tempDir string
+}
+
+func (s *uploadBufferSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.tempDir = c.MkDir()
+	s.PatchEnvironment("TMPDIR", s.tempDir)
+}
+
+func (s *uploadBufferSuite) assertTempFiles(c *gc.C, expected int) {
+	infos, err := ioutil.ReadDir(s.tempDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, expected)
+}
+
+func (s *uploadBufferSuite) assertBuffer(c *gc.C, threshold int64, data string, spilled bool) {
+	b := blobstore.NewUploadBuffer(threshold, "")
+	n, err := b.Write([]byte(data[:5]))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(n, gc.Equals, 5)
+	n, err = b.Write([]byte(data[5:]))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(n, gc.Equals, len(data)-5)
+	c.Assert(blobstore.UploadBufferSpilled(b), gc.Equals, spilled)
+	if spilled {
+		s.assertTempFiles(c, 1)
+	} else {
+		s.assertTempFiles(c, 0)
+	}
+
+	err = blobstore.FinishUploadBuffer(b)
+	c.Assert(err, jc.ErrorIsNil)
+	read, err := ioutil.ReadAll(b)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(read), gc.Equals, data)
+	err = b.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertTempFiles(c, 0)
+}
+
+func (s *uploadBufferSuite) TestInMemory(c *gc.C) {
+	s.assertBuffer(c, 20, "some resource", false)
+}
+
+func (s *uploadBufferSuite) TestAtThreshold(c *gc.C) {
+	s.assertBuffer(c, 13, "some resource", false)
+}
+
+func (s *uploadBufferSuite) TestSpilled(c *gc.C) {
+	s.assertBuffer(c, 8, "some resource", true)
+}
+
+func (s *uploadBufferSuite) TestAlwaysSpilled(c *gc.C) {
+	s.assertBuffer(c, -1, "some resource", true)
+}
+
+func (s *uploadBufferSuite) TestCloseWithoutFinishing(c *gc.C) {
+	b := blobstore.NewUploadBuffer(4, "")
+	_, err := b.Write([]byte(strings.Repeat("x", 10)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertTempFiles(c, 1)
+	err = b.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertTempFiles(c, 0)
+}
+
+func (s *uploadBufferSuite) TestSpilledToDir(c *gc.C) {
+	dir := c.MkDir()
+	b := blobstore.NewUploadBuffer(4, dir)
+	_, err := b.Write([]byte(strings.Repeat("x", 10)))
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertTempFiles(c, 0)
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Mode().Perm(), gc.Equals, os.FileMode(0600))
+	err = b.Close()
+	c.Assert(err, jc.ErrorIsNil)
+	infos, err = ioutil.ReadDir(dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(infos, gc.HasLen, 0)
+
+	// Closing again is harmless.
+	err = b.Close()
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *uploadBufferSuite) assertReadFrom(c *gc.C, threshold int64, data string, spilled bool) {
+	b := blobstore.NewUploadBuffer(threshold, "")
+	defer b.Close()
+	// Only the reader's Read method is visible, as for the hashing
+	// reader from which data being stored is read.
+	n, err := b.(io.ReaderFrom).ReadFrom(struct{ io.Reader }{strings.NewReader(data)})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(n, gc.Equals, int64(len(data)))
+	c.Assert(blobstore.UploadBufferSpilled(b), gc.Equals, spilled)
+	err = blobstore.FinishUploadBuffer(b)
+	c.Assert(err, jc.ErrorIsNil)
+	read, err := ioutil.ReadAll(b)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(read), gc.Equals, data)
+}
+
+func (s *uploadBufferSuite) TestReadFromInMemory(c *gc.C) {
+	s.assertReadFrom(c, 20, "some resource", false)
+}
+
+func (s *uploadBufferSuite) TestReadFromAtThreshold(c *gc.C) {
+	s.assertReadFrom(c, 13, "some resource", false)
+}
+
+func (s *uploadBufferSuite) TestReadFromSpilled(c *gc.C) {
+	s.assertReadFrom(c, 12, "some resource", true)
+}
+
+func (s *uploadBufferSuite) TestReadFromAlwaysSpilled(c *gc.C) {
+	s.assertReadFrom(c, -1, "some resource", true)
+}
+
+// benchmarkBuffer measures buffering a blob of the given size, read
+// through a hashing reader as when stored. If readFrom is false, the
+// buffer's ReadFrom method is hidden, so that io.Copy copies the data
+// through an intermediate buffer.
+func benchmarkBuffer(c *gc.C, threshold int64, size int, readFrom bool) {
+	blob := bytes.Repeat([]byte("x"), size)
+	c.SetBytes(int64(size))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		b := blobstore.NewUploadBuffer(threshold, "")
+		rdr, _ := blobstore.SHA384.NewHashingReader(bytes.NewReader(blob))
+		var w io.Writer = b
+		if !readFrom {
+			w = struct{ io.Writer }{b}
+		}
+		if _, err := io.Copy(w, rdr); err != nil {
+			c.Fatal(err)
+		}
+		b.Close()
+	}
+}
+
+func (s *uploadBufferSuite) BenchmarkBufferCopyInMemory(c *gc.C) {
+	benchmarkBuffer(c, blobstore.DefaultUploadBufferSize, 1<<20, false)
+}
+
+func (s *uploadBufferSuite) BenchmarkBufferReadFromInMemory(c *gc.C) {
+	benchmarkBuffer(c, blobstore.DefaultUploadBufferSize, 1<<20, true)
+}
+
+func (s *uploadBufferSuite) BenchmarkBufferCopySpilled(c *gc.C) {
+	benchmarkBuffer(c, blobstore.DefaultUploadBufferSize, 32<<20, false)
+}
+
+func (s *uploadBufferSuite) BenchmarkBufferReadFromSpilled(c *gc.C) {
+	benchmarkBuffer(c, blobstore.DefaultUploadBufferSize, 32<<20, true)
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Usage describes the storage used by an environment.
+type Usage struct {
+	// LogicalBytes is the total length of the data at all of the
+	// environment's paths, as if none of it were de-duplicated.
+	LogicalBytes int64
+
+	// PhysicalBytes is the environment's share of the stored data.
+	// Data referenced more than once is divided evenly between its
+	// references, wherever they are, so data referenced twice by one
+	// environment and once by another is attributed two thirds to the
+	// first and one third to the second. Each share is rounded down,
+	// so the shares of all environments, users and global storage may
+	// sum to slightly less than the total stored.
+	PhysicalBytes int64
+}
+
+// UsageForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) UsageForEnvironment(envUUID string) (Usage, error) {
+	if err := ms.checkOpen(); err != nil {
+		return Usage{}, err
+	}
+	if envUUID == "" {
+		return Usage{}, errors.NotValidf("empty environment UUID")
+	}
+	refs, err := ms.environmentReferences(envUUID)
+	if err != nil {
+		return Usage{}, err
+	}
+	docs, err := ms.catalogDocs(refs)
+	if err != nil {
+		return Usage{}, err
+	}
+	var usage Usage
+	for _, doc := range docs {
+		if doc.Path == "" || doc.RefCount <= 0 {
+			// The upload is not complete, so no data is stored yet.
+			continue
+		}
+		count := int64(refs[doc.Id])
+		usage.LogicalBytes += doc.Length * count
+		usage.PhysicalBytes += doc.Length * count / doc.RefCount
+	}
+	return usage, nil
+}
+
+// EnvironmentsWithData is defined on the ManagedStorage interface.
+func (ms *managedStorage) EnvironmentsWithData() ([]string, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	var envUUIDs []string
+	query := bson.D{{"envuuid", bson.D{{"$nin", []interface{}{"", nil}}}}}
+	query = append(query, liveRecordQuery(ms.clock.Now())...)
+	if err := ms.managedResourceCollection.Find(query).Distinct("envuuid", &envUUIDs); err != nil {
+		return nil, errors.Annotate(err, "cannot read managed resource records")
+	}
+	sort.Strings(envUUIDs)
+	return envUUIDs, nil
+}
+
+// environmentReferences returns the number of the environment's managed
+// resources referencing each resource catalog entry, keyed on its id.
+func (ms *managedStorage) environmentReferences(envUUID string) (map[string]int, error) {
+	prefix, err := ms.resourceStoragePath(envUUID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	query := bson.D{{"path", bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix+"/")}}}
+	iter := ms.managedResourceCollection.Find(query).Select(bson.D{{"resourceid", 1}}).Iter()
+	refs := make(map[string]int)
+	var doc managedResourceDoc
+	for iter.Next(&doc) {
+		refs[doc.ResourceId]++
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Annotate(err, "cannot read managed resource records")
+	}
+	return refs, nil
+}
+
+// catalogDocs returns the resource catalog records
+// with the ids used as keys in refs.
+func (ms *managedStorage) catalogDocs(refs map[string]int) ([]resourceDoc, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(refs))
+	for id := range refs {
+		ids = append(ids, id)
+	}
+	var docs []resourceDoc
+	query := bson.D{{"_id", bson.D{{"$in", ids}}}}
+	if err := ms.db.C(resourceCatalogCollection).Find(query).Select(bson.D{{"data", 0}}).All(&docs); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource catalog")
+	}
+	return docs, nil
+}
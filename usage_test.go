@@ -0,0 +1,89 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) assertUsage(c *gc.C, envUUID string, expected blobstore.Usage) {
+	usage, err := s.managedStorage.UsageForEnvironment(envUUID)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(usage, gc.Equals, expected)
+}
+
+func (s *managedStorageSuite) TestUsageForEnvironment(c *gc.C) {
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/copy", blob)
+	s.assertPut(c, "/path/to/another", []byte("another resource"))
+	err := s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The 13 bytes of blob are shared three ways, two thirds
+	// to env and one third to another-env.
+	s.assertUsage(c, "env", blobstore.Usage{
+		LogicalBytes:  13*2 + 16,
+		PhysicalBytes: 13*2/3 + 16,
+	})
+	s.assertUsage(c, "another-env", blobstore.Usage{
+		LogicalBytes:  13,
+		PhysicalBytes: 13 / 3,
+	})
+
+	err = s.managedStorage.RemoveForEnvironment("another-env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertUsage(c, "env", blobstore.Usage{
+		LogicalBytes:  13*2 + 16,
+		PhysicalBytes: 13 + 16,
+	})
+}
+
+func (s *managedStorageSuite) TestUsageForEnvironmentEmpty(c *gc.C) {
+	s.assertUsage(c, "env", blobstore.Usage{})
+}
+
+func (s *managedStorageSuite) TestUsageForEnvironmentPending(c *gc.C) {
+	rc := blobstore.GetResourceCatalog(s.managedStorage)
+	id, _, err := rc.Put("foo", 100)
+	c.Assert(err, jc.ErrorIsNil)
+	managedResource := blobstore.ManagedResource{
+		EnvUUID: "env",
+		Path:    "environs/env/path/to/pending",
+	}
+	_, err = blobstore.PutManagedResource(s.managedStorage, managedResource, id)
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertUsage(c, "env", blobstore.Usage{})
+}
+
+func (s *managedStorageSuite) TestUsageForEnvironmentInvalid(c *gc.C) {
+	_, err := s.managedStorage.UsageForEnvironment("")
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestEnvironmentsWithData(c *gc.C) {
+	envUUIDs, err := s.managedStorage.EnvironmentsWithData()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(envUUIDs, gc.HasLen, 0)
+
+	blob := []byte("some resource")
+	s.assertPut(c, "/path/to/blob", blob)
+	s.assertPut(c, "/path/to/another", blob)
+	err = s.managedStorage.PutForEnvironment("another-env", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutForUser("user", "/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.managedStorage.PutGlobal("/path/to/blob", bytes.NewReader(blob), int64(len(blob)))
+	c.Assert(err, jc.ErrorIsNil)
+
+	envUUIDs, err = s.managedStorage.EnvironmentsWithData()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(envUUIDs, jc.DeepEquals, []string{"another-env", "env"})
+}
@@ -0,0 +1,374 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2/txn"
+
+	jujutxn "github.com/juju/txn"
+)
+
+const (
+	// resourceVersionCollection is the name of the collection
+	// which stores the resourceVersionDoc records.
+	resourceVersionCollection = "managedStoredResourceVersions"
+)
+
+// resourceVersionDoc records a version of the data at a path. Each
+// version holds a reference to the resource catalog entry for its data,
+// so the data is kept until the version is pruned.
+type resourceVersionDoc struct {
+	Id         string    `bson:"_id"`
+	Path       string    `bson:"path"`
+	Version    int       `bson:"version"`
+	ResourceId string    `bson:"resourceid"`
+	Created    time.Time `bson:"created"`
+}
+
+// resourceVersionDocId returns the id of the record for the
+// given version of the data at managedPath. The version comes
+// first so that ids are unambiguous whatever the path.
+func resourceVersionDocId(managedPath string, version int) string {
+	return fmt.Sprintf("%d:%s", version, managedPath)
+}
+
+// VersionRetention determines which versions of the data at a path are
+// kept by PutForEnvironmentVersioned. The latest version is always kept.
+type VersionRetention struct {
+	// MaxVersions, if positive, is the number of versions kept.
+	MaxVersions int
+
+	// MaxAge, if positive, is the time for which versions other
+	// than the latest are kept.
+	MaxAge time.Duration
+}
+
+// Validate returns an error if the retention policy is not valid.
+func (r VersionRetention) Validate() error {
+	if r.MaxVersions < 0 {
+		return errors.NotValidf("negative MaxVersions")
+	}
+	if r.MaxAge < 0 {
+		return errors.NotValidf("negative MaxAge")
+	}
+	return nil
+}
+
+// VersionInfo describes a version of the data at a path.
+type VersionInfo struct {
+	// Version is the number of the version; versions
+	// of the data at a path are numbered from 1.
+	Version int
+
+	// Created is the time at which the version was stored.
+	Created time.Time
+
+	// Length is the length of the data.
+	Length int64
+
+	// Hash is the hex-encoded hash of the data,
+	// calculated using HashAlgorithm.
+	Hash          string
+	HashAlgorithm HashAlgorithm
+}
+
+// resourceVersions returns the collection holding the version records.
+func (ms *managedStorage) resourceVersions() *mgo.Collection {
+	return ms.db.C(resourceVersionCollection)
+}
+
+// PutForEnvironmentVersioned is defined on the ManagedStorage interface.
+func (ms *managedStorage) PutForEnvironmentVersioned(
+	envUUID, path string, r io.Reader, length int64, retention VersionRetention,
+) (int, error) {
+	if err := retention.Validate(); err != nil {
+		return 0, err
+	}
+	var version int
+	if _, err := ms.put(context.Background(), envUUID, "", path, r, length, putOptions{version: &version}); err != nil {
+		return 0, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return 0, err
+	}
+	// The data is stored, so failing to prune old versions does not fail
+	// the put; they will be pruned by the next versioned put to the path.
+	if err := ms.pruneVersions(managedPath, retention); err != nil {
+		logger.Errorf("cannot prune versions of resource %q: %v", managedPath, err)
+	}
+	return version, nil
+}
+
+// addVersion records a new version of the data at managedPath, referencing
+// the resource with the given id, and returns its number. The caller must
+// already hold the reference to the resource for the version.
+func (ms *managedStorage) addVersion(managedPath, resourceId string) (int, error) {
+	var version int
+	buildTxn := func(attempt int) ([]txn.Op, error) {
+		var latest resourceVersionDoc
+		err := ms.resourceVersions().Find(bson.D{{"path", managedPath}}).Sort("-version").One(&latest)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		version = latest.Version + 1
+		return []txn.Op{{
+			C:      resourceVersionCollection,
+			Id:     resourceVersionDocId(managedPath, version),
+			Assert: txn.DocMissing,
+			Insert: resourceVersionDoc{
+				Path:       managedPath,
+				Version:    version,
+				ResourceId: resourceId,
+				Created:    ms.clock.Now(),
+			},
+		}}, nil
+	}
+	if err := txnRunner(ms.db).Run(buildTxn); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// cleanupVersion is used to delete the record of a version added
+// by a put if the put subsequently fails.
+func (ms *managedStorage) cleanupVersion(managedPath string, version int, err *error) {
+	if *err == nil {
+		return
+	}
+	logger.Warningf("cleaning up resource version after failed put")
+	ops := []txn.Op{{
+		C:      resourceVersionCollection,
+		Id:     resourceVersionDocId(managedPath, version),
+		Remove: true,
+	}}
+	if removeErr := txnRunner(ms.db).RunTransaction(ops); removeErr != nil {
+		*err = errors.Annotatef(*err, "cannot clean up after failed storage operation because: %v", removeErr)
+	}
+}
+
+// pruneVersions removes the versions of the data at managedPath
+// which are not kept by retention.
+func (ms *managedStorage) pruneVersions(managedPath string, retention VersionRetention) error {
+	if retention.MaxVersions == 0 && retention.MaxAge == 0 {
+		return nil
+	}
+	var docs []resourceVersionDoc
+	if err := ms.resourceVersions().Find(bson.D{{"path", managedPath}}).Sort("-version").All(&docs); err != nil {
+		return errors.Annotate(err, "cannot read resource versions")
+	}
+	cutoff := ms.clock.Now().Add(-retention.MaxAge)
+	var pruned []resourceVersionDoc
+	for i, doc := range docs {
+		if i == 0 {
+			continue
+		}
+		if retention.MaxVersions > 0 && i >= retention.MaxVersions ||
+			retention.MaxAge > 0 && !doc.Created.After(cutoff) {
+			pruned = append(pruned, doc)
+		}
+	}
+	return ms.removeVersions(pruned)
+}
+
+// removeVersions removes the given version records, releasing the
+// references they hold in the same transaction as each is removed.
+func (ms *managedStorage) removeVersions(docs []resourceVersionDoc) error {
+	for _, doc := range docs {
+		var deletedPaths []string
+		buildTxn := func(attempt int) ([]txn.Op, error) {
+			if attempt > 0 {
+				if n, err := ms.resourceVersions().FindId(doc.Id).Count(); err != nil {
+					return nil, err
+				} else if n == 0 {
+					// Removed concurrently, along with its reference.
+					return nil, jujutxn.ErrNoOperations
+				}
+			}
+			var releaseOps []txn.Op
+			var err error
+			releaseOps, deletedPaths, err = ms.releaseOps([]string{doc.ResourceId})
+			if err != nil {
+				return nil, err
+			}
+			return append([]txn.Op{{
+				C:      resourceVersionCollection,
+				Id:     doc.Id,
+				Assert: txn.DocExists,
+				Remove: true,
+			}}, releaseOps...), nil
+		}
+		if err := txnRunner(ms.db).Run(buildTxn); err != nil {
+			return errors.Annotatef(err, "cannot remove version %d of resource %q", doc.Version, doc.Path)
+		}
+		for _, resourcePath := range deletedPaths {
+			if err := ms.removeStored(resourcePath); err != nil && !errors.IsNotFound(err) {
+				return errors.Annotatef(err, "cannot delete version %d of resource %q at storage path %q", doc.Version, doc.Path, resourcePath)
+			}
+		}
+	}
+	return nil
+}
+
+// versionRemoveOps returns the operations to remove the version records of
+// the data at the given managed paths, along with the ids of the resources
+// they reference, whose references must be released in the same transaction.
+func (ms *managedStorage) versionRemoveOps(managedPaths ...string) ([]txn.Op, []string, error) {
+	var docs []resourceVersionDoc
+	query := bson.D{{"path", bson.D{{"$in", managedPaths}}}}
+	if err := ms.resourceVersions().Find(query).All(&docs); err != nil {
+		return nil, nil, errors.Annotate(err, "cannot read resource versions")
+	}
+	ops := make([]txn.Op, len(docs))
+	resourceIds := make([]string, len(docs))
+	for i, doc := range docs {
+		ops[i] = txn.Op{
+			C:      resourceVersionCollection,
+			Id:     doc.Id,
+			Assert: txn.DocExists,
+			Remove: true,
+		}
+		resourceIds[i] = doc.ResourceId
+	}
+	return ops, resourceIds, nil
+}
+
+// versionMoveOps returns the operations to move the version records of
+// the data at srcManagedPath to dstManagedPath, which must have none.
+func (ms *managedStorage) versionMoveOps(srcManagedPath, dstManagedPath string) ([]txn.Op, error) {
+	var docs []resourceVersionDoc
+	if err := ms.resourceVersions().Find(bson.D{{"path", srcManagedPath}}).All(&docs); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource versions")
+	}
+	ops := make([]txn.Op, 0, 2*len(docs))
+	for _, doc := range docs {
+		ops = append(ops, txn.Op{
+			C:      resourceVersionCollection,
+			Id:     doc.Id,
+			Assert: txn.DocExists,
+			Remove: true,
+		}, txn.Op{
+			C:      resourceVersionCollection,
+			Id:     resourceVersionDocId(dstManagedPath, doc.Version),
+			Assert: txn.DocMissing,
+			Insert: resourceVersionDoc{
+				Path:       dstManagedPath,
+				Version:    doc.Version,
+				ResourceId: doc.ResourceId,
+				Created:    doc.Created,
+			},
+		})
+	}
+	return ops, nil
+}
+
+// removeVersionsForPrefix removes the versions of the data
+// at all paths beginning with prefix.
+func (ms *managedStorage) removeVersionsForPrefix(prefix string) error {
+	var docs []resourceVersionDoc
+	query := bson.D{{"path", bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}}}
+	if err := ms.resourceVersions().Find(query).All(&docs); err != nil {
+		return errors.Annotate(err, "cannot read resource versions")
+	}
+	return ms.removeVersions(docs)
+}
+
+// GetForEnvironmentVersion is defined on the ManagedStorage interface.
+func (ms *managedStorage) GetForEnvironmentVersion(envUUID, path string, version int) (rc io.ReadCloser, length int64, err error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	defer func() {
+		rc = ms.observeGet(start, rc, length, err)
+	}()
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var doc resourceVersionDoc
+	if err := ms.resourceVersions().FindId(resourceVersionDocId(managedPath, version)).One(&doc); err == mgo.ErrNotFound {
+		return nil, 0, errors.NotFoundf("version %d of resource at path %q", version, managedPath)
+	} else if err != nil {
+		return nil, 0, errors.Annotatef(err, "cannot load version %d of resource with path %q", version, managedPath)
+	}
+	ctx := context.Background()
+	rdr, length, err := ms.getResource(ctx, doc.ResourceId, managedPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ms.throttleReadCloser(ctx, rdr), length, nil
+}
+
+// ListVersionsForEnvironment is defined on the ManagedStorage interface.
+func (ms *managedStorage) ListVersionsForEnvironment(envUUID, path string) ([]VersionInfo, error) {
+	if err := ms.checkOpen(); err != nil {
+		return nil, err
+	}
+	managedPath, err := ms.resourceStoragePath(envUUID, "", path)
+	if err != nil {
+		return nil, err
+	}
+	var docs []resourceVersionDoc
+	if err := ms.resourceVersions().Find(bson.D{{"path", managedPath}}).Sort("version").All(&docs); err != nil {
+		return nil, errors.Annotate(err, "cannot read resource versions")
+	}
+	refs := make(map[string]int)
+	for _, doc := range docs {
+		refs[doc.ResourceId]++
+	}
+	catalogDocs, err := ms.catalogDocs(refs)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]resourceDoc)
+	for _, doc := range catalogDocs {
+		entries[doc.Id] = doc
+	}
+	infos := make([]VersionInfo, 0, len(docs))
+	for _, doc := range docs {
+		entry, ok := entries[doc.ResourceId]
+		if !ok {
+			return nil, errors.Errorf("missing catalog entry for version %d of resource %q", doc.Version, managedPath)
+		}
+		hash, alg := entry.hash()
+		infos = append(infos, VersionInfo{
+			Version:       doc.Version,
+			Created:       doc.Created,
+			Length:        entry.Length,
+			Hash:          hash,
+			HashAlgorithm: alg,
+		})
+	}
+	return infos, nil
+}
+
+// rehashVersionOps returns the operations to update the version
+// records referencing the resource with oldId to reference newId.
+func (ms *managedStorage) rehashVersionOps(oldId, newId string) ([]txn.Op, error) {
+	var refs []resourceVersionDoc
+	query := bson.D{{"resourceid", oldId}}
+	if err := ms.resourceVersions().Find(query).Select(bson.D{{"_id", 1}}).All(&refs); err != nil {
+		return nil, err
+	}
+	ops := make([]txn.Op, 0, len(refs))
+	for _, ref := range refs {
+		ops = append(ops, txn.Op{
+			C:      resourceVersionCollection,
+			Id:     ref.Id,
+			Assert: bson.D{{"resourceid", oldId}},
+			Update: bson.D{{"$set", bson.D{{"resourceid", newId}}}},
+		})
+	}
+	return ops, nil
+}
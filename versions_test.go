@@ -0,0 +1,162 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/blobstore"
+)
+
+func (s *managedStorageSuite) putVersioned(c *gc.C, path string, blob []byte, retention blobstore.VersionRetention) int {
+	version, err := s.managedStorage.PutForEnvironmentVersioned("env", path, bytes.NewReader(blob), int64(len(blob)), retention)
+	c.Assert(err, jc.ErrorIsNil)
+	return version
+}
+
+func (s *managedStorageSuite) assertGetVersion(c *gc.C, path string, version int, expected []byte) {
+	r, length, err := s.managedStorage.GetForEnvironmentVersion("env", path, version)
+	c.Assert(err, jc.ErrorIsNil)
+	defer r.Close()
+	c.Assert(length, gc.Equals, int64(len(expected)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(data, jc.DeepEquals, expected)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentVersioned(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	first := []byte("some resource")
+	second := []byte("another resource")
+	c.Assert(s.putVersioned(c, "/path/to/blob", first, blobstore.VersionRetention{}), gc.Equals, 1)
+	now = now.Add(time.Minute)
+	c.Assert(s.putVersioned(c, "/path/to/blob", second, blobstore.VersionRetention{}), gc.Equals, 2)
+
+	// The unversioned API addresses the latest version.
+	s.assertGet(c, "/path/to/blob", second)
+	s.assertGetVersion(c, "/path/to/blob", 1, first)
+	s.assertGetVersion(c, "/path/to/blob", 2, second)
+	_, _, err := s.managedStorage.GetForEnvironmentVersion("env", "/path/to/blob", 3)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	versions, err := s.managedStorage.ListVersionsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(versions, gc.HasLen, 2)
+	// Times read from the database are in the local time zone.
+	c.Assert(versions[0].Created.Equal(now.Add(-time.Minute)), jc.IsTrue)
+	c.Assert(versions[1].Created.Equal(now), jc.IsTrue)
+	versions[0].Created, versions[1].Created = time.Time{}, time.Time{}
+	c.Assert(versions, jc.DeepEquals, []blobstore.VersionInfo{{
+		Version:       1,
+		Length:        int64(len(first)),
+		Hash:          calculateCheckSum(c, 0, int64(len(first)), first),
+		HashAlgorithm: blobstore.SHA384,
+	}, {
+		Version:       2,
+		Length:        int64(len(second)),
+		Hash:          calculateCheckSum(c, 0, int64(len(second)), second),
+		HashAlgorithm: blobstore.SHA384,
+	}})
+
+	// Removing the path removes its versions.
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = s.managedStorage.GetForEnvironmentVersion("env", "/path/to/blob", 1)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestRemoveForEnvironmentReleasesVersions(c *gc.C) {
+	blob := []byte("some resource")
+	s.putVersioned(c, "/path/to/blob", blob, blobstore.VersionRetention{})
+	s.putVersioned(c, "/path/to/blob", blob, blobstore.VersionRetention{})
+	s.assertPut(c, "/path/to/other", blob)
+	count, err := s.managedStorage.RefCountForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 4)
+
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	count, err = s.managedStorage.RefCountForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 1)
+
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/other")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestMoveForEnvironmentMovesVersions(c *gc.C) {
+	s.putVersioned(c, "/path/to/blob", []byte("one"), blobstore.VersionRetention{})
+	s.putVersioned(c, "/path/to/blob", []byte("two"), blobstore.VersionRetention{})
+	err := s.managedStorage.MoveForEnvironment("env", "/path/to/blob", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+
+	versions, err := s.managedStorage.ListVersionsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(versions, gc.HasLen, 0)
+	s.assertGetVersion(c, "/path/to/moved", 1, []byte("one"))
+	s.assertGetVersion(c, "/path/to/moved", 2, []byte("two"))
+
+	err = s.managedStorage.RemoveForEnvironment("env", "/path/to/moved")
+	c.Assert(err, jc.ErrorIsNil)
+	s.assertResourceCatalogCount(c, 0)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentVersionedMaxVersions(c *gc.C) {
+	retention := blobstore.VersionRetention{MaxVersions: 2}
+	blobs := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, blob := range blobs {
+		s.putVersioned(c, "/path/to/blob", blob, retention)
+	}
+	versions, err := s.managedStorage.ListVersionsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(versions, gc.HasLen, 2)
+	c.Assert(versions[0].Version, gc.Equals, 2)
+	c.Assert(versions[1].Version, gc.Equals, 3)
+	_, _, err = s.managedStorage.GetForEnvironmentVersion("env", "/path/to/blob", 1)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	// The pruned data is no longer referenced, so is deleted.
+	s.assertResourceCatalogCount(c, 2)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentVersionedMaxAge(c *gc.C) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.patchTimeNow(&now)
+	retention := blobstore.VersionRetention{MaxAge: time.Hour}
+	s.putVersioned(c, "/path/to/blob", []byte("one"), retention)
+	now = now.Add(30 * time.Minute)
+	s.putVersioned(c, "/path/to/blob", []byte("two"), retention)
+	now = now.Add(time.Hour)
+	s.putVersioned(c, "/path/to/blob", []byte("three"), retention)
+
+	versions, err := s.managedStorage.ListVersionsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(versions, gc.HasLen, 1)
+	c.Assert(versions[0].Version, gc.Equals, 3)
+}
+
+func (s *managedStorageSuite) TestPutForEnvironmentVersionedInvalidRetention(c *gc.C) {
+	_, err := s.managedStorage.PutForEnvironmentVersioned("env", "/path/to/blob", bytes.NewReader(nil), 0, blobstore.VersionRetention{MaxVersions: -1})
+	c.Assert(err, jc.Satisfies, errors.IsNotValid)
+}
+
+func (s *managedStorageSuite) TestRemoveAllForEnvironmentRemovesVersions(c *gc.C) {
+	s.putVersioned(c, "/path/to/blob", []byte("one"), blobstore.VersionRetention{})
+	s.putVersioned(c, "/path/to/blob", []byte("two"), blobstore.VersionRetention{})
+	removed, err := s.managedStorage.RemoveAllForEnvironment("env")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(removed, gc.Equals, 1)
+	versions, err := s.managedStorage.ListVersionsForEnvironment("env", "/path/to/blob")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(versions, gc.HasLen, 0)
+	s.assertResourceCatalogCount(c, 0)
+}